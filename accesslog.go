@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// accessLog logs each request once it has been handled. Streams can stay
+// open for hours, so they are logged when they start, every heartbeat while
+// open, and when they end, by streamSession.
+type accessLog struct {
+	// requests logs requests other than streams
+	requests bool
+	// heartbeat is how often open streams are logged (0 disables)
+	heartbeat time.Duration
+}
+
+func newAccessLog(cfg config) *accessLog {
+	return &accessLog{requests: cfg.AccessLog, heartbeat: cfg.AccessLogHeartbeat}
+}
+
+// middleware logs requests other than streams and probes once handled
+func (a *accessLog) middleware() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if !a.requests || probeRoute(c.Path()) || c.Path() == "/metrics" {
+			return c.Next()
+		}
+		start := time.Now()
+		err := c.Next()
+		if streaming, _ := c.Locals("streaming").(bool); streaming {
+			// Logged by the stream as it goes
+			return err
+		}
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = fiber.StatusInternalServerError
+			var ferr *fiber.Error
+			if errors.As(err, &ferr) {
+				status = ferr.Code
+			}
+		}
+		id, _ := c.Locals("identity").(Identity)
+		requestLogger(c).Info("Request",
+			"method", c.Method(),
+			"path", c.Path(),
+			"status", status,
+			"durationMs", time.Since(start).Milliseconds(),
+			"bytes", len(c.Response().Body()),
+			"ip", clientIP(c),
+			"caller", id.Subject,
+		)
+		return err
+	}
+}
+
+// heartbeats ticks every heartbeat for logging an open stream; the channel
+// is nil, and never fires, when heartbeats are off
+func (a *accessLog) heartbeats() (<-chan time.Time, func()) {
+	if a.heartbeat <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(a.heartbeat)
+	return t.C, t.Stop
+}
+
+// streamStarted, streamOpen and streamEnded log a stream's progress with
+// what has been written to it so far
+func (a *accessLog) streamStarted(s *session) {
+	s.log.Info("SSE stream started", "ip", s.clientIP)
+}
+
+func (a *accessLog) streamOpen(s *session) {
+	s.log.Info("SSE stream open", streamProgress(s)...)
+}
+
+func (a *accessLog) streamEnded(s *session, reason string) {
+	s.log.Info("SSE stream ended", append(streamProgress(s), "reason", reason)...)
+}
+
+func streamProgress(s *session) []any {
+	st := s.deliveryStats(time.Now())
+	return []any{
+		"durationMs", st.ConnectedMs,
+		"delivered", st.Delivered,
+		"dropped", st.Dropped,
+		"bytesWritten", st.BytesWritten,
+		"queued", st.Queued,
+	}
+}
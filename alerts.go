@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// alertEvent is the body of an alert webhook, sent when a threshold is
+// crossed and again when the value is back below it
+type alertEvent struct {
+	// ID is the same on every attempt, so receivers can drop retries they
+	// already handled
+	ID     string `json:"id"`
+	Alert  string `json:"alert"`
+	Status string `json:"status"`
+	// Value is what was measured and Threshold what it is compared with
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Node      string    `json:"node"`
+	At        time.Time `json:"at"`
+}
+
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertRule is a threshold on one measurement. It fires once the value goes
+// above threshold, and resolves only once the value is below threshold less
+// the hysteresis, so a value hovering around the threshold doesn't flap.
+type alertRule struct {
+	name      string
+	threshold float64
+	measure   func() (float64, bool)
+	firing    bool
+}
+
+// alerter checks the alert rules every interval, logging and optionally
+// posting to a webhook as they fire and resolve
+type alerter struct {
+	rules      []*alertRule
+	hysteresis float64
+	node       string
+	// hook is nil when alerts are only logged
+	hook *webhook
+
+	// lastDropped and lastCheck are where the drop rate is measured from
+	lastDropped uint64
+	lastCheck   time.Time
+}
+
+// newAlerter returns nil when no threshold is set
+func newAlerter(cfg config, b *broker) *alerter {
+	a := &alerter{hysteresis: cfg.AlertHysteresis, node: cfg.NodeID, lastCheck: time.Now()}
+	if cfg.AlertMaxSessions > 0 {
+		a.rules = append(a.rules, &alertRule{name: "sessions", threshold: float64(cfg.AlertMaxSessions), measure: func() (float64, bool) {
+			return float64(b.sessions.count()), true
+		}})
+	}
+	if cfg.AlertDropRate > 0 {
+		a.rules = append(a.rules, &alertRule{name: "drop_rate", threshold: cfg.AlertDropRate, measure: a.dropRate(b)})
+	}
+	if cfg.AlertMemoryPercent > 0 {
+		a.rules = append(a.rules, &alertRule{name: "memory_percent", threshold: cfg.AlertMemoryPercent, measure: func() (float64, bool) {
+			vm := b.metrics.system.current().vm
+			if vm == nil {
+				return 0, false
+			}
+			return vm.UsedPercent, true
+		}})
+	}
+	if len(a.rules) == 0 {
+		return nil
+	}
+	if cfg.AlertWebhookURL != "" {
+		a.hook = newWebhook("Alert webhook", cfg.AlertWebhookURL, cfg.AlertWebhookSecret, 5, 5*time.Second, 100)
+	}
+	go a.run(cfg.AlertInterval)
+	return a
+}
+
+// dropRate measures the events dropped per second since the previous check
+func (a *alerter) dropRate(b *broker) func() (float64, bool) {
+	a.lastDropped = b.metrics.dropped.Load()
+	return func() (float64, bool) {
+		now, dropped := time.Now(), b.metrics.dropped.Load()
+		elapsed := now.Sub(a.lastCheck).Seconds()
+		rate := float64(dropped-a.lastDropped) / elapsed
+		a.lastDropped, a.lastCheck = dropped, now
+		return rate, elapsed > 0
+	}
+}
+
+func (a *alerter) run(interval time.Duration) {
+	t := time.NewTicker(max(interval, time.Second))
+	defer t.Stop()
+	for range t.C {
+		a.check()
+	}
+}
+
+// check evaluates every rule and notifies those that changed state
+func (a *alerter) check() {
+	for _, r := range a.rules {
+		value, ok := r.measure()
+		if !ok {
+			continue
+		}
+		switch {
+		case !r.firing && value > r.threshold:
+			r.firing = true
+			logger.Warn("Alert firing", "alert", r.name, "value", value, "threshold", r.threshold)
+			a.notify(r, alertFiring, value)
+		case r.firing && value < r.threshold*(1-a.hysteresis):
+			r.firing = false
+			logger.Info("Alert resolved", "alert", r.name, "value", value, "threshold", r.threshold)
+			a.notify(r, alertResolved, value)
+		}
+	}
+}
+
+func (a *alerter) notify(r *alertRule, status string, value float64) {
+	if a.hook == nil {
+		return
+	}
+	ev := alertEvent{ID: newRequestID(), Alert: r.name, Status: status, Value: value, Threshold: r.threshold, Node: a.node, At: time.Now()}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logger.Error("Alert webhook encode error", "error", err)
+		return
+	}
+	a.hook.put(body, "alert", r.name, "status", status)
+}
+
+// close waits for the alerts queued to be delivered, until ctx is done
+func (a *alerter) close(ctx context.Context) {
+	if a == nil {
+		return
+	}
+	a.hook.close(ctx)
+}
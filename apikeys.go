@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiKeys authenticates backends calling the publish and admin endpoints. A
+// caller either sends one of the keys, or names a key and signs the request
+// with it, so the key itself never crosses the wire.
+type apiKeys struct {
+	keys []apiKey
+	// maxSkew is how far a signed request's timestamp may be from now
+	maxSkew time.Duration
+}
+
+// apiKey is a named key; the name tells keys apart in logs and lets one be
+// rotated out while another stays valid
+type apiKey struct {
+	name   string
+	secret []byte
+	// scope limits what the key may publish; nil allows everything
+	scope *publishScope
+}
+
+// newAPIKeys parses comma-separated name:key pairs and the keys' scopes; it
+// returns nil when there are no keys
+func newAPIKeys(spec, scopeSpec string, maxSkew time.Duration) (*apiKeys, error) {
+	scopes, err := parsePublishScopes(scopeSpec, "API key")
+	if err != nil {
+		return nil, err
+	}
+	k := &apiKeys{maxSkew: maxSkew}
+	for i, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, secret, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || secret == "" {
+			// Not quoting the entry, which may be a bare key
+			return nil, fmt.Errorf("API key %d is not name:key", i+1)
+		}
+		k.keys = append(k.keys, apiKey{name: name, secret: []byte(secret), scope: scopes[name]})
+		delete(scopes, name)
+	}
+	for name := range scopes {
+		return nil, fmt.Errorf("scope given for unknown API key %q", name)
+	}
+	if len(k.keys) == 0 {
+		return nil, nil
+	}
+	return k, nil
+}
+
+// match returns the key equal to presented. Every key is compared in
+// constant time, so timing reveals neither a key nor which one matched.
+func (k *apiKeys) match(presented string) (apiKey, bool) {
+	var found apiKey
+	for _, key := range k.keys {
+		if subtle.ConstantTimeCompare([]byte(presented), key.secret) == 1 {
+			found = key
+		}
+	}
+	return found, found.name != ""
+}
+
+// verify checks a request signature: the hex HMAC-SHA256, under the key
+// named id, of the timestamp, method, path and body joined by newlines
+func (k *apiKeys) verify(id, timestamp, signature, method, path string, body []byte) (apiKey, error) {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return apiKey{}, errors.New("invalid timestamp")
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > k.maxSkew || skew < -k.maxSkew {
+		return apiKey{}, errors.New("timestamp too far from now")
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return apiKey{}, errors.New("invalid signature")
+	}
+	for _, key := range k.keys {
+		if key.name != id {
+			continue
+		}
+		h := hmac.New(sha256.New, key.secret)
+		fmt.Fprintf(h, "%s\n%s\n%s\n", timestamp, method, path)
+		h.Write(body)
+		if hmac.Equal(sig, h.Sum(nil)) {
+			return key, nil
+		}
+	}
+	return apiKey{}, errors.New("invalid signature")
+}
+
+// Authenticate accepts a request carrying one of the keys or signed with one;
+// the identity's subject is the key's name and its scope the key's
+func (k *apiKeys) Authenticate(r AuthRequest) (Identity, error) {
+	if signature := r.Header("X-Signature"); signature != "" {
+		key, err := k.verify(r.Header("X-API-Key-ID"), r.Header("X-Timestamp"), signature, r.Method, r.Path, r.Body)
+		if err != nil {
+			return Identity{}, err
+		}
+		return Identity{Subject: key.name, Method: "api-key", Scope: key.scope}, nil
+	}
+	presented := r.Header("X-API-Key")
+	if presented == "" {
+		presented = bearerToken(r.Header("Authorization"))
+	}
+	if presented == "" {
+		return Identity{}, errNoCredentials
+	}
+	key, ok := k.match(presented)
+	if !ok {
+		return Identity{}, errors.New("invalid API key")
+	}
+	return Identity{Subject: key.name, Method: "api-key", Scope: key.scope}, nil
+}
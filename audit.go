@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// auditRecord is one publish or admin operation: who did what to whom, and
+// how it ended
+type auditRecord struct {
+	At time.Time `json:"at"`
+	// Caller is the authenticated subject, empty when the request had none
+	Caller     string `json:"caller,omitempty"`
+	AuthMethod string `json:"authMethod,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	// Action is the route, such as "POST /send-to-user", or the gRPC method
+	Action    string `json:"action"`
+	UserID    string `json:"userID,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+	EventType string `json:"eventType,omitempty"`
+	EventID   uint64 `json:"eventID,omitempty"`
+	// Size is the request body in bytes
+	Size   int    `json:"size"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// auditLog records publish and admin operations to an append-only file,
+// a callback URL and an in-memory buffer for /audit
+type auditLog struct {
+	mu sync.Mutex
+	// recent is a ring of the latest records; nil when disabled
+	recent []auditRecord
+	next   int
+	full   bool
+
+	file     *os.File
+	callback chan auditRecord
+	client   *http.Client
+	url      string
+}
+
+// newAuditLog returns nil when auditing is off. A file of "-" means stdout.
+func newAuditLog(cfg config) (*auditLog, error) {
+	if cfg.AuditLimit <= 0 && cfg.AuditFile == "" && cfg.AuditURL == "" {
+		return nil, nil
+	}
+	a := &auditLog{}
+	if cfg.AuditLimit > 0 {
+		a.recent = make([]auditRecord, cfg.AuditLimit)
+	}
+	switch cfg.AuditFile {
+	case "":
+	case "-":
+		a.file = os.Stdout
+	default:
+		f, err := os.OpenFile(cfg.AuditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		a.file = f
+	}
+	if cfg.AuditURL != "" {
+		a.url = cfg.AuditURL
+		a.callback = make(chan auditRecord, 1000)
+		a.client = &http.Client{Timeout: 5 * time.Second}
+		go a.run()
+	}
+	return a, nil
+}
+
+func (a *auditLog) record(r auditRecord) {
+	if a == nil {
+		return
+	}
+	if r.At.IsZero() {
+		r.At = time.Now()
+	}
+	a.mu.Lock()
+	if a.recent != nil {
+		a.recent[a.next] = r
+		a.next = (a.next + 1) % len(a.recent)
+		if a.next == 0 {
+			a.full = true
+		}
+	}
+	if a.file != nil {
+		if line, err := json.Marshal(r); err == nil {
+			if _, err := a.file.Write(append(line, '\n')); err != nil {
+				logger.Error("Audit file write error", "error", err)
+			}
+		}
+	}
+	a.mu.Unlock()
+	if a.callback != nil {
+		select {
+		case a.callback <- r:
+		default:
+			logger.Warn("Audit callback backlog full, discarding record", "action", r.Action)
+		}
+	}
+}
+
+// auditQuery filters /audit; empty fields match everything
+type auditQuery struct {
+	Caller string
+	UserID string
+	Action string
+	Since  time.Time
+}
+
+func (q auditQuery) matches(r auditRecord) bool {
+	return (q.Caller == "" || r.Caller == q.Caller) &&
+		(q.UserID == "" || r.UserID == q.UserID) &&
+		(q.Action == "" || r.Action == q.Action) &&
+		(q.Since.IsZero() || !r.At.Before(q.Since))
+}
+
+// list returns up to limit buffered records matching q, newest first
+func (a *auditLog) list(q auditQuery, limit int) []auditRecord {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n := a.next
+	if a.full {
+		n = len(a.recent)
+	}
+	out := make([]auditRecord, 0, min(n, limit))
+	for i := 1; i <= n && len(out) < limit; i++ {
+		r := a.recent[(a.next-i+len(a.recent))%len(a.recent)]
+		if q.matches(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (a *auditLog) run() {
+	for r := range a.callback {
+		body, err := json.Marshal(r)
+		if err != nil {
+			continue
+		}
+		resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Error("Audit callback error", "error", err)
+			continue
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Error("Audit callback failed", "status", resp.StatusCode)
+		}
+	}
+}
+
+// middleware records every request to the publish and admin routes once
+// it has been handled, except for scrapes of /metrics. Handlers add what they know about the target with
+// auditDetails.
+func (a *auditLog) middleware() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if a == nil || probeRoute(c.Path()) || c.Path() == "/metrics" || streamRoute(c.Path()) {
+			return c.Next()
+		}
+		r := &auditRecord{
+			IP:     clientIP(c),
+			Action: c.Method() + " " + c.Path(),
+			Size:   len(c.Body()),
+		}
+		c.Locals("audit", r)
+		err := c.Next()
+		// Named by the route, such as "GET /state/:userID", so one can be queried
+		if rt := c.Route(); rt != nil && strings.Contains(rt.Path, ":") {
+			r.Action = c.Method() + " " + rt.Path
+		}
+
+		id, _ := c.Locals("identity").(Identity)
+		r.Caller, r.AuthMethod = id.Subject, id.Method
+		r.UserID = cmp.Or(r.UserID, c.Params("userID"), c.Query("userID"))
+		r.Status = c.Response().StatusCode()
+		if err != nil {
+			// The error handler sets the status after this returns
+			r.Status = fiber.StatusInternalServerError
+			var ferr *fiber.Error
+			if errors.As(err, &ferr) {
+				r.Status = ferr.Code
+			}
+			r.Error = err.Error()
+		} else if r.Status >= 400 {
+			var body struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(c.Response().Body(), &body) == nil {
+				r.Error = body.Error
+			}
+		}
+		a.record(*r)
+		return err
+	}
+}
+
+// auditDetails returns the record being built for the request, to fill in
+// the target of the operation; it is a throwaway when auditing is off
+func auditDetails(c fiber.Ctx) *auditRecord {
+	if r, ok := c.Locals("audit").(*auditRecord); ok {
+		return r
+	}
+	return &auditRecord{}
+}
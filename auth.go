@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Authenticator identifies the caller of a request. Deployments with their
+// own scheme, such as token introspection or mTLS client certificates,
+// implement it and add a factory to authenticatorFactories.
+type Authenticator interface {
+	// Authenticate returns who made r, or errNoCredentials when r carries
+	// nothing this authenticator understands, so the next one is tried
+	Authenticate(r AuthRequest) (Identity, error)
+}
+
+// AuthRequest is what an Authenticator sees of a request, over HTTP or gRPC
+type AuthRequest struct {
+	// Method and Path are the HTTP method and path with query string, or
+	// "GRPC" and the full method name
+	Method string
+	Path   string
+	Header func(name string) string
+	Cookie func(name string) string
+	Query  func(name string) string
+	Body   []byte
+	// TLS is set when the client connected over TLS
+	TLS *tls.ConnectionState
+}
+
+// Identity is who a request was authenticated as
+type Identity struct {
+	// Subject is the user ID for streams and the caller's name for publishes
+	Subject string
+	Claims  map[string]any
+	// Method names the authenticator that accepted the request
+	Method string
+	// ExpiresAt is when the credential stops being valid (zero means never);
+	// streams opened with it are closed then unless reauthenticated
+	ExpiresAt time.Time
+	// Scope limits what the caller may publish; nil allows everything
+	Scope *publishScope
+}
+
+// errNoCredentials is returned by an Authenticator that found nothing to check
+var errNoCredentials = errors.New("credentials are required")
+
+// authError refuses a request; status is the HTTP status to answer with
+type authError struct {
+	status int
+	msg    string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+// authenticatorFactories are the authenticators SSE_STREAM_AUTH and
+// SSE_PUBLISH_AUTH can list. A factory returns nil when its authenticator
+// isn't configured.
+var authenticatorFactories = map[string]func(cfg config) (Authenticator, error){
+	"jwt": func(cfg config) (Authenticator, error) {
+		a, err := newJWTAuth(cfg)
+		if a == nil {
+			return nil, err
+		}
+		return a, nil
+	},
+	"stream-token": func(cfg config) (Authenticator, error) {
+		return newStreamTokens(cfg.StreamTokenSecret, cfg.StreamTokenTTL)
+	},
+	"api-key": func(cfg config) (Authenticator, error) {
+		a, err := newAPIKeys(cfg.APIKeys, cfg.APIKeyScopes, cfg.APISignatureMaxSkew)
+		if a == nil {
+			return nil, err
+		}
+		return a, nil
+	},
+	"mtls": func(cfg config) (Authenticator, error) {
+		a, err := newClientCerts(cfg)
+		if a == nil {
+			return nil, err
+		}
+		return a, nil
+	},
+}
+
+// authChain tries its authenticators in order; an empty chain lets every
+// request through
+type authChain []Authenticator
+
+// newAuthChain builds the comma-separated list of authenticators, leaving out
+// those that aren't configured
+func newAuthChain(cfg config, names string) (authChain, error) {
+	var chain authChain
+	for name := range strings.SplitSeq(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := authenticatorFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown authenticator %q", name)
+		}
+		a, err := factory(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if a != nil {
+			chain = append(chain, a)
+		}
+	}
+	if len(chain) == 1 {
+		if _, ok := chain[0].(*streamTokens); ok {
+			// Stream tokens are minted for callers another authenticator accepted
+			return nil, nil
+		}
+	}
+	return chain, nil
+}
+
+// streamTokens returns the chain's stream token authenticator, if any
+func (ac authChain) streamTokens() *streamTokens {
+	for _, a := range ac {
+		if st, ok := a.(*streamTokens); ok {
+			return st
+		}
+	}
+	return nil
+}
+
+func (ac authChain) enabled() bool {
+	return len(ac) > 0
+}
+
+// authenticate returns the identity from the first authenticator that
+// recognises r's credentials
+func (ac authChain) authenticate(r AuthRequest) (Identity, error) {
+	for _, a := range ac {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		if err != nil {
+			return Identity{}, &authError{status: 401, msg: err.Error()}
+		}
+		return id, nil
+	}
+	return Identity{}, &authError{status: 401, msg: errNoCredentials.Error()}
+}
+
+// streamIdentity returns who a stream is for. With authentication enabled
+// that is the authenticated subject, and a requested userID must match it;
+// without, it is the requested userID.
+func (ac authChain) streamIdentity(r AuthRequest, requested string) (Identity, error) {
+	if !ac.enabled() {
+		return Identity{Subject: requested}, nil
+	}
+	id, err := ac.authenticate(r)
+	if err != nil {
+		return Identity{}, err
+	}
+	if requested != "" && requested != id.Subject {
+		return Identity{}, &authError{status: 403, msg: "userID does not match the token"}
+	}
+	return id, nil
+}
+
+// guard wraps h so it only runs for authenticated requests, with the
+// Identity in the "identity" local
+func (ac authChain) guard(h fiber.Handler) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if !ac.enabled() {
+			return h(c)
+		}
+		id, err := ac.authenticate(httpAuthRequest(c))
+		var aerr *authError
+		if errors.As(err, &aerr) {
+			return c.Status(aerr.status).JSON(fiber.Map{"error": aerr.msg})
+		}
+		c.Locals("identity", id)
+		return h(c)
+	}
+}
+
+// unaryInterceptor authenticates the unary calls of service, a full service
+// name such as "/sse.v1.Publisher/"
+func (ac authChain) unaryInterceptor(service string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if !ac.enabled() || !strings.HasPrefix(info.FullMethod, service) {
+			return handler(ctx, req)
+		}
+		id, err := ac.authenticate(grpcAuthRequest(ctx, info.FullMethod))
+		if err != nil {
+			return nil, grpcAuthError(err)
+		}
+		return handler(context.WithValue(ctx, identityKey{}, id), req)
+	}
+}
+
+// identityKey holds the caller's Identity in the context of an authenticated gRPC call
+type identityKey struct{}
+
+// grpcIdentity returns the identity the interceptor authenticated, if any
+func grpcIdentity(ctx context.Context) Identity {
+	id, _ := ctx.Value(identityKey{}).(Identity)
+	return id
+}
+
+// grpcAuthError maps an authError to a gRPC status
+func grpcAuthError(err error) error {
+	var aerr *authError
+	if errors.As(err, &aerr) && aerr.status == 403 {
+		return status.Error(codes.PermissionDenied, aerr.msg)
+	}
+	return status.Error(codes.Unauthenticated, err.Error())
+}
+
+func httpAuthRequest(c fiber.Ctx) AuthRequest {
+	return AuthRequest{
+		Method: c.Method(),
+		Path:   c.OriginalURL(),
+		Header: func(name string) string { return c.Get(name) },
+		Cookie: func(name string) string { return c.Cookies(name) },
+		Query:  func(name string) string { return c.Query(name) },
+		Body:   c.Body(),
+		TLS:    c.RequestCtx().TLSConnectionState(),
+	}
+}
+
+// grpcAuthRequest exposes a call's metadata as headers; calls have no
+// cookies, query string or body to sign
+func grpcAuthRequest(ctx context.Context, method string) AuthRequest {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r := AuthRequest{
+		Method: "GRPC",
+		Path:   method,
+		Header: func(name string) string {
+			if v := md.Get(name); len(v) > 0 {
+				return v[0]
+			}
+			return ""
+		},
+		Cookie: func(string) string { return "" },
+		Query:  func(string) string { return "" },
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			r.TLS = &info.State
+		}
+	}
+	return r
+}
+
+// jwtAuth validates JWTs and names the user they are for
+type jwtAuth struct {
+	parser    *jwt.Parser
+	userClaim string
+	// secret verifies HS256 tokens, publicKey or jwks RS256 ones
+	secret     []byte
+	publicKey  *rsa.PublicKey
+	jwks       *jwksCache
+	extractors []credentialExtractor
+}
+
+// newJWTAuth returns nil when no signing key is configured
+func newJWTAuth(cfg config) (*jwtAuth, error) {
+	a := &jwtAuth{userClaim: cfg.JWTUserClaim}
+	for name := range strings.SplitSeq(cfg.AuthCredentials, ",") {
+		name = strings.TrimSpace(name)
+		extractor, ok := credentialExtractors[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown credential source %q", name)
+		}
+		a.extractors = append(a.extractors, extractor(cfg))
+	}
+	var methods []string
+	if cfg.JWTSecret != "" {
+		a.secret = []byte(cfg.JWTSecret)
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
+	}
+	if cfg.JWTPublicKey != "" {
+		pem, err := os.ReadFile(cfg.JWTPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if a.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(pem); err != nil {
+			return nil, fmt.Errorf("%s: %w", cfg.JWTPublicKey, err)
+		}
+	}
+	if cfg.JWTJWKSURL != "" {
+		a.jwks = newJWKSCache(cfg.JWTJWKSURL, cfg.JWTJWKSRefresh)
+	}
+	if a.publicKey != nil || a.jwks != nil {
+		methods = append(methods, jwt.SigningMethodRS256.Alg())
+	}
+	if len(methods) == 0 {
+		return nil, nil
+	}
+
+	opts := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithLeeway(30 * time.Second)}
+	if cfg.JWTIssuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.JWTIssuer))
+	}
+	if cfg.JWTAudience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.JWTAudience))
+	}
+	a.parser = jwt.NewParser(opts...)
+	return a, nil
+}
+
+// Authenticate verifies the first JWT found where the extractors look
+func (a *jwtAuth) Authenticate(r AuthRequest) (Identity, error) {
+	var token string
+	for _, extract := range a.extractors {
+		if token = extract(r); token != "" {
+			break
+		}
+	}
+	if token == "" {
+		return Identity{}, errNoCredentials
+	}
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(token, claims, a.key); err != nil {
+		return Identity{}, fmt.Errorf("invalid token: %w", err)
+	}
+	userID, _ := claims[a.userClaim].(string)
+	if userID == "" {
+		return Identity{}, fmt.Errorf("invalid token: no %s claim", a.userClaim)
+	}
+	id := Identity{Subject: userID, Claims: claims, Method: "jwt"}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		id.ExpiresAt = exp.Time
+	}
+	return id, nil
+}
+
+// key picks the key a token is verified with from its algorithm and key ID
+func (a *jwtAuth) key(t *jwt.Token) (any, error) {
+	if t.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+		return a.secret, nil
+	}
+	kid, _ := t.Header["kid"].(string)
+	if a.jwks != nil && (kid != "" || a.publicKey == nil) {
+		return a.jwks.key(kid)
+	}
+	return a.publicKey, nil
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(header string) string {
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// jwksCache holds the RSA keys of a JSON Web Key Set by key ID. It fetches
+// the set again every refresh interval, and sooner when a token names a key it
+// doesn't hold, so rotated keys are picked up
+type jwksCache struct {
+	url     string
+	refresh time.Duration
+	client  *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	fetchedAt time.Time
+	// refreshing is closed when the fetch in flight finishes; nil when none is
+	refreshing chan struct{}
+	// fetchErr is why the last fetch failed
+	fetchErr error
+}
+
+// jwksMinRefetch keeps tokens with unknown key IDs from hammering the JWKS endpoint
+const jwksMinRefetch = 10 * time.Second
+
+func newJWKSCache(url string, refresh time.Duration) *jwksCache {
+	return &jwksCache{
+		url:     url,
+		refresh: refresh,
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// key returns the key with ID kid; an empty kid matches a set's only key.
+// The set is fetched without holding the lock, and a key already held is
+// served while that fetch is in flight, so a slow endpoint only delays the
+// tokens signed with keys it hasn't given out yet.
+func (jc *jwksCache) key(kid string) (*rsa.PublicKey, error) {
+	jc.mu.Lock()
+	k := jc.lookup(kid)
+	age := time.Since(jc.fetchedAt)
+	if (k != nil || age < jwksMinRefetch) && age < jc.refresh {
+		jc.mu.Unlock()
+		if k == nil {
+			return nil, fmt.Errorf("unknown key ID %q", kid)
+		}
+		return k, nil
+	}
+	done := jc.refreshLocked()
+	jc.mu.Unlock()
+	if k != nil {
+		// Keep serving the keys we have while the set is fetched, or while
+		// the endpoint is down
+		return k, nil
+	}
+
+	<-done
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+	if k = jc.lookup(kid); k != nil {
+		return k, nil
+	}
+	if jc.fetchErr != nil {
+		return nil, fmt.Errorf("JWKS fetch failed: %w", jc.fetchErr)
+	}
+	return nil, fmt.Errorf("unknown key ID %q", kid)
+}
+
+// refreshLocked starts fetching the set unless a fetch is in flight already,
+// and returns the channel closed when it finishes
+func (jc *jwksCache) refreshLocked() <-chan struct{} {
+	if jc.refreshing != nil {
+		return jc.refreshing
+	}
+	done := make(chan struct{})
+	jc.refreshing = done
+	go func() {
+		keys, err := jc.fetch()
+		jc.mu.Lock()
+		if err == nil {
+			jc.keys, jc.fetchedAt = keys, time.Now()
+		}
+		jc.fetchErr, jc.refreshing = err, nil
+		jc.mu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+func (jc *jwksCache) lookup(kid string) *rsa.PublicKey {
+	if kid == "" && len(jc.keys) == 1 {
+		for _, k := range jc.keys {
+			return k
+		}
+	}
+	return jc.keys[kid]
+}
+
+func (jc *jwksCache) fetch() (map[string]*rsa.PublicKey, error) {
+	resp, err := jc.client.Get(jc.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA signing keys")
+	}
+	return keys, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Backplane carries publishes between instances, so each one can deliver to
+// the sessions connected to it. Implementations must be safe for concurrent use.
+type Backplane interface {
+	// Publish sends msg to every instance, possibly including this one
+	Publish(ctx context.Context, msg BackplaneMessage) error
+	// Subscribe calls handle for every message published by any instance
+	// until Close; it returns once the subscription is established
+	Subscribe(ctx context.Context, handle func(BackplaneMessage)) error
+	Close() error
+}
+
+// BackplaneMessage is a publish forwarded to the other instances. The origin
+// has already assigned the event its ID and recorded it in the history.
+type BackplaneMessage struct {
+	// Origin is the node ID of the instance that accepted the publish
+	Origin string         `json:"origin"`
+	UserID string         `json:"userID"`
+	Event  event          `json:"event"`
+	Opts   publishOptions `json:"opts"`
+}
+
+// newBackplane returns the Backplane selected by cfg.Backplane, or nil when
+// the instance runs alone
+func newBackplane(cfg config) (Backplane, error) {
+	switch cfg.Backplane {
+	case "", "none":
+		return nil, nil
+	case "redis":
+		return newRedisBackplane(cfg.RedisURL, cfg.RedisPrefix+"backplane", cfg.NodeID)
+	case "nats":
+		return newNATSBackplane(cfg.NATSURL, cfg.NATSSubjectPrefix, cfg.NodeID)
+	case "cluster":
+		return newClusterBackplane(cfg)
+	}
+	return nil, fmt.Errorf("unknown backplane %q", cfg.Backplane)
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cagrico/go-fiber-sse-user-channel/ssepb"
+	"github.com/gofiber/fiber/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// clusterBackplane connects instances to each other without an external
+// broker. Each instance serves an internal HTTP listener and heartbeats every
+// peer it knows with the users connected to it and the other members it has
+// seen, so a node started with a single seed finds the rest of the cluster.
+// A publish is forwarded only to the members holding sessions of its user.
+type clusterBackplane struct {
+	nodeID    string
+	addr      string
+	advertise string
+	// public is the URL clients reach this instance's API at
+	public string
+	// grpc is the address of this instance's gRPC listener, when enabled,
+	// which other instances then forward publishes over
+	grpc      string
+	secret    string
+	heartbeat time.Duration
+	// failAfter is how long a member may go without a heartbeat before
+	// publishes stop being routed to it
+	failAfter time.Duration
+
+	client *http.Client
+	// conns are gRPC connections to members, by address
+	conns  map[string]*grpc.ClientConn
+	app    *fiber.App
+	handle func(BackplaneMessage)
+	wakeup chan struct{}
+	stop   chan struct{}
+	// done is closed when the heartbeat loop has stopped
+	done chan struct{}
+
+	mu      sync.Mutex
+	members map[string]*clusterMember
+	peers   map[string]*clusterPeer
+	// users are the local users as last announced; version changes with them
+	users   []string
+	version uint64
+	// ring maps users to members; nil once membership changed
+	ring *hashRing
+}
+
+// clusterMember is another instance that has sent us a heartbeat
+type clusterMember struct {
+	id       string
+	addr     string
+	public   string
+	grpc     string
+	users    map[string]struct{}
+	version  uint64
+	lastSeen time.Time
+}
+
+// clusterPeer is an address heartbeats are sent to: a seed, a discovered
+// member or an instance that contacted us
+type clusterPeer struct {
+	seed bool
+	// acked is the version of our users the peer has confirmed
+	acked   uint64
+	failing bool
+}
+
+// clusterHeartbeat is sent to every peer each interval
+type clusterHeartbeat struct {
+	Node    string `json:"node"`
+	Addr    string `json:"addr"`
+	Public  string `json:"public"`
+	GRPC    string `json:"grpc,omitempty"`
+	Version uint64 `json:"version"`
+	// Full is set when Users carries the sender's users, which happens only
+	// when the receiver hasn't acknowledged Version yet
+	Full  bool     `json:"full,omitempty"`
+	Users []string `json:"users,omitempty"`
+	// Members are the addresses of the other instances the sender knows
+	Members []string `json:"members,omitempty"`
+	Leaving bool     `json:"leaving,omitempty"`
+}
+
+type clusterHeartbeatReply struct {
+	Node string `json:"node"`
+	// Version is the version of the sender's users the receiver now holds
+	Version uint64 `json:"version"`
+}
+
+func newClusterBackplane(cfg config) (*clusterBackplane, error) {
+	// The internal routes inject events and act on sessions, so they are
+	// never served unauthenticated
+	if cfg.ClusterSecret == "" {
+		return nil, errors.New("SSE_CLUSTER_SECRET is required with the cluster backplane")
+	}
+	advertise := cfg.ClusterAdvertise
+	if advertise == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		_, port, err := net.SplitHostPort(cfg.ClusterAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster address: %w", err)
+		}
+		advertise = net.JoinHostPort(host, port)
+	}
+	var grpcAddr string
+	if cfg.GRPCAddr != "" {
+		// Reachable on the advertised host, at the gRPC listener's port
+		host, _, err := net.SplitHostPort(strings.TrimPrefix(strings.TrimPrefix(advertise, "http://"), "https://"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cluster advertise address: %w", err)
+		}
+		_, port, err := net.SplitHostPort(cfg.GRPCAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gRPC address: %w", err)
+		}
+		grpcAddr = net.JoinHostPort(host, port)
+	}
+	c := &clusterBackplane{
+		nodeID:    cfg.NodeID,
+		addr:      cfg.ClusterAddr,
+		advertise: clusterURL(advertise),
+		public:    cfg.PublicURL,
+		grpc:      grpcAddr,
+		secret:    cfg.ClusterSecret,
+		heartbeat: max(cfg.ClusterHeartbeat, 100*time.Millisecond),
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{MaxIdleConnsPerHost: 32, IdleConnTimeout: time.Minute},
+		},
+		conns:   make(map[string]*grpc.ClientConn),
+		wakeup:  make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		members: make(map[string]*clusterMember),
+		peers:   make(map[string]*clusterPeer),
+		// Differs across restarts, so peers don't keep a previous run's users
+		version: uint64(time.Now().UnixNano()),
+	}
+	c.failAfter = 5 * c.heartbeat
+	for seed := range strings.SplitSeq(cfg.ClusterPeers, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" && clusterURL(seed) != c.advertise {
+			c.peers[clusterURL(seed)] = &clusterPeer{seed: true}
+		}
+	}
+
+	c.app = fiber.New(fiber.Config{BodyLimit: 64 << 20})
+	c.app.Use(func(ctx fiber.Ctx) error {
+		if subtle.ConstantTimeCompare([]byte(ctx.Get("X-Cluster-Secret")), []byte(c.secret)) != 1 {
+			return ctx.Status(401).JSON(fiber.Map{"error": "invalid cluster secret"})
+		}
+		return ctx.Next()
+	})
+	c.app.Post("/cluster/heartbeat", func(ctx fiber.Ctx) error {
+		var hb clusterHeartbeat
+		if err := json.Unmarshal(ctx.Body(), &hb); err != nil || hb.Node == "" {
+			return ctx.Status(400).JSON(fiber.Map{"error": "invalid heartbeat"})
+		}
+		return ctx.JSON(c.receive(hb))
+	})
+	c.app.Post("/cluster/query", func(ctx fiber.Ctx) error {
+		var q peerQuery
+		if err := json.Unmarshal(ctx.Body(), &q); err != nil {
+			return ctx.Status(400).JSON(fiber.Map{"error": "invalid query"})
+		}
+		return ctx.JSON(currentBroker.localView(q))
+	})
+	c.app.Post("/cluster/publish", func(ctx fiber.Ctx) error {
+		var msg BackplaneMessage
+		if err := json.Unmarshal(ctx.Body(), &msg); err != nil {
+			return ctx.Status(400).JSON(fiber.Map{"error": "invalid message"})
+		}
+		c.handle(msg)
+		return ctx.SendStatus(204)
+	})
+	return c, nil
+}
+
+// clusterURL turns a host:port into the base URL of its internal listener
+func clusterURL(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
+func (c *clusterBackplane) Publish(ctx context.Context, msg BackplaneMessage) error {
+	targets := c.holders(msg.UserID)
+	if len(targets) == 0 {
+		return nil
+	}
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, m := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.forward(ctx, m, msg); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", m.id, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// queryPeers asks every live member for its local view; a member that
+// doesn't answer is reported with the error
+func (c *clusterBackplane) queryPeers(ctx context.Context, q peerQuery) []peerReply {
+	c.mu.Lock()
+	var members []clusterMember
+	for _, m := range c.members {
+		if time.Since(m.lastSeen) < c.failAfter {
+			members = append(members, clusterMember{id: m.id, addr: m.addr})
+		}
+	}
+	c.mu.Unlock()
+
+	data, err := json.Marshal(q)
+	if err != nil {
+		logger.Error("Cluster query encode error", "error", err)
+		return nil
+	}
+	replies := make([]peerReply, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.post(ctx, m.addr+"/cluster/query", data, &replies[i]); err != nil {
+				replies[i] = peerReply{Stats: nodeStats{Node: m.id, Error: err.Error()}}
+			}
+		}()
+	}
+	wg.Wait()
+	return replies
+}
+
+// forward sends msg to member m over gRPC when it serves it, else over HTTP
+func (c *clusterBackplane) forward(ctx context.Context, m clusterMember, msg BackplaneMessage) error {
+	if m.grpc == "" {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+		return c.post(ctx, m.addr+"/cluster/publish", data, nil)
+	}
+	conn, err := c.conn(m.grpc)
+	if err != nil {
+		return err
+	}
+	req, err := forwardRequest(msg)
+	if err != nil {
+		return err
+	}
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-cluster-secret", c.secret)
+	_, err = ssepb.NewClusterClient(conn).Forward(ctx, req)
+	return err
+}
+
+// conn returns the gRPC connection to addr, opening it the first time
+func (c *clusterBackplane) conn(addr string) (*grpc.ClientConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	c.conns[addr] = conn
+	return conn, nil
+}
+
+// holders returns the live members with sessions of userID
+func (c *clusterBackplane) holders(userID string) []clusterMember {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var members []clusterMember
+	for _, m := range c.members {
+		if _, ok := m.users[userID]; ok && time.Since(m.lastSeen) < c.failAfter {
+			members = append(members, clusterMember{id: m.id, addr: m.addr, grpc: m.grpc})
+		}
+	}
+	return members
+}
+
+func (c *clusterBackplane) Subscribe(_ context.Context, handle func(BackplaneMessage)) error {
+	c.handle = handle
+	ln, err := listeners.listen(c.addr)
+	if err != nil {
+		return err
+	}
+	if base, ok := strings.CutSuffix(c.advertise, ":0"); ok {
+		// Advertise the port the system picked
+		c.advertise = base + ":" + strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	}
+	go func() {
+		if err := c.app.Listener(ln, fiber.ListenConfig{DisableStartupMessage: true}); err != nil {
+			logger.Error("Cluster listener error", "error", err)
+			reportError("backplane", err)
+		}
+	}()
+	logger.Info("Cluster node listening", "node", c.nodeID, "addr", c.addr, "advertise", c.advertise)
+	go c.run()
+	return nil
+}
+
+// route returns the member userID hashes to and the URL of its API. Every
+// member builds the same ring once heartbeats have spread, so a client sent
+// there lands on the node that other publishes are least likely to need
+// forwarding to.
+func (c *clusterBackplane) route(userID string) (node, url string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring == nil {
+		nodes := []string{c.nodeID}
+		for id := range c.members {
+			nodes = append(nodes, id)
+		}
+		c.ring = newHashRing(nodes)
+	}
+	node = c.ring.owner(userID)
+	if m, ok := c.members[node]; ok {
+		return node, m.public
+	}
+	return c.nodeID, c.public
+}
+
+// announce sends a heartbeat right away, so peers learn of a newly connected
+// user without waiting for the next interval
+func (c *clusterBackplane) announce() {
+	wake(c.wakeup)
+}
+
+func (c *clusterBackplane) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.heartbeat)
+	defer ticker.Stop()
+	for {
+		c.beat(false)
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		case <-c.wakeup:
+		}
+	}
+}
+
+// beat sends a heartbeat to every peer and forgets members that stopped
+// sending theirs
+func (c *clusterBackplane) beat(leaving bool) {
+	users := currentBroker.sessions.users()
+
+	c.mu.Lock()
+	if !slices.Equal(users, c.users) {
+		c.users = users
+		c.version++
+	}
+	version := c.version
+	for id, m := range c.members {
+		if time.Since(m.lastSeen) >= c.failAfter {
+			logger.Info("Cluster node left", "node", id, "addr", m.addr)
+			delete(c.members, id)
+			c.ring = nil
+		}
+	}
+	members := make([]string, 0, len(c.members))
+	for _, m := range c.members {
+		members = append(members, m.addr)
+	}
+	type send struct {
+		addr string
+		full bool
+	}
+	sends := make([]send, 0, len(c.peers))
+	for addr, p := range c.peers {
+		sends = append(sends, send{addr: addr, full: p.acked != version})
+	}
+	c.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, s := range sends {
+		hb := clusterHeartbeat{Node: c.nodeID, Addr: c.advertise, Public: c.public, GRPC: c.grpc, Version: version, Members: members, Leaving: leaving}
+		if s.full && !leaving {
+			hb.Full, hb.Users = true, users
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.send(s.addr, hb)
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *clusterBackplane) send(addr string, hb clusterHeartbeat) {
+	data, err := json.Marshal(hb)
+	if err != nil {
+		logger.Error("Cluster heartbeat encode error", "error", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.heartbeat*2)
+	defer cancel()
+	var reply clusterHeartbeatReply
+	err = c.post(ctx, addr+"/cluster/heartbeat", data, &reply)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.peers[addr]
+	if !ok {
+		return
+	}
+	if err != nil {
+		if !p.seed {
+			// Heard of through another node; it will be added back by its
+			// own heartbeat or the next member list that names it
+			delete(c.peers, addr)
+			return
+		}
+		if !p.failing {
+			logger.Warn("Cluster peer unreachable", "addr", addr, "error", err)
+			p.failing = true
+		}
+		return
+	}
+	if reply.Node == c.nodeID {
+		// A seed list shared by every node includes this one
+		delete(c.peers, addr)
+		return
+	}
+	if p.failing {
+		logger.Info("Cluster peer reachable again", "addr", addr)
+		p.failing = false
+	}
+	p.acked = reply.Version
+}
+
+// receive applies a heartbeat from another instance
+func (c *clusterBackplane) receive(hb clusterHeartbeat) clusterHeartbeatReply {
+	reply := clusterHeartbeatReply{Node: c.nodeID}
+	if hb.Node == c.nodeID {
+		return reply
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hb.Leaving {
+		if m, ok := c.members[hb.Node]; ok {
+			logger.Info("Cluster node left", "node", hb.Node, "addr", m.addr)
+			delete(c.members, hb.Node)
+			c.ring = nil
+		}
+		return reply
+	}
+	m, ok := c.members[hb.Node]
+	if !ok {
+		logger.Info("Cluster node joined", "node", hb.Node, "addr", hb.Addr)
+		m = &clusterMember{id: hb.Node}
+		c.members[hb.Node] = m
+		c.ring = nil
+	}
+	m.addr = hb.Addr
+	m.public = hb.Public
+	m.grpc = hb.GRPC
+	m.lastSeen = time.Now()
+	if hb.Full {
+		m.users = make(map[string]struct{}, len(hb.Users))
+		for _, u := range hb.Users {
+			m.users[u] = struct{}{}
+		}
+		m.version = hb.Version
+	}
+	reply.Version = m.version
+
+	// Heartbeat back whoever contacted us and whoever they know
+	for _, addr := range append(hb.Members, hb.Addr) {
+		if _, ok := c.peers[addr]; !ok && addr != c.advertise {
+			c.peers[addr] = &clusterPeer{}
+		}
+	}
+	return reply
+}
+
+// post sends a JSON body to the internal listener of another instance and
+// decodes the reply into out when it isn't nil
+func (c *clusterBackplane) post(ctx context.Context, url string, data []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cluster-Secret", c.secret)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Close tells the other members this instance is leaving, so they stop
+// routing to it right away, and stops the internal listener
+func (c *clusterBackplane) Close() error {
+	close(c.stop)
+	if c.handle != nil {
+		// A heartbeat still in flight could announce this node again
+		<-c.done
+	}
+	c.beat(true)
+	c.mu.Lock()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+	c.mu.Unlock()
+	return c.app.ShutdownWithTimeout(5 * time.Second)
+}
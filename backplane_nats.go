@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsBackplane fans publishes out over NATS, one subject per user
+// (<prefix>.user.<base64 userID>), with every instance subscribed to all of
+// them. Peer queries are NATS requests on <prefix>.query.
+type natsBackplane struct {
+	conn   *nats.Conn
+	prefix string
+	nodeID string
+}
+
+// natsQueryWindow is how long a peer query collects replies, since NATS
+// doesn't tell how many instances received it
+const natsQueryWindow = 500 * time.Millisecond
+
+func newNATSBackplane(url, prefix, nodeID string) (*natsBackplane, error) {
+	conn, err := nats.Connect(url,
+		nats.Name("go-fiber-sse"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				logger.Warn("NATS disconnected", "error", err)
+				reportError("backplane", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			logger.Info("NATS reconnected", "url", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &natsBackplane{conn: conn, prefix: prefix, nodeID: nodeID}, nil
+}
+
+// subject encodes userID so dots and spaces in it can't break the subject
+func (nb *natsBackplane) subject(userID string) string {
+	return nb.prefix + ".user." + base64.RawURLEncoding.EncodeToString([]byte(userID))
+}
+
+func (nb *natsBackplane) Publish(_ context.Context, msg BackplaneMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return nb.conn.Publish(nb.subject(msg.UserID), data)
+}
+
+func (nb *natsBackplane) Subscribe(_ context.Context, handle func(BackplaneMessage)) error {
+	sub, err := nb.conn.Subscribe(nb.prefix+".user.>", func(m *nats.Msg) {
+		var msg BackplaneMessage
+		if err := json.Unmarshal(m.Data, &msg); err != nil {
+			logger.Error("Backplane decode error", "error", err)
+			reportError("backplane", err, "subject", m.Subject)
+			return
+		}
+		handle(msg)
+	})
+	if err != nil {
+		return err
+	}
+	query, err := nb.conn.Subscribe(nb.prefix+".query", nb.answer)
+	if err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+	// Make sure the server knows about the subscriptions before returning
+	if err := nb.conn.Flush(); err != nil {
+		sub.Unsubscribe()
+		query.Unsubscribe()
+		return err
+	}
+	return nil
+}
+
+// answer replies to another instance's peer query
+func (nb *natsBackplane) answer(m *nats.Msg) {
+	var qm peerQueryMessage
+	if err := json.Unmarshal(m.Data, &qm); err != nil {
+		logger.Error("Peer query decode error", "error", err)
+		return
+	}
+	if qm.Origin == nb.nodeID {
+		return
+	}
+	data, err := json.Marshal(currentBroker.localView(qm.Query))
+	if err == nil {
+		err = m.Respond(data)
+	}
+	if err != nil {
+		logger.Error("Peer query reply error", "error", err)
+	}
+}
+
+// queryPeers sends q to every instance and collects the replies that arrive
+// within natsQueryWindow
+func (nb *natsBackplane) queryPeers(ctx context.Context, q peerQuery) []peerReply {
+	inbox := nb.conn.NewRespInbox()
+	sub, err := nb.conn.SubscribeSync(inbox)
+	if err != nil {
+		logger.Error("Peer query error", "error", err)
+		return nil
+	}
+	defer sub.Unsubscribe()
+	data, err := json.Marshal(peerQueryMessage{Origin: nb.nodeID, Query: q})
+	if err != nil {
+		logger.Error("Peer query error", "error", err)
+		return nil
+	}
+	if err := nb.conn.PublishRequest(nb.prefix+".query", inbox, data); err != nil {
+		logger.Error("Peer query error", "error", err)
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, natsQueryWindow)
+	defer cancel()
+	var replies []peerReply
+	for {
+		m, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			return replies
+		}
+		var reply peerReply
+		if err := json.Unmarshal(m.Data, &reply); err != nil {
+			logger.Error("Peer query decode error", "error", err)
+			continue
+		}
+		replies = append(replies, reply)
+	}
+}
+
+// Ping checks the connection to NATS is up, for /readyz. The client
+// reconnects on its own, so this only reports whether it currently is.
+func (nb *natsBackplane) Ping(ctx context.Context) error {
+	if !nb.conn.IsConnected() {
+		return fmt.Errorf("nats connection %s", nb.conn.Status())
+	}
+	return nil
+}
+
+func (nb *natsBackplane) Close() error {
+	return nb.conn.Drain()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisBackplane fans publishes out over a single Redis pub/sub channel that
+// every instance subscribes to. Peer queries go out on <channel>:query and
+// are answered on a reply channel of the asking instance.
+type redisBackplane struct {
+	client  *redis.Client
+	channel string
+	nodeID  string
+	pubsub  *redis.PubSub
+}
+
+func newRedisBackplane(url, channel, nodeID string) (*redisBackplane, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	return &redisBackplane{client: redis.NewClient(opts), channel: channel, nodeID: nodeID}, nil
+}
+
+func (rb *redisBackplane) Publish(ctx context.Context, msg BackplaneMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return rb.client.Publish(ctx, rb.channel, data).Err()
+}
+
+func (rb *redisBackplane) Subscribe(ctx context.Context, handle func(BackplaneMessage)) error {
+	rb.pubsub = rb.client.Subscribe(ctx, rb.channel, rb.channel+":query")
+	// Wait for the confirmation so no publish after this returns is missed
+	if _, err := rb.pubsub.Receive(ctx); err != nil {
+		rb.pubsub.Close()
+		return err
+	}
+	go func() {
+		// The channel survives reconnects and closes with the subscription
+		for m := range rb.pubsub.Channel() {
+			if m.Channel != rb.channel {
+				go rb.answer(m.Payload)
+				continue
+			}
+			var msg BackplaneMessage
+			if err := json.Unmarshal([]byte(m.Payload), &msg); err != nil {
+				logger.Error("Backplane decode error", "error", err)
+				reportError("backplane", err, "channel", rb.channel)
+				continue
+			}
+			handle(msg)
+		}
+	}()
+	return nil
+}
+
+// answer replies to another instance's peer query
+func (rb *redisBackplane) answer(payload string) {
+	var qm peerQueryMessage
+	if err := json.Unmarshal([]byte(payload), &qm); err != nil {
+		logger.Error("Peer query decode error", "error", err)
+		return
+	}
+	if qm.Origin == rb.nodeID {
+		return
+	}
+	data, err := json.Marshal(currentBroker.localView(qm.Query))
+	if err != nil {
+		logger.Error("Peer query reply error", "error", err)
+		return
+	}
+	if err := rb.client.Publish(context.Background(), qm.ReplyTo, data).Err(); err != nil {
+		logger.Error("Peer query reply error", "error", err)
+	}
+}
+
+// queryPeers publishes q and waits for every other subscriber of the query
+// channel to answer, or for ctx to end
+func (rb *redisBackplane) queryPeers(ctx context.Context, q peerQuery) []peerReply {
+	replyTo := rb.channel + ":reply:" + newSessionID()
+	sub := rb.client.Subscribe(ctx, replyTo)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		logger.Error("Peer query error", "error", err)
+		return nil
+	}
+	data, err := json.Marshal(peerQueryMessage{Origin: rb.nodeID, ReplyTo: replyTo, Query: q})
+	if err != nil {
+		logger.Error("Peer query error", "error", err)
+		return nil
+	}
+	// PUBLISH returns how many instances got the query, this one included
+	receivers, err := rb.client.Publish(ctx, rb.channel+":query", data).Result()
+	if err != nil {
+		logger.Error("Peer query error", "error", err)
+		return nil
+	}
+	var replies []peerReply
+	ch := sub.Channel()
+	for int64(len(replies)) < receivers-1 {
+		select {
+		case m := <-ch:
+			var reply peerReply
+			if err := json.Unmarshal([]byte(m.Payload), &reply); err != nil {
+				logger.Error("Peer query decode error", "error", err)
+				continue
+			}
+			replies = append(replies, reply)
+		case <-ctx.Done():
+			return replies
+		}
+	}
+	return replies
+}
+
+// Ping checks Redis answers, for /readyz
+func (rb *redisBackplane) Ping(ctx context.Context) error {
+	return rb.client.Ping(ctx).Err()
+}
+
+func (rb *redisBackplane) Close() error {
+	if rb.pubsub != nil {
+		rb.pubsub.Close()
+	}
+	return rb.client.Close()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+)
+
+// userBan keeps a user from opening streams until it expires
+type userBan struct {
+	UserID string    `json:"userID"`
+	Reason string    `json:"reason,omitempty"`
+	At     time.Time `json:"at"`
+	Until  time.Time `json:"until"`
+}
+
+// userBans holds the bans in force on this instance. With persistence, they
+// are also kept in the Store, one event per user in the bans stream, so they
+// survive a restart and reach instances that start later.
+type userBans struct {
+	mu   sync.Mutex
+	bans map[string]userBan
+	// store is nil when bans are only kept in memory
+	store Store
+}
+
+// bansStream is the Store stream persisted bans are kept in, topic being
+// the user banned
+const bansStream = "bans"
+
+func newUserBans(store Store, persist bool) *userBans {
+	ub := &userBans{bans: make(map[string]userBan)}
+	if persist {
+		ub.store = store
+	}
+	return ub
+}
+
+// load reads the persisted bans, removing those that have expired
+func (ub *userBans) load(ctx context.Context) error {
+	if ub.store == nil {
+		return nil
+	}
+	events, err := ub.store.Range(ctx, bansStream, 0, 0)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var expired []uint64
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	for _, ev := range events {
+		if ev.expired(now) {
+			expired = append(expired, ev.ID)
+			continue
+		}
+		// Data has been through JSON in most stores
+		raw, err := json.Marshal(ev.Data)
+		if err != nil {
+			continue
+		}
+		var ban userBan
+		if json.Unmarshal(raw, &ban) == nil && ban.At.After(ub.bans[ban.UserID].At) {
+			ub.bans[ban.UserID] = ban
+		}
+	}
+	if len(expired) > 0 {
+		return ub.store.Delete(ctx, bansStream, expired)
+	}
+	return nil
+}
+
+// add bans ban.UserID, replacing any ban it was under
+func (ub *userBans) add(ban userBan) {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	ub.bans[ban.UserID] = ban
+}
+
+// remove lifts userID's ban, reporting false when it wasn't banned
+func (ub *userBans) remove(userID string) (userBan, bool) {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	ban, ok := ub.bans[userID]
+	delete(ub.bans, userID)
+	if ok && time.Now().After(ban.Until) {
+		return userBan{}, false
+	}
+	return ban, ok
+}
+
+// check returns userID's ban, if one is in force
+func (ub *userBans) check(userID string) (userBan, bool) {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	ban, ok := ub.bans[userID]
+	if ok && time.Now().After(ban.Until) {
+		delete(ub.bans, userID)
+		return userBan{}, false
+	}
+	return ban, ok
+}
+
+// list returns the bans in force, soonest to expire first
+func (ub *userBans) list() []userBan {
+	ub.mu.Lock()
+	defer ub.mu.Unlock()
+	now := time.Now()
+	out := make([]userBan, 0, len(ub.bans))
+	for userID, ban := range ub.bans {
+		if now.After(ban.Until) {
+			delete(ub.bans, userID)
+			continue
+		}
+		out = append(out, ban)
+	}
+	slices.SortFunc(out, func(a, b userBan) int {
+		return cmp.Or(a.Until.Compare(b.Until), cmp.Compare(a.UserID, b.UserID))
+	})
+	return out
+}
+
+// persist records ban in the Store, replacing the user's earlier one
+func (ub *userBans) persist(ctx context.Context, id uint64, ban userBan) error {
+	if ub.store == nil {
+		return nil
+	}
+	ev := event{ID: id, Type: "ban", Topic: ban.UserID, Data: ban, PublishedAt: ban.At, ExpiresAt: ban.Until}
+	if err := ub.store.Append(ctx, bansStream, ev); err != nil {
+		return err
+	}
+	return ub.unpersist(ctx, ban.UserID, id)
+}
+
+// unpersist removes userID's bans from the Store, except the one with ID keep
+func (ub *userBans) unpersist(ctx context.Context, userID string, keep uint64) error {
+	if ub.store == nil {
+		return nil
+	}
+	events, err := ub.store.Range(ctx, bansStream, 0, 0)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, ev := range events {
+		if ev.Topic == userID && ev.ID != keep {
+			ids = append(ids, ev.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return ub.store.Delete(ctx, bansStream, ids)
+}
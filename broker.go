@@ -0,0 +1,642 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// backpressurePolicy decides what happens when a session's buffer is full
+type backpressurePolicy string
+
+const (
+	dropNewest             backpressurePolicy = "drop-newest"
+	dropOldest             backpressurePolicy = "drop-oldest"
+	blockWithTimeout       backpressurePolicy = "block-with-timeout"
+	disconnectSlowConsumer backpressurePolicy = "disconnect"
+)
+
+func parseBackpressurePolicy(v string) (backpressurePolicy, bool) {
+	switch p := backpressurePolicy(v); p {
+	case dropNewest, dropOldest, blockWithTimeout, disconnectSlowConsumer:
+		return p, true
+	}
+	return "", false
+}
+
+// publishOptions control how a single publish is delivered
+type publishOptions struct {
+	// Policy overrides the broker's backpressure policy when set
+	Policy backpressurePolicy `json:"policy,omitempty"`
+	// AtLeastOnce retains the event until a session acknowledges it and
+	// redelivers it when the user reconnects
+	AtLeastOnce bool `json:"atLeastOnce,omitempty"`
+	// State publishes ev as a snapshot or patch of the topic's state document
+	State stateMode `json:"state,omitempty"`
+	// Replica is set on a publish mirrored from another region
+	Replica *replicaOrigin `json:"replica,omitempty"`
+}
+
+// broker routes published events to the sessions that should receive them
+type broker struct {
+	sessions sessionsLock
+
+	bufferSize    int
+	maxBufferSize int
+	policy        backpressurePolicy
+	blockTimeout  time.Duration
+
+	slowConsumers *slowConsumerDetector
+	drops         *dropLog
+	deliveries    *deliveryTracker
+	redelivery    *redeliveryQueue
+	offline       *offlineQueue
+	idempotency   *idempotencyCache
+	scheduler     *timerWheel
+	throttle      *userThrottle
+	history       *eventHistory
+	state         *latestValues
+	stateDocs     *stateDocs
+	deadLetters   deadLetterSinks
+	// recentDeadLetters backs /dead-letters; nil when disabled
+	recentDeadLetters *deadLetterRing
+	wal               *writeAheadLog
+	// backplane forwards publishes to other instances; nil when running alone
+	backplane Backplane
+	nodeID    string
+	publicURL string
+	// replication mirrors publishes to other regions
+	replication *replicator
+	// reauthWarning is how early streams are asked to reauthenticate
+	reauthWarning time.Duration
+	// streamIdleTimeout and streamMaxDuration bound how long a stream stays
+	// open without events, and at all
+	streamIdleTimeout time.Duration
+	streamMaxDuration time.Duration
+	// writeTimeout bounds each write to a stream's connection
+	writeTimeout  time.Duration
+	limits        *connectionLimits
+	publishLimits *publishLimits
+	payloadLimits payloadLimits
+	encryption    *payloadEncryption
+	pollWaiters   pollWaiters
+	pollTimeout   time.Duration
+	streamFormats streamFormats
+	metrics       *brokerMetrics
+	accessLog     *accessLog
+	// tail shows broker activity on /admin/tail
+	tail *activityTail
+	// presence notifies a webhook as users come online and go offline; nil
+	// when not configured
+	presence *presenceWebhook
+
+	// sessionMetadata picks what clients may say about their sessions
+	sessionMetadata sessionMetadata
+	// sessionLabels tags sessions for publishes that select by label
+	sessionLabels sessionLabeler
+	// pauses holds back delivery to users an operator paused
+	pauses *userPauses
+	// bans keeps banned users from opening streams
+	bans *userBans
+	// keepAlive is the KeepAliveInterval, which a config reload can change
+	keepAlive atomic.Int64
+	// streamOrigins are the origins whose pages may open /sse, which a config
+	// reload can change
+	streamOrigins atomic.Pointer[[]string]
+	// mqtt mirrors API publishes to MQTT; nil when not configured
+	mqtt *mqttBridge
+	// push notifies the devices of users without a session; nil when not
+	// configured
+	push *pushFallback
+
+	lastEventID atomic.Uint64
+	// closing is set once shutdown starts
+	closing atomic.Bool
+	// unsentOnShutdown counts the events sessions closed by shutdown were
+	// left holding, kept in the write-ahead log for the next start
+	unsentOnShutdown atomic.Int64
+}
+
+var currentBroker *broker
+
+func newBroker(cfg config, store Store, wal *writeAheadLog, backplane Backplane, replication *replicator) *broker {
+	b := &broker{
+		bufferSize:        cfg.SessionBuffer,
+		maxBufferSize:     cfg.MaxSessionBuffer,
+		policy:            cfg.BackpressurePolicy,
+		blockTimeout:      cfg.BlockTimeout,
+		slowConsumers:     newSlowConsumerDetector(cfg),
+		drops:             newDropLog(cfg.DropLogInterval),
+		deliveries:        newDeliveryTracker(cfg.DeliveryTrackingLimit),
+		redelivery:        newRedeliveryQueue(cfg.RedeliveryLimit),
+		offline:           newOfflineQueue(store, cfg.OfflineQueueLimit, cfg.OfflineQueueTTL),
+		idempotency:       newIdempotencyCache(cfg.IdempotencyWindow),
+		scheduler:         newTimerWheel(cfg.SchedulerTick, 512, cfg.MaxScheduled),
+		history:           newEventHistory(store, cfg.historyRetention(), cfg.HistoryTrimInterval),
+		state:             newLatestValues(store, cfg.LatestValue),
+		stateDocs:         newStateDocs(cfg.SnapshotEvery),
+		wal:               wal,
+		backplane:         backplane,
+		nodeID:            cfg.NodeID,
+		publicURL:         cfg.PublicURL,
+		replication:       replication,
+		reauthWarning:     cfg.ReauthWarning,
+		streamIdleTimeout: cfg.StreamIdleTimeout,
+		streamMaxDuration: cfg.StreamMaxDuration,
+		writeTimeout:      cfg.WriteTimeout,
+		limits:            newConnectionLimits(cfg),
+		publishLimits:     newPublishLimits(cfg),
+		payloadLimits:     newPayloadLimits(cfg),
+		encryption:        newPayloadEncryption(cfg),
+		streamFormats:     newStreamFormats(cfg),
+		pollTimeout:       cfg.PollTimeout,
+		metrics:           newBrokerMetrics(cfg),
+		accessLog:         newAccessLog(cfg),
+		presence:          newPresenceWebhook(cfg),
+		tail:              newActivityTail(),
+
+		sessionMetadata: newSessionMetadata(cfg),
+		sessionLabels:   newSessionLabeler(cfg),
+		bans:            newUserBans(store, cfg.BanPersist),
+	}
+	b.sessions.changed = func(s *session, joined, userOnline bool) {
+		b.tail.sessionChanged(s, joined)
+		if b.presence != nil {
+			b.presence.sessionChanged(s, joined, userOnline)
+		}
+	}
+	b.keepAlive.Store(int64(cfg.KeepAliveInterval))
+	b.setStreamOrigins(cfg.StreamOrigins)
+	b.pauses = newUserPauses(cfg.PauseBufferLimit, b.resumed)
+	b.throttle = newUserThrottle(cfg.UserMaxRate, cfg.UserBurst, func(userID string, ev event, opts publishOptions) {
+		b.publish(userID, ev, opts)
+	}, func(_ string, ev event) {
+		b.wal.release(ev.walID)
+	})
+	if cfg.DeadLetterLimit > 0 {
+		b.recentDeadLetters = newDeadLetterRing(cfg.DeadLetterLimit)
+		b.deadLetters = append(b.deadLetters, b.recentDeadLetters)
+	}
+	if cfg.DeadLetterFile != "" {
+		df, err := newDeadLetterFile(cfg.DeadLetterFile)
+		if err != nil {
+			logger.Warn("Dead letter file disabled", "error", err)
+		} else {
+			b.deadLetters = append(b.deadLetters, df)
+		}
+	}
+	if cfg.DeadLetterURL != "" {
+		b.deadLetters = append(b.deadLetters, newDeadLetterCallback(cfg.DeadLetterURL))
+	}
+	if b.offline.enabled() {
+		go b.pruneOffline(time.Minute)
+	}
+	return b
+}
+
+// nextEventID returns a unique, increasing event ID that follows the clock in
+// microseconds, so IDs keep increasing across restarts and interleave in time
+// order between instances sharing a store
+func (b *broker) nextEventID() uint64 {
+	for {
+		last := b.lastEventID.Load()
+		id := max(last+1, uint64(time.Now().UnixMicro()))
+		if b.lastEventID.CompareAndSwap(last, id) {
+			return id
+		}
+	}
+}
+
+// keepAliveTimer returns how long until a stream's next keepalive, and
+// whether one is due then; while keepalives are disabled, streams check
+// again every minute in case a reload enables them
+func (b *broker) keepAliveTimer() (time.Duration, bool) {
+	if d := time.Duration(b.keepAlive.Load()); d > 0 {
+		return d, true
+	}
+	return time.Minute, false
+}
+
+// setStreamOrigins puts a comma-separated origin allowlist in force for
+// /sse, as at startup or on a config reload
+func (b *broker) setStreamOrigins(spec string) {
+	origins := splitList(spec)
+	b.streamOrigins.Store(&origins)
+}
+
+// streamOriginAllowed reports whether pages from origin may open streams
+func (b *broker) streamOriginAllowed(origin string) bool {
+	return originAllowed(origin, *b.streamOrigins.Load())
+}
+
+// sessionBuffer returns the channel capacity for a new session, honoring a
+// client-requested size (0 means the broker default) up to the configured maximum
+func (b *broker) sessionBuffer(requested int) int {
+	if requested <= 0 {
+		return max(b.bufferSize, 1)
+	}
+	return max(min(requested, b.maxBufferSize), 1)
+}
+
+// publishResult describes what happened to a published event
+type publishResult struct {
+	EventID uint64
+	// Sent is the number of sessions the event was queued for, Dropped the number it wasn't
+	Sent    int
+	Dropped int
+	// Online is set when the user had at least one session, subscribed to the topic or not
+	Online bool
+	// QueuedOffline is set when the user had no session and the event waits in the offline queue
+	QueuedOffline bool
+	// Throttled is set when the user is over their rate limit and the event was
+	// held back; it goes out later unless a newer event for the same topic replaces it
+	Throttled bool
+	// Paused is set when delivery to the user is paused and the event was
+	// held for the resume or dead-lettered, as the pause says
+	Paused   bool
+	Sessions []sessionReport
+}
+
+// sessionReport is the outcome of a publish for one session
+type sessionReport struct {
+	SessionID string `json:"sessionID"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// publish assigns ev an ID and delivers it to every session of userID subscribed
+// to the event's topic
+func (b *broker) publish(userID string, ev event, opts publishOptions) publishResult {
+	policy := opts.Policy
+	if policy == "" {
+		policy = b.policy
+	}
+	// The log entry settles once every session queue below has let go of it
+	defer b.wal.release(ev.walID)
+	ev.ID = b.nextEventID()
+	ev.PublishedAt = time.Now()
+	b.metrics.published.Add(1)
+	b.deliveries.track(ev.ID, userID)
+	// A publish to labels alone belongs to no user's history or state
+	if userID != "" {
+		b.history.append(userID, ev)
+		b.state.set(userID, ev)
+		b.pollWaiters.wake(userID)
+	}
+	if opts.AtLeastOnce {
+		b.redelivery.retain(userID, ev)
+	}
+
+	b.forward(userID, ev, opts)
+	b.replication.mirror(userID, ev, opts)
+
+	res := b.deliverLocal(userID, ev, policy)
+	// With a backplane the user may be connected to another instance, so only
+	// a lone instance can tell that nobody received the event
+	if len(res.Sessions) == 0 && !opts.AtLeastOnce && !res.Paused && b.backplane == nil {
+		switch {
+		case userID == "":
+			b.deadLetter(userID, "", ev, "no session has the labels")
+		case res.Online:
+			b.deadLetter(userID, "", ev, "not subscribed to topic")
+		case !b.offline.enabled():
+			b.deadLetter(userID, "", ev, "user offline")
+		case b.offline.add(userID, ev):
+			res.QueuedOffline = true
+		default:
+			b.deadLetter(userID, "", ev, "offline queue full")
+		}
+	}
+	// As with the offline queue, only a lone instance knows the user has no
+	// session anywhere
+	if userID != "" && !res.Online && b.backplane == nil {
+		b.push.offline(userID, ev)
+	}
+	return res
+}
+
+// deliverLocal queues ev for every session on this instance of userID
+// subscribed to the event's topic and carrying its labels. Without a
+// userID, the labels alone pick the sessions, of any user.
+func (b *broker) deliverLocal(userID string, ev event, policy backpressurePolicy) publishResult {
+	targets := b.sessions.matching(func(s *session) bool {
+		return (userID == "" || s.userID == userID) && s.receives(ev)
+	})
+	res := publishResult{
+		EventID:  ev.ID,
+		Online:   len(targets) > 0 || (userID != "" && b.sessions.hasUser(userID)),
+		Sessions: make([]sessionReport, 0, len(targets)),
+	}
+	if len(targets) > 0 {
+		targets = b.holdPaused(targets, ev, policy, &res)
+	}
+	for _, s := range targets {
+		// Mark queued first so the writer's "written" can't be overtaken
+		b.deliveries.set(ev.ID, s.id, deliveryQueued)
+		b.wal.hold(ev.walID)
+		reason, displaced := s.enqueue(ev, policy, b.blockTimeout)
+		if reason == "" {
+			res.Sent++
+			res.Sessions = append(res.Sessions, sessionReport{SessionID: s.id, Status: "queued"})
+		} else {
+			b.wal.release(ev.walID)
+			res.Dropped++
+			res.Sessions = append(res.Sessions, sessionReport{SessionID: s.id, Status: "dropped", Reason: reason})
+			b.dropped(s.userID, s, ev, reason)
+		}
+		// Events pushed out by higher-priority or newer ones count as drops too
+		for _, d := range displaced {
+			b.wal.release(d.walID)
+			b.dropped(s.userID, s, d, "displaced from full buffer")
+		}
+	}
+	b.tail.published(userID, ev, res)
+	return res
+}
+
+// holdPaused leaves out of targets the sessions of paused users, holding ev
+// for their resume or dead-lettering it, as each pause says
+func (b *broker) holdPaused(targets []*session, ev event, policy backpressurePolicy, res *publishResult) []*session {
+	held := make(map[string]bool, 1)
+	return slices.DeleteFunc(targets, func(s *session) bool {
+		paused, seen := held[s.userID]
+		if !seen {
+			var reason string
+			paused, reason = b.pauses.hold(s.userID, ev, policy)
+			if reason != "" {
+				b.deadLetter(s.userID, "", ev, reason)
+			}
+			held[s.userID] = paused
+			res.Paused = res.Paused || paused
+		}
+		return paused
+	})
+}
+
+// forward sends a publish accepted here to the other instances
+func (b *broker) forward(userID string, ev event, opts publishOptions) {
+	if b.backplane == nil {
+		return
+	}
+	ev.walID = 0
+	msg := BackplaneMessage{Origin: b.nodeID, UserID: userID, Event: ev, Opts: opts}
+	if err := b.backplane.Publish(context.Background(), msg); err != nil {
+		logger.Error("Backplane publish error", "userID", userID, "eventID", ev.ID, "error", err)
+		reportError("backplane", err, "userID", userID, "eventID", strconv.FormatUint(ev.ID, 10))
+	}
+}
+
+// listen delivers publishes forwarded by other instances to local sessions
+func (b *broker) listen(ctx context.Context) error {
+	if b.backplane == nil {
+		return nil
+	}
+	return b.backplane.Subscribe(ctx, b.receive)
+}
+
+// receive delivers a publish forwarded by another instance
+func (b *broker) receive(msg BackplaneMessage) {
+	if msg.Origin == b.nodeID {
+		return
+	}
+	if msg.Opts.State != "" {
+		b.publishState(msg.UserID, msg.Event, msg.Opts, true)
+		return
+	}
+	policy := msg.Opts.Policy
+	if policy == "" {
+		policy = b.policy
+	}
+	b.deliverLocal(msg.UserID, msg.Event, policy)
+	// With a shared store, the event is in the history polls read
+	b.pollWaiters.wake(msg.UserID)
+}
+
+// route returns the node clients of userID should connect to and the URL of
+// its API; without a backplane that routes by user, that's this one
+func (b *broker) route(userID string) (node, url string) {
+	if r, ok := b.backplane.(interface{ route(string) (string, string) }); ok {
+		return r.route(userID)
+	}
+	return b.nodeID, b.publicURL
+}
+
+// announce tells a backplane that routes publishes by user that a session
+// connected here
+func (b *broker) announce() {
+	if a, ok := b.backplane.(interface{ announce() }); ok {
+		a.announce()
+	}
+}
+
+// updateSubscriptions changes the topic set of a live session and emits a
+// subscription-updated confirmation on its stream
+func (b *broker) updateSubscriptions(sessionID string, subscribe, unsubscribe []string) ([]string, bool) {
+	s := b.sessions.findSession(sessionID)
+	if s == nil {
+		return nil, false
+	}
+	topics := s.updateTopics(subscribe, unsubscribe)
+	s.enqueue(event{Type: "subscription-updated", Data: map[string]any{"topics": topics}}, dropNewest, 0)
+	return topics, true
+}
+
+// ack records that the client behind sessionID processed eventID
+func (b *broker) ack(sessionID string, eventID uint64) bool {
+	if !b.deliveries.set(eventID, sessionID, deliveryAcked) {
+		return false
+	}
+	if rec, ok := b.deliveries.get(eventID); ok {
+		b.redelivery.ack(rec.UserID, eventID)
+	}
+	return true
+}
+
+// pendingRedeliveries returns the unacknowledged at-least-once events for a
+// newly connected session, skipping those up to the client's Last-Event-ID
+func (b *broker) pendingRedeliveries(s *session, lastEventID uint64) []event {
+	var out []event
+	for _, ev := range b.redelivery.unacked(s.userID, lastEventID) {
+		if !s.receives(ev) {
+			continue
+		}
+		b.deliveries.set(ev.ID, s.id, deliveryQueued)
+		out = append(out, ev)
+	}
+	return out
+}
+
+// publishOnce is publish guarded by an idempotency key: a repeat of the same
+// key for the same user within the window returns the first result instead of
+// publishing again
+func (b *broker) publishOnce(key, userID string, ev event, opts publishOptions) (res publishResult, duplicate bool) {
+	if key == "" || b.idempotency.window <= 0 {
+		return b.publishThrottled(userID, ev, opts), false
+	}
+	e, first := b.idempotency.begin(userID + "\x00" + key)
+	if !first {
+		b.wal.release(ev.walID)
+		<-e.done
+		return e.result, true
+	}
+	res = b.publishThrottled(userID, ev, opts)
+	b.idempotency.finish(e, res)
+	return res, false
+}
+
+// publishThrottled applies the per-user rate limit before publishing.
+// At-least-once events, state updates and publishes to labels alone are
+// never held back or coalesced.
+func (b *broker) publishThrottled(userID string, ev event, opts publishOptions) publishResult {
+	if opts.State != "" {
+		return b.publishState(userID, ev, opts, false)
+	}
+	if b.throttle.enabled() && !opts.AtLeastOnce && userID != "" && !b.throttle.allow(userID, ev, opts) {
+		return publishResult{Throttled: true, Sessions: []sessionReport{}}
+	}
+	return b.publish(userID, ev, opts)
+}
+
+// schedule publishes ev at deliverAt, then calls published, if set, unless
+// the publish was a duplicate. It reports false when too many publishes are
+// already waiting.
+func (b *broker) schedule(deliverAt time.Time, key, userID string, ev event, opts publishOptions, published func()) bool {
+	return b.scheduler.schedule(deliverAt, func() {
+		if _, duplicate := b.publishOnce(key, userID, ev, opts); !duplicate && published != nil {
+			published()
+		}
+	})
+}
+
+// accept logs a publish in the write-ahead log before it is acknowledged;
+// deliverAt is zero unless it is scheduled
+func (b *broker) accept(userID string, ev event, opts publishOptions, deliverAt time.Time) event {
+	ev.walID = b.wal.accept(userID, ev, opts, deliverAt)
+	return ev
+}
+
+// republish publishes again what the write-ahead log holds from the previous
+// run, after delay so that clients have a chance to reconnect first
+func (b *broker) republish(records []walRecord, delay time.Duration) {
+	if len(records) == 0 {
+		return
+	}
+	logger.Info("WAL republishing unsettled events", "count", len(records))
+	for _, rec := range records {
+		if rec.Event == nil || rec.Opts == nil {
+			continue
+		}
+		ev := *rec.Event
+		ev.ID, ev.walID = 0, rec.ID
+		b.wal.adopt(rec.ID)
+		at := time.Now().Add(delay)
+		if rec.DeliverAt.After(at) {
+			at = rec.DeliverAt
+		}
+		if !b.schedule(at, "", rec.UserID, ev, *rec.Opts, nil) {
+			logger.Warn("WAL dropped event, too many scheduled", "userID", rec.UserID)
+			b.wal.release(rec.ID)
+		}
+	}
+}
+
+// shutdown closes every session, leaving what they had queued in the
+// write-ahead log, and returns how many there were and how many events they
+// had queued; writers send what they can before their streams end
+func (b *broker) shutdown() (sessions, queued int) {
+	b.closing.Store(true)
+	if b.backplane != nil {
+		if err := b.backplane.Close(); err != nil {
+			logger.Error("Backplane close error", "error", err)
+			reportError("backplane", err)
+		}
+	}
+	sessions, queued = b.sessions.closeAllSessions()
+	b.tail.close()
+	return sessions, queued
+}
+
+// missedEvents returns the events a reconnecting session missed after lastEventID
+func (b *broker) missedEvents(s *session, lastEventID uint64) []event {
+	if lastEventID == 0 {
+		return nil
+	}
+	events, err := b.history.since(context.Background(), s.userID, lastEventID)
+	if err != nil {
+		s.log.Error("History read error", "error", err)
+		return nil
+	}
+	var out []event
+	for _, ev := range events {
+		if s.receives(ev) {
+			b.deliveries.set(ev.ID, s.id, deliveryQueued)
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// currentState returns the latest values of the topics a new session is
+// subscribed to, newer than its Last-Event-ID
+func (b *broker) currentState(s *session, lastEventID uint64) []event {
+	events, err := b.state.get(context.Background(), s.userID)
+	if err != nil {
+		s.log.Error("State read error", "error", err)
+		return nil
+	}
+	var out []event
+	for _, ev := range events {
+		if ev.ID > lastEventID && s.receives(ev) {
+			b.deliveries.set(ev.ID, s.id, deliveryQueued)
+			out = append(out, ev)
+		}
+	}
+	return out
+}
+
+// pendingOffline returns the events queued while the user had no session
+func (b *broker) pendingOffline(s *session) []event {
+	if !b.offline.enabled() {
+		return nil
+	}
+	events, discarded := b.offline.take(s.userID, func(ev event) bool { return s.receives(ev) })
+	for _, ev := range discarded {
+		b.deadLetter(s.userID, s.id, ev, "expired or not subscribed to topic")
+	}
+	for _, ev := range events {
+		b.deliveries.set(ev.ID, s.id, deliveryQueued)
+	}
+	return events
+}
+
+// pruneOffline periodically dead-letters offline events that waited too long
+func (b *broker) pruneOffline(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		for userID, events := range b.offline.prune() {
+			for _, ev := range events {
+				b.deadLetter(userID, "", ev, "expired")
+			}
+		}
+	}
+}
+
+// deadLetter hands an undeliverable event to the configured dead-letter sinks
+func (b *broker) deadLetter(userID, sessionID string, ev event, reason string) {
+	if len(b.deadLetters) == 0 {
+		return
+	}
+	b.deadLetters.put(deadLetter{
+		EventID:   ev.ID,
+		UserID:    userID,
+		SessionID: sessionID,
+		Type:      ev.Type,
+		Topic:     ev.Topic,
+		Data:      ev.Data,
+		Reason:    reason,
+		At:        time.Now(),
+	})
+}
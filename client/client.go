@@ -0,0 +1,84 @@
+// Package client is a Go client for the server: it subscribes to a user's
+// event stream, reconnecting and catching up on missed events by itself, and
+// publishes events through the HTTP API.
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client talks to one server, or to the load balancer in front of several
+type Client struct {
+	// BaseURL is the server's address, such as "http://localhost:8080"
+	BaseURL string
+	// APIKey is sent with publishes, in the X-API-Key header, when the
+	// server sets SSE_API_KEYS
+	APIKey string
+	// HTTPClient makes the requests; http.DefaultClient when nil. A client
+	// Timeout would end every stream after that long, so bound publishes
+	// with their context instead.
+	HTTPClient *http.Client
+}
+
+// New returns a client of the server at baseURL
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) url(path string) string {
+	return strings.TrimRight(c.BaseURL, "/") + path
+}
+
+// Error is a request the server refused
+type Error struct {
+	StatusCode int
+	// Message is the server's "error" field, or the status text
+	Message string
+	// RetryAfter is how long the server asked to wait before trying again,
+	// from its Retry-After header; zero when it didn't say
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("server answered %d: %s", e.StatusCode, e.Message)
+}
+
+// Temporary reports whether the same request may succeed later: the server
+// was overloaded, draining or over a limit, rather than refusing the request
+// itself
+func (e *Error) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// responseError reads the error a refused request was answered with
+func responseError(resp *http.Response) *Error {
+	e := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	var body struct {
+		Error string `json:"error"`
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(raw, &body) == nil && body.Error != "" {
+		e.Message = body.Error
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
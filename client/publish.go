@@ -0,0 +1,111 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// PublishRequest is an event to publish, as POST /send-to-user takes it
+type PublishRequest struct {
+	// UserID is the user to deliver to; it may be left out when Labels
+	// picks the sessions
+	UserID string `json:"userID,omitempty"`
+	// Topic only delivers to the sessions subscribed to it; without one the
+	// event goes to every session of the user
+	Topic string `json:"topic,omitempty"`
+	// Value is the event's value, encoded as JSON
+	Value any `json:"value"`
+
+	// Backpressure overrides SSE_BACKPRESSURE_POLICY for this event
+	Backpressure string `json:"backpressure,omitempty"`
+	// Delivery is "at-least-once" for events kept until acknowledged
+	Delivery string `json:"delivery,omitempty"`
+	// Priority is "high", "normal" or "low"
+	Priority string `json:"priority,omitempty"`
+	// State is "snapshot" or "patch" to update the user's state document
+	State string `json:"state,omitempty"`
+	// Labels only delivers to the sessions carrying every label
+	Labels map[string]string `json:"labels,omitempty"`
+	// IdempotencyKey makes a retried publish harmless: the server doesn't
+	// deliver the same key for the same user twice
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+
+	// TTL discards the event if it couldn't be written within it
+	TTL time.Duration `json:"-"`
+	// DeliverAt, or Delay, schedules the event instead of sending it now
+	DeliverAt time.Time     `json:"-"`
+	Delay     time.Duration `json:"-"`
+}
+
+// SessionReport is what became of a publish for one session
+type SessionReport struct {
+	SessionID string `json:"sessionID"`
+	Status    string `json:"status"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// PublishResult is what became of a publish
+type PublishResult struct {
+	EventID uint64 `json:"eventID"`
+	// Sent is the number of sessions the event was queued for, Dropped the
+	// number whose buffer had no room for it
+	Sent    int `json:"sent"`
+	Dropped int `json:"dropped"`
+	// Online is set when the user had a session, subscribed to the topic or not
+	Online        bool `json:"online"`
+	QueuedOffline bool `json:"queuedOffline"`
+	Throttled     bool `json:"throttled"`
+	Paused        bool `json:"paused"`
+	// Duplicate is set when the idempotency key was seen before, and the
+	// result is the original publish's
+	Duplicate bool            `json:"duplicate"`
+	Sessions  []SessionReport `json:"sessions"`
+
+	// Scheduled is set, with DeliverAt, when the event was scheduled
+	// rather than sent; the rest of the result is then empty
+	Scheduled bool      `json:"scheduled"`
+	DeliverAt time.Time `json:"deliverAt"`
+}
+
+// Publish sends an event to a user's sessions. A refused publish returns an
+// *Error, whose Temporary tells whether it is worth retrying.
+func (c *Client) Publish(ctx context.Context, pr PublishRequest) (*PublishResult, error) {
+	type wire PublishRequest
+	body := struct {
+		wire
+		TTLMs     int64      `json:"ttlMs,omitempty"`
+		DelayMs   int64      `json:"delayMs,omitempty"`
+		DeliverAt *time.Time `json:"deliverAt,omitempty"`
+	}{wire: wire(pr), TTLMs: pr.TTL.Milliseconds(), DelayMs: pr.Delay.Milliseconds()}
+	if !pr.DeliverAt.IsZero() {
+		body.DeliverAt = &pr.DeliverAt
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("/send-to-user"), bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, responseError(resp)
+	}
+	var res PublishResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is an event received on a stream
+type Event struct {
+	// ID is the event's ID, which the stream resumes after on a reconnect;
+	// zero for the server's own events, such as session
+	ID uint64
+	// Type is the SSE event type: current-value for a published event,
+	// session first on every stream, and the others the server documents
+	Type string
+	// Data is the event's value, the data field of the JSON the server sends
+	Data json.RawMessage
+}
+
+// Decode unmarshals the event's value into v
+func (e Event) Decode(v any) error {
+	return json.Unmarshal(e.Data, v)
+}
+
+// sessionInfo is the data of a stream's session event
+type sessionInfo struct {
+	SessionID string   `json:"sessionID"`
+	Topics    []string `json:"topics"`
+}
+
+// frameReader reads the events of a text/event-stream body
+type frameReader struct {
+	r *bufio.Reader
+	// retry is the last reconnection delay the server sent, zero if none
+	retry time.Duration
+	// line is called for every line read, comments included, so a stream
+	// going quiet can be told from one idling with keepalives
+	line  func()
+	first bool
+}
+
+func newFrameReader(r io.Reader, line func()) *frameReader {
+	return &frameReader{r: bufio.NewReader(r), line: line, first: true}
+}
+
+// next returns the next event, skipping comments and events without data
+func (fr *frameReader) next() (Event, error) {
+	var ev Event
+	var data []string
+	hasID := false
+	for {
+		raw, err := fr.r.ReadString('\n')
+		if err != nil {
+			// An event cut off by the end of the stream is incomplete
+			return Event{}, err
+		}
+		fr.line()
+		line := strings.TrimSuffix(strings.TrimSuffix(raw, "\n"), "\r")
+		if fr.first {
+			line = strings.TrimPrefix(line, "\ufeff")
+			fr.first = false
+		}
+		if line == "" {
+			// A blank line ends the event
+			if len(data) == 0 {
+				ev, hasID = Event{}, false
+				continue
+			}
+			ev.Data = eventData(strings.Join(data, "\n"))
+			if ev.Type == "" {
+				ev.Type = "message"
+			}
+			if !hasID {
+				ev.ID = 0
+			}
+			return ev, nil
+		}
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.Type = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			if id, err := strconv.ParseUint(value, 10, 64); err == nil {
+				ev.ID, hasID = id, true
+			}
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				fr.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// eventData is the value in an event's data: the server wraps it in an
+// object's data field, as does a CloudEvent. Anything else is passed on as
+// it came.
+func eventData(raw string) json.RawMessage {
+	var envelope struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal([]byte(raw), &envelope); err == nil && envelope.Data != nil {
+		return envelope.Data
+	}
+	return json.RawMessage(raw)
+}
@@ -0,0 +1,270 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStreamEnded is why a stream reconnects when the server closed it, as
+// it does on a drain or once the stream has been open too long
+var ErrStreamEnded = errors.New("stream closed by the server")
+
+// ErrStreamIdle is why a stream reconnects when nothing, not even a
+// keepalive, arrived within SubscribeOptions.IdleTimeout
+var ErrStreamIdle = errors.New("stream idle")
+
+// SubscribeOptions are the stream to open and how to keep it open
+type SubscribeOptions struct {
+	// UserID is the user whose events to receive; it may be left out when
+	// Token is a JWT, which names the user
+	UserID string
+	// Topics are subscribed to right away
+	Topics []string
+	// Buffer asks for a session buffer of this many events, zero for the
+	// server's default
+	Buffer int
+	// LastEventID resumes a stream after this event, as after a reconnect
+	LastEventID uint64
+	// Token returns the JWT to open the stream with. It is called before
+	// every connection, so a token that expired can be replaced.
+	Token func(ctx context.Context) (string, error)
+
+	// MinBackoff is the wait before the first reconnect, when the server
+	// didn't send a retry interval; 1s when zero. Every failed attempt in a
+	// row doubles the wait, up to MaxBackoff, 30s when zero. Each wait is
+	// cut by up to half at random, so clients don't reconnect together.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// IdleTimeout reconnects a stream that received nothing, keepalives
+	// included, for this long, as a connection dropped without a close
+	// does; zero never does. A few of the server's SSE_KEEPALIVE_INTERVAL.
+	IdleTimeout time.Duration
+	// OnReconnect, if set, is called before each reconnect with why the
+	// stream ended and how long it waits
+	OnReconnect func(err error, wait time.Duration)
+}
+
+// Stream is a subscription that reconnects until its context ends, resuming
+// after the last event received each time, so no event is missed while the
+// server still holds it in the user's history
+type Stream struct {
+	events chan Event
+	// retry is the reconnection delay the server sent last
+	retry time.Duration
+
+	mu          sync.Mutex
+	sessionID   string
+	lastEventID uint64
+	err         error
+}
+
+// Subscribe opens a stream of opts.UserID's events. It returns at once; the
+// events come on the stream's channel, which is closed once ctx ends or the
+// server refuses the stream for good.
+func (c *Client) Subscribe(ctx context.Context, opts SubscribeOptions) *Stream {
+	s := &Stream{events: make(chan Event), lastEventID: opts.LastEventID}
+	go s.run(ctx, c, opts)
+	return s
+}
+
+// Events are the stream's events, in the order the server sent them. Each
+// stream starts with a session event, so one comes after every reconnect.
+func (s *Stream) Events() <-chan Event {
+	return s.events
+}
+
+// Err is why the stream stopped, once its channel is closed: the context's
+// error, or the *Error the server refused it with
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// SessionID is the ID of the stream's current session, which changes on
+// every reconnect; empty before the first
+func (s *Stream) SessionID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessionID
+}
+
+// LastEventID is the ID of the last event received, which the stream
+// resumes after
+func (s *Stream) LastEventID() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastEventID
+}
+
+func (s *Stream) run(ctx context.Context, c *Client, opts SubscribeOptions) {
+	defer close(s.events)
+	failures := 0
+	for {
+		established, err := s.connect(ctx, c, opts)
+		if ctx.Err() != nil {
+			s.stop(ctx.Err())
+			return
+		}
+		var herr *Error
+		if errors.As(err, &herr) && !herr.Temporary() {
+			s.stop(err)
+			return
+		}
+		if established {
+			failures = 0
+		}
+		wait := s.backoff(opts, failures)
+		failures++
+		if herr != nil && herr.RetryAfter > wait {
+			wait = herr.RetryAfter
+		}
+		if opts.OnReconnect != nil {
+			opts.OnReconnect(err, wait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.stop(ctx.Err())
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *Stream) stop(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// backoff is the wait before the next reconnect, after failures failed
+// attempts in a row
+func (s *Stream) backoff(opts SubscribeOptions, failures int) time.Duration {
+	wait := s.retry
+	if wait <= 0 {
+		wait = opts.MinBackoff
+	}
+	if wait <= 0 {
+		wait = time.Second
+	}
+	limit := opts.MaxBackoff
+	if limit <= 0 {
+		limit = 30 * time.Second
+	}
+	limit = max(limit, wait)
+	for range min(failures, 32) {
+		wait *= 2
+		if wait >= limit {
+			wait = limit
+			break
+		}
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// connect opens the stream once and passes its events on until it ends.
+// established is set when the server accepted the stream.
+func (s *Stream) connect(ctx context.Context, c *Client, opts SubscribeOptions) (established bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url("/sse?"+streamQuery(opts).Encode()), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if id := s.LastEventID(); id != 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(id, 10))
+	}
+	if opts.Token != nil {
+		token, err := opts.Token(ctx)
+		if err != nil {
+			return false, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, responseError(resp)
+	}
+
+	// The idle timer runs while waiting on the server, not on the consumer
+	var idle atomic.Bool
+	pause, touch := func() {}, func() {}
+	if opts.IdleTimeout > 0 {
+		timer := time.AfterFunc(opts.IdleTimeout, func() {
+			idle.Store(true)
+			cancel()
+		})
+		defer timer.Stop()
+		pause = func() { timer.Stop() }
+		touch = func() { timer.Reset(opts.IdleTimeout) }
+	}
+	fr := newFrameReader(resp.Body, touch)
+	for {
+		ev, err := fr.next()
+		if fr.retry > 0 {
+			s.retry = fr.retry
+		}
+		if err != nil {
+			switch {
+			case idle.Load():
+				err = ErrStreamIdle
+			case errors.Is(err, io.EOF):
+				err = ErrStreamEnded
+			}
+			return true, err
+		}
+		if ev.Type == "session" {
+			var info sessionInfo
+			if ev.Decode(&info) == nil {
+				s.mu.Lock()
+				s.sessionID = info.SessionID
+				s.mu.Unlock()
+			}
+		}
+		pause()
+		select {
+		case s.events <- ev:
+		case <-ctx.Done():
+			// Not received, so not skipped on the next connection
+			return true, ctx.Err()
+		}
+		touch()
+		if ev.ID != 0 {
+			s.mu.Lock()
+			s.lastEventID = ev.ID
+			s.mu.Unlock()
+		}
+	}
+}
+
+// streamQuery is the query string the stream is opened with
+func streamQuery(opts SubscribeOptions) url.Values {
+	q := url.Values{}
+	if opts.UserID != "" {
+		q.Set("userID", opts.UserID)
+	}
+	if len(opts.Topics) > 0 {
+		q.Set("topics", strings.Join(opts.Topics, ","))
+	}
+	if opts.Buffer > 0 {
+		q.Set("buffer", strconv.Itoa(opts.Buffer))
+	}
+	return q
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cloudEventsMediaType is the content type of a CloudEvent sent in
+// structured mode, the whole event as the JSON body
+const cloudEventsMediaType = "application/cloudevents+json"
+
+// cloudEvent is a CloudEvent received in structured mode. The userid and
+// topic extensions say where it is published.
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+	DataBase64      string          `json:"data_base64"`
+	UserID          string          `json:"userid"`
+	Topic           string          `json:"topic"`
+}
+
+// cloudEventRequest reads a publish from a CloudEvent, in structured mode
+// when the content type says so, or in binary mode when the ce-specversion
+// header is set. It reports false when the request is neither, to be read as
+// a plain publish.
+func cloudEventRequest(header func(string) string, body []byte) (publishRequest, bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(header("Content-Type"))
+	var ce cloudEvent
+	switch {
+	case mediaType == cloudEventsMediaType:
+		if err := json.Unmarshal(body, &ce); err != nil {
+			return publishRequest{}, true, errors.New("invalid CloudEvent")
+		}
+		if ce.DataBase64 != "" {
+			// Binary data is published as the base64 text it came as
+			ce.Data, _ = json.Marshal(ce.DataBase64)
+		}
+	case header("Ce-Specversion") != "":
+		// Header values point into the request, which is reused
+		ce = cloudEvent{
+			SpecVersion:     strings.Clone(header("Ce-Specversion")),
+			ID:              strings.Clone(header("Ce-Id")),
+			Source:          strings.Clone(header("Ce-Source")),
+			Type:            strings.Clone(header("Ce-Type")),
+			DataContentType: strings.Clone(header("Content-Type")),
+			Data:            bytes.Clone(body),
+			UserID:          strings.Clone(header("Ce-Userid")),
+			Topic:           strings.Clone(header("Ce-Topic")),
+		}
+	default:
+		return publishRequest{}, false, nil
+	}
+	if ce.SpecVersion != "1.0" {
+		return publishRequest{}, true, fmt.Errorf("unsupported CloudEvents specversion %q", ce.SpecVersion)
+	}
+	if ce.ID == "" || ce.Source == "" || ce.Type == "" {
+		return publishRequest{}, true, errors.New("a CloudEvent needs an id, source and type")
+	}
+	req := publishRequest{
+		UserID: ce.UserID,
+		Topic:  ce.Topic,
+		Value:  ce.Data,
+		// Producers keep id unique per source, so resending an event
+		// doesn't publish it twice
+		IdempotencyKey: "ce:" + ce.Source + " " + ce.ID,
+	}
+	if len(req.Value) > 0 && !jsonMediaType(ce.DataContentType) {
+		// Data that isn't JSON is published as a string
+		req.Value, _ = json.Marshal(string(req.Value))
+	}
+	return req, true, nil
+}
+
+// jsonMediaType reports whether data of contentType is JSON, as it is when
+// the type is left out
+func jsonMediaType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// cloudEventEnvelope is a published event as written to a stream in the
+// CloudEvents format
+type cloudEventEnvelope struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            any       `json:"data"`
+}
+
+// cloudEventWriter wraps each published event in a CloudEvents envelope,
+// with the user as its subject. Events without an ID are the server's own
+// notices, and go out as they are.
+type cloudEventWriter struct {
+	eventWriter
+	source  string
+	subject string
+}
+
+func (cw cloudEventWriter) write(id uint64, eventType string, data any) error {
+	if id == 0 {
+		return cw.eventWriter.write(id, eventType, data)
+	}
+	return cw.eventWriter.write(id, eventType, cloudEventEnvelope{
+		SpecVersion:     "1.0",
+		ID:              strconv.FormatUint(id, 10),
+		Source:          cw.source,
+		Type:            eventType,
+		Subject:         cw.subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	})
+}
+
+// streamFormats picks the format a stream's events are written in
+type streamFormats struct {
+	source string
+	// cloudEvents is whether streams that don't ask get CloudEvents
+	cloudEvents bool
+}
+
+func newStreamFormats(cfg config) streamFormats {
+	return streamFormats{source: cfg.CloudEventsSource, cloudEvents: cfg.StreamFormat == "cloudevents"}
+}
+
+// cloudEventsFor reports whether a stream asking for format gets CloudEvents
+func (sf streamFormats) cloudEventsFor(format string) (bool, error) {
+	switch format {
+	case "":
+		return sf.cloudEvents, nil
+	case "sse":
+		return false, nil
+	case "cloudevents":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown format %q", format)
+}
@@ -0,0 +1,926 @@
+package main
+
+import (
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// config holds the tunable settings of the server, read from the environment
+// (and SSE_CONFIG_FILE and the command line) at startup and on a reload
+type config struct {
+	// SessionBuffer is the default number of events queued per session before publishes start dropping
+	SessionBuffer int
+	// MaxSessionBuffer caps the buffer a client may request with /sse?buffer=
+	MaxSessionBuffer int
+	// BackpressurePolicy applies when a session's buffer is full, unless a publish overrides it
+	BackpressurePolicy backpressurePolicy
+	// BlockTimeout bounds how long a block-with-timeout publish waits for buffer space
+	BlockTimeout time.Duration
+	// KeepAliveInterval is how often a quiet SSE stream gets a comment, so
+	// proxies keep it open and a client that left is noticed (0 disables)
+	KeepAliveInterval time.Duration
+	// WriteTimeout bounds each write to a stream's connection, and how long
+	// the kernel keeps a connection whose writes go unacknowledged (0
+	// disables both)
+	WriteTimeout time.Duration
+	// SlowConsumerMaxDrops evicts a session dropping more events than this within SlowConsumerWindow (0 disables)
+	SlowConsumerMaxDrops int
+	SlowConsumerWindow   time.Duration
+	// DropLogInterval is how often the events dropped for a user are logged,
+	// after the first is logged at once (0 logs every drop)
+	DropLogInterval time.Duration
+	// SlowConsumerMaxWriteLatency evicts a session whose average write time exceeds it (0 disables)
+	SlowConsumerMaxWriteLatency time.Duration
+	// MaxSessionsPerUser and MaxConnectionsPerIP cap the open sessions of one
+	// user and one client address (0 means unlimited); ConnectionLimitPolicy
+	// says whether a connection over a cap is refused or replaces the oldest
+	MaxSessionsPerUser    int
+	MaxConnectionsPerIP   int
+	ConnectionLimitPolicy limitPolicy
+	// SessionMetadataQuery and SessionMetadataHeaders are the comma-separated
+	// query parameters and headers a client may describe its session with
+	SessionMetadataQuery   string
+	SessionMetadataHeaders string
+	// SessionLabelsQuery and SessionLabelsClaims are the comma-separated
+	// query parameters and token claims sessions are labelled with
+	SessionLabelsQuery  string
+	SessionLabelsClaims string
+	// DeliveryTrackingLimit is how many recent events keep per-session delivery state (0 disables)
+	DeliveryTrackingLimit int
+	// RedeliveryLimit caps unacknowledged at-least-once events retained per user (0 disables)
+	RedeliveryLimit int
+	// DeadLetterLimit is how many undeliverable events /dead-letters keeps in memory (0 disables)
+	DeadLetterLimit int
+	// DeadLetterFile, when set, receives every dead letter as a line of JSON
+	DeadLetterFile string
+	// DeadLetterURL, when set, receives every dead letter as a JSON POST
+	DeadLetterURL string
+	// AuditLimit is how many publish and admin operations /audit keeps in
+	// memory (0 disables); AuditFile ("-" for stdout) and AuditURL receive
+	// every one
+	AuditLimit int
+	AuditFile  string
+	AuditURL   string
+	// OfflineQueueLimit caps events queued per user while they have no session (0 disables)
+	OfflineQueueLimit int
+	// OfflineQueueTTL is how long queued events wait for the user to connect
+	OfflineQueueTTL time.Duration
+	// PauseBufferLimit caps the events held for a user whose delivery is paused
+	PauseBufferLimit int
+	// BanDuration is how long a ban lasts when POST /admin/bans gives no
+	// duration; BanPersist keeps bans in the Store as well as in memory
+	BanDuration time.Duration
+	BanPersist  bool
+	// IdempotencyWindow is how long a publish idempotency key suppresses duplicates (0 disables)
+	IdempotencyWindow time.Duration
+	// SchedulerTick is the resolution of delayed publishes
+	SchedulerTick time.Duration
+	// MaxScheduled caps pending delayed publishes (0 means unlimited)
+	MaxScheduled int
+	// UserMaxRate limits events per second per user, coalescing the excess (0 disables)
+	UserMaxRate float64
+	// UserBurst is how many events a user may receive at once before UserMaxRate applies
+	UserBurst int
+	// PublishRate limits publishes per second from one caller, and
+	// PublishUserRate those to one user, refusing the excess (0 disables)
+	PublishRate      float64
+	PublishBurst     int
+	PublishUserRate  float64
+	PublishUserBurst int
+	// MaxPayloadBytes caps the encoded value of a publish, MaxPayloadDepth how
+	// deeply it nests and MaxPayloadFields its object and array members in
+	// total (0 means unlimited)
+	MaxPayloadBytes  int
+	MaxPayloadDepth  int
+	MaxPayloadFields int
+	// MetricsUserBuckets is how many buckets /metrics hashes users into for
+	// the per-bucket session counts
+	MetricsUserBuckets int
+	// MetricsLatencySamples is how many of the latest deliveries the latency
+	// quantiles on /metrics are computed over
+	MetricsLatencySamples int
+	// SystemMetricsInterval is how often the host's and the process's
+	// resources are sampled, and what CPU usage is averaged over
+	SystemMetricsInterval time.Duration
+	// SystemDiskPath is a path on the filesystem whose usage is reported
+	SystemDiskPath string
+	// AccessLog logs every request other than streams once handled, and
+	// AccessLogHeartbeat how often open streams are logged (0 disables)
+	AccessLog          bool
+	AccessLogHeartbeat time.Duration
+	// LogFormat is json, text or a handler added to logHandlers, and
+	// LogLevel the least severe level logged (debug, info, warn or error)
+	LogFormat string
+	LogLevel  string
+	// OTLPEndpoint is where spans are exported over OTLP/HTTP, such as
+	// http://collector:4318/v1/traces (empty disables tracing)
+	OTLPEndpoint string
+	// TraceSampleRatio is the share of publishes traced when the publisher
+	// sent no sampling decision of its own
+	TraceSampleRatio float64
+	// ErrorReporter is sentry or a reporter added to errorReporterFactories
+	// (empty reports nothing). SentryDSN is the project reports go to.
+	ErrorReporter     string
+	SentryDSN         string
+	SentryEnvironment string
+	// HistorySize is how many recent events are kept per user for replay and /history (0 disables)
+	HistorySize int
+	// HistoryMaxAge drops retained events older than this (0 keeps them until pushed out)
+	HistoryMaxAge time.Duration
+	// HistoryMaxBytes caps the encoded size of each user's history (0 means unlimited)
+	HistoryMaxBytes int
+	// HistoryRetention overrides the history limits for particular users and
+	// topics, e.g. "user:vip maxEvents=500; topic:prices maxEvents=10 maxAge=1m"
+	HistoryRetention string
+	// HistoryTrimInterval is how often byte, age and topic limits are enforced
+	HistoryTrimInterval time.Duration
+	// LatestValue remembers each user's latest value per topic, sends it to new
+	// sessions and serves it from /state/:userID
+	LatestValue bool
+	// SnapshotEvery sends a full state snapshot after this many deltas (0 only on the first publish)
+	SnapshotEvery int
+	// WALFile, when set, logs accepted publishes until they are delivered and
+	// publishes the undelivered ones again on the next start
+	WALFile string
+	// WALFsync syncs the log to disk after every record, surviving OS crashes too
+	WALFsync bool
+	// WALReplayDelay gives clients time to reconnect before the log is replayed
+	WALReplayDelay time.Duration
+	// ExportDir is where POST /admin/export writes files
+	ExportDir string
+	// ExportS3* configure the S3-compatible bucket exports can be uploaded to
+	ExportS3Endpoint  string
+	ExportS3Bucket    string
+	ExportS3Prefix    string
+	ExportS3Region    string
+	ExportS3AccessKey string
+	ExportS3SecretKey string
+	ExportS3Secure    bool
+	// NodeID identifies this instance to the others
+	NodeID string
+	// PayloadEncryption is off, optional or required: whether stream payloads
+	// are encrypted with a per-user key, from the client's X-SSE-Payload-Key
+	// header, derived from PayloadKeySecret, or fetched from PayloadKeyURL
+	PayloadEncryption encryptionMode
+	PayloadKeySecret  string
+	PayloadKeyURL     string
+	// Addr lists where the public HTTP API listens: TCP addresses, or unix:
+	// and the path of a socket
+	Addr string
+	// TLSCert and TLSKey are the files of the public listener's certificate.
+	// Alternatively, certificates for ACMEDomains are obtained from an ACME CA
+	// (Let's Encrypt unless ACMEDirectory is set) and kept in ACMECache;
+	// ACMEHTTPAddr answers HTTP-01 challenges (empty leaves only TLS-ALPN-01)
+	TLSCert       string
+	TLSKey        string
+	ACMEDomains   string
+	ACMEEmail     string
+	ACMECache     string
+	ACMEDirectory string
+	ACMEHTTPAddr  string
+	// AdminAddr lists the addresses of a second listener, TCP or unix:path,
+	// that takes the publish and admin routes off the public port (empty
+	// serves them there)
+	AdminAddr string
+	// SocketMode is the permissions of the unix sockets listened on
+	SocketMode fs.FileMode
+	// ReusePort lets another process listen on the same TCP addresses, so a
+	// new version can start before this one shuts down
+	ReusePort bool
+	// HTTP2 serves HTTP/2 to TLS clients that offer it; H2C serves it in
+	// clear text to clients, a proxy usually, that open the connection with it
+	HTTP2 bool
+	H2C   bool
+	// AdminTLSCert and AdminTLSKey make the admin listener serve HTTPS
+	AdminTLSCert string
+	AdminTLSKey  string
+	// PresenceWebhookURL is notified when a user's first session on this
+	// instance connects and its last one disconnects, with requests signed by
+	// PresenceWebhookSecret if set. Each event is tried up to
+	// PresenceWebhookAttempts times.
+	PresenceWebhookURL      string
+	PresenceWebhookSecret   string
+	PresenceWebhookAttempts int
+	PresenceWebhookTimeout  time.Duration
+	// Push* configure notifying the devices of users who have no session
+	// when an event is published to them, on the PushTopics if set: through
+	// FCM with a service account key file, through APNs with a signing key,
+	// and through a webhook
+	PushTopics          string
+	PushTitleField      string
+	PushBodyField       string
+	PushFCMCredentials  string
+	PushAPNsKeyFile     string
+	PushAPNsKeyID       string
+	PushAPNsTeamID      string
+	PushAPNsTopic       string
+	PushAPNsSandbox     bool
+	PushWebhookURL      string
+	PushWebhookSecret   string
+	PushWebhookAttempts int
+	PushWebhookTimeout  time.Duration
+	// AlertMaxSessions, AlertDropRate (events per second) and
+	// AlertMemoryPercent (of the host's memory used) raise an alert when
+	// exceeded, checked every AlertInterval (0 disables each). An alert
+	// resolves once its value is AlertHysteresis (a fraction) below the
+	// threshold. Alerts are logged, and posted to AlertWebhookURL if set.
+	AlertMaxSessions   int
+	AlertDropRate      float64
+	AlertMemoryPercent float64
+	AlertHysteresis    float64
+	AlertInterval      time.Duration
+	AlertWebhookURL    string
+	AlertWebhookSecret string
+	// DebugEndpoints serves pprof and expvar on the admin listener
+	DebugEndpoints bool
+	// ReadyMaxSessions is the number of open sessions at which /readyz
+	// reports the instance full (0 never does)
+	ReadyMaxSessions int
+	// DrainDelay is how long shutdown keeps serving after /readyz starts
+	// failing, for load balancers to notice before sessions are closed
+	DrainDelay time.Duration
+	// DrainSpread is how long POST /admin/drain takes to ask every session
+	// to reconnect, and DrainRetryAfter when streams refused meanwhile are
+	// told to retry
+	DrainSpread     time.Duration
+	DrainRetryAfter time.Duration
+	// MemoryLimit and GCPercent override GOMEMLIMIT and GOGC, and GCBallast
+	// is the size of a heap ballast; see parseMemorySettings
+	MemoryLimit string
+	GCPercent   string
+	GCBallast   string
+	// ShutdownSteps is the order graceful shutdown ends sessions in;
+	// ShutdownDrain is how long its drain asks sessions to reconnect over (0
+	// skips it), and ShutdownTimeout bounds what follows: open requests,
+	// gRPC streams, and flushing webhooks, pushes and traces
+	ShutdownSteps   []shutdownStep
+	ShutdownDrain   time.Duration
+	ShutdownTimeout time.Duration
+	// MTLSClientCA is a PEM bundle of the CAs signing publishers' client
+	// certificates, which the admin listener then requires; MTLSIdentity lists
+	// the certificate names a caller is known by and MTLSScopes limits what
+	// particular callers may publish
+	MTLSClientCA string
+	MTLSIdentity string
+	MTLSScopes   string
+	// GRPCAddr is where the gRPC API listens (empty disables it)
+	GRPCAddr string
+	// PublicURL is where clients reach this instance's API, for routing hints
+	PublicURL string
+	// Prefork runs a process per CPU; the processes are connected over the
+	// backplane, which defaults to cluster
+	Prefork bool
+	// Backplane selects how publishes reach sessions on other instances: none, redis, nats or cluster
+	Backplane string
+	// ClusterAddr is where the cluster backplane listens for other instances,
+	// ClusterAdvertise the address they reach it at and ClusterPeers the seed
+	// instances it joins through
+	ClusterAddr      string
+	ClusterAdvertise string
+	ClusterPeers     string
+	// ClusterSecret must be sent by every instance of the cluster
+	ClusterSecret    string
+	ClusterHeartbeat time.Duration
+	// JWTSecret, JWTPublicKey (a PEM file) and JWTJWKSURL verify the HS256 and
+	// RS256 tokens stream clients must present once any of them is set;
+	// JWTUserClaim names the claim holding the user ID
+	JWTSecret      string
+	JWTPublicKey   string
+	JWTJWKSURL     string
+	JWTJWKSRefresh time.Duration
+	JWTUserClaim   string
+	// JWTIssuer and JWTAudience, when set, must match the token's iss and aud
+	JWTIssuer   string
+	JWTAudience string
+	// StreamAuth and PublishAuth list the authenticators tried, in order, for
+	// streams and for the publish and admin endpoints
+	StreamAuth  string
+	PublishAuth string
+	// AuthCredentials lists where JWTs are looked for, in order: header,
+	// cookie and query
+	AuthCredentials string
+	// AuthCookie names the cookie holding a JWT
+	AuthCookie string
+	// StreamTokenSecret signs the one-time stream tokens, which expire after
+	// StreamTokenTTL; instances sharing it accept each other's tokens
+	StreamTokenSecret string
+	StreamTokenTTL    time.Duration
+	// ReauthWarning is how long before its credential expires a stream is
+	// sent a reauthenticate event
+	ReauthWarning time.Duration
+	// StreamIdleTimeout closes a stream that went this long without an event,
+	// and StreamMaxDuration asks one open this long to reconnect (0 disables
+	// either)
+	StreamIdleTimeout time.Duration
+	StreamMaxDuration time.Duration
+	// APIKeys are the name:key pairs that publish and admin requests must
+	// carry or be signed with; APISignatureMaxSkew bounds a signed request's age
+	APIKeys             string
+	APISignatureMaxSkew time.Duration
+	// APIKeyScopes limits what particular keys may publish
+	APIKeyScopes string
+	// CORSStream* is the CORS policy of the routes browsers call, /sse and
+	// its companions, and CORSAPI* that of the publish and admin routes.
+	// Origins, methods and headers are comma-separated; no origins means
+	// same-origin only.
+	CORSStreamOrigins     string
+	CORSStreamMethods     string
+	CORSStreamHeaders     string
+	CORSStreamCredentials bool
+	CORSAPIOrigins        string
+	CORSAPIMethods        string
+	CORSAPIHeaders        string
+	CORSAPICredentials    bool
+	// StreamAllowIPs, PublishAllowIPs and AdminAllowIPs limit which client
+	// addresses may call each group of routes, and the *DenyIPs refuse some;
+	// both are comma-separated CIDRs or addresses
+	StreamAllowIPs  string
+	StreamDenyIPs   string
+	PublishAllowIPs string
+	PublishDenyIPs  string
+	AdminAllowIPs   string
+	AdminDenyIPs    string
+	// TrustedProxies are the reverse proxies whose ProxyHeader names the
+	// client they forward for; ProxyHeader lists the headers tried, in order
+	TrustedProxies string
+	ProxyHeader    string
+	// StreamOrigins are the origins whose pages may open streams, checked
+	// against the Origin header as CORS doesn't stop EventSource; it
+	// defaults to CORSStreamOrigins
+	StreamOrigins string
+	// StreamFormat is the format of streams that don't ask for one, sse or
+	// cloudevents; CloudEventsSource is the source of the CloudEvents written
+	StreamFormat      string
+	CloudEventsSource string
+	// PollTimeout is the longest a GET /poll waits for an event
+	PollTimeout time.Duration
+	// Region names this deployment; ReplicationPeers lists the other regions'
+	// deployments as region=url pairs that every publish is mirrored to
+	Region           string
+	ReplicationPeers string
+	// ReplicationSecret is sent to the peers and, when set, lets peers mirror
+	// their publishes here
+	ReplicationSecret string
+	// ReplicationQueue caps the publishes waiting for each peer region
+	ReplicationQueue int
+	// NATSURL and NATSSubjectPrefix configure the nats backplane
+	NATSURL           string
+	NATSSubjectPrefix string
+	// KafkaBrokers, when set, consumes KafkaTopic and publishes each message
+	// to the user named by KafkaUserField
+	KafkaBrokers    string
+	KafkaTopic      string
+	KafkaGroup      string
+	KafkaUserField  string
+	KafkaTopicField string
+	KafkaValueField string
+	// RedisSourceChannels, when set, are the Redis channels whose messages
+	// are published to the user named by RedisSourceUserField; RedisSourceURL
+	// defaults to RedisURL
+	RedisSourceChannels   string
+	RedisSourceURL        string
+	RedisSourceUserField  string
+	RedisSourceTopicField string
+	RedisSourceValueField string
+	// PGSourceChannels, when set, are the Postgres channels whose
+	// notifications are published to the user named by PGSourceUserField;
+	// PGSourceDSN defaults to SQLDSN with the postgres store
+	PGSourceChannels   string
+	PGSourceDSN        string
+	PGSourceUserField  string
+	PGSourceTopicField string
+	PGSourceValueField string
+	// MQTTBroker, when set, bridges to an MQTT broker: messages on the
+	// MQTTSubscribe filters are published to the user named by MQTTUserField,
+	// and API publishes are sent to MQTTMirrorTopic when it is set
+	MQTTBroker      string
+	MQTTClientID    string
+	MQTTUsername    string
+	MQTTPassword    string
+	MQTTSubscribe   string
+	MQTTShareGroup  string
+	MQTTQoS         int
+	MQTTUserField   string
+	MQTTTopicField  string
+	MQTTValueField  string
+	MQTTMirrorTopic string
+	// AMQPURL, when set, consumes AMQPQueue, bound to the exchanges in
+	// AMQPBindings, and publishes each message to the user named by
+	// AMQPUserField
+	AMQPURL        string
+	AMQPQueue      string
+	AMQPBindings   string
+	AMQPPrefetch   int
+	AMQPUserField  string
+	AMQPTopicField string
+	AMQPValueField string
+	// SQSQueueURL, when set, polls that SQS queue and publishes each
+	// message, or the message SNS wrapped, to the user named by SQSUserField
+	SQSQueueURL          string
+	SQSRegion            string
+	SQSEndpoint          string
+	SQSVisibilityTimeout time.Duration
+	SQSWaitTime          time.Duration
+	SQSMaxMessages       int
+	// SQSDLQURL, when set, is where messages that can't be mapped are moved
+	SQSDLQURL     string
+	SQSUserField  string
+	SQSTopicField string
+	SQSValueField string
+	// PubSubSubscription, when set, pulls that subscription of PubSubProject
+	// and publishes each message to the user named by PubSubUserField
+	PubSubProject        string
+	PubSubSubscription   string
+	PubSubMaxOutstanding int
+	PubSubUserField      string
+	PubSubTopicField     string
+	PubSubValueField     string
+	// WebhookSources are the third-party services that may push events to
+	// /ingest/webhook/:source, with how each is verified and mapped
+	WebhookSources string
+	// Store selects where history and offline queues live: memory, redis, postgres or sqlite3
+	Store string
+	// RedisURL and RedisPrefix configure the redis store
+	RedisURL    string
+	RedisPrefix string
+	// SQLDSN is the data source of the postgres and sqlite3 stores
+	SQLDSN string
+	// SQLBatchSize caps how many appends are inserted in one transaction
+	SQLBatchSize int
+	// SQLRetention deletes history and offline events older than this across all users (0 disables)
+	SQLRetention time.Duration
+}
+
+func loadConfig() config {
+	cfg := config{
+		SessionBuffer:    envInt("SSE_SESSION_BUFFER", 16),
+		MaxSessionBuffer: envInt("SSE_MAX_SESSION_BUFFER", 1024),
+		BlockTimeout:     envDuration("SSE_BLOCK_TIMEOUT", 100*time.Millisecond),
+
+		KeepAliveInterval: envDuration("SSE_KEEPALIVE_INTERVAL", 15*time.Second),
+		WriteTimeout:      envDuration("SSE_WRITE_TIMEOUT", 10*time.Second),
+
+		SlowConsumerMaxDrops:        envInt("SSE_SLOW_CONSUMER_MAX_DROPS", 50),
+		SlowConsumerWindow:          envDuration("SSE_SLOW_CONSUMER_WINDOW", 10*time.Second),
+		DropLogInterval:             envDuration("SSE_DROP_LOG_INTERVAL", 10*time.Second),
+		SlowConsumerMaxWriteLatency: envDuration("SSE_SLOW_CONSUMER_MAX_WRITE_LATENCY", 0),
+
+		MaxSessionsPerUser:  envInt("SSE_MAX_SESSIONS_PER_USER", 0),
+		MaxConnectionsPerIP: envInt("SSE_MAX_CONNECTIONS_PER_IP", 0),
+
+		SessionMetadataQuery:   getenv("SSE_SESSION_METADATA_QUERY"),
+		SessionMetadataHeaders: getenv("SSE_SESSION_METADATA_HEADERS"),
+		SessionLabelsQuery:     getenv("SSE_SESSION_LABELS_QUERY"),
+		SessionLabelsClaims:    getenv("SSE_SESSION_LABELS_CLAIMS"),
+
+		DeliveryTrackingLimit: envInt("SSE_DELIVERY_TRACKING_LIMIT", 10000),
+		RedeliveryLimit:       envInt("SSE_REDELIVERY_LIMIT", 100),
+
+		DeadLetterLimit: envInt("SSE_DEAD_LETTER_LIMIT", 1000),
+		DeadLetterFile:  getenv("SSE_DEAD_LETTER_FILE"),
+		DeadLetterURL:   getenv("SSE_DEAD_LETTER_URL"),
+
+		AuditLimit: envInt("SSE_AUDIT_LIMIT", 1000),
+		AuditFile:  getenv("SSE_AUDIT_FILE"),
+		AuditURL:   getenv("SSE_AUDIT_URL"),
+
+		OfflineQueueLimit: envInt("SSE_OFFLINE_QUEUE_LIMIT", 0),
+		OfflineQueueTTL:   envDuration("SSE_OFFLINE_QUEUE_TTL", time.Hour),
+		PauseBufferLimit:  envInt("SSE_PAUSE_BUFFER_LIMIT", 1000),
+		BanDuration:       envDuration("SSE_BAN_DURATION", time.Hour),
+		BanPersist:        envBool("SSE_BAN_PERSIST", false),
+
+		IdempotencyWindow: envDuration("SSE_IDEMPOTENCY_WINDOW", 5*time.Minute),
+
+		SchedulerTick: envDuration("SSE_SCHEDULER_TICK", 100*time.Millisecond),
+		MaxScheduled:  envInt("SSE_MAX_SCHEDULED", 100000),
+
+		UserMaxRate: envFloat("SSE_USER_MAX_RATE", 0),
+		UserBurst:   envInt("SSE_USER_BURST", 10),
+
+		PublishRate:      envFloat("SSE_PUBLISH_RATE", 0),
+		PublishBurst:     envInt("SSE_PUBLISH_BURST", 100),
+		PublishUserRate:  envFloat("SSE_PUBLISH_USER_RATE", 0),
+		PublishUserBurst: envInt("SSE_PUBLISH_USER_BURST", 20),
+
+		MaxPayloadBytes:  envInt("SSE_MAX_PAYLOAD_BYTES", 64<<10),
+		MaxPayloadDepth:  envInt("SSE_MAX_PAYLOAD_DEPTH", 0),
+		MaxPayloadFields: envInt("SSE_MAX_PAYLOAD_FIELDS", 0),
+
+		MetricsUserBuckets:    envInt("SSE_METRICS_USER_BUCKETS", 16),
+		MetricsLatencySamples: envInt("SSE_METRICS_LATENCY_SAMPLES", 1024),
+		SystemMetricsInterval: envDuration("SSE_SYSTEM_METRICS_INTERVAL", 5*time.Second),
+		SystemDiskPath:        envString("SSE_SYSTEM_DISK_PATH", "/"),
+
+		LogFormat: envString("SSE_LOG_FORMAT", "json"),
+		LogLevel:  envString("SSE_LOG_LEVEL", "info"),
+
+		AccessLog:          envBool("SSE_ACCESS_LOG", true),
+		AccessLogHeartbeat: envDuration("SSE_ACCESS_LOG_HEARTBEAT", 5*time.Minute),
+
+		OTLPEndpoint:     getenv("SSE_OTLP_ENDPOINT"),
+		TraceSampleRatio: envFloat("SSE_TRACE_SAMPLE_RATIO", 1),
+
+		ErrorReporter:     getenv("SSE_ERROR_REPORTER"),
+		SentryDSN:         getenv("SSE_SENTRY_DSN"),
+		SentryEnvironment: getenv("SSE_SENTRY_ENVIRONMENT"),
+
+		HistorySize:   envInt("SSE_HISTORY_SIZE", 50),
+		HistoryMaxAge: envDuration("SSE_HISTORY_MAX_AGE", 10*time.Minute),
+
+		HistoryMaxBytes:     envInt("SSE_HISTORY_MAX_BYTES", 0),
+		HistoryRetention:    getenv("SSE_HISTORY_RETENTION"),
+		HistoryTrimInterval: envDuration("SSE_HISTORY_TRIM_INTERVAL", time.Minute),
+
+		LatestValue:   envBool("SSE_LATEST_VALUE", false),
+		SnapshotEvery: envInt("SSE_SNAPSHOT_EVERY", 20),
+
+		WALFile:        getenv("SSE_WAL_FILE"),
+		WALFsync:       envBool("SSE_WAL_FSYNC", false),
+		WALReplayDelay: envDuration("SSE_WAL_REPLAY_DELAY", 5*time.Second),
+
+		ExportDir:         envString("SSE_EXPORT_DIR", "exports"),
+		ExportS3Endpoint:  getenv("SSE_EXPORT_S3_ENDPOINT"),
+		ExportS3Bucket:    getenv("SSE_EXPORT_S3_BUCKET"),
+		ExportS3Prefix:    getenv("SSE_EXPORT_S3_PREFIX"),
+		ExportS3Region:    getenv("SSE_EXPORT_S3_REGION"),
+		ExportS3AccessKey: getenv("SSE_EXPORT_S3_ACCESS_KEY"),
+		ExportS3SecretKey: getenv("SSE_EXPORT_S3_SECRET_KEY"),
+		ExportS3Secure:    envBool("SSE_EXPORT_S3_SECURE", true),
+
+		NodeID:     envString("SSE_NODE_ID", defaultNodeID()),
+		PublicURL:  getenv("SSE_PUBLIC_URL"),
+		Addr:       envString("SSE_ADDR", ":8080"),
+		AdminAddr:  getenv("SSE_ADMIN_ADDR"),
+		SocketMode: envFileMode("SSE_SOCKET_MODE", 0o600),
+		ReusePort:  envBool("SSE_REUSEPORT", false),
+		HTTP2:      envBool("SSE_HTTP2", false),
+		H2C:        envBool("SSE_H2C", false),
+		GRPCAddr:   getenv("SSE_GRPC_ADDR"),
+		Backplane:  envString("SSE_BACKPLANE", "none"),
+		Prefork:    envBool("SSE_PREFORK", false),
+
+		DebugEndpoints: envBool("SSE_DEBUG_ENDPOINTS", false),
+
+		ReadyMaxSessions: envInt("SSE_READY_MAX_SESSIONS", 0),
+		DrainDelay:       envDuration("SSE_DRAIN_DELAY", 0),
+		DrainSpread:      envDuration("SSE_DRAIN_SPREAD", 30*time.Second),
+		DrainRetryAfter:  envDuration("SSE_DRAIN_RETRY_AFTER", 5*time.Second),
+		MemoryLimit:      getenv("SSE_MEMORY_LIMIT"),
+		GCPercent:        getenv("SSE_GC_PERCENT"),
+		GCBallast:        getenv("SSE_GC_BALLAST"),
+		ShutdownDrain:    envDuration("SSE_SHUTDOWN_DRAIN", 0),
+		ShutdownTimeout:  envDuration("SSE_SHUTDOWN_TIMEOUT", 5*time.Second),
+
+		PresenceWebhookURL:      getenv("SSE_PRESENCE_WEBHOOK_URL"),
+		PresenceWebhookSecret:   getenv("SSE_PRESENCE_WEBHOOK_SECRET"),
+		PresenceWebhookAttempts: envInt("SSE_PRESENCE_WEBHOOK_ATTEMPTS", 5),
+		PresenceWebhookTimeout:  envDuration("SSE_PRESENCE_WEBHOOK_TIMEOUT", 5*time.Second),
+
+		PushTopics:          getenv("SSE_PUSH_TOPICS"),
+		PushTitleField:      envString("SSE_PUSH_TITLE_FIELD", "json:title"),
+		PushBodyField:       envString("SSE_PUSH_BODY_FIELD", "json:body"),
+		PushFCMCredentials:  getenv("SSE_PUSH_FCM_CREDENTIALS"),
+		PushAPNsKeyFile:     getenv("SSE_PUSH_APNS_KEY_FILE"),
+		PushAPNsKeyID:       getenv("SSE_PUSH_APNS_KEY_ID"),
+		PushAPNsTeamID:      getenv("SSE_PUSH_APNS_TEAM_ID"),
+		PushAPNsTopic:       getenv("SSE_PUSH_APNS_TOPIC"),
+		PushAPNsSandbox:     envBool("SSE_PUSH_APNS_SANDBOX", false),
+		PushWebhookURL:      getenv("SSE_PUSH_WEBHOOK_URL"),
+		PushWebhookSecret:   getenv("SSE_PUSH_WEBHOOK_SECRET"),
+		PushWebhookAttempts: envInt("SSE_PUSH_WEBHOOK_ATTEMPTS", 5),
+		PushWebhookTimeout:  envDuration("SSE_PUSH_WEBHOOK_TIMEOUT", 5*time.Second),
+
+		AlertMaxSessions:   envInt("SSE_ALERT_MAX_SESSIONS", 0),
+		AlertDropRate:      envFloat("SSE_ALERT_DROP_RATE", 0),
+		AlertMemoryPercent: envFloat("SSE_ALERT_MEMORY_PERCENT", 0),
+		AlertHysteresis:    envFloat("SSE_ALERT_HYSTERESIS", 0.1),
+		AlertInterval:      envDuration("SSE_ALERT_INTERVAL", 15*time.Second),
+		AlertWebhookURL:    getenv("SSE_ALERT_WEBHOOK_URL"),
+		AlertWebhookSecret: getenv("SSE_ALERT_WEBHOOK_SECRET"),
+
+		AdminTLSCert: getenv("SSE_ADMIN_TLS_CERT"),
+		AdminTLSKey:  getenv("SSE_ADMIN_TLS_KEY"),
+		MTLSClientCA: getenv("SSE_MTLS_CLIENT_CA"),
+		MTLSIdentity: envString("SSE_MTLS_IDENTITY", "cn"),
+		MTLSScopes:   getenv("SSE_MTLS_SCOPES"),
+
+		TLSCert:       getenv("SSE_TLS_CERT"),
+		TLSKey:        getenv("SSE_TLS_KEY"),
+		ACMEDomains:   getenv("SSE_ACME_DOMAINS"),
+		ACMEEmail:     getenv("SSE_ACME_EMAIL"),
+		ACMECache:     envString("SSE_ACME_CACHE", "acme-cache"),
+		ACMEDirectory: getenv("SSE_ACME_DIRECTORY"),
+		ACMEHTTPAddr:  envString("SSE_ACME_HTTP_ADDR", ":80"),
+
+		ClusterAddr:      envString("SSE_CLUSTER_ADDR", ":7946"),
+		ClusterAdvertise: getenv("SSE_CLUSTER_ADVERTISE"),
+		ClusterPeers:     getenv("SSE_CLUSTER_PEERS"),
+		ClusterSecret:    getenv("SSE_CLUSTER_SECRET"),
+		ClusterHeartbeat: envDuration("SSE_CLUSTER_HEARTBEAT", time.Second),
+
+		JWTSecret:      getenv("SSE_JWT_SECRET"),
+		JWTPublicKey:   getenv("SSE_JWT_PUBLIC_KEY"),
+		JWTJWKSURL:     getenv("SSE_JWT_JWKS_URL"),
+		JWTJWKSRefresh: envDuration("SSE_JWT_JWKS_REFRESH", time.Hour),
+		JWTUserClaim:   envString("SSE_JWT_USER_CLAIM", "sub"),
+		JWTIssuer:      getenv("SSE_JWT_ISSUER"),
+		JWTAudience:    getenv("SSE_JWT_AUDIENCE"),
+
+		StreamAuth:        envString("SSE_STREAM_AUTH", "jwt,stream-token"),
+		PublishAuth:       envString("SSE_PUBLISH_AUTH", "mtls,api-key"),
+		AuthCredentials:   envString("SSE_AUTH_CREDENTIALS", "header,cookie,query"),
+		AuthCookie:        envString("SSE_AUTH_COOKIE", "sse_token"),
+		StreamTokenSecret: getenv("SSE_STREAM_TOKEN_SECRET"),
+		StreamTokenTTL:    envDuration("SSE_STREAM_TOKEN_TTL", 30*time.Second),
+		ReauthWarning:     envDuration("SSE_REAUTH_WARNING", time.Minute),
+		StreamIdleTimeout: envDuration("SSE_STREAM_IDLE_TIMEOUT", 0),
+		StreamMaxDuration: envDuration("SSE_STREAM_MAX_DURATION", 0),
+
+		APIKeys:             getenv("SSE_API_KEYS"),
+		APISignatureMaxSkew: envDuration("SSE_API_SIGNATURE_MAX_SKEW", 5*time.Minute),
+		APIKeyScopes:        getenv("SSE_API_KEY_SCOPES"),
+
+		CORSStreamOrigins:     envString("SSE_CORS_STREAM_ORIGINS", "*"),
+		CORSStreamMethods:     envString("SSE_CORS_STREAM_METHODS", "GET,POST"),
+		CORSStreamHeaders:     envString("SSE_CORS_STREAM_HEADERS", "Authorization,Content-Type,Last-Event-ID"),
+		CORSStreamCredentials: envBool("SSE_CORS_STREAM_CREDENTIALS", false),
+		CORSAPIOrigins:        getenv("SSE_CORS_API_ORIGINS"),
+		CORSAPIMethods:        envString("SSE_CORS_API_METHODS", "GET,POST"),
+		CORSAPIHeaders:        envString("SSE_CORS_API_HEADERS", "Authorization,Content-Type,Idempotency-Key,X-API-Key,X-API-Key-ID,X-Timestamp,X-Signature"),
+		CORSAPICredentials:    envBool("SSE_CORS_API_CREDENTIALS", false),
+		StreamOrigins:         getenv("SSE_STREAM_ORIGINS"),
+		StreamFormat:          envString("SSE_STREAM_FORMAT", "sse"),
+		CloudEventsSource:     envString("SSE_CLOUDEVENTS_SOURCE", "/sse"),
+		PollTimeout:           envDuration("SSE_POLL_TIMEOUT", 30*time.Second),
+
+		StreamAllowIPs:  getenv("SSE_STREAM_ALLOW_IPS"),
+		StreamDenyIPs:   getenv("SSE_STREAM_DENY_IPS"),
+		PublishAllowIPs: getenv("SSE_PUBLISH_ALLOW_IPS"),
+		PublishDenyIPs:  getenv("SSE_PUBLISH_DENY_IPS"),
+		AdminAllowIPs:   getenv("SSE_ADMIN_ALLOW_IPS"),
+		AdminDenyIPs:    getenv("SSE_ADMIN_DENY_IPS"),
+		TrustedProxies:  getenv("SSE_TRUSTED_PROXIES"),
+		ProxyHeader:     envString("SSE_PROXY_HEADER", "X-Forwarded-For"),
+
+		PayloadKeySecret: getenv("SSE_PAYLOAD_KEY_SECRET"),
+		PayloadKeyURL:    getenv("SSE_PAYLOAD_KEY_URL"),
+
+		Region:            envString("SSE_REGION", "default"),
+		ReplicationPeers:  getenv("SSE_REPLICATION_PEERS"),
+		ReplicationSecret: getenv("SSE_REPLICATION_SECRET"),
+		ReplicationQueue:  envInt("SSE_REPLICATION_QUEUE", 10000),
+
+		NATSURL:           envString("SSE_NATS_URL", "nats://127.0.0.1:4222"),
+		NATSSubjectPrefix: envString("SSE_NATS_SUBJECT_PREFIX", "sse"),
+
+		KafkaBrokers:    getenv("SSE_KAFKA_BROKERS"),
+		KafkaTopic:      envString("SSE_KAFKA_TOPIC", "sse-events"),
+		KafkaGroup:      envString("SSE_KAFKA_GROUP", "sse"),
+		KafkaUserField:  envString("SSE_KAFKA_USER_FIELD", "json:userID"),
+		KafkaTopicField: envString("SSE_KAFKA_TOPIC_FIELD", "json:topic"),
+		KafkaValueField: envString("SSE_KAFKA_VALUE_FIELD", "json:value"),
+
+		RedisSourceChannels:   getenv("SSE_REDIS_SOURCE_CHANNELS"),
+		RedisSourceURL:        getenv("SSE_REDIS_SOURCE_URL"),
+		RedisSourceUserField:  envString("SSE_REDIS_SOURCE_USER_FIELD", "json:userID"),
+		RedisSourceTopicField: envString("SSE_REDIS_SOURCE_TOPIC_FIELD", "json:topic"),
+		RedisSourceValueField: envString("SSE_REDIS_SOURCE_VALUE_FIELD", "json:value"),
+
+		PGSourceChannels:   getenv("SSE_PG_SOURCE_CHANNELS"),
+		PGSourceDSN:        getenv("SSE_PG_SOURCE_DSN"),
+		PGSourceUserField:  envString("SSE_PG_SOURCE_USER_FIELD", "json:userID"),
+		PGSourceTopicField: envString("SSE_PG_SOURCE_TOPIC_FIELD", "json:topic"),
+		PGSourceValueField: envString("SSE_PG_SOURCE_VALUE_FIELD", "json:value"),
+
+		MQTTBroker:      getenv("SSE_MQTT_BROKER"),
+		MQTTClientID:    getenv("SSE_MQTT_CLIENT_ID"),
+		MQTTUsername:    getenv("SSE_MQTT_USERNAME"),
+		MQTTPassword:    getenv("SSE_MQTT_PASSWORD"),
+		MQTTSubscribe:   getenv("SSE_MQTT_SUBSCRIBE"),
+		MQTTShareGroup:  envString("SSE_MQTT_SHARE_GROUP", "sse"),
+		MQTTQoS:         envInt("SSE_MQTT_QOS", 1),
+		MQTTUserField:   envString("SSE_MQTT_USER_FIELD", "json:userID"),
+		MQTTTopicField:  envString("SSE_MQTT_TOPIC_FIELD", "json:topic"),
+		MQTTValueField:  envString("SSE_MQTT_VALUE_FIELD", "json:value"),
+		MQTTMirrorTopic: getenv("SSE_MQTT_MIRROR_TOPIC"),
+
+		AMQPURL:        getenv("SSE_AMQP_URL"),
+		AMQPQueue:      envString("SSE_AMQP_QUEUE", "sse-events"),
+		AMQPBindings:   getenv("SSE_AMQP_BINDINGS"),
+		AMQPPrefetch:   envInt("SSE_AMQP_PREFETCH", 100),
+		AMQPUserField:  envString("SSE_AMQP_USER_FIELD", "json:userID"),
+		AMQPTopicField: envString("SSE_AMQP_TOPIC_FIELD", "json:topic"),
+		AMQPValueField: envString("SSE_AMQP_VALUE_FIELD", "json:value"),
+
+		SQSQueueURL:          getenv("SSE_SQS_QUEUE_URL"),
+		SQSRegion:            getenv("SSE_SQS_REGION"),
+		SQSEndpoint:          getenv("SSE_SQS_ENDPOINT"),
+		SQSVisibilityTimeout: envDuration("SSE_SQS_VISIBILITY_TIMEOUT", 30*time.Second),
+		SQSWaitTime:          envDuration("SSE_SQS_WAIT_TIME", 20*time.Second),
+		SQSMaxMessages:       envInt("SSE_SQS_MAX_MESSAGES", 10),
+		SQSDLQURL:            getenv("SSE_SQS_DLQ_URL"),
+		SQSUserField:         envString("SSE_SQS_USER_FIELD", "json:userID"),
+		SQSTopicField:        envString("SSE_SQS_TOPIC_FIELD", "json:topic"),
+		SQSValueField:        envString("SSE_SQS_VALUE_FIELD", "json:value"),
+
+		PubSubProject:        getenv("SSE_PUBSUB_PROJECT"),
+		PubSubSubscription:   getenv("SSE_PUBSUB_SUBSCRIPTION"),
+		PubSubMaxOutstanding: envInt("SSE_PUBSUB_MAX_OUTSTANDING", 1000),
+		PubSubUserField:      envString("SSE_PUBSUB_USER_FIELD", "json:userID"),
+		PubSubTopicField:     envString("SSE_PUBSUB_TOPIC_FIELD", "json:topic"),
+		PubSubValueField:     envString("SSE_PUBSUB_VALUE_FIELD", "json:value"),
+
+		WebhookSources: getenv("SSE_WEBHOOK_SOURCES"),
+
+		Store:       envString("SSE_STORE", "memory"),
+		RedisURL:    envString("SSE_REDIS_URL", "redis://localhost:6379/0"),
+		RedisPrefix: envString("SSE_REDIS_PREFIX", "sse:"),
+
+		SQLDSN:       envString("SSE_SQL_DSN", "file:sse.db?_journal_mode=WAL"),
+		SQLBatchSize: envInt("SSE_SQL_BATCH_SIZE", 100),
+		SQLRetention: envDuration("SSE_SQL_RETENTION", 24*time.Hour),
+	}
+
+	policy := envString("SSE_BACKPRESSURE_POLICY", string(dropNewest))
+	if p, ok := parseBackpressurePolicy(policy); ok {
+		cfg.BackpressurePolicy = p
+	} else {
+		logger.Warn("Invalid setting, using default", "name", "SSE_BACKPRESSURE_POLICY", "value", policy, "default", dropNewest)
+		cfg.BackpressurePolicy = dropNewest
+	}
+	limitPolicy := envString("SSE_CONNECTION_LIMIT_POLICY", string(rejectNew))
+	if p, ok := parseLimitPolicy(limitPolicy); ok {
+		cfg.ConnectionLimitPolicy = p
+	} else {
+		logger.Warn("Invalid setting, using default", "name", "SSE_CONNECTION_LIMIT_POLICY", "value", limitPolicy, "default", rejectNew)
+		cfg.ConnectionLimitPolicy = rejectNew
+	}
+	encryption := envString("SSE_PAYLOAD_ENCRYPTION", string(encryptionOff))
+	if m, ok := parseEncryptionMode(encryption); ok {
+		cfg.PayloadEncryption = m
+	} else {
+		logger.Warn("Invalid setting, using default", "name", "SSE_PAYLOAD_ENCRYPTION", "value", encryption, "default", encryptionOff)
+		cfg.PayloadEncryption = encryptionOff
+	}
+	steps := envString("SSE_SHUTDOWN_STEPS", "readiness,drain,close")
+	if s, ok := parseShutdownSteps(steps); ok {
+		cfg.ShutdownSteps = s
+	} else {
+		logger.Warn("Invalid setting, using default", "name", "SSE_SHUTDOWN_STEPS", "value", steps, "default", "readiness,drain,close")
+		cfg.ShutdownSteps = defaultShutdownSteps
+	}
+	if cfg.PublicURL == "" {
+		cfg.PublicURL = defaultPublicURL(cfg)
+	}
+	if cfg.StreamOrigins == "" {
+		cfg.StreamOrigins = cfg.CORSStreamOrigins
+	}
+	if cfg.StreamFormat != "sse" && cfg.StreamFormat != "cloudevents" {
+		logger.Warn("Invalid setting, using default", "name", "SSE_STREAM_FORMAT", "value", cfg.StreamFormat, "default", "sse")
+		cfg.StreamFormat = "sse"
+	}
+	if cfg.MaxSessionBuffer < cfg.SessionBuffer {
+		cfg.MaxSessionBuffer = cfg.SessionBuffer
+	}
+	if cfg.SchedulerTick <= 0 {
+		cfg.SchedulerTick = 100 * time.Millisecond
+	}
+	return cfg
+}
+
+// historyRetention returns the history limits with the per-user and per-topic overrides applied
+func (cfg config) historyRetention() retentionRules {
+	return parseRetentionRules(cfg.HistoryRetention, retentionPolicy{
+		MaxEvents: cfg.HistorySize,
+		MaxBytes:  cfg.HistoryMaxBytes,
+		MaxAge:    cfg.HistoryMaxAge,
+	})
+}
+
+// defaultNodeID is unique per process on a host
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "sse"
+	}
+	return host + "-" + strconv.Itoa(os.Getpid())
+}
+
+// defaultPublicURL assumes clients reach this host directly on the API port
+func defaultPublicURL(cfg config) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	scheme := "http"
+	if cfg.tlsEnabled() {
+		scheme = "https"
+	}
+	// Clients elsewhere can't reach a socket, so the first TCP address counts
+	port := "8080"
+	for _, addr := range splitList(cfg.Addr) {
+		if strings.HasPrefix(addr, "unix:") {
+			continue
+		}
+		if _, p, err := net.SplitHostPort(addr); err == nil && p != "" {
+			port = p
+			break
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// settingNames records the name of every setting loadConfig reads, for
+// telling a misspelt setting in a config file or flag from a real one
+var settingNames sync.Map
+
+// getenv reads a setting from the environment
+func getenv(name string) string {
+	settingNames.Store(name, struct{}{})
+	return os.Getenv(name)
+}
+
+// knownSetting reports whether name is a setting, once loadConfig has run
+func knownSetting(name string) bool {
+	_, ok := settingNames.Load(name)
+	return ok
+}
+
+func envInt(name string, def int) int {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		logger.Warn("Invalid setting, using default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return n
+}
+
+func envFloat(name string, def float64) float64 {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		logger.Warn("Invalid setting, using default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return f
+}
+
+func envBool(name string, def bool) bool {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		logger.Warn("Invalid setting, using default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return b
+}
+
+// envFileMode reads permissions in octal, as chmod takes them
+func envFileMode(name string, def fs.FileMode) fs.FileMode {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+	m, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || m > 0o777 {
+		logger.Warn("Invalid setting, using default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return fs.FileMode(m)
+}
+
+func envString(name, def string) string {
+	if v := getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		logger.Warn("Invalid setting, using default", "name", name, "value", v, "default", def)
+		return def
+	}
+	return d
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// flagUsage is printed for --help
+const flagUsage = `Usage: sse [--config FILE] [--SETTING=VALUE ...]
+
+Every setting can be given as a flag, named as its environment variable
+without SSE_, in lower case with dashes: --keepalive-interval=30s sets
+SSE_KEEPALIVE_INTERVAL. Flags take precedence over the environment, which
+takes precedence over the config file.
+
+--config FILE is SSE_CONFIG_FILE: a .yaml, .yml, .json or .toml file, or
+NAME=value lines.`
+
+// parseFlags reads the settings given on the command line, as --name=value
+// or --name value, by the names of their environment variables
+func parseFlags(args []string) (map[string]string, error) {
+	flags := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-h" || arg == "-help" || arg == "--help" {
+			fmt.Println(flagUsage)
+			os.Exit(0)
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name == "" {
+			return nil, fmt.Errorf("unexpected argument %q, see --help", arg)
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("flag --%s needs a value", name)
+			}
+			i++
+			value = args[i]
+		}
+		if name == "config" {
+			name = "config-file"
+		}
+		flags[settingName("", name)] = value
+	}
+	return flags, nil
+}
+
+// settingName is the environment variable a key of a structured config file
+// or a flag stands for: key in upper case with dashes as underscores, under
+// prefix, or SSE_ at the top level unless key starts with it
+func settingName(prefix, key string) string {
+	key = strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+	if prefix != "" {
+		return prefix + "_" + key
+	}
+	if strings.HasPrefix(key, "SSE_") {
+		return key
+	}
+	return "SSE_" + key
+}
+
+// readStructuredConfig reads a YAML, JSON or TOML config file into
+// settings. Nested keys join with underscores, so kafka: {brokers: ...} sets
+// SSE_KAFKA_BROKERS, and lists join with commas.
+func readStructuredConfig(path string, unmarshal func([]byte, any) error) (map[string]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	vars := make(map[string]string)
+	if err := flattenSettings("", doc, vars); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return vars, nil
+}
+
+func flattenSettings(prefix string, doc map[string]any, vars map[string]string) error {
+	for key, v := range doc {
+		name := settingName(prefix, key)
+		switch v := v.(type) {
+		case map[string]any:
+			if err := flattenSettings(name, v, vars); err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				s, ok := settingValue(item)
+				if !ok {
+					return fmt.Errorf("%s: list items must be strings, numbers or booleans", name)
+				}
+				items[i] = s
+			}
+			vars[name] = strings.Join(items, ",")
+		default:
+			s, ok := settingValue(v)
+			if !ok {
+				return fmt.Errorf("%s: unexpected value %v", name, v)
+			}
+			vars[name] = s
+		}
+	}
+	return nil
+}
+
+// settingValue writes a scalar as the environment would hold it
+func settingValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", true
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// readConfigFile reads the settings of a config file in the format its
+// extension names
+func readConfigFile(path string) (map[string]string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		return readStructuredConfig(path, yaml.Unmarshal)
+	case ".toml":
+		return readStructuredConfig(path, toml.Unmarshal)
+	}
+	return readEnvFile(path)
+}
+
+// unknownSettings lists the settings in names that the server doesn't
+// read, most likely misspelt; only SSE_ names are checked, since a file
+// may set other variables too. It is only meaningful once loadConfig ran.
+func unknownSettings(names []string) []string {
+	var unknown []string
+	for _, name := range names {
+		if strings.HasPrefix(name, "SSE_") && !knownSetting(name) {
+			unknown = append(unknown, name)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/gofiber/fiber/v3/middleware/cors"
+)
+
+// corsPolicy is the CORS configuration of one group of routes
+type corsPolicy struct {
+	// Origins allowed to call the routes; empty allows none, "*" any
+	Origins     []string
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	// Expose lists the response headers scripts may read
+	Expose []string
+}
+
+// streamRoute reports whether path is one of the routes browsers call: the
+// stream itself and the endpoints a page uses alongside it. Everything else
+// is for backends and follows the API policy.
+func streamRoute(path string) bool {
+	switch path {
+	case "/sse", "/stream-token", "/ack":
+		return true
+	}
+	if strings.HasPrefix(path, "/route/") {
+		return true
+	}
+	return strings.HasPrefix(path, "/sessions/") &&
+		(strings.HasSuffix(path, "/subscriptions") || strings.HasSuffix(path, "/reauthenticate"))
+}
+
+// corsRoutes applies the stream policy to stream routes and the API policy
+// to the rest. A config reload can replace the policies while serving.
+type corsRoutes struct {
+	handlers atomic.Pointer[corsHandlers]
+}
+
+type corsHandlers struct {
+	stream, api fiber.Handler
+}
+
+func newCORSRoutes(stream, api corsPolicy) (*corsRoutes, error) {
+	cr := &corsRoutes{}
+	if err := cr.set(stream, api); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// set replaces the policies, leaving them as they were when either is invalid
+func (cr *corsRoutes) set(stream, api corsPolicy) error {
+	streamHandler, err := stream.handler()
+	if err != nil {
+		return errors.New("stream CORS policy: " + err.Error())
+	}
+	apiHandler, err := api.handler()
+	if err != nil {
+		return errors.New("API CORS policy: " + err.Error())
+	}
+	cr.handlers.Store(&corsHandlers{stream: streamHandler, api: apiHandler})
+	return nil
+}
+
+func (cr *corsRoutes) middleware() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		h := cr.handlers.Load()
+		if streamRoute(c.Path()) {
+			return h.stream(c)
+		}
+		return h.api(c)
+	}
+}
+
+func (p corsPolicy) handler() (fiber.Handler, error) {
+	if len(p.Origins) == 0 {
+		// No CORS headers, so browsers only allow same-origin calls
+		return func(c fiber.Ctx) error { return c.Next() }, nil
+	}
+	if p.Credentials && slices.Contains(p.Origins, "*") {
+		return nil, errors.New("credentials can't be allowed for every origin; list the origins")
+	}
+	return cors.New(cors.Config{
+		AllowOrigins:     p.Origins,
+		AllowMethods:     p.Methods,
+		AllowHeaders:     p.Headers,
+		AllowCredentials: p.Credentials,
+		ExposeHeaders:    p.Expose,
+	}), nil
+}
+
+// streamCORS is the policy for the routes browsers call
+func (cfg config) streamCORS() corsPolicy {
+	return corsPolicy{
+		Origins:     splitList(cfg.CORSStreamOrigins),
+		Methods:     splitList(cfg.CORSStreamMethods),
+		Headers:     splitList(cfg.CORSStreamHeaders),
+		Credentials: cfg.CORSStreamCredentials,
+		Expose:      []string{"X-SSE-Owner", "X-SSE-Owner-URL"},
+	}
+}
+
+// apiCORS is the policy for the publish and admin routes
+func (cfg config) apiCORS() corsPolicy {
+	return corsPolicy{
+		Origins:     splitList(cfg.CORSAPIOrigins),
+		Methods:     splitList(cfg.CORSAPIMethods),
+		Headers:     splitList(cfg.CORSAPIHeaders),
+		Credentials: cfg.CORSAPICredentials,
+		Expose:      []string{"Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset"},
+	}
+}
+
+// originAllowed reports whether origin matches one of allowed, which may hold
+// "*" or wildcard patterns such as "https://*.example.com"
+func originAllowed(origin string, allowed []string) bool {
+	for _, pattern := range allowed {
+		if pattern == "*" || strings.EqualFold(pattern, origin) {
+			return true
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated setting, dropping empty entries
+func splitList(v string) []string {
+	var out []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
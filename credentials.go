@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialExtractor looks for a JWT in one place of a request
+type credentialExtractor func(r AuthRequest) string
+
+// credentialExtractors are the places SSE_AUTH_CREDENTIALS can list
+var credentialExtractors = map[string]func(cfg config) credentialExtractor{
+	"header": func(config) credentialExtractor {
+		return func(r AuthRequest) string {
+			return bearerToken(r.Header("Authorization"))
+		}
+	},
+	"cookie": func(cfg config) credentialExtractor {
+		return func(r AuthRequest) string {
+			return r.Cookie(cfg.AuthCookie)
+		}
+	},
+	// EventSource can't set headers, so a JWT may come in the query string
+	"query": func(config) credentialExtractor {
+		return func(r AuthRequest) string {
+			return r.Query("access_token")
+		}
+	},
+}
+
+// streamTokens mints short-lived tokens that open one stream each, so a
+// browser never has to put its long-lived JWT in a URL. Tokens are signed, so
+// any instance sharing the secret accepts them; each instance remembers the
+// tokens redeemed on it until they expire.
+type streamTokens struct {
+	secret []byte
+	ttl    time.Duration
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// streamTokenClaims is the signed payload of a stream token
+type streamTokenClaims struct {
+	UserID    string `json:"u"`
+	ExpiresAt int64  `json:"x"`
+	Nonce     string `json:"n"`
+	// AuthExpiresAt is when the credential the token was minted for expires,
+	// which the stream it opens inherits
+	AuthExpiresAt int64 `json:"e,omitempty"`
+}
+
+// newStreamTokens signs with secret, or with a random key when it is empty,
+// in which case only this process accepts the tokens it mints
+func newStreamTokens(secret string, ttl time.Duration) (*streamTokens, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &streamTokens{secret: key, ttl: ttl, used: make(map[string]time.Time)}, nil
+}
+
+// mint returns a token for the caller id and when it expires
+func (st *streamTokens) mint(id Identity) (string, time.Time, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(st.ttl)
+	claims := streamTokenClaims{UserID: id.Subject, ExpiresAt: expiresAt.Unix(), Nonce: hex.EncodeToString(nonce)}
+	if !id.ExpiresAt.IsZero() {
+		claims.AuthExpiresAt = id.ExpiresAt.Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(st.sign(encoded)), expiresAt, nil
+}
+
+// Authenticate redeems the token in the stream_token query parameter
+func (st *streamTokens) Authenticate(r AuthRequest) (Identity, error) {
+	token := r.Query("stream_token")
+	if token == "" {
+		return Identity{}, errNoCredentials
+	}
+	claims, err := st.redeem(token)
+	if err != nil {
+		return Identity{}, fmt.Errorf("invalid token: %w", err)
+	}
+	id := Identity{Subject: claims.UserID, Method: "stream-token"}
+	if claims.AuthExpiresAt != 0 {
+		id.ExpiresAt = time.Unix(claims.AuthExpiresAt, 0)
+	}
+	return id, nil
+}
+
+// redeem checks token and returns its claims, refusing it from then on
+func (st *streamTokens) redeem(token string) (streamTokenClaims, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return streamTokenClaims{}, errors.New("malformed stream token")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, st.sign(encoded)) {
+		return streamTokenClaims{}, errors.New("bad stream token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return streamTokenClaims{}, errors.New("malformed stream token")
+	}
+	var claims streamTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return streamTokenClaims{}, errors.New("malformed stream token")
+	}
+	now := time.Now()
+	expiresAt := time.Unix(claims.ExpiresAt, 0)
+	if now.After(expiresAt) {
+		return streamTokenClaims{}, errors.New("stream token expired")
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for nonce, exp := range st.used {
+		if now.After(exp) {
+			delete(st.used, nonce)
+		}
+	}
+	if _, ok := st.used[claims.Nonce]; ok {
+		return streamTokenClaims{}, errors.New("stream token already used")
+	}
+	st.used[claims.Nonce] = expiresAt
+	return claims, nil
+}
+
+func (st *streamTokens) sign(encoded string) []byte {
+	h := hmac.New(sha256.New, st.secret)
+	h.Write([]byte(encoded))
+	return h.Sum(nil)
+}
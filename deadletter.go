@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// deadLetter is an event that could not be delivered to a session or user
+type deadLetter struct {
+	EventID   uint64    `json:"eventID,omitempty"`
+	UserID    string    `json:"userID"`
+	SessionID string    `json:"sessionID,omitempty"`
+	Type      string    `json:"type"`
+	Topic     string    `json:"topic,omitempty"`
+	Data      any       `json:"data"`
+	Reason    string    `json:"reason"`
+	At        time.Time `json:"at"`
+}
+
+// deadLetterSink receives undeliverable events
+type deadLetterSink interface {
+	put(dl deadLetter)
+}
+
+// deadLetterSinks fans a dead letter out to several sinks
+type deadLetterSinks []deadLetterSink
+
+func (ds deadLetterSinks) put(dl deadLetter) {
+	for _, sink := range ds {
+		sink.put(dl)
+	}
+}
+
+// deadLetterRing keeps the most recent dead letters in memory for /dead-letters
+type deadLetterRing struct {
+	mu    sync.Mutex
+	items []deadLetter
+	next  int
+	full  bool
+}
+
+func newDeadLetterRing(size int) *deadLetterRing {
+	return &deadLetterRing{items: make([]deadLetter, size)}
+}
+
+func (r *deadLetterRing) put(dl deadLetter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.items[r.next] = dl
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns up to limit dead letters, newest first, optionally only for userID
+func (r *deadLetterRing) list(userID string, limit int) []deadLetter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.items)
+	}
+	out := make([]deadLetter, 0, min(n, limit))
+	for i := 1; i <= n && len(out) < limit; i++ {
+		dl := r.items[(r.next-i+len(r.items))%len(r.items)]
+		if userID == "" || dl.UserID == userID {
+			out = append(out, dl)
+		}
+	}
+	return out
+}
+
+// deadLetterFile appends dead letters to a file as newline-delimited JSON
+type deadLetterFile struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func newDeadLetterFile(path string) (*deadLetterFile, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterFile{f: f}, nil
+}
+
+func (df *deadLetterFile) put(dl deadLetter) {
+	line, err := json.Marshal(dl)
+	if err != nil {
+		logger.Error("Dead letter encode error", "error", err)
+		return
+	}
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	if _, err := df.f.Write(append(line, '\n')); err != nil {
+		logger.Error("Dead letter file write error", "error", err)
+	}
+}
+
+// deadLetterCallback POSTs each dead letter as JSON to a URL from a background
+// goroutine, dropping them if the endpoint can't keep up
+type deadLetterCallback struct {
+	url    string
+	queue  chan deadLetter
+	client *http.Client
+}
+
+func newDeadLetterCallback(url string) *deadLetterCallback {
+	dc := &deadLetterCallback{
+		url:    url,
+		queue:  make(chan deadLetter, 1000),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}
+	go dc.run()
+	return dc
+}
+
+func (dc *deadLetterCallback) put(dl deadLetter) {
+	select {
+	case dc.queue <- dl:
+	default:
+		logger.Warn("Dead letter callback backlog full, discarding event", "userID", dl.UserID, "sessionID", dl.SessionID, "eventID", dl.EventID)
+	}
+}
+
+func (dc *deadLetterCallback) run() {
+	for dl := range dc.queue {
+		body, err := json.Marshal(dl)
+		if err != nil {
+			logger.Error("Dead letter encode error", "error", err)
+			continue
+		}
+		resp, err := dc.client.Post(dc.url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logger.Error("Dead letter callback error", "error", err)
+			continue
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			logger.Error("Dead letter callback failed", "status", resp.StatusCode)
+		}
+	}
+}
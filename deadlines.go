@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// writeDeadline is when a write to a stream's connection starting now must
+// have completed; zero when writes aren't bounded
+func writeDeadline() time.Time {
+	if d := currentBroker.writeTimeout; d > 0 {
+		return time.Now().Add(d)
+	}
+	return time.Time{}
+}
+
+// errResponseClosed is a write to an SSE response that the server stopped
+// sending, having failed to write to the client
+var errResponseClosed = errors.New("response closed")
+
+// clientGone reports whether err is a write that failed because the client
+// went away: it closed or reset the connection, or stopped reading, so the
+// write missed its deadline
+func clientGone(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, errResponseClosed) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// detectHalfOpen has the kernel drop conn once data written to it went
+// unacknowledged for the write timeout. A peer that vanished without closing
+// the connection, behind a middlebox that lost it, is then noticed by the
+// stream's next keepalive rather than after the TCP retransmissions give up,
+// which takes many minutes.
+func detectHalfOpen(conn net.Conn) {
+	d := currentBroker.writeTimeout
+	if d <= 0 {
+		return
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := setTCPUserTimeout(tcp, d); err != nil {
+		logger.Debug("TCP user timeout not set", "error", err)
+	}
+}
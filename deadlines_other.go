@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// setTCPUserTimeout is only available on Linux; elsewhere half-open
+// connections are left to the write deadlines and TCP keepalives
+func setTCPUserTimeout(*net.TCPConn, time.Duration) error {
+	return errors.New("not supported on this platform")
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"runtime"
+
+	"github.com/gofiber/fiber/v3"
+	fiberexpvar "github.com/gofiber/fiber/v3/middleware/expvar"
+	"github.com/gofiber/fiber/v3/middleware/pprof"
+)
+
+// streamWriters counts the goroutines running streamSession. Well above the
+// open sessions, it points at writers stuck on clients that went away.
+var streamWriters = expvar.NewInt("sse_stream_writers")
+
+func init() {
+	expvar.Publish("sse_sessions", expvar.Func(func() any {
+		if currentBroker == nil {
+			return 0
+		}
+		return currentBroker.sessions.count()
+	}))
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+}
+
+// debugRoutes serves net/http/pprof under /debug/pprof/ and expvar on
+// /debug/vars. Both reveal the process's internals, so they are only served
+// on the admin listener, behind guard.
+func debugRoutes(cfg config, admin *fiber.App, guard func(fiber.Handler) fiber.Handler) error {
+	if !cfg.DebugEndpoints {
+		return nil
+	}
+	if cfg.AdminAddr == "" {
+		return errors.New("debug endpoints need an admin listener")
+	}
+	admin.Use("/debug", guard(func(c fiber.Ctx) error { return c.Next() }), pprof.New(), fiberexpvar.New())
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// deliveryState is how far an event got on its way to one session
+type deliveryState string
+
+const (
+	deliveryQueued  deliveryState = "queued"
+	deliveryDropped deliveryState = "dropped"
+	deliveryExpired deliveryState = "expired"
+	deliveryWritten deliveryState = "written"
+	deliveryAcked   deliveryState = "acked"
+)
+
+// sessionDelivery is the state of an event for a single session
+type sessionDelivery struct {
+	State     deliveryState `json:"state"`
+	UpdatedAt time.Time     `json:"updatedAt"`
+}
+
+// deliveryRecord tracks an event across all the sessions it was published to
+type deliveryRecord struct {
+	EventID   uint64                      `json:"eventID"`
+	UserID    string                      `json:"userID"`
+	CreatedAt time.Time                   `json:"createdAt"`
+	Sessions  map[string]*sessionDelivery `json:"sessions"`
+}
+
+// deliveryTracker keeps the delivery state of the most recent events, oldest evicted first
+type deliveryTracker struct {
+	mu      sync.Mutex
+	records map[uint64]*deliveryRecord
+	order   []uint64
+	limit   int
+}
+
+func newDeliveryTracker(limit int) *deliveryTracker {
+	return &deliveryTracker{
+		records: make(map[uint64]*deliveryRecord),
+		limit:   limit,
+	}
+}
+
+// track starts tracking a newly published event
+func (dt *deliveryTracker) track(eventID uint64, userID string) {
+	if dt.limit <= 0 {
+		return
+	}
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	dt.records[eventID] = &deliveryRecord{
+		EventID:   eventID,
+		UserID:    userID,
+		CreatedAt: time.Now(),
+		Sessions:  make(map[string]*sessionDelivery),
+	}
+	dt.order = append(dt.order, eventID)
+	for len(dt.order) > dt.limit {
+		delete(dt.records, dt.order[0])
+		dt.order = dt.order[1:]
+	}
+}
+
+// set records the state of an event for a session; states never move backwards,
+// so a late "written" can't overwrite an "acked"
+func (dt *deliveryTracker) set(eventID uint64, sessionID string, state deliveryState) bool {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	rec, ok := dt.records[eventID]
+	if !ok {
+		return false
+	}
+	sd, ok := rec.Sessions[sessionID]
+	if !ok {
+		if state == deliveryAcked {
+			// Only sessions the event was published to can acknowledge it
+			return false
+		}
+		sd = &sessionDelivery{}
+		rec.Sessions[sessionID] = sd
+	}
+	if sd.State == deliveryAcked || (sd.State == deliveryWritten && state == deliveryQueued) {
+		return true
+	}
+	sd.State = state
+	sd.UpdatedAt = time.Now()
+	return true
+}
+
+// get returns a copy of the record for eventID
+func (dt *deliveryTracker) get(eventID uint64) (deliveryRecord, bool) {
+	dt.mu.Lock()
+	defer dt.mu.Unlock()
+	rec, ok := dt.records[eventID]
+	if !ok {
+		return deliveryRecord{}, false
+	}
+	out := *rec
+	out.Sessions = make(map[string]*sessionDelivery, len(rec.Sessions))
+	for id, sd := range rec.Sessions {
+		cp := *sd
+		out.Sessions[id] = &cp
+	}
+	return out, true
+}
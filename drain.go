@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// drainer takes the instance out of rotation for a rolling deploy, without
+// a thundering herd: /readyz fails, new streams are turned away, and the
+// open sessions are asked to reconnect a few at a time over a spread, so
+// they move to the other instances gradually
+type drainer struct {
+	ready *readiness
+	b     *broker
+	// spread is how long asking every session to reconnect takes, unless a
+	// drain says otherwise; retryAfter is when refused clients should retry
+	spread     time.Duration
+	retryAfter time.Duration
+
+	mu     sync.Mutex
+	status drainStatus
+	// stop ends the running drain's reconnects; nil when not draining.
+	// done is closed once that drain has asked every session, or stopped.
+	stop chan struct{}
+	done chan struct{}
+}
+
+// drainStatus is a drain's progress, as /admin/drain reports it
+type drainStatus struct {
+	Draining  bool      `json:"draining"`
+	StartedAt time.Time `json:"startedAt,omitzero"`
+	SpreadMs  int64     `json:"spreadMs"`
+	// Sessions is how many were open when the drain started, Reconnected
+	// how many have been asked to reconnect since, and Remaining how many
+	// are still open
+	Sessions    int `json:"sessions"`
+	Reconnected int `json:"reconnected"`
+	Remaining   int `json:"remaining"`
+}
+
+func newDrainer(cfg config, ready *readiness, b *broker) *drainer {
+	return &drainer{ready: ready, b: b, spread: cfg.DrainSpread, retryAfter: cfg.DrainRetryAfter}
+}
+
+// start drains over spread (the default when negative); a drain already
+// running carries on unchanged
+func (d *drainer) start(spread time.Duration) drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		return d.current()
+	}
+	if spread < 0 {
+		spread = d.spread
+	}
+	d.ready.drain()
+	sessions := d.b.sessions.matching(func(*session) bool { return true })
+	d.status = drainStatus{Draining: true, StartedAt: time.Now(), SpreadMs: spread.Milliseconds(), Sessions: len(sessions)}
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+	logger.Warn("Draining", "sessions", len(sessions), "spread", spread.String())
+	go d.run(sessions, spread, d.stop, d.done)
+	return d.current()
+}
+
+// run asks sessions to reconnect, evenly over spread, oldest first
+func (d *drainer) run(sessions []*session, spread time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	if len(sessions) == 0 {
+		return
+	}
+	interval := spread / time.Duration(len(sessions))
+	for i, s := range sessions {
+		if i > 0 && interval > 0 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if s.evictAs("reconnect", "draining") {
+			s.log.Info("Session asked to reconnect, draining")
+			d.mu.Lock()
+			d.status.Reconnected++
+			d.mu.Unlock()
+		}
+	}
+	logger.Info("Drained", "sessions", len(sessions))
+}
+
+// cancel ends the drain, so the instance takes connections again; the
+// sessions already asked to reconnect stay closed
+func (d *drainer) cancel() drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+		d.ready.undrain()
+		logger.Info("Drain cancelled", "reconnected", d.status.Reconnected)
+	}
+	d.status.Draining = false
+	return d.current()
+}
+
+// finish drains for shutdown: it asks every session to reconnect over
+// spread, or lets a drain already running go on for at most spread, and
+// returns how many sessions were asked to reconnect
+func (d *drainer) finish(spread time.Duration) int {
+	d.start(spread)
+	d.mu.Lock()
+	done := d.done
+	d.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(spread):
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop != nil {
+		close(d.stop)
+		d.stop = nil
+	}
+	return d.status.Reconnected
+}
+
+// current returns the drain's progress; callers hold d.mu
+func (d *drainer) current() drainStatus {
+	st := d.status
+	st.Remaining = d.b.sessions.count()
+	return st
+}
+
+// progress returns the drain's progress
+func (d *drainer) progress() drainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.current()
+	// Also set while draining for shutdown
+	st.Draining = d.ready.draining.Load()
+	return st
+}
+
+// refusing reports whether new streams are turned away, and the
+// Retry-After, in seconds, to send them
+func (d *drainer) refusing() (bool, string) {
+	if !d.ready.draining.Load() {
+		return false, ""
+	}
+	return true, strconv.Itoa(int(math.Ceil(d.retryAfter.Seconds())))
+}
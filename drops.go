@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// dropLog warns about events dropped from full session buffers. The first
+// drop for a user is logged at once; those that follow within interval are
+// counted and logged together when it ends, so a user dropping thousands of
+// events costs a line per interval.
+type dropLog struct {
+	interval time.Duration
+
+	mu    sync.Mutex
+	users map[string]*userDrops
+}
+
+// userDrops are the drops for a user not logged yet
+type userDrops struct {
+	count  int
+	reason string
+	// sessions are the IDs of the sessions that dropped them
+	sessions map[string]struct{}
+}
+
+// newDropLog logs every drop when interval is 0
+func newDropLog(interval time.Duration) *dropLog {
+	dl := &dropLog{interval: interval, users: make(map[string]*userDrops)}
+	if interval > 0 {
+		go dl.run()
+	}
+	return dl
+}
+
+func (dl *dropLog) record(s *session, reason string) {
+	if dl.interval <= 0 {
+		s.log.Warn("Event dropped", "reason", reason)
+		return
+	}
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	u, ok := dl.users[s.userID]
+	if !ok {
+		dl.users[s.userID] = &userDrops{sessions: map[string]struct{}{}}
+		s.log.Warn("Event dropped", "reason", reason)
+		return
+	}
+	u.count++
+	u.reason = reason
+	u.sessions[s.id] = struct{}{}
+}
+
+func (dl *dropLog) run() {
+	t := time.NewTicker(dl.interval)
+	defer t.Stop()
+	for range t.C {
+		dl.flush()
+	}
+}
+
+// flush logs the drops counted since the previous flush. Users that had
+// none are forgotten, so that their next drop is logged at once.
+func (dl *dropLog) flush() {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	for userID, u := range dl.users {
+		if u.count == 0 {
+			delete(dl.users, userID)
+			continue
+		}
+		logger.Warn("Events dropped", "userID", userID, "count", u.count, "sessions", len(u.sessions), "lastReason", u.reason, "over", dl.interval.String())
+		u.count = 0
+		clear(u.sessions)
+	}
+}
+
+// dropped accounts for ev not reaching s, or being pushed out of its buffer:
+// the event is dead-lettered, counted and logged, and s judged as a consumer
+func (b *broker) dropped(userID string, s *session, ev event, reason string) {
+	b.metrics.dropped.Add(1)
+	b.deliveries.set(ev.ID, s.id, deliveryDropped)
+	b.deadLetter(userID, s.id, ev, reason)
+	b.drops.record(s, reason)
+	b.tail.dropped(userID, s, ev, reason)
+	b.slowConsumers.recordDrop(s)
+}
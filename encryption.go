@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PayloadKeyProvider looks up the key a user's event payloads are encrypted
+// with. It returns nil and no error when the user has no key.
+type PayloadKeyProvider interface {
+	PayloadKey(userID string) ([]byte, error)
+}
+
+// encryptionMode says whether streams have their payloads encrypted
+type encryptionMode string
+
+const (
+	encryptionOff      encryptionMode = "off"
+	encryptionOptional encryptionMode = "optional"
+	encryptionRequired encryptionMode = "required"
+)
+
+func parseEncryptionMode(v string) (encryptionMode, bool) {
+	switch m := encryptionMode(v); m {
+	case encryptionOff, encryptionOptional, encryptionRequired:
+		return m, true
+	}
+	return "", false
+}
+
+// payloadKeyHeader carries a key the client picked itself, base64-encoded
+const payloadKeyHeader = "X-SSE-Payload-Key"
+
+// payloadEncryption picks the key for each new stream: the one the client
+// sent, or else the provider's
+type payloadEncryption struct {
+	mode     encryptionMode
+	provider PayloadKeyProvider
+}
+
+func newPayloadEncryption(cfg config) *payloadEncryption {
+	pe := &payloadEncryption{mode: cfg.PayloadEncryption}
+	switch {
+	case cfg.PayloadKeySecret != "":
+		pe.provider = derivedPayloadKeys{secret: []byte(cfg.PayloadKeySecret)}
+	case cfg.PayloadKeyURL != "":
+		pe.provider = newPayloadKeyService(cfg.PayloadKeyURL)
+	}
+	return pe
+}
+
+// forStream returns the cipher for a stream of userID, or nil to send it in
+// plaintext. presented is the client's own key, if it sent one.
+func (pe *payloadEncryption) forStream(userID, presented string) (cipher.AEAD, error) {
+	if pe.mode == encryptionOff {
+		return nil, nil
+	}
+	var key []byte
+	if presented != "" {
+		k, err := base64.StdEncoding.DecodeString(presented)
+		if err != nil {
+			return nil, fmt.Errorf("%s is not base64", payloadKeyHeader)
+		}
+		key = k
+	} else if pe.provider != nil {
+		k, err := pe.provider.PayloadKey(userID)
+		if err != nil {
+			logger.Error("Payload key lookup failed", "userID", userID, "error", err)
+			return nil, errors.New("payload key unavailable")
+		}
+		key = k
+	}
+	if key == nil {
+		if pe.mode == encryptionRequired {
+			return nil, errors.New("an encryption key is required")
+		}
+		return nil, nil
+	}
+	if len(key) != 32 {
+		return nil, errors.New("payload keys must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedPayload replaces the data of an encrypted event
+type encryptedPayload struct {
+	Alg        string `json:"alg"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// encryptingWriter seals the data of published events with AES-256-GCM. The
+// event ID and type stay readable, as the stream needs them, and are bound to
+// the ciphertext as additional data. Events without an ID are the server's
+// own notices and carry no user data, so they go out as they are.
+type encryptingWriter struct {
+	eventWriter
+	aead cipher.AEAD
+}
+
+func (ew encryptingWriter) write(id uint64, eventType string, data any) error {
+	if id == 0 {
+		return ew.eventWriter.write(id, eventType, data)
+	}
+	plain, err := json.Marshal(data)
+	if err != nil {
+		logger.Error("Payload encode error", "error", err)
+		return nil
+	}
+	nonce := make([]byte, ew.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := ew.aead.Seal(nil, nonce, plain, payloadAAD(id, eventType))
+	return ew.eventWriter.write(id, eventType, encryptedPayload{
+		Alg:        "A256GCM",
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(sealed),
+	})
+}
+
+func payloadAAD(id uint64, eventType string) []byte {
+	return []byte(strconv.FormatUint(id, 10) + ":" + eventType)
+}
+
+// derivedPayloadKeys derives each user's key from a secret shared with the
+// application backend, which hands it to its users: HMAC-SHA256 of
+// "sse-payload:" and the user ID
+type derivedPayloadKeys struct {
+	secret []byte
+}
+
+func (dk derivedPayloadKeys) PayloadKey(userID string) ([]byte, error) {
+	h := hmac.New(sha256.New, dk.secret)
+	h.Write([]byte("sse-payload:" + userID))
+	return h.Sum(nil), nil
+}
+
+// payloadKeyCacheTTL is how long keys fetched from the key service are reused
+const payloadKeyCacheTTL = 5 * time.Minute
+
+// payloadKeyService fetches keys from an HTTP service: GET url?userID=...
+// answering {"key": "<base64>"}, or 404 for a user without one
+type payloadKeyService struct {
+	url    string
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedPayloadKey
+}
+
+type cachedPayloadKey struct {
+	key     []byte
+	fetched time.Time
+}
+
+func newPayloadKeyService(url string) *payloadKeyService {
+	return &payloadKeyService{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		cache:  make(map[string]cachedPayloadKey),
+	}
+}
+
+func (ks *payloadKeyService) PayloadKey(userID string) ([]byte, error) {
+	ks.mu.Lock()
+	cached, ok := ks.cache[userID]
+	ks.mu.Unlock()
+	if ok && time.Since(cached.fetched) < payloadKeyCacheTTL {
+		return cached.key, nil
+	}
+
+	resp, err := ks.client.Get(ks.url + "?userID=" + url.QueryEscape(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var key []byte
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("key service returned %s", resp.Status)
+	default:
+		var body struct {
+			Key []byte `json:"key"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		key = body.Key
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for id, c := range ks.cache {
+		if time.Since(c.fetched) >= payloadKeyCacheTTL {
+			delete(ks.cache, id)
+		}
+	}
+	ks.cache[userID] = cachedPayloadKey{key: key, fetched: time.Now()}
+	return key, nil
+}
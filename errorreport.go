@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// ErrorReporter sends errors an operator should hear about to a service
+// such as Sentry: panics recovered while handling a request, failed stream
+// writes and backplane errors. Report must not block; a reporter that can't
+// keep up drops reports.
+type ErrorReporter interface {
+	Report(r ErrorReport)
+	// Close waits for the reports already made to be sent, until ctx is done
+	Close(ctx context.Context)
+}
+
+// ErrorReport is one error, with where it happened
+type ErrorReport struct {
+	// Kind is what failed: "panic", "stream write" or "backplane"
+	Kind string
+	Err  error
+	// Stack is the program counters of the goroutine that panicked
+	Stack []uintptr
+	// Context identifies the request, user and session involved, as far as
+	// they are known
+	Context map[string]string
+	At      time.Time
+}
+
+// errorReporterFactories are the reporters SSE_ERROR_REPORTER can name
+var errorReporterFactories = map[string]func(cfg config) (ErrorReporter, error){
+	"sentry": func(cfg config) (ErrorReporter, error) { return newSentryReporter(cfg) },
+}
+
+// errorReporter receives reportError's reports; nil discards them
+var errorReporter ErrorReporter
+
+// setupErrorReporting starts the reporter cfg.ErrorReporter names, if any
+func setupErrorReporting(cfg config) error {
+	if cfg.ErrorReporter == "" || cfg.ErrorReporter == "none" {
+		return nil
+	}
+	factory, ok := errorReporterFactories[cfg.ErrorReporter]
+	if !ok {
+		return fmt.Errorf("unknown error reporter %q", cfg.ErrorReporter)
+	}
+	r, err := factory(cfg)
+	if err != nil {
+		return err
+	}
+	errorReporter = r
+	return nil
+}
+
+// reportError passes err on to the error reporter, with context as
+// alternating keys and values
+func reportError(kind string, err error, context ...string) {
+	if errorReporter == nil || err == nil {
+		return
+	}
+	errorReporter.Report(newErrorReport(kind, err, context...))
+}
+
+// newErrorReport leaves out the context with empty values
+func newErrorReport(kind string, err error, context ...string) ErrorReport {
+	r := ErrorReport{Kind: kind, Err: err, Context: map[string]string{}, At: time.Now()}
+	for i := 0; i+1 < len(context); i += 2 {
+		if context[i+1] != "" {
+			r.Context[context[i]] = context[i+1]
+		}
+	}
+	return r
+}
+
+// sessionContext is the context reported with errors of s's stream
+func sessionContext(s *session) []string {
+	return []string{"userID", s.userID, "sessionID", s.id, "clientIP", s.clientIP}
+}
+
+// reportPanic is the recover middleware's stack trace handler. It logs the
+// panic and reports it with the stack and the request it happened in.
+func reportPanic(c fiber.Ctx, e any) {
+	err, ok := e.(error)
+	if !ok {
+		err = fmt.Errorf("%v", e)
+	}
+	requestLogger(c).Error("Panic recovered", "method", c.Method(), "path", c.Path(), "error", err)
+	if errorReporter == nil {
+		return
+	}
+	id, _ := c.Locals("identity").(Identity)
+	r := newErrorReport("panic", err, "method", c.Method(), "path", c.Path(), "requestID", requestID(c), "caller", id.Subject)
+	// Skip runtime.Callers, reportPanic, the middleware's deferred call and
+	// the runtime's panic, leaving the call that panicked on top
+	r.Stack = make([]uintptr, 64)
+	r.Stack = r.Stack[:runtime.Callers(5, r.Stack)]
+	errorReporter.Report(r)
+}
+
+// reportingWriter reports the first write or flush that fails on a stream,
+// which then ends
+type reportingWriter struct {
+	eventWriter
+	s *session
+}
+
+func (rw reportingWriter) write(id uint64, eventType string, data any) error {
+	err := rw.eventWriter.write(id, eventType, data)
+	reportError("stream write", err, sessionContext(rw.s)...)
+	return err
+}
+
+func (rw reportingWriter) flush() error {
+	err := rw.eventWriter.flush()
+	reportError("stream write", err, sessionContext(rw.s)...)
+	return err
+}
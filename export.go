@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// exportJob is an admin-triggered export of users' history as NDJSON
+type exportJob struct {
+	ID          string    `json:"id"`
+	Status      string    `json:"status"`
+	UserIDs     []string  `json:"userIDs"`
+	Destination string    `json:"destination"`
+	Location    string    `json:"location"`
+	Events      int       `json:"events"`
+	Error       string    `json:"error,omitempty"`
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt,omitzero"`
+}
+
+// exportLine is one line of an export: an event and the user it was sent to
+type exportLine struct {
+	UserID string `json:"userID"`
+	event
+}
+
+// exporter runs export jobs and remembers the most recent ones
+type exporter struct {
+	dir string
+	s3  *s3Destination
+
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+	// order of job IDs, oldest first, to forget old jobs
+	order []string
+}
+
+// s3Destination is an S3-compatible bucket exports can be uploaded to
+type s3Destination struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newExporter(cfg config) *exporter {
+	ex := &exporter{dir: cfg.ExportDir, jobs: make(map[string]*exportJob)}
+	if cfg.ExportS3Endpoint != "" && cfg.ExportS3Bucket != "" {
+		client, err := minio.New(cfg.ExportS3Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(cfg.ExportS3AccessKey, cfg.ExportS3SecretKey, ""),
+			Secure: cfg.ExportS3Secure,
+			Region: cfg.ExportS3Region,
+		})
+		if err != nil {
+			logger.Warn("S3 export disabled", "error", err)
+		} else {
+			ex.s3 = &s3Destination{client: client, bucket: cfg.ExportS3Bucket, prefix: cfg.ExportS3Prefix}
+		}
+	}
+	return ex
+}
+
+// start validates an export request and runs it in the background
+func (ex *exporter) start(h *eventHistory, userIDs []string, destination, name string, q historyQuery) (*exportJob, error) {
+	job := &exportJob{
+		ID:          newSessionID(),
+		Status:      "running",
+		UserIDs:     userIDs,
+		Destination: destination,
+		StartedAt:   time.Now(),
+	}
+	if name == "" {
+		name = job.ID + ".ndjson"
+	}
+	// Keep exports inside the configured directory or prefix
+	if name != filepath.Base(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("name must be a plain file name")
+	}
+
+	var open func() (io.WriteCloser, error)
+	switch destination {
+	case "", "file":
+		job.Destination = "file"
+		job.Location = filepath.Join(ex.dir, name)
+		open = func() (io.WriteCloser, error) {
+			if err := os.MkdirAll(ex.dir, 0o755); err != nil {
+				return nil, err
+			}
+			return os.OpenFile(job.Location, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+		}
+	case "s3":
+		if ex.s3 == nil {
+			return nil, fmt.Errorf("S3 export is not configured")
+		}
+		key := ex.s3.prefix + name
+		job.Location = "s3://" + ex.s3.bucket + "/" + key
+		open = func() (io.WriteCloser, error) { return ex.s3.upload(key), nil }
+	default:
+		return nil, fmt.Errorf("destination must be file or s3")
+	}
+
+	ex.mu.Lock()
+	ex.jobs[job.ID] = job
+	ex.order = append(ex.order, job.ID)
+	if len(ex.order) > 100 {
+		delete(ex.jobs, ex.order[0])
+		ex.order = ex.order[1:]
+	}
+	snapshot := *job
+	ex.mu.Unlock()
+
+	go ex.run(job, h, open, q)
+	return &snapshot, nil
+}
+
+func (ex *exporter) run(job *exportJob, h *eventHistory, open func() (io.WriteCloser, error), q historyQuery) {
+	events, err := ex.write(job, h, open, q)
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	job.Events = events
+	job.FinishedAt = time.Now()
+	if err != nil {
+		job.Status = "failed"
+		job.Error = err.Error()
+		logger.Error("Export failed", "exportID", job.ID, "error", err)
+		return
+	}
+	job.Status = "done"
+	logger.Info("Export complete", "exportID", job.ID, "events", events, "location", job.Location)
+}
+
+// write streams every matching event of the job's users to the destination,
+// a page of history at a time
+func (ex *exporter) write(job *exportJob, h *eventHistory, open func() (io.WriteCloser, error), q historyQuery) (int, error) {
+	w, err := open()
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	ctx := context.Background()
+	events := 0
+	for _, userID := range job.UserIDs {
+		page := q
+		page.Limit = 1000
+		for {
+			batch, next, err := h.query(ctx, userID, page)
+			if err != nil {
+				err = fmt.Errorf("read history of %s: %w", userID, err)
+				abort(w, err)
+				return events, err
+			}
+			for _, ev := range batch {
+				if err := enc.Encode(exportLine{UserID: userID, event: ev}); err != nil {
+					abort(w, err)
+					return events, err
+				}
+				events++
+			}
+			if next == 0 {
+				break
+			}
+			page.After = next
+		}
+	}
+	return events, w.Close()
+}
+
+// abort closes w after a failed export, cancelling an upload in progress
+func abort(w io.WriteCloser, err error) {
+	if u, ok := w.(*s3Upload); ok {
+		u.pw.CloseWithError(err)
+		<-u.done
+		return
+	}
+	w.Close()
+}
+
+func (ex *exporter) get(id string) (exportJob, bool) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+	job, ok := ex.jobs[id]
+	if !ok {
+		return exportJob{}, false
+	}
+	return *job, true
+}
+
+// upload returns a writer whose content is streamed to key; Close waits for
+// the upload to finish and returns its error
+func (d *s3Destination) upload(key string) io.WriteCloser {
+	pr, pw := io.Pipe()
+	u := &s3Upload{pw: pw, done: make(chan error, 1)}
+	go func() {
+		_, err := d.client.PutObject(context.Background(), d.bucket, key, pr, -1, minio.PutObjectOptions{
+			ContentType: "application/x-ndjson",
+			// The size isn't known up front; bound the memory of each part
+			PartSize: 16 << 20,
+		})
+		pr.CloseWithError(err)
+		u.done <- err
+	}()
+	return u
+}
+
+type s3Upload struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (u *s3Upload) Write(p []byte) (int, error) {
+	return u.pw.Write(p)
+}
+
+func (u *s3Upload) Close() error {
+	u.pw.Close()
+	return <-u.done
+}
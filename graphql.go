@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v3"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/valyala/fasthttp"
+)
+
+// graphqlProtocol is the WebSocket subprotocol of GraphQL subscriptions,
+// spoken by graphql-ws and Apollo Client
+const graphqlProtocol = "graphql-transport-ws"
+
+// graphqlInitTimeout is how long a client has to send connection_init
+const graphqlInitTimeout = 10 * time.Second
+
+// Close codes of graphql-transport-ws
+const (
+	graphqlBadRequest     = 4400
+	graphqlUnauthorized   = 4401
+	graphqlBadProtocol    = 4406
+	graphqlInitTimedOut   = 4408
+	graphqlDuplicateID    = 4409
+	graphqlDuplicateInits = 4429
+)
+
+var graphqlUpgrader = websocket.FastHTTPUpgrader{
+	Subprotocols: []string{graphqlProtocol},
+	// The origin was checked against the stream origins before upgrading
+	CheckOrigin: func(*fasthttp.RequestCtx) bool { return true },
+}
+
+// graphqlMessage is a message of the graphql-transport-ws protocol
+type graphqlMessage struct {
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// graphqlRequest is the payload of a subscribe message
+type graphqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// graphqlEvent is an event as the schema's Event type
+type graphqlEvent struct {
+	id        uint64
+	eventType string
+	data      any
+}
+
+// graphqlOperationKey is the context key of the operation a resolver runs for
+type graphqlOperationKey struct{}
+
+// newGraphQLSchema returns the schema /graphql serves: a subscription to the
+// user's events, as /sse streams them
+//
+//	type Query { userID: String! }
+//	type Subscription { events(topics: [String!], lastEventId: ID): Event! }
+//	type Event { id: ID, type: String!, data: JSON }
+func newGraphQLSchema() (graphql.Schema, error) {
+	jsonScalar := graphql.NewScalar(graphql.ScalarConfig{
+		Name:        "JSON",
+		Description: "Any JSON value",
+		Serialize:   func(v any) any { return v },
+	})
+	eventType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Event",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{
+				Type:        graphql.ID,
+				Description: "The event's ID, null for the server's own notices",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					if ev := p.Source.(graphqlEvent); ev.id != 0 {
+						return strconv.FormatUint(ev.id, 10), nil
+					}
+					return nil, nil
+				},
+			},
+			"type": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(graphqlEvent).eventType, nil
+				},
+			},
+			"data": &graphql.Field{
+				Type: jsonScalar,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(graphqlEvent).data, nil
+				},
+			},
+		},
+	})
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Query",
+			Fields: graphql.Fields{
+				"userID": &graphql.Field{
+					Type:        graphql.NewNonNull(graphql.String),
+					Description: "The user the connection is authenticated as",
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						return p.Context.Value(graphqlOperationKey{}).(*graphqlOperation).conn.template.userID, nil
+					},
+				},
+			},
+		}),
+		Subscription: graphql.NewObject(graphql.ObjectConfig{
+			Name: "Subscription",
+			Fields: graphql.Fields{
+				"events": &graphql.Field{
+					Type:        graphql.NewNonNull(eventType),
+					Description: "The user's events on the topics, replaying those after lastEventId",
+					Args: graphql.FieldConfigArgument{
+						"topics":      &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+						"lastEventId": &graphql.ArgumentConfig{Type: graphql.ID},
+					},
+					Subscribe: func(p graphql.ResolveParams) (any, error) {
+						return p.Context.Value(graphqlOperationKey{}).(*graphqlOperation).subscribe(p.Args)
+					},
+					Resolve: func(p graphql.ResolveParams) (any, error) {
+						return p.Source, nil
+					},
+				},
+			},
+		}),
+	})
+}
+
+// graphqlConn is a client's GraphQL WebSocket. Each subscription operation
+// is a session of its own, opened like the connection's template.
+type graphqlConn struct {
+	conn   *websocket.Conn
+	schema graphql.Schema
+	// template is the session the upgrade request set up, which is never
+	// admitted itself
+	template  *session
+	lastSeen  uint64
+	requestID string
+
+	// writeMu serializes messages, which operations send concurrently
+	writeMu sync.Mutex
+
+	mu  sync.Mutex
+	ops map[string]*graphqlOperation
+	// running counts the operations still sending
+	running sync.WaitGroup
+}
+
+// graphqlOperation is one subscribe message being answered
+type graphqlOperation struct {
+	id     string
+	conn   *graphqlConn
+	ctx    context.Context
+	cancel context.CancelFunc
+	// s is the session of a subscription, once open
+	s *session
+}
+
+// serveGraphQL upgrades the request and answers the GraphQL operations the
+// client sends over it, as the user the request was authenticated as
+func serveGraphQL(c fiber.Ctx, schema graphql.Schema, template *session, lastSeen uint64) error {
+	// Fiber's strings point into the request buffer, which is reused
+	reqID := strings.Clone(requestID(c))
+	return graphqlUpgrader.Upgrade(c.RequestCtx(), func(conn *websocket.Conn) {
+		defer conn.Close()
+		gc := &graphqlConn{
+			conn:      conn,
+			schema:    schema,
+			template:  template,
+			lastSeen:  lastSeen,
+			requestID: reqID,
+			ops:       make(map[string]*graphqlOperation),
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		gc.serve(ctx)
+		// Ends every subscription, closing its session
+		cancel()
+		gc.running.Wait()
+	})
+}
+
+// serve reads the client's messages until it goes away or breaks the protocol
+func (gc *graphqlConn) serve(ctx context.Context) {
+	if gc.conn.Subprotocol() != graphqlProtocol {
+		gc.closeWith(graphqlBadProtocol, "Subprotocol not acceptable")
+		return
+	}
+	acked := false
+	_ = gc.conn.SetReadDeadline(time.Now().Add(graphqlInitTimeout))
+	for {
+		_, raw, err := gc.conn.ReadMessage()
+		if err != nil {
+			var nerr interface{ Timeout() bool }
+			if !acked && errors.As(err, &nerr) && nerr.Timeout() {
+				gc.closeWith(graphqlInitTimedOut, "Connection initialisation timeout")
+			}
+			return
+		}
+		var msg graphqlMessage
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			gc.closeWith(graphqlBadRequest, "Invalid message received")
+			return
+		}
+		switch msg.Type {
+		case "connection_init":
+			// The upgrade request was authenticated; the payload adds nothing
+			if acked {
+				gc.closeWith(graphqlDuplicateInits, "Too many initialisation requests")
+				return
+			}
+			acked = true
+			_ = gc.conn.SetReadDeadline(time.Time{})
+			gc.send(graphqlMessage{Type: "connection_ack"})
+		case "ping":
+			gc.send(graphqlMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			if !acked {
+				gc.closeWith(graphqlUnauthorized, "Unauthorized")
+				return
+			}
+			var req graphqlRequest
+			if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil {
+				gc.closeWith(graphqlBadRequest, "Invalid message received")
+				return
+			}
+			if !gc.start(ctx, msg.ID, req) {
+				gc.closeWith(graphqlDuplicateID, "Subscriber for "+msg.ID+" already exists")
+				return
+			}
+		case "complete":
+			gc.stop(msg.ID)
+		default:
+			gc.closeWith(graphqlBadRequest, "Invalid message received")
+			return
+		}
+	}
+}
+
+// start runs an operation, sending its results until it completes; false
+// means id is taken by a running one
+func (gc *graphqlConn) start(ctx context.Context, id string, req graphqlRequest) bool {
+	gc.mu.Lock()
+	defer gc.mu.Unlock()
+	if _, taken := gc.ops[id]; taken {
+		return false
+	}
+	op := &graphqlOperation{id: id, conn: gc}
+	op.ctx, op.cancel = context.WithCancel(ctx)
+	gc.ops[id] = op
+	params := graphql.Params{
+		Schema:         gc.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        context.WithValue(op.ctx, graphqlOperationKey{}, op),
+	}
+	gc.running.Add(1)
+	go func() {
+		defer gc.running.Done()
+		if isSubscription(req.Query, req.OperationName) {
+			op.forward(graphql.Subscribe(params))
+		} else {
+			results := make(chan *graphql.Result, 1)
+			results <- graphql.Do(params)
+			close(results)
+			op.forward(results)
+		}
+	}()
+	return true
+}
+
+// stop ends the operation id, at the client's request
+func (gc *graphqlConn) stop(id string) {
+	gc.mu.Lock()
+	op, ok := gc.ops[id]
+	delete(gc.ops, id)
+	gc.mu.Unlock()
+	if ok {
+		op.cancel()
+	}
+}
+
+// isSubscription reports whether the operation named in query is a
+// subscription; a query that doesn't parse is left to the executor to reject
+func isSubscription(query, operationName string) bool {
+	doc, err := parser.Parse(parser.ParseParams{Source: query})
+	if err != nil {
+		return false
+	}
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok || (operationName != "" && (op.Name == nil || op.Name.Value != operationName)) {
+			continue
+		}
+		return op.Operation == ast.OperationTypeSubscription
+	}
+	return false
+}
+
+// forward sends an operation's results until they run out, then completes it.
+// A result that fails before producing data is the operation's error.
+func (op *graphqlOperation) forward(results chan *graphql.Result) {
+	gc := op.conn
+	defer func() {
+		gc.mu.Lock()
+		if gc.ops[op.id] == op {
+			delete(gc.ops, op.id)
+		}
+		gc.mu.Unlock()
+		op.cancel()
+	}()
+	first := true
+	failed := false
+	// Results are drained even once the operation is cancelled, which the
+	// executor needs to stop
+	for res := range results {
+		if op.ctx.Err() != nil || failed {
+			continue
+		}
+		if first && res.Data == nil && res.HasErrors() {
+			payload, _ := json.Marshal(res.Errors)
+			gc.send(graphqlMessage{Type: "error", ID: op.id, Payload: payload})
+			failed = true
+			continue
+		}
+		first = false
+		payload, err := json.Marshal(res)
+		if err != nil {
+			gc.template.log.Error("GraphQL result encode error", "operationID", op.id, "error", err)
+			continue
+		}
+		if n, ok := gc.send(graphqlMessage{Type: "next", ID: op.id, Payload: payload}); ok && op.s != nil {
+			op.s.stats.wrote(n)
+		}
+	}
+	// An operation the client completed, or whose connection is gone, is not
+	// completed again
+	if op.ctx.Err() == nil && !failed {
+		gc.send(graphqlMessage{Type: "complete", ID: op.id})
+	}
+}
+
+// subscribe opens the session of an events subscription and streams it to
+// the channel the executor reads from
+func (op *graphqlOperation) subscribe(args map[string]any) (any, error) {
+	gc := op.conn
+	t := gc.template
+	topics := t.currentTopics()
+	if list, ok := args["topics"].([]any); ok {
+		topics = topics[:0]
+		for _, v := range list {
+			topics = append(topics, v.(string))
+		}
+	}
+	lastSeen := gc.lastSeen
+	if v, ok := args["lastEventId"].(string); ok {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, errors.New("lastEventId must be an event ID")
+		}
+		lastSeen = id
+	}
+
+	s := newSession(t.userID, topics, t.queue.capacity)
+	s.log = s.log.With("requestID", gc.requestID, "operationID", op.id)
+	s.setAuthExpiry(t.authExpiry())
+	s.clientIP = t.clientIP
+	s.userAgent = t.userAgent
+	s.metadata = t.metadata
+	s.labels = t.labels
+	s.payload = t.payload
+	s.cloudEvents = t.cloudEvents
+	var lerr *limitError
+	if err := currentBroker.sessions.admit(s, currentBroker.limits); errors.As(err, &lerr) {
+		return nil, errors.New(lerr.msg)
+	}
+	currentBroker.announce()
+	op.s = s
+
+	events := make(chan any)
+	go func() {
+		defer close(events)
+		streamSession(graphqlWriter{ctx: op.ctx, events: events, conn: gc}, s, lastSeen)
+	}()
+	go func() {
+		// Ends streamSession when the client completes the subscription
+		<-op.ctx.Done()
+		currentBroker.sessions.removeSession(s)
+	}()
+	return events, nil
+}
+
+// send writes msg to the client, returning its size and whether it was
+// written. A failed write closes the connection, which ends every operation.
+func (gc *graphqlConn) send(msg graphqlMessage) (int, bool) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, false
+	}
+	gc.writeMu.Lock()
+	defer gc.writeMu.Unlock()
+	_ = gc.conn.SetWriteDeadline(writeDeadline())
+	if err := gc.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+		gc.conn.Close()
+		return 0, false
+	}
+	return len(payload), true
+}
+
+// closeWith closes the connection with a graphql-transport-ws close code
+func (gc *graphqlConn) closeWith(code int, reason string) {
+	_ = gc.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteTimeout))
+}
+
+// graphqlWriter hands a subscription's events to the GraphQL executor,
+// which shapes them into results as the client's selection asks
+type graphqlWriter struct {
+	ctx    context.Context
+	events chan<- any
+	conn   *graphqlConn
+}
+
+func (gw graphqlWriter) write(id uint64, eventType string, data any) error {
+	select {
+	case gw.events <- graphqlEvent{id: id, eventType: eventType, data: data}:
+		return nil
+	case <-gw.ctx.Done():
+		return gw.ctx.Err()
+	}
+}
+
+// flush is a no-op: each event is sent as a message of its own
+func (gw graphqlWriter) flush() error {
+	return nil
+}
+
+// keepAlive sends a WebSocket ping, which clients answer without the
+// application seeing it
+func (gw graphqlWriter) keepAlive() error {
+	return gw.conn.conn.WriteControl(websocket.PingMessage, nil, writeDeadline())
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"cagrico/go-fiber-sse-user-channel/ssepb"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// grpcServer serves the Publisher API and, in cluster mode, the Cluster
+// service other instances forward publishes over
+type grpcServer struct {
+	ssepb.UnimplementedPublisherServer
+	ssepb.UnimplementedClusterServer
+	clusterSecret string
+	// streamAuth authenticates Subscribe calls
+	streamAuth authChain
+	audit      *auditLog
+	// drain turns Subscribe calls away while the instance drains
+	drain *drainer
+	// proxies finds the client behind a gRPC-aware load balancer
+	proxies trustedProxies
+}
+
+// startGRPCServer listens on cfg.GRPCAddr; it returns nil when gRPC is disabled
+func startGRPCServer(cfg config, streamAuth, publishAuth authChain, audit *auditLog, drain *drainer, proxies trustedProxies) (*grpc.Server, error) {
+	if cfg.GRPCAddr == "" {
+		return nil, nil
+	}
+	ln, err := listeners.listen(cfg.GRPCAddr)
+	if err != nil {
+		return nil, err
+	}
+	opts := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(16 << 20),
+		grpc.UnaryInterceptor(publishAuth.unaryInterceptor("/" + ssepb.Publisher_ServiceDesc.ServiceName + "/")),
+	}
+	// Pings at the keepalive interval find clients that vanished without
+	// closing their connection, as keepalives do on the other transports
+	if cfg.WriteTimeout > 0 && cfg.KeepAliveInterval > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    cfg.KeepAliveInterval,
+			Timeout: cfg.WriteTimeout,
+		}))
+	}
+	srv := grpc.NewServer(opts...)
+	gs := &grpcServer{clusterSecret: cfg.ClusterSecret, streamAuth: streamAuth, audit: audit, drain: drain, proxies: proxies}
+	ssepb.RegisterPublisherServer(srv, gs)
+	if cfg.Backplane == "cluster" {
+		ssepb.RegisterClusterServer(srv, gs)
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			logger.Error("gRPC server error", "error", err)
+		}
+	}()
+	logger.Info("gRPC listening", "addr", cfg.GRPCAddr)
+	return srv, nil
+}
+
+// stopGRPCServer waits up to timeout for in-flight calls before cutting them off
+func stopGRPCServer(srv *grpc.Server, timeout time.Duration) {
+	if srv == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		srv.Stop()
+	}
+}
+
+func (gs *grpcServer) Publish(ctx context.Context, r *ssepb.PublishRequest) (*ssepb.PublishResponse, error) {
+	resp, err := gs.publish(ctx, r)
+	if err != nil {
+		var perr *publishError
+		if errors.As(err, &perr) && (perr.status == 503 || perr.status == 429) {
+			return nil, status.Error(codes.ResourceExhausted, perr.msg)
+		}
+		if errors.As(err, &perr) && perr.status == 403 {
+			return nil, status.Error(codes.PermissionDenied, perr.msg)
+		}
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return resp, nil
+}
+
+func (gs *grpcServer) PublishBatch(ctx context.Context, r *ssepb.PublishBatchRequest) (*ssepb.PublishBatchResponse, error) {
+	results := make([]*ssepb.PublishBatchResult, len(r.Requests))
+	for i, req := range r.Requests {
+		resp, err := gs.publish(ctx, req)
+		if err != nil {
+			results[i] = &ssepb.PublishBatchResult{Error: err.Error()}
+			continue
+		}
+		results[i] = &ssepb.PublishBatchResult{Response: resp}
+	}
+	return &ssepb.PublishBatchResponse{Results: results}, nil
+}
+
+func (gs *grpcServer) publish(ctx context.Context, r *ssepb.PublishRequest) (resp *ssepb.PublishResponse, err error) {
+	id := grpcIdentity(ctx)
+	method, _ := grpc.Method(ctx)
+	ctx, span := startGRPCPublishSpan(ctx, method)
+	span.SetAttributes(attribute.String("sse.user_id", r.UserId), attribute.String("sse.topic", r.Topic))
+	defer func() {
+		ar := auditRecord{
+			Caller:     id.Subject,
+			AuthMethod: id.Method,
+			IP:         gs.clientIP(ctx),
+			Action:     method,
+			UserID:     r.UserId,
+			Topic:      r.Topic,
+			EventType:  cmp.Or(r.State, "current-value"),
+			Size:       len(r.Value),
+			Status:     200,
+		}
+		if resp != nil {
+			ar.EventID = resp.EventId
+			span.SetAttributes(attribute.Int64("sse.event_id", int64(resp.EventId)))
+		}
+		if err != nil {
+			ar.Status = 400
+			var perr *publishError
+			if errors.As(err, &perr) {
+				ar.Status = perr.status
+			}
+			ar.Error = err.Error()
+			failSpan(span, err)
+		}
+		span.End()
+		gs.audit.record(ar)
+	}()
+	if !id.Scope.allows(r.UserId, r.Topic) {
+		return nil, &publishError{status: 403, msg: "not allowed to publish to this user or topic"}
+	}
+	if d, ok := currentBroker.publishLimits.take(callerKey(id, gs.clientIP(ctx)), r.UserId); ok && !d.allowed {
+		return nil, &publishError{status: 429, msg: fmt.Sprintf("rate limit exceeded, retry in %s", d.retryAfter.Round(time.Millisecond))}
+	}
+	req := publishRequest{
+		UserID:         r.UserId,
+		Topic:          r.Topic,
+		Backpressure:   r.Backpressure,
+		Delivery:       r.Delivery,
+		TTLMs:          r.TtlMs,
+		Priority:       r.Priority,
+		IdempotencyKey: r.IdempotencyKey,
+		DelayMs:        r.DelayMs,
+		Value:          r.Value,
+		State:          r.State,
+		Labels:         r.Labels,
+		trace:          span.SpanContext(),
+	}
+	if r.DeliverAt != nil {
+		deliverAt := r.DeliverAt.AsTime()
+		req.DeliverAt = &deliverAt
+	}
+
+	out, err := req.submit()
+	if err != nil {
+		return nil, err
+	}
+	if out.Scheduled {
+		return &ssepb.PublishResponse{Scheduled: true, DeliverAt: timestamppb.New(out.DeliverAt)}, nil
+	}
+	res := out.Result
+	resp = &ssepb.PublishResponse{
+		EventId:       res.EventID,
+		Sent:          int32(res.Sent),
+		Dropped:       int32(res.Dropped),
+		Online:        res.Online,
+		QueuedOffline: res.QueuedOffline,
+		Throttled:     res.Throttled,
+		Duplicate:     out.Duplicate,
+	}
+	for _, sr := range res.Sessions {
+		resp.Sessions = append(resp.Sessions, &ssepb.SessionReport{SessionId: sr.SessionID, Status: sr.Status, Reason: sr.Reason})
+	}
+	return resp, nil
+}
+
+func (gs *grpcServer) Subscribe(r *ssepb.SubscribeRequest, stream grpc.ServerStreamingServer[ssepb.Event]) error {
+	id, err := gs.streamAuth.streamIdentity(grpcAuthRequest(stream.Context(), ssepb.Publisher_Subscribe_FullMethodName), r.UserId)
+	if err != nil {
+		return grpcAuthError(err)
+	}
+	userID := id.Subject
+	if userID == "" {
+		return status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	if refused, _ := gs.drain.refusing(); refused {
+		return status.Error(codes.Unavailable, "draining, connect to another instance")
+	}
+	if ban, banned := currentBroker.bans.check(userID); banned {
+		return status.Errorf(codes.PermissionDenied, "user is banned until %s", ban.Until.UTC().Format(time.RFC3339))
+	}
+	s := newSession(userID, r.Topics, currentBroker.sessionBuffer(int(r.Buffer)))
+	s.log = s.log.With("requestID", grpcRequestID(stream.Context()))
+	s.setAuthExpiry(id.ExpiresAt)
+	s.clientIP = gs.clientIP(stream.Context())
+	var presented string
+	if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+		if len(md.Get(payloadKeyHeader)) > 0 {
+			presented = md.Get(payloadKeyHeader)[0]
+		}
+		if ua := md.Get("user-agent"); len(ua) > 0 {
+			s.userAgent = ua[0]
+		}
+		s.metadata = currentBroker.sessionMetadata.fromGRPC(md)
+		s.labels = currentBroker.sessionLabels.fromGRPC(md, id)
+	} else {
+		s.labels = currentBroker.sessionLabels.withClaims(nil, id)
+	}
+	if s.payload, err = currentBroker.encryption.forStream(userID, presented); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := currentBroker.sessions.admit(s, currentBroker.limits); err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	currentBroker.announce()
+	// Unlike an SSE response, a stream learns of a gone client from its
+	// context; closing the session ends streamSession
+	go func() {
+		<-stream.Context().Done()
+		currentBroker.sessions.removeSession(s)
+	}()
+	streamSession(grpcWriter{stream: stream, stats: &s.stats}, s, r.LastEventId)
+	return nil
+}
+
+// grpcWriter writes a session's events to a Subscribe stream
+type grpcWriter struct {
+	stream grpc.ServerStreamingServer[ssepb.Event]
+	stats  *sessionStats
+}
+
+func (gw grpcWriter) write(id uint64, eventType string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		logger.Error("gRPC event encode error", "eventID", id, "eventType", eventType, "error", err)
+		return nil
+	}
+	msg := &ssepb.Event{Id: id, Type: eventType, Data: payload}
+	if err := gw.stream.Send(msg); err != nil {
+		return err
+	}
+	gw.stats.wrote(proto.Size(msg))
+	return nil
+}
+
+// flush is a no-op: Send hands each event to the transport
+func (gw grpcWriter) flush() error {
+	return nil
+}
+
+// keepAlive is a no-op: gRPC keeps its connections alive itself, with pings
+func (gw grpcWriter) keepAlive() error {
+	return nil
+}
+
+func (gs *grpcServer) Forward(ctx context.Context, r *ssepb.ForwardRequest) (*ssepb.ForwardResponse, error) {
+	if gs.clusterSecret != "" {
+		md, _ := metadata.FromIncomingContext(ctx)
+		got := md.Get("x-cluster-secret")
+		if len(got) != 1 || subtle.ConstantTimeCompare([]byte(got[0]), []byte(gs.clusterSecret)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "invalid cluster secret")
+		}
+	}
+	msg, err := backplaneMessageFromProto(r)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	currentBroker.receive(msg)
+	return &ssepb.ForwardResponse{}, nil
+}
+
+func forwardRequest(msg BackplaneMessage) (*ssepb.ForwardRequest, error) {
+	data, err := json.Marshal(msg.Event.Data)
+	if err != nil {
+		return nil, err
+	}
+	ev := &ssepb.ForwardedEvent{
+		Id:       msg.Event.ID,
+		Type:     msg.Event.Type,
+		Topic:    msg.Event.Topic,
+		Data:     data,
+		Priority: int32(msg.Event.Priority),
+	}
+	if !msg.Event.PublishedAt.IsZero() {
+		ev.PublishedAt = timestamppb.New(msg.Event.PublishedAt)
+	}
+	if !msg.Event.ExpiresAt.IsZero() {
+		ev.ExpiresAt = timestamppb.New(msg.Event.ExpiresAt)
+	}
+	return &ssepb.ForwardRequest{
+		Origin:      msg.Origin,
+		UserId:      msg.UserID,
+		Event:       ev,
+		Policy:      string(msg.Opts.Policy),
+		AtLeastOnce: msg.Opts.AtLeastOnce,
+		State:       string(msg.Opts.State),
+	}, nil
+}
+
+func backplaneMessageFromProto(r *ssepb.ForwardRequest) (BackplaneMessage, error) {
+	msg := BackplaneMessage{
+		Origin: r.Origin,
+		UserID: r.UserId,
+		Opts: publishOptions{
+			Policy:      backpressurePolicy(r.Policy),
+			AtLeastOnce: r.AtLeastOnce,
+			State:       stateMode(r.State),
+		},
+	}
+	if pe := r.Event; pe != nil {
+		msg.Event = event{ID: pe.Id, Type: pe.Type, Topic: pe.Topic, Priority: priority(pe.Priority)}
+		if len(pe.Data) > 0 {
+			if err := json.Unmarshal(pe.Data, &msg.Event.Data); err != nil {
+				return msg, err
+			}
+		}
+		if pe.PublishedAt != nil {
+			msg.Event.PublishedAt = pe.PublishedAt.AsTime()
+		}
+		if pe.ExpiresAt != nil {
+			msg.Event.ExpiresAt = pe.ExpiresAt.AsTime()
+		}
+	}
+	return msg, nil
+}
+
+// clientIP returns the address a call came from, behind any trusted
+// proxies, or "" if unknown
+func (gs *grpcServer) clientIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	ap, err := netip.ParseAddrPort(p.Addr.String())
+	if err != nil {
+		return ""
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := func(name string) string { return strings.Join(md.Get(name), ",") }
+	return gs.proxies.resolve(ap.Addr().Unmap(), gs.proxies.hops(values)).String()
+}
+
+// grpcRequestID is the caller's x-request-id metadata, or a fresh ID when it
+// sent none that is usable
+func grpcRequestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(requestIDHeader); len(v) > 0 && validRequestID(v[0]) {
+		return v[0]
+	}
+	return newRequestID()
+}
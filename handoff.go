@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// handoffTimeout is how long a restart waits for the new process to report
+// its listeners up before giving up on it
+const handoffTimeout = time.Minute
+
+// inheritedListenersEnv names, comma-separated, the listeners a process
+// hands the one it restarts into, as file descriptors from 3 in that order.
+// The descriptor after them is a pipe the new process writes to once it
+// serves.
+const inheritedListenersEnv = "SSE_INHERITED_LISTENERS"
+
+// listenerSet opens the server's listeners, taking over those the previous
+// process handed down on a restart, and hands them on in turn, so that no
+// connection is refused while one process replaces the other
+type listenerSet struct {
+	// reusePort opens TCP listeners with SO_REUSEPORT, so another process
+	// can listen on the same addresses
+	reusePort bool
+
+	mu sync.Mutex
+	// inherited are the listeners handed down and not yet claimed, by name
+	inherited map[string]net.Listener
+	// handoff is written to once this process serves; nil unless it was
+	// started by a restart
+	handoff *os.File
+	// names and open are the listeners opened or claimed, to hand on
+	names []string
+	open  []net.Listener
+}
+
+var listeners = &listenerSet{}
+
+// inherit takes the listeners handed down by the process that restarted
+// into this one, if any
+func (ls *listenerSet) inherit() error {
+	spec, ok := os.LookupEnv(inheritedListenersEnv)
+	if !ok {
+		return nil
+	}
+	// Not for the processes this one starts
+	_ = os.Unsetenv(inheritedListenersEnv)
+	ls.inherited = make(map[string]net.Listener)
+	names := splitList(spec)
+	for i, name := range names {
+		f := os.NewFile(uintptr(3+i), name)
+		ln, err := net.FileListener(f)
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("inherited listener %s: %w", name, err)
+		}
+		// Removed on close, as the socket this process would have created
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		ls.inherited[name] = ln
+	}
+	ls.handoff = os.NewFile(uintptr(3+len(names)), "handoff")
+	return nil
+}
+
+// claim returns the inherited listener on network and addr, if there is one
+func (ls *listenerSet) claim(network, addr string) (net.Listener, bool) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	name := network + ":" + addr
+	ln, ok := ls.inherited[name]
+	if !ok {
+		return nil, false
+	}
+	delete(ls.inherited, name)
+	return ls.addLocked(name, ln), true
+}
+
+// add records ln, opened on network and addr, to be handed on
+func (ls *listenerSet) add(network, addr string, ln net.Listener) net.Listener {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.addLocked(network+":"+addr, ln)
+}
+
+func (ls *listenerSet) addLocked(name string, ln net.Listener) net.Listener {
+	ls.names = append(ls.names, name)
+	ls.open = append(ls.open, ln)
+	return &onceClosedListener{Listener: ln}
+}
+
+// listen listens on a TCP address, or takes over the inherited listener on it
+func (ls *listenerSet) listen(addr string) (net.Listener, error) {
+	if ln, ok := ls.claim("tcp", addr); ok {
+		return ln, nil
+	}
+	lc := net.ListenConfig{}
+	if ls.reusePort {
+		lc.Control = reusePort
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return ls.add("tcp", addr, ln), nil
+}
+
+// ready closes the inherited listeners nothing claimed, those of addresses
+// no longer configured, and lets the previous process know this one serves
+func (ls *listenerSet) ready() {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	for name, ln := range ls.inherited {
+		logger.Info("Inherited listener not configured, closing", "listener", name)
+		_ = ln.Close()
+	}
+	ls.inherited = nil
+	if ls.handoff != nil {
+		_, _ = ls.handoff.Write([]byte{1})
+		_ = ls.handoff.Close()
+		ls.handoff = nil
+	}
+}
+
+// handOff starts the server's binary again, as it was started, handing it
+// the listeners, and returns once it serves. The executable is looked up
+// again, so a binary replaced on disk is the one started.
+func (ls *listenerSet) handOff() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for i, ln := range ls.open {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("listener %s can't be handed on", ls.names[i])
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("listener %s: %w", ls.names[i], err)
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+	fds := []uintptr{rawFD(os.Stdin), rawFD(os.Stdout), rawFD(os.Stderr)}
+	for _, f := range files {
+		fds = append(fds, rawFD(f))
+	}
+	fds = append(fds, rawFD(w))
+
+	// The new process owns the sockets from now on, so closing them here
+	// mustn't remove their files
+	ls.unlinkOnClose(false)
+	pid, _, err := syscall.StartProcess(path, os.Args, &syscall.ProcAttr{
+		Env:   append(handoffEnv(), inheritedListenersEnv+"="+strings.Join(ls.names, ",")),
+		Files: fds,
+	})
+	if err != nil {
+		ls.unlinkOnClose(true)
+		return err
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	_ = w.Close()
+	logger.Info("Restarting", "pid", pid, "listeners", len(ls.open))
+
+	_ = r.SetReadDeadline(time.Now().Add(handoffTimeout))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+		ls.unlinkOnClose(true)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return errors.New("new process not ready after " + handoffTimeout.String())
+		}
+		return errors.New("new process exited before it was ready")
+	}
+	go func() { _, _ = proc.Wait() }()
+	logger.Info("Restarted, handing over", "pid", pid)
+	return nil
+}
+
+// handoffEnv is the environment of the process restarted into: this one's,
+// but for systemd's watchdog PID, which the new process takes over
+func handoffEnv() []string {
+	return slices.DeleteFunc(os.Environ(), func(v string) bool { return strings.HasPrefix(v, "WATCHDOG_PID=") })
+}
+
+// rawFD is f's descriptor. Unlike f.Fd, it leaves the descriptor in
+// non-blocking mode, which a listener's duplicate shares with the listener:
+// a blocking listener would stall in Accept, and so in Close.
+func rawFD(f *os.File) uintptr {
+	var fd uintptr
+	if rc, err := f.SyscallConn(); err == nil {
+		_ = rc.Control(func(d uintptr) { fd = d })
+	}
+	return fd
+}
+
+// unlinkOnClose sets whether closing the unix sockets removes their files
+func (ls *listenerSet) unlinkOnClose(unlink bool) {
+	for _, ln := range ls.open {
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(unlink)
+		}
+	}
+}
+
+// onceClosedListener closes its listener once; closing it again, as server
+// shutdown does after a restart closed it early, does nothing
+type onceClosedListener struct {
+	net.Listener
+	once sync.Once
+	err  error
+}
+
+func (l *onceClosedListener) Close() error {
+	l.once.Do(func() { l.err = l.Listener.Close() })
+	return l.err
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// restartSignals restart the server, handing its listeners to a new process
+var restartSignals = []os.Signal{syscall.SIGUSR2}
+
+// reusePort sets SO_REUSEPORT on a listener's socket before it binds
+func reusePort(_, _ string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
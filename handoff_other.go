@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// restartSignals is empty: restarts hand listeners on only on Linux
+var restartSignals []os.Signal
+
+// reusePort is only available on Linux
+func reusePort(string, string, syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT not supported on this platform")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// eventHistory keeps the last events published to each user in the Store,
+// bounded by the retention rules, so reconnecting clients can catch up from
+// their Last-Event-ID
+type eventHistory struct {
+	store Store
+	rules retentionRules
+
+	// users with retained history, visited by the background trim
+	mu    sync.Mutex
+	users map[string]struct{}
+}
+
+func newEventHistory(store Store, rules retentionRules, trimEvery time.Duration) *eventHistory {
+	h := &eventHistory{
+		store: store,
+		rules: rules,
+		users: make(map[string]struct{}),
+	}
+	if h.enabled() && trimEvery > 0 {
+		go h.trim(trimEvery)
+	}
+	return h
+}
+
+func historyStream(userID string) string {
+	return "history:" + userID
+}
+
+func (h *eventHistory) enabled() bool {
+	return h.rules.defaults.MaxEvents > 0
+}
+
+func (h *eventHistory) append(userID string, ev event) {
+	if !h.enabled() {
+		return
+	}
+	ctx := context.Background()
+	stream := historyStream(userID)
+	if err := h.store.Append(ctx, stream, ev); err != nil {
+		logger.Error("History append error", "userID", userID, "error", err)
+		return
+	}
+	// The count limit is cheap to apply right away; the rest waits for trim
+	if err := h.store.Trim(ctx, stream, TrimOptions{MaxLen: h.rules.forUser(userID).MaxEvents}); err != nil {
+		logger.Error("History trim error", "userID", userID, "error", err)
+	}
+	h.mu.Lock()
+	h.users[userID] = struct{}{}
+	h.mu.Unlock()
+}
+
+// latest returns userID's most recent retained event; ok is false when
+// there is none
+func (h *eventHistory) latest(ctx context.Context, userID string) (ev event, ok bool, err error) {
+	if !h.enabled() {
+		return event{}, false, nil
+	}
+	stream := historyStream(userID)
+	id, err := h.store.LatestSeq(ctx, stream)
+	if err != nil || id == 0 {
+		return event{}, false, err
+	}
+	events, err := h.store.Range(ctx, stream, id-1, 1)
+	if err != nil || len(events) == 0 {
+		return event{}, false, err
+	}
+	return events[0], true, nil
+}
+
+// since returns userID's retained events newer than afterID, oldest first
+func (h *eventHistory) since(ctx context.Context, userID string, afterID uint64) ([]event, error) {
+	stream := historyStream(userID)
+	if afterID > 0 {
+		// Cheap check first: most reconnecting clients missed nothing
+		latest, err := h.store.LatestSeq(ctx, stream)
+		if err != nil || latest <= afterID {
+			return nil, err
+		}
+	}
+	events, err := h.store.Range(ctx, stream, afterID, 0)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	out := events[:0]
+	for _, ev := range events {
+		if !h.stale(userID, ev, now) {
+			out = append(out, ev)
+		}
+	}
+	return out, nil
+}
+
+// historyQuery filters and pages a user's history; zero fields are ignored
+type historyQuery struct {
+	// After continues from a previous page: only events with a higher ID are returned
+	After     uint64
+	Since     time.Time
+	EventType string
+	Topic     string
+	Limit     int
+}
+
+func (q historyQuery) matches(ev event) bool {
+	return (q.Since.IsZero() || !ev.PublishedAt.Before(q.Since)) &&
+		(q.EventType == "" || ev.Type == q.EventType) &&
+		(q.Topic == "" || ev.Topic == q.Topic)
+}
+
+// query returns up to q.Limit of userID's retained events matching q, oldest
+// first, and the cursor of the next page (0 when there is none)
+func (h *eventHistory) query(ctx context.Context, userID string, q historyQuery) ([]event, uint64, error) {
+	stream := historyStream(userID)
+	now := time.Now()
+	out := []event{}
+	after := q.After
+	for {
+		// Read a little past the limit so a full page can tell whether more follow
+		chunk, err := h.store.Range(ctx, stream, after, q.Limit+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ev := range chunk {
+			if h.stale(userID, ev, now) || !q.matches(ev) {
+				after = ev.ID
+				continue
+			}
+			if len(out) == q.Limit {
+				return out, out[len(out)-1].ID, nil
+			}
+			out = append(out, ev)
+			after = ev.ID
+		}
+		if len(chunk) <= q.Limit {
+			return out, 0, nil
+		}
+	}
+}
+
+func (h *eventHistory) stale(userID string, ev event, now time.Time) bool {
+	if ev.expired(now) {
+		return true
+	}
+	age := h.rules.maxAge(userID, ev)
+	return age > 0 && now.Sub(ev.PublishedAt) > age
+}
+
+// trim periodically enforces the retention rules on every user's history and
+// forgets users with none left
+func (h *eventHistory) trim(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		h.mu.Lock()
+		users := make([]string, 0, len(h.users))
+		for userID := range h.users {
+			users = append(users, userID)
+		}
+		h.mu.Unlock()
+
+		ctx := context.Background()
+		for _, userID := range users {
+			if err := h.trimUser(ctx, userID); err != nil {
+				logger.Error("History trim error", "userID", userID, "error", err)
+			}
+		}
+	}
+}
+
+func (h *eventHistory) trimUser(ctx context.Context, userID string) error {
+	stream := historyStream(userID)
+	events, err := h.store.Range(ctx, stream, 0, 0)
+	if err != nil {
+		return err
+	}
+	if len(events) == 0 {
+		h.mu.Lock()
+		delete(h.users, userID)
+		h.mu.Unlock()
+		return nil
+	}
+	drop := h.rules.overflow(userID, events, time.Now())
+	if len(drop) == 0 {
+		return nil
+	}
+	return h.store.Delete(ctx, stream, drop)
+}
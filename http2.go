@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+	"golang.org/x/net/http2"
+)
+
+// http2HandshakeTimeout bounds the TLS handshake, or the wait for the h2c
+// preface, before a connection is handed to a server
+const http2HandshakeTimeout = 10 * time.Second
+
+// http2Conns counts the open HTTP/2 connections, which Fiber doesn't see
+var http2Conns atomic.Int32
+
+// enableHTTP2 offers HTTP/2 in the TLS handshake, ahead of HTTP/1.1
+func enableHTTP2(tc *tls.Config) {
+	protos := tc.NextProtos
+	if len(protos) == 0 {
+		protos = []string{"http/1.1"}
+	}
+	tc.NextProtos = append([]string{http2.NextProtoTLS}, protos...)
+}
+
+// http2Listener splits a listener's connections by protocol. Those that
+// negotiate HTTP/2 over TLS, or open with the HTTP/2 preface in clear text
+// (h2c) when that is allowed, are served over HTTP/2; the rest, HTTP/1.1
+// and WebSocket upgrades among them, are accepted by Fiber as before.
+type http2Listener struct {
+	net.Listener
+	h2c    bool
+	server *http2Server
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newHTTP2Listener(ln net.Listener, server *http2Server, h2c bool) *http2Listener {
+	l := &http2Listener{Listener: ln, h2c: h2c, server: server, conns: make(chan net.Conn), closed: make(chan struct{})}
+	go l.run()
+	return l
+}
+
+func (l *http2Listener) run() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			l.Close()
+			return
+		}
+		go l.dispatch(conn)
+	}
+}
+
+// dispatch finds out which protocol conn speaks and hands it on
+func (l *http2Listener) dispatch(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(http2HandshakeTimeout))
+	h2 := false
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			_ = conn.Close()
+			return
+		}
+		h2 = tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS
+	} else if l.h2c {
+		pc := &peekedConn{Conn: conn, r: bufio.NewReader(conn)}
+		conn = pc
+		h2 = pc.startsWith(http2.ClientPreface)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	if h2 {
+		l.server.serve(conn)
+		return
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		_ = conn.Close()
+	}
+}
+
+func (l *http2Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting and sends the HTTP/2 connections a GOAWAY, so they
+// close once their streams have ended
+func (l *http2Listener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+		l.server.shutdown()
+	})
+	return err
+}
+
+// peekedConn is a connection whose first bytes were read to tell HTTP/2 from
+// HTTP/1.1; reads return them again
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (pc *peekedConn) Read(p []byte) (int, error) {
+	return pc.r.Read(p)
+}
+
+// startsWith reports whether the connection's first bytes are prefix,
+// reading only as far as they match
+func (pc *peekedConn) startsWith(prefix string) bool {
+	for n := 1; n <= len(prefix); n++ {
+		b, err := pc.r.Peek(n)
+		if err != nil || b[n-1] != prefix[n-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// http2Server serves HTTP/2 connections with the Fiber app, each request
+// on a fasthttp context of its own
+type http2Server struct {
+	app  *fiber.App
+	h2   *http2.Server
+	base *http.Server
+}
+
+func newHTTP2Server(cfg config, app *fiber.App) *http2Server {
+	s := &http2Server{app: app, base: &http.Server{}}
+	s.h2 = &http2.Server{
+		// Pings find connections that went away without closing, as
+		// keepalives do on HTTP/1.1
+		ReadIdleTimeout: cfg.KeepAliveInterval,
+		PingTimeout:     cfg.WriteTimeout,
+	}
+	s.base.Handler = s
+	// Registers the GOAWAY sent on shutdown
+	_ = http2.ConfigureServer(s.base, s.h2)
+	return s
+}
+
+func (s *http2Server) serve(conn net.Conn) {
+	http2Conns.Add(1)
+	defer http2Conns.Add(-1)
+	ctx := context.WithValue(context.Background(), http2ConnKey{}, conn)
+	s.h2.ServeConn(conn, &http2.ServeConnOpts{Context: ctx, BaseConfig: s.base, Handler: s})
+}
+
+func (s *http2Server) shutdown() {
+	_ = s.base.Shutdown(context.Background())
+}
+
+// http2ConnKey finds the connection a request came over in its context
+type http2ConnKey struct{}
+
+// hopHeaders are the HTTP/1.1 headers that mean nothing in HTTP/2, which
+// forbids them in a response
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Content-Length":    true,
+}
+
+// ServeHTTP runs the request through the Fiber app. A streamed response,
+// such as an SSE stream, is copied out as it is written, and ends when the
+// client resets the stream.
+func (s *http2Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fctx := &fasthttp.RequestCtx{}
+	conn := &http2StreamConn{Conn: r.Context().Value(http2ConnKey{}).(net.Conn), rc: http.NewResponseController(w)}
+	defer conn.finish()
+	if r.TLS != nil {
+		fctx.Init2(&http2TLSStreamConn{http2StreamConn: conn, state: *r.TLS}, fasthttpLogger{}, false)
+	} else {
+		fctx.Init2(conn, fasthttpLogger{}, false)
+	}
+
+	req := &fctx.Request
+	req.Header.SetMethod(r.Method)
+	req.SetRequestURI(r.URL.RequestURI())
+	req.Header.SetHost(r.Host)
+	for name, values := range r.Header {
+		for _, v := range values {
+			req.Header.Add(name, v)
+		}
+	}
+	if r.Body != nil {
+		limit := int64(s.app.Config().BodyLimit)
+		body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+		if err != nil {
+			return
+		}
+		if int64(len(body)) > limit {
+			http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.SetBodyRaw(body)
+	}
+
+	s.app.Handler()(fctx)
+
+	resp := &fctx.Response
+	resp.Header.VisitAll(func(name, value []byte) {
+		if !hopHeaders[http.CanonicalHeaderKey(string(name))] {
+			w.Header().Add(string(name), string(value))
+		}
+	})
+	if !resp.IsBodyStream() {
+		w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body())))
+		w.WriteHeader(resp.StatusCode())
+		_, _ = w.Write(resp.Body())
+		return
+	}
+	w.WriteHeader(resp.StatusCode())
+	_ = conn.rc.Flush()
+	// Closing the body, when the client resets the stream or a write fails,
+	// fails the stream writer's next write
+	body := resp.BodyStream()
+	if c, ok := body.(io.Closer); ok {
+		stop := context.AfterFunc(r.Context(), func() { _ = c.Close() })
+		defer stop()
+		defer c.Close()
+	}
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if ferr := conn.rc.Flush(); ferr != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// http2StreamConn stands in for the connection of an HTTP/2 request's
+// fasthttp context. Its addresses are the connection's; its write deadline
+// is the stream's, and the connection itself, shared with other streams, is
+// never read, written or closed.
+type http2StreamConn struct {
+	net.Conn
+	rc *http.ResponseController
+
+	mu sync.Mutex
+	// done is set once the handler returned, when the response can no longer
+	// be changed
+	done bool
+}
+
+func (c *http2StreamConn) Read([]byte) (int, error)        { return 0, io.EOF }
+func (c *http2StreamConn) Write([]byte) (int, error)       { return 0, errResponseClosed }
+func (c *http2StreamConn) Close() error                    { return nil }
+func (c *http2StreamConn) SetDeadline(t time.Time) error   { return c.SetWriteDeadline(t) }
+func (c *http2StreamConn) SetReadDeadline(time.Time) error { return nil }
+
+func (c *http2StreamConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done {
+		return nil
+	}
+	return c.rc.SetWriteDeadline(t)
+}
+
+func (c *http2StreamConn) finish() {
+	c.mu.Lock()
+	c.done = true
+	c.mu.Unlock()
+}
+
+// http2TLSStreamConn is an http2StreamConn over TLS, whose state the
+// authenticators read client certificates from
+type http2TLSStreamConn struct {
+	*http2StreamConn
+	state tls.ConnectionState
+}
+
+func (c *http2TLSStreamConn) Handshake() error                     { return nil }
+func (c *http2TLSStreamConn) ConnectionState() tls.ConnectionState { return c.state }
+
+// fasthttpLogger passes fasthttp's messages on to the log
+type fasthttpLogger struct{}
+
+func (fasthttpLogger) Printf(format string, args ...any) {
+	logger.Warn("HTTP/2 request error", "error", fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyCache remembers recent publishes by idempotency key so retried
+// requests don't deliver the same event twice
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	window  time.Duration
+	swept   time.Time
+}
+
+type idempotencyEntry struct {
+	// done is closed once result is set
+	done    chan struct{}
+	result  publishResult
+	expires time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		entries: make(map[string]*idempotencyEntry),
+		window:  window,
+	}
+}
+
+// begin claims key. The first caller gets first=true and must call finish;
+// later callers within the window get the same entry to wait on.
+func (ic *idempotencyCache) begin(key string) (e *idempotencyEntry, first bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	now := time.Now()
+	if now.Sub(ic.swept) > ic.window {
+		for k, e := range ic.entries {
+			if now.After(e.expires) {
+				delete(ic.entries, k)
+			}
+		}
+		ic.swept = now
+	}
+	if e, ok := ic.entries[key]; ok && now.Before(e.expires) {
+		return e, false
+	}
+	e = &idempotencyEntry{done: make(chan struct{}), expires: now.Add(ic.window)}
+	ic.entries[key] = e
+	return e, true
+}
+
+func (ic *idempotencyCache) finish(e *idempotencyEntry, result publishResult) {
+	e.result = result
+	close(e.done)
+}
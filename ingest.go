@@ -0,0 +1,246 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookTolerance is how old a signed Stripe delivery may be, as Stripe's
+// own libraries allow
+const webhookTolerance = 5 * time.Minute
+
+// webhookFields are the fields a webhook delivery adds: "header:<name>"
+var webhookFields = map[string]fieldArg{"header": nameArg}
+
+// webhookSource is a third-party service allowed to push events to
+// /ingest/webhook/<name>: how its deliveries are verified, and how each one
+// is mapped onto a publish
+type webhookSource struct {
+	name string
+	// verify is github, stripe, hmac-sha256 or token
+	verify string
+	secret []byte
+	// header carries the signature or token for hmac-sha256 and token
+	header string
+	user   messageField
+	// topic, when set, and id, when set, name the event's topic and the
+	// delivery, so a retried delivery is published once
+	topic messageField
+	id    messageField
+	// value is published as is, unless pick lists the paths of the body to
+	// publish, keyed by path
+	value messageField
+	pick  []string
+}
+
+// newIngestedDelivery prepares a delivery for mapping onto a publish
+func newIngestedDelivery(header func(string) string, body []byte) *mappedMessage {
+	return newMappedMessage(func(f messageField) any {
+		if v := header(f.name); v != "" {
+			// Copied out of the request buffer, which Fiber reuses
+			return strings.Clone(v)
+		}
+		return nil
+	}, body)
+}
+
+// parseWebhookSources parses ";"-separated sources, each a name followed by
+// key=value settings, e.g. "github verify=github secret=s3cret
+// user=json:sender.login topic=header:X-GitHub-Event". Like publish scopes,
+// an invalid source is an error rather than skipped.
+func parseWebhookSources(spec string) (map[string]*webhookSource, error) {
+	sources := make(map[string]*webhookSource)
+	for rule := range strings.SplitSeq(spec, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+		if _, dup := sources[name]; dup {
+			return nil, fmt.Errorf("webhook source %q is defined more than once", name)
+		}
+		ws := &webhookSource{name: name, value: messageField{kind: "message", index: -1}}
+		for _, f := range fields[1:] {
+			key, value, _ := strings.Cut(f, "=")
+			var err error
+			switch key {
+			case "verify":
+				ws.verify = value
+			case "secret":
+				ws.secret = []byte(value)
+			case "header":
+				ws.header = value
+			case "user":
+				ws.user, err = parseMessageField(value, webhookFields)
+			case "topic":
+				ws.topic, err = parseMessageField(value, webhookFields)
+			case "id":
+				ws.id, err = parseMessageField(value, webhookFields)
+			case "value":
+				if paths, ok := strings.CutPrefix(value, "pick:"); ok {
+					ws.pick = splitList(paths)
+					if len(ws.pick) == 0 {
+						err = errors.New("pick lists nothing")
+					}
+				} else {
+					ws.value, err = parseMessageField(value, webhookFields)
+				}
+			default:
+				err = fmt.Errorf("unknown setting %q", key)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("webhook source %q: %s: %w", name, key, err)
+			}
+		}
+		if err := ws.defaults(); err != nil {
+			return nil, fmt.Errorf("webhook source %q: %w", name, err)
+		}
+		sources[name] = ws
+	}
+	return sources, nil
+}
+
+// defaults fills in what the verification scheme implies and checks that
+// the source can be verified and mapped
+func (ws *webhookSource) defaults() error {
+	switch ws.verify {
+	case "github":
+		if ws.id.kind == "" {
+			ws.id = messageField{kind: "header", name: "X-GitHub-Delivery", index: -1}
+		}
+	case "stripe":
+		if ws.id.kind == "" {
+			ws.id = messageField{kind: "json", name: "id", index: -1}
+		}
+	case "hmac-sha256":
+		ws.header = cmp.Or(ws.header, "X-Signature")
+	case "token":
+		ws.header = cmp.Or(ws.header, "X-Webhook-Token")
+	default:
+		return errors.New("verify must be github, stripe, hmac-sha256 or token")
+	}
+	if len(ws.secret) == 0 {
+		return errors.New("secret is required")
+	}
+	if ws.user.kind == "" {
+		return errors.New("user is required")
+	}
+	return nil
+}
+
+// authenticate checks that a delivery comes from the source, by its
+// signature of the body or its token
+func (ws *webhookSource) authenticate(header func(string) string, body []byte, now time.Time) error {
+	switch ws.verify {
+	case "github":
+		return ws.checkHMAC(strings.TrimPrefix(header("X-Hub-Signature-256"), "sha256="), body)
+	case "hmac-sha256":
+		return ws.checkHMAC(strings.TrimPrefix(header(ws.header), "sha256="), body)
+	case "stripe":
+		return ws.checkStripe(header("Stripe-Signature"), body, now)
+	}
+	if subtle.ConstantTimeCompare([]byte(header(ws.header)), ws.secret) != 1 {
+		return errors.New("invalid token")
+	}
+	return nil
+}
+
+// checkHMAC checks a hex HMAC-SHA256 of signed under the secret
+func (ws *webhookSource) checkHMAC(signature string, signed ...[]byte) error {
+	if signature == "" {
+		return errors.New("missing signature")
+	}
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return errors.New("invalid signature")
+	}
+	h := hmac.New(sha256.New, ws.secret)
+	for _, part := range signed {
+		h.Write(part)
+	}
+	if !hmac.Equal(sig, h.Sum(nil)) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// checkStripe checks a Stripe-Signature header, "t=<unix time>,v1=<hex>",
+// which signs the time and the body and may carry several v1 signatures
+// while a secret is rolled
+func (ws *webhookSource) checkStripe(header string, body []byte, now time.Time) error {
+	var timestamp string
+	var signatures []string
+	for part := range strings.SplitSeq(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errors.New("missing signature")
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return errors.New("timestamp too far from now")
+	}
+	for _, sig := range signatures {
+		if ws.checkHMAC(sig, []byte(timestamp+"."), body) == nil {
+			return nil
+		}
+	}
+	return errors.New("invalid signature")
+}
+
+// publishRequest maps a verified delivery onto a publish
+func (ws *webhookSource) publishRequest(header func(string) string, body []byte) (publishRequest, error) {
+	d := newIngestedDelivery(header, body)
+	userID, err := d.text(ws.user)
+	if err == nil && userID == "" {
+		err = errors.New("no userID")
+	}
+	if err != nil {
+		return publishRequest{}, err
+	}
+	req := publishRequest{UserID: userID}
+	if req.Topic, err = d.text(ws.topic); err != nil {
+		return publishRequest{}, err
+	}
+	id, err := d.text(ws.id)
+	if err != nil {
+		return publishRequest{}, err
+	}
+	if id != "" {
+		// Providers retry deliveries they think failed
+		req.IdempotencyKey = "webhook:" + ws.name + ":" + id
+	}
+
+	var value any
+	if len(ws.pick) > 0 {
+		if d.bodyErr != nil {
+			return publishRequest{}, fmt.Errorf("body is not JSON: %w", d.bodyErr)
+		}
+		picked := make(map[string]any, len(ws.pick))
+		for _, path := range ws.pick {
+			picked[path] = jsonPath(d.body, path)
+		}
+		value = picked
+	} else if value, err = d.value(ws.value); err != nil {
+		return publishRequest{}, err
+	}
+	if req.Value, err = json.Marshal(value); err != nil {
+		return publishRequest{}, err
+	}
+	return req, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// ipList is a set of address ranges, given as CIDRs or single addresses
+type ipList []netip.Prefix
+
+func parseIPList(spec string) (ipList, error) {
+	var l ipList
+	for _, entry := range splitList(spec) {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			l = append(l, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q", entry)
+		}
+		l = append(l, p.Masked())
+	}
+	return l, nil
+}
+
+func (l ipList) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range l {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipRule decides which clients may call a group of routes. A denied address
+// is refused even when it is also allowed; an empty allow list allows every
+// address that isn't denied.
+type ipRule struct {
+	allow ipList
+	deny  ipList
+}
+
+func (r ipRule) allows(addr netip.Addr) bool {
+	if r.deny.contains(addr) {
+		return false
+	}
+	return len(r.allow) == 0 || r.allow.contains(addr)
+}
+
+func newIPRule(allow, deny string) (ipRule, error) {
+	a, err := parseIPList(allow)
+	if err != nil {
+		return ipRule{}, err
+	}
+	d, err := parseIPList(deny)
+	if err != nil {
+		return ipRule{}, err
+	}
+	return ipRule{allow: a, deny: d}, nil
+}
+
+// ipFilter applies an ipRule to each group of routes: the stream routes
+// browsers call, publishing, and the admin routes that read or manage the
+// broker. /health is left open for load balancers.
+type ipFilter struct {
+	stream  ipRule
+	publish ipRule
+	admin   ipRule
+}
+
+func newIPFilter(cfg config) (*ipFilter, error) {
+	f := &ipFilter{}
+	var err error
+	if f.stream, err = newIPRule(cfg.StreamAllowIPs, cfg.StreamDenyIPs); err != nil {
+		return nil, fmt.Errorf("stream routes: %w", err)
+	}
+	if f.publish, err = newIPRule(cfg.PublishAllowIPs, cfg.PublishDenyIPs); err != nil {
+		return nil, fmt.Errorf("publish routes: %w", err)
+	}
+	if f.admin, err = newIPRule(cfg.AdminAllowIPs, cfg.AdminDenyIPs); err != nil {
+		return nil, fmt.Errorf("admin routes: %w", err)
+	}
+	return f, nil
+}
+
+// publishRoute reports whether path publishes events
+func publishRoute(path string) bool {
+	return path == "/send-to-user" || strings.HasPrefix(path, "/ingest/webhook/")
+}
+
+func (f *ipFilter) rule(path string) ipRule {
+	switch {
+	case streamRoute(path):
+		return f.stream
+	case publishRoute(path):
+		return f.publish
+	}
+	return f.admin
+}
+
+// middleware refuses clients outside the rule of the route group with 403
+func (f *ipFilter) middleware() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if probeRoute(c.Path()) {
+			return c.Next()
+		}
+		// Clients of a unix socket have no address to check, unless the
+		// proxy in front passed one on
+		if _, ok := c.Locals("clientIP").(string); !ok && unixClient(c) {
+			return c.Next()
+		}
+		addr, err := netip.ParseAddr(clientIP(c))
+		if err != nil || !f.rule(c.Path()).allows(addr) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "address not allowed"})
+		}
+		return c.Next()
+	}
+}
+
+// trustedProxies finds the client's address behind the reverse proxies in
+// front of the server. The forwarding header is only believed when the
+// connection comes from one of them, and it is read from the right, as
+// everything left of the last proxy's entry could be made up by the client.
+type trustedProxies struct {
+	// headers are tried in order; the first the proxy sent names the client
+	headers []string
+	proxies ipList
+}
+
+func newTrustedProxies(cfg config) (trustedProxies, error) {
+	l, err := parseIPList(cfg.TrustedProxies)
+	if err != nil {
+		return trustedProxies{}, fmt.Errorf("trusted proxies: %w", err)
+	}
+	headers := splitList(cfg.ProxyHeader)
+	if len(l) > 0 && len(headers) == 0 {
+		return trustedProxies{}, errors.New("trusted proxies need a header to read the client's address from")
+	}
+	return trustedProxies{headers: headers, proxies: l}, nil
+}
+
+// hops returns the addresses in the first forwarding header that values
+// finds, nearest the client first. values returns every line of a header,
+// joined with commas.
+func (tp trustedProxies) hops(values func(name string) string) []string {
+	for _, name := range tp.headers {
+		v := values(name)
+		if v == "" {
+			continue
+		}
+		hops := strings.Split(v, ",")
+		// Forwarded: for=192.0.2.60;proto=http, for="[2001:db8::1]:4711"
+		if strings.EqualFold(name, "Forwarded") {
+			for i, hop := range hops {
+				hops[i] = ""
+				for _, param := range strings.Split(hop, ";") {
+					if k, v, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.EqualFold(k, "for") {
+						hops[i] = v
+					}
+				}
+			}
+		}
+		return hops
+	}
+	return nil
+}
+
+// parseHop reads one address of a forwarding header, which may be quoted, in
+// brackets, or carry a port
+func parseHop(hop string) (netip.Addr, error) {
+	hop = strings.Trim(strings.TrimSpace(hop), `"`)
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]"))
+	return addr.Unmap(), err
+}
+
+// resolve returns the client's address given the connection's remote address
+// and the hops of the forwarding header
+func (tp trustedProxies) resolve(remote netip.Addr, hops []string) netip.Addr {
+	if !tp.proxies.contains(remote) {
+		return remote
+	}
+	return tp.forwardedFor(remote, hops)
+}
+
+// forwardedFor returns the client's address in the forwarding header a
+// trusted proxy at remote sent
+func (tp trustedProxies) forwardedFor(remote netip.Addr, hops []string) netip.Addr {
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseHop(hops[i])
+		if err != nil {
+			// The nearest address anyone vouched for; obfuscated and
+			// "unknown" entries end the search too
+			return client
+		}
+		client = addr
+		if !tp.proxies.contains(client) {
+			return client
+		}
+	}
+	return client
+}
+
+// middleware stores the client's address for clientIP
+func (tp trustedProxies) middleware() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		values := func(name string) string {
+			var lines []string
+			for _, v := range c.Request().Header.PeekAll(name) {
+				lines = append(lines, string(v))
+			}
+			return strings.Join(lines, ",")
+		}
+		// Only a proxy on this host reaches a unix socket, so its header is
+		// believed
+		if unixClient(c) {
+			if client := tp.forwardedFor(netip.Addr{}, tp.hops(values)); client.IsValid() {
+				c.Locals("clientIP", client.String())
+			}
+			return c.Next()
+		}
+		if len(tp.proxies) > 0 {
+			remote, ok := netip.AddrFromSlice(c.RequestCtx().RemoteIP())
+			if ok {
+				c.Locals("clientIP", tp.resolve(remote.Unmap(), tp.hops(values)).String())
+			}
+		}
+		return c.Next()
+	}
+}
+
+// clientIP is the address of the client, behind any trusted proxies
+func clientIP(c fiber.Ctx) string {
+	if ip, ok := c.Locals("clientIP").(string); ok {
+		return ip
+	}
+	return c.IP()
+}
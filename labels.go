@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+	"google.golang.org/grpc/metadata"
+)
+
+// labelSelector targets a publish at the sessions carrying every one of its
+// labels, such as region=eu and plan=pro; an empty selector matches all
+type labelSelector map[string]string
+
+// matches reports whether labels has every label of the selector
+func (ls labelSelector) matches(labels map[string]string) bool {
+	for k, v := range ls {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionLabeler tags sessions at connect, from the query parameters and
+// token claims allowed, so publishes can select them by label. A claim wins
+// over a query parameter of the same name, as only the claim is vouched for
+// by the token.
+type sessionLabeler struct {
+	query  []string
+	claims []string
+}
+
+func newSessionLabeler(cfg config) sessionLabeler {
+	return sessionLabeler{query: splitList(cfg.SessionLabelsQuery), claims: splitList(cfg.SessionLabelsClaims)}
+}
+
+// fromHTTP reads the labels of a stream opened over HTTP; it returns nil
+// when there are none
+func (sl sessionLabeler) fromHTTP(c fiber.Ctx, id Identity) map[string]string {
+	var labels map[string]string
+	for _, q := range sl.query {
+		labels = setSessionMetadata(labels, q, c.Query(q))
+	}
+	return sl.withClaims(labels, id)
+}
+
+// fromGRPC reads the labels of a gRPC stream, the allowed query parameters
+// being taken from its metadata
+func (sl sessionLabeler) fromGRPC(md metadata.MD, id Identity) map[string]string {
+	var labels map[string]string
+	for _, q := range sl.query {
+		if vs := md.Get(q); len(vs) > 0 {
+			labels = setSessionMetadata(labels, q, vs[0])
+		}
+	}
+	return sl.withClaims(labels, id)
+}
+
+func (sl sessionLabeler) withClaims(labels map[string]string, id Identity) map[string]string {
+	for _, name := range sl.claims {
+		if v, ok := claimLabel(id.Claims[name]); ok {
+			labels = setSessionMetadata(labels, name, v)
+		} else if labels != nil {
+			// The token is silent, so the client doesn't get to say either
+			delete(labels, name)
+		}
+	}
+	return labels
+}
+
+// claimLabel turns a scalar claim into a label value
+func claimLabel(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// parseLabelSelector checks a publish's selector
+func parseLabelSelector(labels map[string]string) (labelSelector, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	for k := range labels {
+		if strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("label names must not be empty")
+		}
+	}
+	return labelSelector(labels), nil
+}
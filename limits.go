@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// limitPolicy decides what happens when a new connection would exceed a limit
+type limitPolicy string
+
+const (
+	rejectNew   limitPolicy = "reject"
+	closeOldest limitPolicy = "close-oldest"
+)
+
+func parseLimitPolicy(v string) (limitPolicy, bool) {
+	switch p := limitPolicy(v); p {
+	case rejectNew, closeOldest:
+		return p, true
+	}
+	return "", false
+}
+
+// connectionLimits caps the sessions one user and one client IP may hold at a
+// time, so a client reconnecting in a loop can't exhaust the server
+type connectionLimits struct {
+	// perUser and perIP are the caps (0 means unlimited)
+	perUser int
+	perIP   int
+	policy  limitPolicy
+
+	rejected atomic.Uint64
+	closed   atomic.Uint64
+}
+
+func newConnectionLimits(cfg config) *connectionLimits {
+	return &connectionLimits{
+		perUser: cfg.MaxSessionsPerUser,
+		perIP:   cfg.MaxConnectionsPerIP,
+		policy:  cfg.ConnectionLimitPolicy,
+	}
+}
+
+// limitError refuses a connection over a limit; status is the HTTP status
+type limitError struct {
+	status int
+	msg    string
+}
+
+func (e *limitError) Error() string { return e.msg }
+
+// admit adds s to the sessions unless that would put its user or client IP
+// over a limit. Under close-oldest, the oldest sessions in the way are
+// evicted instead.
+func (sl *sessionsLock) admit(s *session, limits *connectionLimits) error {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+
+	var byUser, byIP []*session
+	for _, other := range sl.sessions {
+		if other == nil {
+			continue
+		}
+		select {
+		case <-other.done:
+			// Closed and on its way out
+			continue
+		default:
+		}
+		if other.userID == s.userID {
+			byUser = append(byUser, other)
+		}
+		if s.clientIP != "" && other.clientIP == s.clientIP {
+			byIP = append(byIP, other)
+		}
+	}
+	overUser := limits.perUser > 0 && len(byUser) >= limits.perUser
+	overIP := limits.perIP > 0 && len(byIP) >= limits.perIP
+
+	if limits.policy == rejectNew {
+		switch {
+		case overIP:
+			limits.rejected.Add(1)
+			return &limitError{status: 429, msg: fmt.Sprintf("too many connections from this address (max %d)", limits.perIP)}
+		case overUser:
+			limits.rejected.Add(1)
+			return &limitError{status: 409, msg: fmt.Sprintf("user already has the maximum of %d sessions", limits.perUser)}
+		}
+	} else {
+		// Sessions are kept in the order they connected, so the first are the oldest
+		if overUser {
+			limits.closeOldest(byUser[:len(byUser)-limits.perUser+1], "replaced by a newer session of the user")
+		}
+		if overIP {
+			limits.closeOldest(byIP[:len(byIP)-limits.perIP+1], "replaced by a newer connection from the same address")
+		}
+	}
+	sl.sessions = append(sl.sessions, s)
+	sl.notifyChanged(s, true)
+	return nil
+}
+
+func (limits *connectionLimits) closeOldest(sessions []*session, reason string) {
+	for _, s := range sessions {
+		if s.evictAs("session-replaced", reason) {
+			limits.closed.Add(1)
+			s.log.Info("Session replaced", "ip", s.clientIP)
+		}
+	}
+}
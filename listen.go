@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// openListeners opens a listener on each of the comma-separated addrs: a TCP
+// address such as "127.0.0.1:9091", or "unix:" and the path of a socket,
+// created with mode. With tc, they serve TLS. When one fails, the ones
+// already open are closed.
+func openListeners(addrs string, tc *tls.Config, mode fs.FileMode) ([]net.Listener, error) {
+	var lns []net.Listener
+	for _, addr := range splitList(addrs) {
+		ln, err := listenAddr(addr, mode)
+		if err != nil {
+			for _, ln := range lns {
+				_ = ln.Close()
+			}
+			return nil, err
+		}
+		if tc != nil {
+			ln = tls.NewListener(ln, tc)
+		}
+		lns = append(lns, ln)
+	}
+	if len(lns) == 0 {
+		return nil, errors.New("no address to listen on")
+	}
+	return lns, nil
+}
+
+// listenAddr listens on addr, or takes over the listener a restart handed
+// down for it
+func listenAddr(addr string, mode fs.FileMode) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return listeners.listen(addr)
+	}
+	if ln, ok := listeners.claim("unix", path); ok {
+		return ln, nil
+	}
+	// A socket left behind by an earlier run would make Listen fail
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return listeners.add("unix", path, ln), nil
+}
+
+// unixClient reports whether the request came over a unix socket, which only
+// processes on this host can reach
+func unixClient(c fiber.Ctx) bool {
+	_, ok := c.RequestCtx().RemoteAddr().(*net.UnixAddr)
+	return ok
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// logger is what the server logs through. It writes JSON to stderr until
+// setupLogging applies SSE_LOG_FORMAT and SSE_LOG_LEVEL.
+var logger = slog.New(slog.NewJSONHandler(os.Stderr, nil))
+
+// logLevel is the least severe level logged, which a config reload can change
+var logLevel = new(slog.LevelVar)
+
+// logHandlers are the formats SSE_LOG_FORMAT can name. An application
+// embedding the server plugs in its own handler by adding it here; the
+// options carry the level from SSE_LOG_LEVEL.
+var logHandlers = map[string]func(w io.Writer, opts *slog.HandlerOptions) slog.Handler{
+	"json": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, opts) },
+	"text": func(w io.Writer, opts *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, opts) },
+}
+
+// setupLogging replaces logger with one in cfg.LogFormat. It also becomes
+// slog's default, so that libraries logging through the log package are
+// formatted the same.
+func setupLogging(cfg config) error {
+	newHandler, ok := logHandlers[cfg.LogFormat]
+	if !ok {
+		return fmt.Errorf("unknown log format %q", cfg.LogFormat)
+	}
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	logger = slog.New(newHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	slog.SetDefault(logger)
+	return nil
+}
+
+func parseLogLevel(v string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(v)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", v)
+	}
+	return level, nil
+}
+
+// fatal logs err and exits, for failures the server can't start or stop without
+func fatal(msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// requestIDHeader carries the ID that ties a request's log lines together
+const requestIDHeader = "X-Request-ID"
+
+// requestIDs gives each request an ID, the caller's own if it sent a usable
+// one, and echoes it in the response
+func requestIDs() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		id := c.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Locals("requestID", id)
+		c.Set(requestIDHeader, id)
+		return c.Next()
+	}
+}
+
+// validRequestID accepts up to 128 printable ASCII characters, which keeps
+// log lines readable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestID returns the ID requestIDs gave c
+func requestID(c fiber.Ctx) string {
+	id, _ := c.Locals("requestID").(string)
+	return id
+}
+
+// requestLogger logs with c's request ID
+func requestLogger(c fiber.Ctx) *slog.Logger {
+	return logger.With("requestID", requestID(c))
+}
@@ -3,108 +3,508 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/fasthttp/websocket"
 	"github.com/gofiber/fiber/v3"
-	"github.com/gofiber/fiber/v3/middleware/cors"
 	"github.com/gofiber/fiber/v3/middleware/recover"
-	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"net"
 	"os"
 	"os/signal"
 	"runtime"
 	"slices"
+	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
-// session represents a single SSE connection for a user
-type session struct {
-	stateChannel chan interface{}
-	userID       string
-}
+func main() {
+	flags, err := parseFlags(os.Args[1:])
+	if err != nil {
+		fatal("Invalid command line", err)
+	}
+	configFile, err := openConfigFile(flags)
+	if err != nil {
+		fatal("Config file failed to load", err)
+	}
+	cfg := loadConfig()
+	if err := configFile.check(); err != nil {
+		fatal("Invalid settings", err)
+	}
+	if err := setupLogging(cfg); err != nil {
+		fatal("Logging setup failed", err)
+	}
+	if err := setupMemory(cfg); err != nil {
+		fatal("Memory setup failed", err)
+	}
+	cfg, err = preforkConfig(cfg)
+	if err != nil {
+		fatal("Prefork setup failed", err)
+	}
+	// Before anything listens, so the listeners a restart handed down are
+	// taken over rather than opened again
+	listeners.reusePort = cfg.ReusePort
+	if err := listeners.inherit(); err != nil {
+		fatal("Restart failed", err)
+	}
+	stopTracing, err := setupTracing(cfg)
+	if err != nil {
+		fatal("Tracing setup failed", err)
+	}
+	if err := setupErrorReporting(cfg); err != nil {
+		fatal("Error reporting setup failed", err)
+	}
+	store, err := newStore(cfg)
+	if err != nil {
+		fatal("Store setup failed", err)
+	}
+	wal, unsettled, err := openWriteAheadLog(cfg.WALFile, cfg.WALFsync)
+	if err != nil {
+		fatal("Write-ahead log setup failed", err)
+	}
+	backplane, err := newBackplane(cfg)
+	if err != nil {
+		fatal("Backplane setup failed", err)
+	}
+	replication, err := newReplicator(cfg)
+	if err != nil {
+		fatal("Replication setup failed", err)
+	}
+	currentBroker = newBroker(cfg, store, wal, backplane, replication)
+	if currentBroker.push, err = newPushFallback(cfg, store, currentBroker.nextEventID); err != nil {
+		fatal("Push setup failed", err)
+	}
+	if err := currentBroker.bans.load(context.Background()); err != nil {
+		logger.Error("Bans load error", "error", err)
+	}
+	if err := currentBroker.listen(context.Background()); err != nil {
+		fatal("Backplane subscribe failed", err)
+	}
+	currentBroker.republish(unsettled, cfg.WALReplayDelay)
+	alerts := newAlerter(cfg, currentBroker)
+	exports := newExporter(cfg)
 
-// sessionsLock stores and manages all active sessions
-type sessionsLock struct {
-	MU       sync.Mutex
-	sessions []*session
-}
+	// Kafka, Redis, Postgres, MQTT, AMQP, SQS and Pub/Sub, as configured
+	sources, err := newSourceSupervisor(cfg)
+	if err != nil {
+		fatal("Source setup failed", err)
+	}
+	sources.start(publishFromSource)
 
-func (sl *sessionsLock) addSession(s *session) {
-	sl.MU.Lock()
-	defer sl.MU.Unlock()
-	sl.sessions = append(sl.sessions, s)
-}
+	streamAuth, err := newAuthChain(cfg, cfg.StreamAuth)
+	if err != nil {
+		fatal("Stream authentication setup failed", err)
+	}
+	publishAuth, err := newAuthChain(cfg, cfg.PublishAuth)
+	if err != nil {
+		fatal("Publish authentication setup failed", err)
+	}
 
-func (sl *sessionsLock) removeSession(s *session) {
-	sl.MU.Lock()
-	defer sl.MU.Unlock()
-	idx := slices.Index(sl.sessions, s)
-	if idx != -1 {
-		if sl.sessions[idx].stateChannel != nil {
-			close(sl.sessions[idx].stateChannel)
-		}
-		sl.sessions[idx] = nil
-		sl.sessions = slices.Delete(sl.sessions, idx, idx+1)
+	audit, err := newAuditLog(cfg)
+	if err != nil {
+		fatal("Audit log setup failed", err)
 	}
-}
 
-func (sl *sessionsLock) closeAllSessions() {
-	sl.MU.Lock()
-	defer sl.MU.Unlock()
-	for _, s := range sl.sessions {
-		if s != nil && s.stateChannel != nil {
-			close(s.stateChannel)
-		}
+	ready := newReadiness(cfg, store, backplane, sources)
+	drain := newDrainer(cfg, ready, currentBroker)
+
+	proxies, err := newTrustedProxies(cfg)
+	if err != nil {
+		fatal("Proxy setup failed", err)
+	}
+	grpcServer, err := startGRPCServer(cfg, streamAuth, publishAuth, audit, drain, proxies)
+	if err != nil {
+		fatal("gRPC server failed to start", err)
 	}
-	sl.sessions = nil
-}
 
-var currentSessions sessionsLock
+	cors, err := newCORSRoutes(cfg.streamCORS(), cfg.apiCORS())
+	if err != nil {
+		fatal("CORS setup failed", err)
+	}
+	configFile.apply = func(cfg config) error {
+		return applyReloadable(cfg, cors)
+	}
+
+	ipFilter, err := newIPFilter(cfg)
+	if err != nil {
+		fatal("IP filter setup failed", err)
+	}
+	webhookSources, err := parseWebhookSources(cfg.WebhookSources)
+	if err != nil {
+		fatal("Webhook sources setup failed", err)
+	}
 
-func main() {
 	app := fiber.New()
-	app.Use(recover.New())
-	app.Use(cors.New())
+	app.Use(recover.New(recover.Config{EnableStackTrace: true, StackTraceHandler: reportPanic}))
+	app.Use(requestIDs())
+	app.Use(currentBroker.accessLog.middleware())
+	app.Use(currentBroker.metrics.middleware())
+	app.Use(proxies.middleware())
+	app.Use(cors.middleware())
+	app.Use(audit.middleware())
+	app.Use(ipFilter.middleware())
 
-	// Health check
-	app.Get("/health", func(c fiber.Ctx) error {
+	// Health check, and the liveness and readiness probes
+	health := func(c fiber.Ctx) error {
 		return c.Send(nil)
-	})
+	}
+	app.Get("/health", health)
+	app.Get("/livez", livez)
+	app.Get("/readyz", ready.readyz)
+
+	// With an admin listener, the publish and admin routes are only served
+	// there, and the public port keeps the stream routes
+	admin := app
+	if cfg.AdminAddr != "" {
+		admin = fiber.New()
+		admin.Use(recover.New(recover.Config{EnableStackTrace: true, StackTraceHandler: reportPanic}))
+		admin.Use(requestIDs())
+		admin.Use(currentBroker.accessLog.middleware())
+		admin.Use(currentBroker.metrics.middleware())
+		admin.Use(proxies.middleware())
+		admin.Use(cors.middleware())
+		admin.Use(audit.middleware())
+		admin.Use(ipFilter.middleware())
+		admin.Get("/health", health)
+		admin.Get("/livez", livez)
+		admin.Get("/readyz", ready.readyz)
+	}
+
+	// The prefork master serves nothing and reports -1
+	openConnections = func() int32 { return max(app.Server().GetOpenConnectionsCount(), 0) + http2Conns.Load() }
 
 	// Returns open sessions and connection count
-	app.Get("/connections", func(c fiber.Ctx) error {
+	admin.Get("/connections", publishAuth.guard(func(c fiber.Ctx) error {
+		res := fiber.Map{
+			"open-connections": openConnections(),
+			"sessions":         currentBroker.sessions.count(),
+		}
+		// With a backplane, add the totals and a breakdown of every instance
+		if _, ok := currentBroker.backplane.(peerQuerier); ok && c.Query("scope") != "local" {
+			nodes := currentBroker.clusterView(c.Context(), peerQuery{})
+			var open int32
+			var sessions int
+			for _, n := range nodes {
+				open += n.Stats.OpenConnections
+				sessions += n.Stats.Sessions
+			}
+			stats := make([]nodeStats, len(nodes))
+			for i, n := range nodes {
+				stats[i] = n.Stats
+			}
+			res["cluster"] = fiber.Map{"openConnections": open, "sessions": sessions, "nodes": stats}
+		}
+		return c.JSON(res)
+	}))
+
+	// List sessions a page at a time, oldest first, across every instance
+	// when there is a backplane
+	listSessions := publishAuth.guard(func(c fiber.Ctx) error {
+		limit := 100
+		if v := c.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "limit must be a positive integer"})
+			}
+			limit = min(n, 1000)
+		}
+		page, err := strconv.Atoi(c.Query("page", "1"))
+		if err != nil || page <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "page must be a positive integer"})
+		}
+		// Each instance sends its oldest sessions up to the end of the page,
+		// which is enough to know the page of all of them together
+		offset := (page - 1) * limit
+		q := peerQuery{Sessions: true, UserID: c.Query("userID"), Limit: offset + limit}
+		nodes := []peerReply{currentBroker.localView(q)}
+		if c.Query("scope") != "local" {
+			nodes = currentBroker.clusterView(c.Context(), q)
+		}
+		sessions := []sessionInfo{}
+		stats := make([]nodeStats, len(nodes))
+		total := 0
+		for i, n := range nodes {
+			sessions = append(sessions, n.Sessions...)
+			stats[i] = n.Stats
+			total += n.Matched
+		}
+		slices.SortFunc(sessions, func(a, b sessionInfo) int { return a.ConnectedAt.Compare(b.ConnectedAt) })
+		sessions = sessions[min(offset, len(sessions)):min(offset+limit, len(sessions))]
 		return c.JSON(fiber.Map{
-			"open-connections": app.Server().GetOpenConnectionsCount(),
-			"sessions":         len(currentSessions.sessions),
+			"sessions": sessions,
+			"page":     page,
+			"limit":    limit,
+			"total":    total,
+			"hasMore":  offset+limit < total,
+			"nodes":    stats,
 		})
 	})
+	admin.Get("/sessions", listSessions)
+	admin.Get("/admin/sessions", listSessions)
+
+	// Force-disconnect sessions, wherever they are connected, such as a
+	// revoked user's or a broken client's
+	disconnectSessions := func(c fiber.Ctx, q peerQuery) []sessionInfo {
+		q.Sessions = true
+		q.Disconnect = c.Query("reason", "disconnected by an administrator")
+		nodes := currentBroker.view(c.Context(), q, c.Query("scope"))
+		closed := []sessionInfo{}
+		for _, n := range nodes {
+			closed = append(closed, n.Sessions...)
+		}
+		return closed
+	}
+	admin.Delete("/admin/sessions/:id", publishAuth.guard(func(c fiber.Ctx) error {
+		closed := disconnectSessions(c, peerQuery{SessionID: c.Params("id")})
+		if len(closed) == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "session not found"})
+		}
+		auditDetails(c).UserID = closed[0].UserID
+		return c.JSON(fiber.Map{"disconnected": closed})
+	}))
+	admin.Delete("/admin/users/:userID/sessions", publishAuth.guard(func(c fiber.Ctx) error {
+		return c.JSON(fiber.Map{"disconnected": disconnectSessions(c, peerQuery{UserID: c.Params("userID")})})
+	}))
+
+	// Pause and resume delivery to a user on every instance, such as while a
+	// client bug makes each event expensive
+	pauseQuery := func(c fiber.Ctx, q peerQuery) []pauseInfo {
+		// Kept past the request by a pause, so not left pointing into its buffer
+		q.UserID = strings.Clone(c.Params("userID"))
+		nodes := currentBroker.view(c.Context(), q, c.Query("scope"))
+		pauses := []pauseInfo{}
+		for _, n := range nodes {
+			if n.Pause != nil {
+				pauses = append(pauses, *n.Pause)
+			}
+		}
+		return pauses
+	}
+	admin.Post("/admin/users/:userID/pause", publishAuth.guard(func(c fiber.Ctx) error {
+		type reqBody struct {
+			Policy     string `json:"policy"`
+			Reason     string `json:"reason"`
+			DurationMs int64  `json:"durationMs"`
+		}
+		var body reqBody
+		if len(c.Body()) > 0 {
+			if err := c.Bind().Body(&body); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
+			}
+		}
+		policy, err := parsePausePolicy(body.Policy)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if body.DurationMs < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "durationMs must not be negative"})
+		}
+		req := pauseRequest{Policy: policy, Reason: body.Reason, For: time.Duration(body.DurationMs) * time.Millisecond}
+		return c.JSON(fiber.Map{"paused": pauseQuery(c, peerQuery{Pause: &req})})
+	}))
+	admin.Post("/admin/users/:userID/resume", publishAuth.guard(func(c fiber.Ctx) error {
+		resumed := pauseQuery(c, peerQuery{Resume: true})
+		if len(resumed) == 0 {
+			return c.Status(404).JSON(fiber.Map{"error": "user not paused"})
+		}
+		return c.JSON(fiber.Map{"resumed": resumed})
+	}))
+
+	// Take the instance out of rotation for a deploy, report how far the
+	// drain has got, or cancel it
+	admin.Post("/admin/drain", publishAuth.guard(func(c fiber.Ctx) error {
+		type reqBody struct {
+			// SpreadMs is nil for the default spread
+			SpreadMs *int64 `json:"spreadMs"`
+		}
+		var body reqBody
+		if len(c.Body()) > 0 {
+			if err := c.Bind().Body(&body); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
+			}
+		}
+		spread := time.Duration(-1)
+		if body.SpreadMs != nil {
+			if *body.SpreadMs < 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "spreadMs must not be negative"})
+			}
+			spread = time.Duration(*body.SpreadMs) * time.Millisecond
+		}
+		return c.JSON(drain.start(spread))
+	}))
+	admin.Get("/admin/drain", publishAuth.guard(func(c fiber.Ctx) error {
+		return c.JSON(drain.progress())
+	}))
+	admin.Delete("/admin/drain", publishAuth.guard(func(c fiber.Ctx) error {
+		return c.JSON(drain.cancel())
+	}))
+
+	// Read the config file again and apply the settings that can change
+	// without dropping streams, as SIGHUP does
+	admin.Post("/admin/reload", publishAuth.guard(func(c fiber.Ctx) error {
+		res, err := configFile.reload()
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(res)
+	}))
+
+	// Ban a user for a while: disconnect their sessions everywhere and refuse
+	// their streams until the ban expires
+	admin.Get("/admin/bans", publishAuth.guard(func(c fiber.Ctx) error {
+		return c.JSON(fiber.Map{"bans": currentBroker.bans.list()})
+	}))
+	admin.Post("/admin/bans", publishAuth.guard(func(c fiber.Ctx) error {
+		type reqBody struct {
+			UserID     string `json:"userID"`
+			Reason     string `json:"reason"`
+			DurationMs int64  `json:"durationMs"`
+		}
+		var body reqBody
+		if err := c.Bind().Body(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
+		}
+		if body.UserID == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "userID is required"})
+		}
+		if body.DurationMs < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "durationMs must not be negative"})
+		}
+		auditDetails(c).UserID = body.UserID
+		d := cfg.BanDuration
+		if body.DurationMs > 0 {
+			d = time.Duration(body.DurationMs) * time.Millisecond
+		}
+		now := time.Now()
+		ban := userBan{UserID: body.UserID, Reason: body.Reason, At: now, Until: now.Add(d)}
+		if err := currentBroker.bans.persist(c.Context(), currentBroker.nextEventID(), ban); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		q := peerQuery{Sessions: true, UserID: ban.UserID, Ban: &ban, Disconnect: cmp.Or(ban.Reason, "banned")}
+		nodes := currentBroker.view(c.Context(), q, c.Query("scope"))
+		disconnected := []sessionInfo{}
+		for _, n := range nodes {
+			disconnected = append(disconnected, n.Sessions...)
+		}
+		return c.JSON(fiber.Map{"ban": ban, "disconnected": disconnected})
+	}))
+	admin.Delete("/admin/bans/:userID", publishAuth.guard(func(c fiber.Ctx) error {
+		userID := c.Params("userID")
+		if err := currentBroker.bans.unpersist(c.Context(), userID, 0); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		q := peerQuery{UserID: strings.Clone(userID), Unban: true}
+		nodes := currentBroker.view(c.Context(), q, c.Query("scope"))
+		for _, n := range nodes {
+			if n.Ban != nil {
+				return c.JSON(fiber.Map{"unbanned": n.Ban})
+			}
+		}
+		return c.Status(404).JSON(fiber.Map{"error": "user not banned"})
+	}))
 
-	// System metrics endpoint
-	app.Get("/metrics/system", func(c fiber.Ctx) error {
-		// Go memory stats
-		var memStats runtime.MemStats
-		runtime.ReadMemStats(&memStats)
+	// Delivery statistics per user, adding up their open sessions, most
+	// backpressured first
+	admin.Get("/users", publishAuth.guard(func(c fiber.Ctx) error {
+		order, ok := userStatsOrders[c.Query("sort", "dropped")]
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{"error": "sort must be dropped, queued, delivered, bytes, sessions or latency"})
+		}
+		limit, err := strconv.Atoi(c.Query("limit", "100"))
+		if err != nil || limit <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be a positive integer"})
+		}
+		q := peerQuery{Sessions: true, UserID: c.Query("userID")}
+		nodes := []peerReply{currentBroker.localView(q)}
+		if c.Query("scope") != "local" {
+			nodes = currentBroker.clusterView(c.Context(), q)
+		}
+		var sessions []sessionInfo
+		for _, n := range nodes {
+			sessions = append(sessions, n.Sessions...)
+		}
+		users := aggregateUsers(sessions, order)
+		if len(users) > limit {
+			users = users[:limit]
+		}
+		return c.JSON(fiber.Map{"users": users})
+	}))
+
+	// One user's delivery, for when they say they aren't getting updates
+	admin.Get("/users/:id/stats", publishAuth.guard(func(c fiber.Ctx) error {
+		userID := c.Params("id")
+		q := peerQuery{Sessions: true, UserID: userID}
+		nodes := []peerReply{currentBroker.localView(q)}
+		if c.Query("scope") != "local" {
+			nodes = currentBroker.clusterView(c.Context(), q)
+		}
+		sessions := []sessionInfo{}
+		for _, n := range nodes {
+			sessions = append(sessions, n.Sessions...)
+		}
+		detail, err := currentBroker.userDetail(c.Context(), userID, sessions)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(detail)
+	}))
+
+	// Routing hint: the node userID hashes to, so load balancers and clients
+	// can connect there and avoid cross-node forwarding
+	app.Get("/route/:userID", func(c fiber.Ctx) error {
+		userID := c.Params("userID")
+		node, url := currentBroker.route(userID)
+		return c.JSON(fiber.Map{
+			"userID": userID,
+			"node":   node,
+			"url":    url,
+			"local":  node == currentBroker.nodeID,
+		})
+	})
 
-		// OS memory stats
-		vmStat, _ := mem.VirtualMemory()
+	// What binary is running, and for how long
+	build := binaryInfo()
+	admin.Get("/version", publishAuth.guard(func(c fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"version":       build.Version,
+			"commit":        build.Commit,
+			"buildTime":     build.BuildTime,
+			"modified":      build.Modified,
+			"goVersion":     build.GoVersion,
+			"node":          cfg.NodeID,
+			"startedAt":     startedAt,
+			"uptimeSeconds": int64(time.Since(startedAt).Seconds()),
+		})
+	}))
 
-		// CPU usage (averaged over 1 second)
-		cpuPercent, _ := cpu.Percent(time.Second, false)
+	// System metrics endpoint, answered from the latest background sample
+	admin.Get("/metrics/system", publishAuth.guard(func(c fiber.Ctx) error {
+		sample := currentBroker.metrics.system.current()
+		memStats := sample.mem
+		vmStat := sample.vm
+		if vmStat == nil {
+			vmStat = &mem.VirtualMemoryStat{}
+		}
 
 		return c.JSON(fiber.Map{
-			"timestamp": time.Now().Format(time.RFC3339),
+			"timestamp": sample.at.Format(time.RFC3339),
 			"system_memory": fiber.Map{
 				"total_mb":     bToMb(vmStat.Total),
 				"used_mb":      bToMb(vmStat.Used),
 				"used_percent": fmt.Sprintf("%.2f", vmStat.UsedPercent),
 			},
 			"cpu": fiber.Map{
-				"usage_percent": fmt.Sprintf("%.2f", cpuPercent[0]),
+				"usage_percent": fmt.Sprintf("%.2f", sample.cpuPercent),
 			},
 			"go_memory": fiber.Map{
 				"alloc_mb":       fmt.Sprintf("%.2f", bToMbFloat(memStats.Alloc)),
@@ -114,131 +514,856 @@ func main() {
 				"gc_cycles":      memStats.NumGC,
 			},
 			"goroutines": runtime.NumGoroutine(),
+			"process": fiber.Map{
+				"open_fds":        sample.fds,
+				"max_fds":         sample.fdLimit,
+				"tcp_connections": sample.tcpStates,
+			},
+			"network": systemNetwork(sample),
+			"disk":    systemDisk(sample),
+			"broker": fiber.Map{
+				"sessions":                currentBroker.sessions.count(),
+				"slow_consumer_evictions": currentBroker.slowConsumers.evictions.Load(),
+				"connections_rejected":    currentBroker.limits.rejected.Load(),
+				"sessions_replaced":       currentBroker.limits.closed.Load(),
+			},
+			"replication": currentBroker.replication.stats(),
 		})
-	})
+	}))
+
+	// Prometheus metrics
+	admin.Get("/metrics", publishAuth.guard(func(c fiber.Ctx) error {
+		c.Set(fiber.HeaderContentType, metricsContentType)
+		return currentBroker.metrics.write(c)
+	}))
+
+	// Everything an operations dashboard shows, in one document
+	admin.Get("/admin/overview", publishAuth.guard(func(c fiber.Ctx) error {
+		return c.JSON(currentBroker.clusterOverview(c.Context(), cfg.Backplane, c.Query("scope")))
+	}))
+
+	// Profiles and runtime variables, for diagnosing stuck writers
+	if err := debugRoutes(cfg, admin, publishAuth.guard); err != nil {
+		fatal("Debug endpoints setup failed", err)
+	}
 
 	// SSE connection
-	app.Get("/sse", func(c fiber.Ctx) error {
-		userID := c.Query("userID")
+	// prepareStream checks a request for a stream or poll and sets up its
+	// session. A refused request has been answered, and gets a nil session.
+	prepareStream := func(c fiber.Ctx, transport string) (*session, uint64, error) {
+		// Browsers always send Origin on cross-site requests; other clients may omit it
+		if origin := c.Get("Origin"); origin != "" && !currentBroker.streamOriginAllowed(origin) {
+			requestLogger(c).Warn(transport+" refused, origin not allowed", "origin", origin)
+			return nil, 0, c.Status(403).SendString("origin not allowed")
+		}
+		id, err := streamAuth.streamIdentity(httpAuthRequest(c), c.Query("userID"))
+		var aerr *authError
+		if errors.As(err, &aerr) {
+			return nil, 0, c.Status(aerr.status).SendString(aerr.msg)
+		}
+		userID := id.Subject
 		if userID == "" {
-			return c.Status(400).SendString("userID is required")
+			return nil, 0, c.Status(400).SendString("userID is required")
+		}
+		if refused, retryAfter := drain.refusing(); refused {
+			c.Set(fiber.HeaderRetryAfter, retryAfter)
+			return nil, 0, c.Status(503).SendString("draining, connect to another instance")
+		}
+		if ban, banned := currentBroker.bans.check(userID); banned {
+			requestLogger(c).Info(transport+" refused, user banned", "userID", userID, "until", ban.Until)
+			return nil, 0, c.Status(403).SendString("user is banned until " + ban.Until.UTC().Format(time.RFC3339))
+		}
+
+		var topics []string
+		if q := c.Query("topics"); q != "" {
+			topics = strings.Split(q, ",")
+		}
+
+		buffer, _ := strconv.Atoi(c.Query("buffer"))
+
+		// Browsers send Last-Event-ID when reconnecting; other clients may use the query string
+		lastEventID := c.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = c.Query("lastEventId")
+		}
+		lastSeen, _ := strconv.ParseUint(lastEventID, 10, 64)
+
+		s := newSession(userID, topics, currentBroker.sessionBuffer(buffer))
+		s.log = s.log.With("requestID", requestID(c))
+		s.setAuthExpiry(id.ExpiresAt)
+		s.clientIP = clientIP(c)
+		// Fiber's strings point into the request buffer, which is reused
+		s.userAgent = strings.Clone(c.Get(fiber.HeaderUserAgent))
+		s.metadata = currentBroker.sessionMetadata.fromHTTP(c)
+		s.labels = currentBroker.sessionLabels.fromHTTP(c, id)
+		if s.payload, err = currentBroker.encryption.forStream(userID, c.Get(payloadKeyHeader)); err != nil {
+			return nil, 0, c.Status(400).SendString(err.Error())
 		}
+		if s.cloudEvents, err = currentBroker.streamFormats.cloudEventsFor(c.Query("format")); err != nil {
+			return nil, 0, c.Status(400).SendString(err.Error())
+		}
+		return s, lastSeen, nil
+	}
 
+	// openStream checks a request for a stream and admits its session. A
+	// refused request has been answered, and gets a nil session.
+	openStream := func(c fiber.Ctx, transport string) (*session, uint64, error) {
+		s, lastSeen, err := prepareStream(c, transport)
+		if s == nil {
+			return nil, 0, err
+		}
+		var lerr *limitError
+		if err := currentBroker.sessions.admit(s, currentBroker.limits); errors.As(err, &lerr) {
+			return nil, 0, c.Status(lerr.status).SendString(lerr.msg)
+		}
+		currentBroker.announce()
+
+		// Lets clients reconnect straight to the node owning the user
+		owner, ownerURL := currentBroker.route(s.userID)
+		c.Set("X-SSE-Owner", owner)
+		c.Set("X-SSE-Owner-URL", ownerURL)
+		c.Locals("streaming", true)
+		detectHalfOpen(c.RequestCtx().Conn())
+		return s, lastSeen, nil
+	}
+
+	app.Get("/sse", func(c fiber.Ctx) error {
+		s, lastSeen, err := openStream(c, "SSE")
+		if s == nil {
+			return err
+		}
 		c.Set("Content-Type", "text/event-stream")
 		c.Set("Cache-Control", "no-cache")
 		c.Set("Connection", "keep-alive")
 		c.Set("Transfer-Encoding", "chunked")
+		conn := c.RequestCtx().Conn()
+		return c.SendStreamWriter(func(w *bufio.Writer) {
+			// The connection may serve further requests once the stream ends
+			defer conn.SetWriteDeadline(time.Time{})
+			streamSession(sseWriter{w: w, conn: conn, stats: &s.stats}, s, lastSeen)
+		})
+	})
 
-		stateChan := make(chan interface{})
-		s := &session{stateChannel: stateChan, userID: userID}
-		currentSessions.addSession(s)
-
-		err := c.SendStreamWriter(func(w *bufio.Writer) {
-			keepAlive := time.NewTicker(15 * time.Second)
-			defer keepAlive.Stop()
-			// Remove session when client disconnects
-			defer func() {
-				currentSessions.removeSession(s)
-				log.Printf("SSE disconnected: userID=%s", userID)
-			}()
+	// The same streams over WebSocket, for clients that handle it better
+	app.Get("/ws", func(c fiber.Ctx) error {
+		if !websocket.FastHTTPIsWebSocketUpgrade(c.RequestCtx()) {
+			return c.Status(426).SendString("WebSocket upgrade required")
+		}
+		s, lastSeen, err := openStream(c, "WebSocket")
+		if s == nil {
+			return err
+		}
+		return serveWebSocket(c, s, lastSeen)
+	})
 
-			for {
-				select {
-				case ev, ok := <-stateChan:
-					if !ok {
-						// Channel closed gracefully
-						return
-					}
-
-					sseMessage, err := buildSSEPayload("current-value", ev)
-					if err != nil {
-						log.Printf("SSE format error: %v", err)
-						continue
-					}
-
-					if _, err := fmt.Fprint(w, sseMessage); err != nil {
-						log.Printf("SSE write error: %v", err)
-						return
-					}
-					if err := w.Flush(); err != nil {
-						log.Printf("SSE flush error: %v", err)
-						return
-					}
-				case <-keepAlive.C:
-					// Optional: Send heartbeat if desired
-					// _, _ = fmt.Fprint(w, ":keepalive\n")
-					// _ = w.Flush()
-				}
+	// GraphQL subscriptions over WebSocket, for clients such as Apollo; each
+	// subscription operation is a session of its own
+	graphqlSchema, err := newGraphQLSchema()
+	if err != nil {
+		fatal("GraphQL setup failed", err)
+	}
+	app.Get("/graphql", func(c fiber.Ctx) error {
+		if !websocket.FastHTTPIsWebSocketUpgrade(c.RequestCtx()) {
+			return c.Status(426).SendString("WebSocket upgrade required")
+		}
+		s, lastSeen, err := prepareStream(c, "GraphQL")
+		if s == nil {
+			return err
+		}
+		owner, ownerURL := currentBroker.route(s.userID)
+		c.Set("X-SSE-Owner", owner)
+		c.Set("X-SSE-Owner-URL", ownerURL)
+		c.Locals("streaming", true)
+		detectHalfOpen(c.RequestCtx().Conn())
+		return serveGraphQL(c, graphqlSchema, s, lastSeen)
+	})
+
+	// Events since the client's last poll, for networks neither streams nor
+	// WebSockets get through; a poll is no session, so the user isn't online
+	app.Get("/poll", func(c fiber.Ctx) error {
+		if !currentBroker.history.enabled() {
+			return c.Status(404).JSON(fiber.Map{"error": "history is disabled"})
+		}
+		s, _, err := prepareStream(c, "Poll")
+		if s == nil {
+			return err
+		}
+		var since uint64
+		if v := c.Query("since"); v != "" {
+			if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "since must be an event ID"})
 			}
-		})
+		}
+		wait := currentBroker.pollTimeout
+		if v := c.Query("timeout"); v != "" {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs < 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "timeout must be a number of seconds"})
+			}
+			wait = min(wait, time.Duration(secs)*time.Second)
+		}
 
-		return err
+		events, next, err := currentBroker.poll(c.Context(), s, since, wait)
+		if err != nil {
+			requestLogger(c).Error("History read error", "userID", s.userID, "error", err)
+			return c.Status(500).JSON(fiber.Map{"error": "history unavailable"})
+		}
+		pw := &pollWriter{events: []any{}}
+		w := formatWriter(pw, s)
+		for _, ev := range events {
+			if err := w.write(ev.ID, ev.Type, ev.Data); err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+		c.Set("Cache-Control", "no-cache")
+		return c.JSON(fiber.Map{"events": pw.events, "lastEventID": next})
 	})
 
+	// Devices a user's events are pushed to while the user has no session,
+	// registered by the app as the user
+	if currentBroker.push != nil {
+		deviceUser := func(c fiber.Ctx) (string, error) {
+			id, err := streamAuth.streamIdentity(httpAuthRequest(c), c.Query("userID"))
+			var aerr *authError
+			if errors.As(err, &aerr) {
+				return "", c.Status(aerr.status).JSON(fiber.Map{"error": aerr.msg})
+			}
+			if id.Subject == "" {
+				return "", c.Status(400).JSON(fiber.Map{"error": "userID is required"})
+			}
+			return id.Subject, nil
+		}
+		app.Post("/push/devices", func(c fiber.Ctx) error {
+			userID, err := deviceUser(c)
+			if userID == "" {
+				return err
+			}
+			var d pushDevice
+			if err := json.Unmarshal(c.Body(), &d); err != nil || d.Token == "" {
+				return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
+			}
+			if !currentBroker.push.platformEnabled(d.Platform) {
+				return c.Status(400).JSON(fiber.Map{"error": "platform must be one of those configured, fcm or apns"})
+			}
+			if err := currentBroker.push.devices.add(c.Context(), userID, d); err != nil {
+				requestLogger(c).Error("Push devices write error", "userID", userID, "error", err)
+				return c.Status(500).JSON(fiber.Map{"error": "devices unavailable"})
+			}
+			return c.Status(201).JSON(fiber.Map{"userID": userID, "platform": d.Platform})
+		})
+		app.Delete("/push/devices/:token", func(c fiber.Ctx) error {
+			userID, err := deviceUser(c)
+			if userID == "" {
+				return err
+			}
+			if err := currentBroker.push.devices.remove(c.Context(), userID, c.Params("token")); err != nil {
+				requestLogger(c).Error("Push devices write error", "userID", userID, "error", err)
+				return c.Status(500).JSON(fiber.Map{"error": "devices unavailable"})
+			}
+			return c.SendStatus(204)
+		})
+	}
+
+	// Mints a one-time token for opening a stream, so browsers can keep their JWT out of URLs
+	if tokens := streamAuth.streamTokens(); tokens != nil {
+		app.Post("/stream-token", func(c fiber.Ctx) error {
+			if c.Query("stream_token") != "" {
+				return c.Status(401).JSON(fiber.Map{"error": "a stream token can't mint another"})
+			}
+			id, err := streamAuth.streamIdentity(httpAuthRequest(c), "")
+			var aerr *authError
+			if errors.As(err, &aerr) {
+				return c.Status(aerr.status).JSON(fiber.Map{"error": aerr.msg})
+			}
+			token, expiresAt, err := tokens.mint(id)
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			return c.JSON(fiber.Map{"token": token, "userID": id.Subject, "expiresAt": expiresAt})
+		})
+	}
+
 	// Broadcast to all sessions of a user
-	app.Post("/send-to-user", func(c fiber.Ctx) error {
+	admin.Post("/send-to-user", tracePublish(publishAuth.guard(func(c fiber.Ctx) error {
+		if !utf8.Valid(c.Body()) {
+			return c.Status(400).JSON(fiber.Map{"error": "body is not valid UTF-8"})
+		}
+		// A CloudEvent names its user and topic in its extensions
+		header := func(name string) string { return c.Get(name) }
+		body, isCloudEvent, err := cloudEventRequest(header, c.Body())
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !isCloudEvent {
+			if err := c.Bind().Body(&body); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
+			}
+		}
+		if key := c.Get("Idempotency-Key"); key != "" {
+			body.IdempotencyKey = key
+		}
+		ar := auditDetails(c)
+		ar.UserID, ar.Topic, ar.EventType = body.UserID, body.Topic, cmp.Or(body.State, "current-value")
+		span := trace.SpanFromContext(c.Context())
+		span.SetAttributes(publishAttributes(body)...)
+		body.trace = span.SpanContext()
+		id, _ := c.Locals("identity").(Identity)
+		if !id.Scope.allows(body.UserID, body.Topic) {
+			return c.Status(403).JSON(fiber.Map{"error": "not allowed to publish to this user or topic"})
+		}
+		if d, ok := currentBroker.publishLimits.take(callerKey(id, clientIP(c)), body.UserID); ok {
+			d.setHeaders(c)
+			if !d.allowed {
+				return c.Status(429).JSON(fiber.Map{"error": "rate limit exceeded"})
+			}
+		}
+
+		out, err := body.submit()
+		var perr *publishError
+		if errors.As(err, &perr) {
+			return c.Status(perr.status).JSON(fiber.Map{"error": perr.msg})
+		}
+		if out.Scheduled {
+			return c.Status(202).JSON(fiber.Map{"scheduled": true, "deliverAt": out.DeliverAt})
+		}
+
+		ar.EventID = out.Result.EventID
+		span.SetAttributes(attribute.Int64("sse.event_id", int64(out.Result.EventID)))
+		return c.JSON(out.response())
+	})))
+
+	// Events pushed by third-party services such as Stripe or GitHub, each
+	// verified with its source's secret and mapped onto a publish to the
+	// user it names
+	if len(webhookSources) > 0 {
+		app.Post("/ingest/webhook/:source", tracePublish(func(c fiber.Ctx) error {
+			src, ok := webhookSources[c.Params("source")]
+			if !ok {
+				return c.Status(404).JSON(fiber.Map{"error": "unknown webhook source"})
+			}
+			header := func(name string) string { return c.Get(name) }
+			if err := src.authenticate(header, c.Body(), time.Now()); err != nil {
+				return c.Status(401).JSON(fiber.Map{"error": err.Error()})
+			}
+			id := Identity{Subject: src.name, Method: "webhook"}
+			c.Locals("identity", id)
+			body, err := src.publishRequest(header, c.Body())
+			if err != nil {
+				// Delivering it again wouldn't map it any better, so the
+				// source is told not to retry
+				requestLogger(c).Warn("Webhook delivery skipped", "source", src.name, "error", err)
+				return c.Status(202).JSON(fiber.Map{"skipped": true, "reason": err.Error()})
+			}
+			ar := auditDetails(c)
+			ar.UserID, ar.Topic, ar.EventType = body.UserID, body.Topic, "current-value"
+			span := trace.SpanFromContext(c.Context())
+			span.SetAttributes(publishAttributes(body)...)
+			body.trace = span.SpanContext()
+			if d, ok := currentBroker.publishLimits.take(callerKey(id, clientIP(c)), body.UserID); ok {
+				d.setHeaders(c)
+				if !d.allowed {
+					return c.Status(429).JSON(fiber.Map{"error": "rate limit exceeded"})
+				}
+			}
+
+			out, err := body.submit()
+			var perr *publishError
+			if errors.As(err, &perr) {
+				return c.Status(perr.status).JSON(fiber.Map{"error": perr.msg})
+			}
+			ar.EventID = out.Result.EventID
+			span.SetAttributes(attribute.Int64("sse.event_id", int64(out.Result.EventID)))
+			return c.JSON(out.response())
+		}))
+	}
+
+	// Publishes mirrored from other regions; only served with a replication secret
+	if cfg.ReplicationSecret != "" {
+		app.Post("/replication/events", func(c fiber.Ctx) error {
+			if subtle.ConstantTimeCompare([]byte(c.Get("X-Replication-Secret")), []byte(cfg.ReplicationSecret)) != 1 {
+				return c.Status(401).JSON(fiber.Map{"error": "invalid replication secret"})
+			}
+			var batch []replicatedEvent
+			if err := json.Unmarshal(c.Body(), &batch); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
+			}
+			currentBroker.replication.accept(batch)
+			return c.SendStatus(204)
+		})
+	}
+
+	// Acknowledge that a session's client processed an event; with stream
+	// auth, only the session's own user may
+	app.Post("/ack", func(c fiber.Ctx) error {
 		type reqBody struct {
-			UserID string      `json:"userID"`
-			Value  interface{} `json:"value"`
+			SessionID string `json:"sessionID"`
+			EventID   uint64 `json:"eventID"`
 		}
 		var body reqBody
 		if err := c.Bind().Body(&body); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
 		}
-		if body.UserID == "" {
+		if body.SessionID == "" || body.EventID == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "sessionID and eventID are required"})
+		}
+		var owner string
+		if streamAuth.enabled() {
+			id, err := streamAuth.authenticate(httpAuthRequest(c))
+			var aerr *authError
+			if errors.As(err, &aerr) {
+				return c.Status(aerr.status).JSON(fiber.Map{"error": aerr.msg})
+			}
+			owner = id.Subject
+		}
+
+		cmd := sessionCommand{SessionID: body.SessionID, Owner: owner, Ack: body.EventID}
+		res, ok := currentBroker.runCommand(c.Context(), cmd)
+		if !ok {
+			return c.Status(404).JSON(fiber.Map{"error": "unknown event for session"})
+		}
+		if res.Forbidden {
+			return c.Status(403).JSON(fiber.Map{"error": "session belongs to another user"})
+		}
+
+		return c.JSON(fiber.Map{"sessionID": body.SessionID, "eventID": body.EventID, "state": deliveryAcked})
+	})
+
+	// Per-session delivery state of a published event
+	admin.Get("/messages/:id", publishAuth.guard(func(c fiber.Ctx) error {
+		eventID, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid event ID"})
+		}
+
+		rec, ok := currentBroker.deliveries.get(eventID)
+		if !ok {
+			return c.Status(404).JSON(fiber.Map{"error": "event not found"})
+		}
+
+		return c.JSON(rec)
+	}))
+
+	// Recent events published to a user, oldest first
+	admin.Get("/history", publishAuth.guard(func(c fiber.Ctx) error {
+		userID := c.Query("userID")
+		if userID == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "userID is required"})
 		}
+		if !currentBroker.history.enabled() {
+			return c.Status(404).JSON(fiber.Map{"error": "history is disabled"})
+		}
 
-		sent := 0
-		currentSessions.MU.Lock()
-		for _, s := range currentSessions.sessions {
-			if s != nil && s.userID == body.UserID {
-				select {
-				case s.stateChannel <- body.Value:
-					sent++
-				default:
-					// Drop if blocked
-				}
+		q := historyQuery{EventType: c.Query("eventType"), Topic: c.Query("topic")}
+		limit, err := strconv.Atoi(c.Query("limit", "100"))
+		if err != nil || limit <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "limit must be a positive integer"})
+		}
+		q.Limit = min(limit, 1000)
+		if v := c.Query("since"); v != "" {
+			if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "since must be an RFC 3339 timestamp"})
+			}
+		}
+		if v := c.Query("cursor"); v != "" {
+			if q.After, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "invalid cursor"})
+			}
+		}
+
+		events, next, err := currentBroker.history.query(c.Context(), userID, q)
+		if err != nil {
+			requestLogger(c).Error("History read error", "userID", userID, "error", err)
+			return c.Status(500).JSON(fiber.Map{"error": "history unavailable"})
+		}
+		res := fiber.Map{"userID": userID, "events": events}
+		if next > 0 {
+			res["nextCursor"] = strconv.FormatUint(next, 10)
+		}
+		return c.JSON(res)
+	}))
+
+	// Latest value per topic of a user
+	admin.Get("/state/:userID", publishAuth.guard(func(c fiber.Ctx) error {
+		userID := c.Params("userID")
+		if !currentBroker.state.enabled {
+			return c.Status(404).JSON(fiber.Map{"error": "latest-value state is disabled"})
+		}
+		events, err := currentBroker.state.get(c.Context(), userID)
+		if err != nil {
+			requestLogger(c).Error("State read error", "userID", userID, "error", err)
+			return c.Status(500).JSON(fiber.Map{"error": "state unavailable"})
+		}
+		if topic := c.Query("topic"); topic != "" {
+			events = slices.DeleteFunc(events, func(ev event) bool { return ev.Topic != topic })
+		}
+		return c.JSON(fiber.Map{"userID": userID, "values": events})
+	}))
+
+	// Streams what the broker does as it happens, for debugging
+	admin.Get("/admin/tail", publishAuth.guard(func(c fiber.Ctx) error {
+		w := currentBroker.tail.watch(c.Query("userID"))
+		if w == nil {
+			return c.Status(503).JSON(fiber.Map{"error": "shutting down"})
+		}
+		c.Set("Content-Type", "text/event-stream")
+		c.Set("Cache-Control", "no-cache")
+		c.Set("Connection", "keep-alive")
+		c.Set("Transfer-Encoding", "chunked")
+		c.Locals("streaming", true)
+		return c.SendStreamWriter(func(out *bufio.Writer) {
+			currentBroker.tail.follow(out, w)
+		})
+	}))
+
+	// Export users' history as NDJSON to a file or S3 bucket
+	admin.Post("/admin/export", publishAuth.guard(func(c fiber.Ctx) error {
+		type reqBody struct {
+			UserID      string     `json:"userID"`
+			UserIDs     []string   `json:"userIDs"`
+			Destination string     `json:"destination"`
+			Name        string     `json:"name"`
+			Since       *time.Time `json:"since"`
+			EventType   string     `json:"eventType"`
+			Topic       string     `json:"topic"`
+		}
+		var body reqBody
+		if err := c.Bind().Body(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
+		}
+		userIDs := body.UserIDs
+		if body.UserID != "" {
+			userIDs = append(userIDs, body.UserID)
+		}
+		if len(userIDs) == 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "userID or userIDs is required"})
+		}
+		if !currentBroker.history.enabled() {
+			return c.Status(404).JSON(fiber.Map{"error": "history is disabled"})
+		}
+
+		q := historyQuery{EventType: body.EventType, Topic: body.Topic}
+		if body.Since != nil {
+			q.Since = *body.Since
+		}
+		job, err := exports.start(currentBroker.history, userIDs, body.Destination, body.Name, q)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(202).JSON(job)
+	}))
+
+	admin.Get("/admin/export/:id", publishAuth.guard(func(c fiber.Ctx) error {
+		job, ok := exports.get(c.Params("id"))
+		if !ok {
+			return c.Status(404).JSON(fiber.Map{"error": "export not found"})
+		}
+		return c.JSON(job)
+	}))
+
+	// Recently undeliverable events, newest first
+	admin.Get("/dead-letters", publishAuth.guard(func(c fiber.Ctx) error {
+		if currentBroker.recentDeadLetters == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "dead letter buffer is disabled"})
+		}
+		limit, err := strconv.Atoi(c.Query("limit", "100"))
+		if err != nil || limit <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid limit"})
+		}
+
+		return c.JSON(fiber.Map{"deadLetters": currentBroker.recentDeadLetters.list(c.Query("userID"), limit)})
+	}))
+
+	// Recent publish and admin operations
+	admin.Get("/audit", publishAuth.guard(func(c fiber.Ctx) error {
+		if audit == nil || audit.recent == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "audit buffer is disabled"})
+		}
+		limit, err := strconv.Atoi(c.Query("limit", "100"))
+		if err != nil || limit <= 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid limit"})
+		}
+		q := auditQuery{Caller: c.Query("caller"), UserID: c.Query("userID"), Action: c.Query("action")}
+		if since := c.Query("since"); since != "" {
+			if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "since must be an RFC 3339 time"})
+			}
+		}
+
+		return c.JSON(fiber.Map{"records": audit.list(q, limit)})
+	}))
+
+	// Change the topic subscriptions of a live session; with stream auth,
+	// only its own user may
+	app.Post("/sessions/:id/subscriptions", func(c fiber.Ctx) error {
+		type reqBody struct {
+			Subscribe   []string `json:"subscribe"`
+			Unsubscribe []string `json:"unsubscribe"`
+		}
+		var body reqBody
+		if err := c.Bind().Body(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid body"})
+		}
+		var owner string
+		if streamAuth.enabled() {
+			id, err := streamAuth.authenticate(httpAuthRequest(c))
+			var aerr *authError
+			if errors.As(err, &aerr) {
+				return c.Status(aerr.status).JSON(fiber.Map{"error": aerr.msg})
 			}
+			owner = id.Subject
 		}
-		currentSessions.MU.Unlock()
 
-		return c.JSON(fiber.Map{"sent": sent})
+		cmd := sessionCommand{
+			SessionID:   c.Params("id"),
+			Owner:       owner,
+			Resubscribe: true,
+			Subscribe:   body.Subscribe,
+			Unsubscribe: body.Unsubscribe,
+		}
+		res, ok := currentBroker.runCommand(c.Context(), cmd)
+		if !ok {
+			return c.Status(404).JSON(fiber.Map{"error": "session not found"})
+		}
+		if res.Forbidden {
+			return c.Status(403).JSON(fiber.Map{"error": "session belongs to another user"})
+		}
+
+		return c.JSON(fiber.Map{"sessionID": c.Params("id"), "topics": res.Topics})
 	})
 
-	// Start server in goroutine
+	// Extends a live session past the expiry of the credential it was opened
+	// with; the session has to be on this instance
+	if streamAuth.enabled() {
+		app.Post("/sessions/:id/reauthenticate", func(c fiber.Ctx) error {
+			id, err := streamAuth.authenticate(httpAuthRequest(c))
+			var aerr *authError
+			if errors.As(err, &aerr) {
+				return c.Status(aerr.status).JSON(fiber.Map{"error": aerr.msg})
+			}
+			cmd := sessionCommand{SessionID: c.Params("id"), Owner: id.Subject, ExpiresAt: &id.ExpiresAt}
+			res, ok := currentBroker.runCommand(c.Context(), cmd)
+			if !ok {
+				return c.Status(404).JSON(fiber.Map{"error": "session not found"})
+			}
+			if res.Forbidden {
+				return c.Status(403).JSON(fiber.Map{"error": "session belongs to another user"})
+			}
+
+			return c.JSON(fiber.Map{"sessionID": c.Params("id"), "expiresAt": id.ExpiresAt})
+		})
+	}
+
+	// Under prefork the master only supervises the children serving the API
+	var children preforkChildren
+	app.Hooks().OnFork(children.add)
+	var stopping atomic.Bool
+	// accepting are the listeners new API connections arrive on
+	var accepting []net.Listener
+
+	// SIGHUP reloads the config file, in every prefork child too
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
-		if err := app.Listen(":8080"); err != nil {
-			log.Fatalf("Server failed to start: %v", err)
+		for range hup {
+			children.signal(syscall.SIGHUP)
+			if _, err := configFile.reload(); err != nil {
+				logger.Error("Config reload failed", "error", err)
+			}
 		}
 	}()
 
-	// Graceful shutdown listener
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	listen, challenges, err := listenConfig(cfg)
+	if err != nil {
+		fatal("TLS setup failed", err)
+	}
+	if challenges != nil {
+		if ln, err := listeners.listen(challenges.Addr); err != nil {
+			logger.Error("ACME challenge server error", "error", err)
+		} else {
+			go serveACMEChallenges(challenges, ln)
+		}
+	}
+	// Fiber's banner would be the one line not in the log format
+	listen.DisableStartupMessage = true
+	if !fiber.IsChild() {
+		logger.Info("Server listening", "addr", cfg.Addr, "tls", cfg.tlsEnabled(), "http2", cfg.HTTP2, "h2c", cfg.H2C, "prefork", cfg.Prefork)
+	}
+
+	// Start server in goroutine
+	if cfg.Prefork {
+		go func() {
+			// In the prefork master, Listen returns once a child has exited
+			if err := app.Listen(cfg.Addr, listen); err != nil && !stopping.Load() {
+				fatal("Server failed to start", err)
+			}
+		}()
+	} else {
+		tc, err := publicTLSConfig(listen)
+		if err != nil {
+			fatal("TLS setup failed", err)
+		}
+		if cfg.HTTP2 {
+			if tc == nil {
+				fatal("HTTP/2 setup failed", errors.New("HTTP/2 needs HTTPS; behind a proxy, use h2c"))
+			}
+			enableHTTP2(tc)
+		}
+		lns, err := openListeners(cfg.Addr, tc, cfg.SocketMode)
+		if err != nil {
+			fatal("Server failed to start", err)
+		}
+		if cfg.HTTP2 || cfg.H2C {
+			h2 := newHTTP2Server(cfg, app)
+			for i, ln := range lns {
+				lns[i] = newHTTP2Listener(ln, h2, cfg.H2C)
+			}
+		}
+		accepting = append(accepting, lns...)
+		for _, ln := range lns {
+			go func() {
+				if err := app.Listener(ln, listen); err != nil && !stopping.Load() {
+					fatal("Server failed", err)
+				}
+			}()
+		}
+	}
+
+	if admin != app {
+		tc, err := adminTLSConfig(cfg)
+		if err != nil {
+			fatal("Admin listener TLS setup failed", err)
+		}
+		lns, err := openListeners(cfg.AdminAddr, tc, cfg.SocketMode)
+		if err != nil {
+			fatal("Admin listener failed to start", err)
+		}
+		accepting = append(accepting, lns...)
+		for _, ln := range lns {
+			go func() {
+				if err := admin.Listener(ln, fiber.ListenConfig{DisableStartupMessage: true}); err != nil && !stopping.Load() {
+					fatal("Admin server failed", err)
+				}
+			}()
+		}
+		logger.Info("Admin routes listening", "addr", cfg.AdminAddr)
+	}
+	// systemd first, so it knows this process as the main one before the
+	// process restarted from exits
+	sdReady()
+	listeners.ready()
+	watchdog := make(chan struct{})
+	go sdWatchdog(watchdog)
 
-	log.Println("Gracefully shutting down the server...")
+	// Graceful shutdown listener. A restart signal starts the binary again
+	// with the listeners, then shuts down once the new process serves.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM}, restartSignals...)...)
+	handedOff := false
+	for !handedOff {
+		if sig := <-quit; !slices.Contains(restartSignals, sig) {
+			break
+		}
+		if cfg.Prefork {
+			logger.Error("Restart failed", "error", "prefork processes can't hand their listeners on")
+			continue
+		}
+		if err := listeners.handOff(); err != nil {
+			logger.Error("Restart failed, still serving", "error", err)
+			continue
+		}
+		handedOff = true
+	}
+	stopping.Store(true)
+	if handedOff || cfg.ReusePort {
+		// Another process accepts on the same addresses now; new connections
+		// are left to it while the open ones end
+		for _, ln := range accepting {
+			_ = ln.Close()
+		}
+	}
 
-	// Close all SSE connections before shutdown
-	currentSessions.closeAllSessions()
+	logger.Info("Gracefully shutting down the server", "steps", cfg.ShutdownSteps)
+	shutdownStarted := time.Now()
+	grace := cfg.DrainDelay + cfg.ShutdownDrain + 2*cfg.ShutdownTimeout
+	// After a restart, the new process is the one systemd hears from
+	status := func(string) {}
+	if handedOff {
+		close(watchdog)
+	} else {
+		// Gives systemd's stop timeout room for the whole sequence
+		sdNotify("STOPPING=1\nSTATUS=Shutting down\nEXTEND_TIMEOUT_USEC=" + strconv.FormatInt(grace.Microseconds(), 10))
+		status = func(s string) { sdNotify("STATUS=" + s) }
+	}
+	// Prefork children run the same steps themselves
+	children.stop(grace)
+	var reconnected, closed, queued int
+	for _, step := range cfg.ShutdownSteps {
+		switch step {
+		case stepReadiness:
+			status("Shutting down: failing readiness")
+			// Fail readiness, so load balancers stop sending new connections
+			// before the open ones end
+			ready.drain()
+			if cfg.DrainDelay > 0 {
+				logger.Info("Draining before shutdown", "delay", cfg.DrainDelay.String())
+				time.Sleep(cfg.DrainDelay)
+			}
+		case stepDrain:
+			if cfg.ShutdownDrain > 0 {
+				status("Shutting down: asking sessions to reconnect")
+				reconnected = drain.finish(cfg.ShutdownDrain)
+			}
+		case stepClose:
+			// Stop taking in new events, then close all SSE connections
+			status("Shutting down: closing sessions")
+			sources.stop()
+			closed, queued = currentBroker.shutdown()
+			logger.Info("Sessions closed", "sessions", closed, "queuedEvents", queued)
+		}
+	}
+	stopGRPCServer(grpcServer, cfg.ShutdownTimeout)
 
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
 	defer cancel()
 
 	if err := app.ShutdownWithContext(shutdownCtx); err != nil {
-		log.Fatalf("Server shutdown error: %v", err)
+		fatal("Server shutdown error", err)
+	}
+	if admin != app {
+		if err := admin.ShutdownWithContext(shutdownCtx); err != nil {
+			logger.Error("Admin server shutdown error", "error", err)
+		}
+	}
+	if challenges != nil {
+		_ = challenges.Shutdown(shutdownCtx)
+	}
+	currentBroker.presence.close(shutdownCtx)
+	currentBroker.push.close(shutdownCtx)
+	alerts.close(shutdownCtx)
+	if errorReporter != nil {
+		errorReporter.Close(shutdownCtx)
 	}
 
-	log.Println("Server shutdown complete.")
+	currentBroker.wal.close()
+	if stopTracing != nil {
+		if err := stopTracing(shutdownCtx); err != nil {
+			logger.Error("Trace export error", "error", err)
+		}
+	}
+	logger.Info("Server shutdown complete", "reconnected", reconnected, "closed", closed, "queuedEvents", queued,
+		"unsentEvents", currentBroker.unsentOnShutdown.Load(), "durationMs", time.Since(shutdownStarted).Milliseconds())
 }
 
-func buildSSEPayload(eventType string, data any) (string, error) {
+func buildSSEPayload(id uint64, eventType string, data any) (string, error) {
 	var buf bytes.Buffer
 	enc := json.NewEncoder(&buf)
 
-	// Create JSON-serializable structure
-	payload := map[string]any{"data": data}
+	// Create JSON-serializable structure; a CloudEvent carries its data
+	// itself, so it is the whole data line
+	var payload any = map[string]any{"data": data}
+	if ce, ok := data.(cloudEventEnvelope); ok {
+		payload = ce
+	}
 
 	// Encode the payload into JSON and write it into a buffer
 	if err := enc.Encode(payload); err != nil {
@@ -251,6 +1376,11 @@ func buildSSEPayload(eventType string, data any) (string, error) {
 	// Add SSE event type
 	sb.WriteString(fmt.Sprintf("event: %s\n", eventType))
 
+	// Add event ID so clients can acknowledge it (0 means the event has none)
+	if id != 0 {
+		sb.WriteString(fmt.Sprintf("id: %d\n", id))
+	}
+
 	// Add retry interval (client will retry connection after 15s if disconnected)
 	sb.WriteString("retry: 15000\n")
 
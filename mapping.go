@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fieldArg is what one of a source's own kinds of field takes after its colon
+type fieldArg int
+
+const (
+	// noArg fields stand alone, like "key"
+	noArg fieldArg = iota
+	// nameArg fields name something, like "header:<name>"
+	nameArg
+	// indexArg fields count parts from 0, like "segment:<n>"
+	indexArg
+	// optionalIndexArg fields stand alone or count parts, like "routing-key"
+	// and "routing-key:<n>"
+	optionalIndexArg
+)
+
+// messageField says where a value is read from in a message being mapped
+// onto a publish: "json:<dot.path>" into a JSON body, "message" for the
+// whole body, or one of the kinds of field the source adds, such as "key" or
+// "header:<name>"
+type messageField struct {
+	kind string
+	name string
+	// index is the part a counting field picks, or -1 for the whole
+	index int
+}
+
+// parseMessageField parses spec, allowing the source's own kinds of field
+// besides "json" and "message"
+func parseMessageField(spec string, kinds map[string]fieldArg) (messageField, error) {
+	kind, name, hasName := strings.Cut(spec, ":")
+	arg, ok := kinds[kind]
+	switch kind {
+	case "message":
+		arg, ok = noArg, true
+	case "json":
+		arg, ok = nameArg, true
+	}
+	if !ok {
+		return messageField{}, fmt.Errorf("unknown field %q", spec)
+	}
+	f := messageField{kind: kind, index: -1}
+	switch arg {
+	case nameArg:
+		if name == "" {
+			return messageField{}, fmt.Errorf("%q needs a name", spec)
+		}
+		f.name = name
+	case indexArg, optionalIndexArg:
+		if arg == optionalIndexArg && !hasName {
+			break
+		}
+		n, err := strconv.Atoi(name)
+		if err != nil || n < 0 {
+			return messageField{}, fmt.Errorf("%q needs a part number", spec)
+		}
+		f.index = n
+	}
+	return f, nil
+}
+
+// jsonPath follows a dot path such as "data.object.id" or "commits.0.id"
+// into a decoded JSON value; it returns nil where the path leads nowhere
+func jsonPath(v any, path string) any {
+	for key := range strings.SplitSeq(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+// fieldPart returns the index-th sep-separated part of s, all of s for -1,
+// or nil past the last part
+func fieldPart(s, sep string, index int) any {
+	if index < 0 {
+		return s
+	}
+	parts := strings.Split(s, sep)
+	if index >= len(parts) {
+		return nil
+	}
+	return parts[index]
+}
+
+// mappedMessage is a message being mapped onto a publish
+type mappedMessage struct {
+	// own reads the source's own kinds of field; a missing field is nil
+	own  func(f messageField) any
+	body any
+	// bodyErr is why the body isn't JSON, reported only if a field needs it
+	bodyErr error
+}
+
+func newMappedMessage(own func(messageField) any, body []byte) *mappedMessage {
+	m := &mappedMessage{own: own}
+	// Numbers are kept as sent, so large IDs don't lose digits
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	m.bodyErr = dec.Decode(&m.body)
+	return m
+}
+
+// value returns the field's value; a missing field is nil
+func (m *mappedMessage) value(f messageField) (any, error) {
+	switch f.kind {
+	case "json", "message":
+	default:
+		return m.own(f), nil
+	}
+	if m.bodyErr != nil {
+		return nil, fmt.Errorf("body is not JSON: %w", m.bodyErr)
+	}
+	if f.kind == "message" {
+		return m.body, nil
+	}
+	return jsonPath(m.body, f.name), nil
+}
+
+// text returns the field's value as a string; an unset or missing field is
+// empty
+func (m *mappedMessage) text(f messageField) (string, error) {
+	if f.kind == "" {
+		return "", nil
+	}
+	v, err := m.value(f)
+	if err != nil || v == nil {
+		return "", err
+	}
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// fieldMapping says where a source reads the user, topic and value of each
+// message it publishes
+type fieldMapping struct {
+	user  messageField
+	topic messageField
+	value messageField
+}
+
+// newFieldMapping parses a source's fields, allowing its own kinds; errors
+// name the settings by their env prefix. Without a topic field, messages
+// are published without a topic.
+func newFieldMapping(prefix string, kinds map[string]fieldArg, user, topic, value string) (fieldMapping, error) {
+	var fm fieldMapping
+	var err error
+	if fm.user, err = parseMessageField(user, kinds); err != nil {
+		return fm, fmt.Errorf("%s_USER_FIELD: %w", prefix, err)
+	}
+	if topic != "" {
+		if fm.topic, err = parseMessageField(topic, kinds); err != nil {
+			return fm, fmt.Errorf("%s_TOPIC_FIELD: %w", prefix, err)
+		}
+	}
+	if fm.value, err = parseMessageField(value, kinds); err != nil {
+		return fm, fmt.Errorf("%s_VALUE_FIELD: %w", prefix, err)
+	}
+	return fm, nil
+}
+
+// resolve reads the user a message is published to, its topic and value, or
+// returns why it can't be mapped
+func (fm fieldMapping) resolve(m *mappedMessage) (userID, topic string, value any, err error) {
+	if userID, err = m.text(fm.user); err == nil && userID == "" {
+		err = errors.New("no userID")
+	}
+	if err == nil {
+		topic, err = m.text(fm.topic)
+	}
+	if err == nil {
+		value, err = m.value(fm.value)
+	}
+	return userID, topic, value, err
+}
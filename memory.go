@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+// memorySettings are the Go runtime's memory limit and GC percent, and the
+// size of the heap ballast
+type memorySettings struct {
+	// limit is the soft memory limit in bytes, and gcPercent GOGC's value
+	// (-1 turns the GC off until the limit); either is what the process
+	// started with when unset
+	limit     int64
+	gcPercent int
+	ballast   int64
+}
+
+// runtimeDefaults are the memory limit and GC percent the process started
+// with, from GOMEMLIMIT and GOGC, put back when the settings are unset
+var runtimeDefaults = sync.OnceValue(func() memorySettings {
+	gc := debug.SetGCPercent(100)
+	debug.SetGCPercent(gc)
+	return memorySettings{limit: debug.SetMemoryLimit(-1), gcPercent: gc}
+})
+
+// currentGCPercent is GOGC's value in force, for /metrics; the runtime only
+// tells by being given another
+var currentGCPercent atomic.Int64
+
+// gcBallast is never read; it only makes the heap look larger to the GC
+var gcBallast []byte
+
+// parseMemorySettings reads SSE_MEMORY_LIMIT, SSE_GC_PERCENT and
+// SSE_GC_BALLAST
+func parseMemorySettings(cfg config) (memorySettings, error) {
+	ms := runtimeDefaults()
+	var err error
+	if cfg.MemoryLimit != "" {
+		if ms.limit, err = parseMemorySize(cfg.MemoryLimit); err != nil {
+			return ms, fmt.Errorf("SSE_MEMORY_LIMIT: %w", err)
+		}
+	}
+	switch cfg.GCPercent {
+	case "":
+	case "off":
+		ms.gcPercent = -1
+	default:
+		if ms.gcPercent, err = strconv.Atoi(cfg.GCPercent); err != nil || ms.gcPercent < 0 {
+			return ms, fmt.Errorf("SSE_GC_PERCENT: %q is not a percentage or off", cfg.GCPercent)
+		}
+	}
+	if cfg.GCBallast != "" {
+		if ms.ballast, err = parseMemorySize(cfg.GCBallast); err != nil {
+			return ms, fmt.Errorf("SSE_GC_BALLAST: %w", err)
+		}
+	}
+	if cfg.GCPercent == "off" && ms.limit == math.MaxInt64 {
+		return ms, errors.New("SSE_GC_PERCENT=off needs SSE_MEMORY_LIMIT, or the heap grows without bound")
+	}
+	return ms, nil
+}
+
+// parseMemorySize reads a size as GOMEMLIMIT takes it, in bytes or with a
+// B, KiB, MiB, GiB or TiB suffix, or a percentage of the memory the process
+// may use: its cgroup's limit in a container, the host's otherwise
+func parseMemorySize(v string) (int64, error) {
+	if pct, ok := strings.CutSuffix(v, "%"); ok {
+		p, err := strconv.ParseFloat(pct, 64)
+		if err != nil || p <= 0 || p > 100 {
+			return 0, fmt.Errorf("%q is not a percentage", v)
+		}
+		total, err := availableMemory()
+		if err != nil {
+			return 0, err
+		}
+		return int64(float64(total) * p / 100), nil
+	}
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}, {"B", 1}}
+	unit := int64(1)
+	for _, u := range units {
+		if n, ok := strings.CutSuffix(v, u.suffix); ok {
+			v, unit = n, u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/unit {
+		return 0, fmt.Errorf("%q is not a size such as 1536MiB", v)
+	}
+	return n * unit, nil
+}
+
+// availableMemory is the memory limit of the process's cgroup, or the host's
+// memory when there is none
+func availableMemory() (int64, error) {
+	// cgroup v2, then v1, which reports no limit as a huge number
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(raw)), 10, 64)
+		if err == nil && n > 0 && n < 1<<60 {
+			return n, nil
+		}
+	}
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, fmt.Errorf("memory size unknown: %w", err)
+	}
+	return int64(vm.Total), nil
+}
+
+// apply puts the memory limit and GC percent in force; the ballast is only
+// allocated at startup
+func (ms memorySettings) apply() {
+	debug.SetMemoryLimit(ms.limit)
+	debug.SetGCPercent(ms.gcPercent)
+	currentGCPercent.Store(int64(ms.gcPercent))
+}
+
+// setupMemory applies cfg's memory settings at startup
+func setupMemory(cfg config) error {
+	ms, err := parseMemorySettings(cfg)
+	if err != nil {
+		return err
+	}
+	ms.apply()
+	if ms.ballast > 0 {
+		// Never written, so the pages aren't resident
+		gcBallast = make([]byte, ms.ballast)
+	}
+	if cfg.MemoryLimit != "" || cfg.GCPercent != "" || ms.ballast > 0 {
+		logger.Info("Memory settings", "limit", ms.limit, "gcPercent", ms.gcPercent, "ballast", ms.ballast)
+	}
+	return nil
+}
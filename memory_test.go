@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+func TestParseMemorySize(t *testing.T) {
+	tests := []struct {
+		v    string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1024", 1024, true},
+		{"10B", 10, true},
+		{"4KiB", 4 << 10, true},
+		{"1536MiB", 1536 << 20, true},
+		{"2GiB", 2 << 30, true},
+		{"1TiB", 1 << 40, true},
+		{"512 MiB", 512 << 20, true},
+		{"8388607TiB", 8388607 << 40, true},
+		{"8388608TiB", 0, false},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"1.5GiB", 0, false},
+		{"1GB", 0, false},
+		{"MiB", 0, false},
+		{"0%", 0, false},
+		{"101%", 0, false},
+		{"half%", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseMemorySize(tt.v)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseMemorySize(%q) error = %v, want ok %v", tt.v, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseMemorySize(%q) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestParseMemorySizePercent(t *testing.T) {
+	total, err := availableMemory()
+	if err != nil {
+		t.Skipf("available memory unknown: %v", err)
+	}
+	tests := []struct {
+		v    string
+		want int64
+	}{
+		{"100%", total},
+		{"50%", total / 2},
+		{"12.5%", total / 8},
+	}
+	for _, tt := range tests {
+		got, err := parseMemorySize(tt.v)
+		if err != nil {
+			t.Errorf("parseMemorySize(%q) error = %v", tt.v, err)
+			continue
+		}
+		// Percentages go through a float, which may round the last byte
+		if d := got - tt.want; d < -1 || d > 1 {
+			t.Errorf("parseMemorySize(%q) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// brokerMetrics are the counters and histograms /metrics exposes in the
+// Prometheus text format. Gauges are read from the broker when scraped.
+type brokerMetrics struct {
+	published atomic.Uint64
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+	bytes     atomic.Uint64
+	// deliveryLatency is the time from publish to the event being written to
+	// a live stream and flushed, and recentLatency the latest of those times
+	deliveryLatency *histogram
+	recentLatency   *latencyWindow
+	// handlers times requests by method and route
+	handlers *histogramVec
+	// userBuckets is how many buckets users are hashed into for the
+	// per-bucket session gauge, which keeps user IDs out of the labels
+	userBuckets int
+	// system samples the host and process resources
+	system *systemCollector
+	// rates measures the publish and drop rates for /admin/overview
+	rates *eventRates
+}
+
+var latencyBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+func newBrokerMetrics(cfg config) *brokerMetrics {
+	m := &brokerMetrics{
+		deliveryLatency: newHistogram(latencyBuckets),
+		recentLatency:   newLatencyWindow(cfg.MetricsLatencySamples),
+		handlers:        &histogramVec{buckets: latencyBuckets, series: make(map[string]*histogram)},
+		userBuckets:     max(cfg.MetricsUserBuckets, 1),
+		system:          newSystemCollector(cfg.SystemMetricsInterval, cfg.SystemDiskPath),
+	}
+	m.rates = newEventRates(&m.published, &m.dropped)
+	return m
+}
+
+// histogram counts observations into cumulative buckets of upper bounds
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i, _ := slices.BinarySearch(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// histogramVec is a histogram per set of label values
+type histogramVec struct {
+	buckets []float64
+	mu      sync.Mutex
+	// series is keyed by the rendered labels, such as `method="GET",route="/"`
+	series map[string]*histogram
+}
+
+func (hv *histogramVec) with(labels string) *histogram {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.series[labels]
+	if !ok {
+		h = newHistogram(hv.buckets)
+		hv.series[labels] = h
+	}
+	return h
+}
+
+// latencyWindow keeps the latest observations, for the quantiles of recent
+// deliveries
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []float64
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{samples: make([]float64, max(size, 1))}
+}
+
+func (w *latencyWindow) observe(v float64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.samples[w.next] = v
+	w.next = (w.next + 1) % len(w.samples)
+	w.full = w.full || w.next == 0
+}
+
+// quantiles returns the nearest-rank value of each of qs, or nil when
+// nothing has been observed
+func (w *latencyWindow) quantiles(qs ...float64) []float64 {
+	w.mu.Lock()
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	sorted := slices.Clone(w.samples[:n])
+	w.mu.Unlock()
+	if n == 0 {
+		return nil
+	}
+	slices.Sort(sorted)
+	out := make([]float64, len(qs))
+	for i, q := range qs {
+		out[i] = sorted[max(int(math.Ceil(q*float64(n)))-1, 0)]
+	}
+	return out
+}
+
+// latencyQuantiles are the quantiles /metrics reports of recent deliveries
+var latencyQuantiles = []float64{.5, .95, .99}
+
+// observeDelivery records ev being written to a live stream of st's session
+// and flushed
+func (m *brokerMetrics) observeDelivery(ev event, st *sessionStats) {
+	m.delivered.Add(1)
+	st.delivered.Add(1)
+	if ev.PublishedAt.IsZero() {
+		return
+	}
+	d := time.Since(ev.PublishedAt).Seconds()
+	m.deliveryLatency.observe(d)
+	m.recentLatency.observe(d)
+	st.latency.observe(d)
+}
+
+// middleware times each request by its route. Streams and profiles are left
+// out, as they last as long as the client stays connected or asked for.
+func (m *brokerMetrics) middleware() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		if c.Path() == "/sse" || strings.HasPrefix(c.Path(), "/debug/") {
+			return c.Next()
+		}
+		start := time.Now()
+		err := c.Next()
+		if streaming, _ := c.Locals("streaming").(bool); streaming {
+			return err
+		}
+		// Unmatched paths share one series, so scanners can't add any
+		route := "unmatched"
+		if rt := c.Route(); rt != nil && (rt.Path != "/" || c.Path() == "/") {
+			route = rt.Path
+		}
+		labels := fmt.Sprintf(`method=%q,route=%q`, c.Method(), route)
+		m.handlers.with(labels).observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// write renders the metrics in the Prometheus text exposition format
+func (m *brokerMetrics) write(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	b := currentBroker
+
+	sessions := b.sessions.matching(func(*session) bool { return true })
+	type bucket struct {
+		sessions, queued int
+		dropped          int64
+	}
+	buckets := make([]bucket, m.userBuckets)
+	now := time.Now()
+	for _, s := range sessions {
+		st := s.deliveryStats(now)
+		bk := &buckets[ringHash(s.userID)%uint64(m.userBuckets)]
+		bk.sessions++
+		bk.queued += st.Queued
+		bk.dropped += st.Dropped
+	}
+	metricHeader(w, "sse_sessions", "gauge", "Open sessions on this instance.")
+	fmt.Fprintf(w, "sse_sessions %d\n", len(sessions))
+	metricHeader(w, "sse_user_bucket_sessions", "gauge", "Open sessions by the bucket their user hashes to.")
+	for i, bk := range buckets {
+		fmt.Fprintf(w, "sse_user_bucket_sessions{bucket=\"%d\"} %d\n", i, bk.sessions)
+	}
+	metricHeader(w, "sse_user_bucket_queued_events", "gauge", "Events waiting in the buffers of open sessions, by user bucket.")
+	for i, bk := range buckets {
+		fmt.Fprintf(w, "sse_user_bucket_queued_events{bucket=\"%d\"} %d\n", i, bk.queued)
+	}
+	metricHeader(w, "sse_user_bucket_dropped_events", "gauge", "Events dropped so far by open sessions, by user bucket.")
+	for i, bk := range buckets {
+		fmt.Fprintf(w, "sse_user_bucket_dropped_events{bucket=\"%d\"} %d\n", i, bk.dropped)
+	}
+	build := binaryInfo()
+	metricHeader(w, "sse_build_info", "gauge", "Always 1, labelled with the running binary's version.")
+	fmt.Fprintf(w, "sse_build_info{version=%q,commit=%q,goversion=%q} 1\n", build.Version, build.Commit, build.GoVersion)
+	metricHeader(w, "sse_process_start_time_seconds", "gauge", "Start time of the process since the Unix epoch.")
+	fmt.Fprintf(w, "sse_process_start_time_seconds %d\n", startedAt.Unix())
+	metricHeader(w, "sse_open_connections", "gauge", "Connections open on the public listener.")
+	fmt.Fprintf(w, "sse_open_connections %d\n", openConnections())
+
+	counters := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"sse_events_published_total", "Events published.", m.published.Load()},
+		{"sse_events_delivered_total", "Events written to live streams.", m.delivered.Load()},
+		{"sse_events_dropped_total", "Events a session's buffer had no room for.", m.dropped.Load()},
+		{"sse_written_bytes_total", "Bytes written to streams.", m.bytes.Load()},
+		{"sse_slow_consumer_evictions_total", "Sessions evicted for not keeping up.", uint64(b.slowConsumers.evictions.Load())},
+		{"sse_connections_rejected_total", "Streams refused for being over a connection limit.", b.limits.rejected.Load()},
+		{"sse_sessions_replaced_total", "Sessions closed to make room for newer ones.", b.limits.closed.Load()},
+	}
+	for _, c := range counters {
+		metricHeader(w, c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+	}
+
+	metricHeader(w, "sse_delivery_latency_seconds", "histogram", "Time from publish to the event being written to a stream and flushed.")
+	writeHistogram(w, "sse_delivery_latency_seconds", "", m.deliveryLatency)
+	if qs := m.recentLatency.quantiles(latencyQuantiles...); qs != nil {
+		metricHeader(w, "sse_delivery_latency_recent_seconds", "gauge", "Quantiles of the time from publish to flush over the latest deliveries.")
+		for i, q := range latencyQuantiles {
+			fmt.Fprintf(w, "sse_delivery_latency_recent_seconds{quantile=%q} %s\n", strconv.FormatFloat(q, 'g', -1, 64), strconv.FormatFloat(qs[i], 'g', -1, 64))
+		}
+	}
+	metricHeader(w, "sse_http_request_duration_seconds", "histogram", "Time taken to handle requests, by route.")
+	m.handlers.mu.Lock()
+	labels := make([]string, 0, len(m.handlers.series))
+	for l := range m.handlers.series {
+		labels = append(labels, l)
+	}
+	m.handlers.mu.Unlock()
+	slices.Sort(labels)
+	for _, l := range labels {
+		writeHistogram(w, "sse_http_request_duration_seconds", l, m.handlers.with(l))
+	}
+
+	m.writeSystem(w)
+
+	metricHeader(w, "go_goroutines", "gauge", "Goroutines that currently exist.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	metricHeader(w, "go_memstats_heap_alloc_bytes", "gauge", "Bytes of allocated heap objects.")
+	fmt.Fprintf(w, "go_memstats_heap_alloc_bytes %d\n", mem.HeapAlloc)
+	metricHeader(w, "go_gc_cycles_total", "counter", "Completed GC cycles.")
+	fmt.Fprintf(w, "go_gc_cycles_total %d\n", mem.NumGC)
+	metricHeader(w, "go_gc_gogc_percent", "gauge", "Heap size target percentage (GOGC); -1 when the GC only runs at the memory limit.")
+	fmt.Fprintf(w, "go_gc_gogc_percent %d\n", currentGCPercent.Load())
+	metricHeader(w, "go_gc_gomemlimit_bytes", "gauge", "Go runtime soft memory limit (GOMEMLIMIT).")
+	fmt.Fprintf(w, "go_gc_gomemlimit_bytes %d\n", debug.SetMemoryLimit(-1))
+	return w.Flush()
+}
+
+func metricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeHistogram writes h's cumulative buckets, sum and count; labels, if
+// any, are added to each series
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=%q} %d\n", name, labels, sep, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// metricsContentType is the Prometheus text exposition format
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// writeSystem renders the latest system sample, leaving out what couldn't
+// be read
+func (m *brokerMetrics) writeSystem(w io.Writer) {
+	s := m.system.current()
+	if s.fds >= 0 {
+		metricHeader(w, "process_open_fds", "gauge", "Open file descriptors, sockets included.")
+		fmt.Fprintf(w, "process_open_fds %d\n", s.fds)
+	}
+	if s.fdLimit >= 0 {
+		metricHeader(w, "process_max_fds", "gauge", "Most file descriptors the process may open.")
+		fmt.Fprintf(w, "process_max_fds %d\n", s.fdLimit)
+	}
+	if s.tcpStates != nil {
+		metricHeader(w, "sse_tcp_connections", "gauge", "The process's TCP connections, by state.")
+		states := slices.Sorted(maps.Keys(s.tcpStates))
+		for _, state := range states {
+			fmt.Fprintf(w, "sse_tcp_connections{state=%q} %d\n", state, s.tcpStates[state])
+		}
+	}
+	if s.net != nil {
+		metricHeader(w, "sse_network_receive_bytes_total", "counter", "Bytes received by the host's network interfaces.")
+		fmt.Fprintf(w, "sse_network_receive_bytes_total %d\n", s.net.BytesRecv)
+		metricHeader(w, "sse_network_transmit_bytes_total", "counter", "Bytes sent by the host's network interfaces.")
+		fmt.Fprintf(w, "sse_network_transmit_bytes_total %d\n", s.net.BytesSent)
+	}
+	if s.disk != nil {
+		metricHeader(w, "sse_disk_size_bytes", "gauge", "Size of the filesystem holding SSE_SYSTEM_DISK_PATH.")
+		fmt.Fprintf(w, "sse_disk_size_bytes{path=%q} %d\n", s.disk.Path, s.disk.Total)
+		metricHeader(w, "sse_disk_free_bytes", "gauge", "Free space on the filesystem holding SSE_SYSTEM_DISK_PATH.")
+		fmt.Fprintf(w, "sse_disk_free_bytes{path=%q} %d\n", s.disk.Path, s.disk.Free)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// clientCerts authenticates publishers by the certificate they presented,
+// which the listener has already verified against the client CA. The
+// certificate's common name or one of its SANs is the caller's name.
+type clientCerts struct {
+	// names lists which certificate names are tried, in order: cn, dns, uri
+	// or email
+	names  []string
+	scopes map[string]*publishScope
+}
+
+// newClientCerts returns nil when no client CA is set
+func newClientCerts(cfg config) (*clientCerts, error) {
+	if cfg.MTLSClientCA == "" {
+		return nil, nil
+	}
+	cc := &clientCerts{names: splitList(cfg.MTLSIdentity)}
+	if len(cc.names) == 0 {
+		return nil, errors.New("no certificate names to identify callers by")
+	}
+	for _, n := range cc.names {
+		switch n {
+		case "cn", "dns", "uri", "email":
+		default:
+			return nil, fmt.Errorf("unknown certificate name %q", n)
+		}
+	}
+	scopes, err := parsePublishScopes(cfg.MTLSScopes, "client certificate")
+	if err != nil {
+		return nil, err
+	}
+	cc.scopes = scopes
+	return cc, nil
+}
+
+func (cc *clientCerts) Authenticate(r AuthRequest) (Identity, error) {
+	// Only verified chains count; a certificate the listener merely received
+	// proves nothing
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Identity{}, errNoCredentials
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	name := cc.subject(cert)
+	if name == "" {
+		return Identity{}, errors.New("client certificate names no caller")
+	}
+	return Identity{
+		Subject: name,
+		Claims: map[string]any{
+			"serial": cert.SerialNumber.String(),
+			"issuer": cert.Issuer.String(),
+		},
+		Method: "mtls",
+		Scope:  cc.scopes[name],
+	}, nil
+}
+
+// subject returns the first of the configured names the certificate has
+func (cc *clientCerts) subject(cert *x509.Certificate) string {
+	for _, n := range cc.names {
+		switch {
+		case n == "cn" && cert.Subject.CommonName != "":
+			return cert.Subject.CommonName
+		case n == "dns" && len(cert.DNSNames) > 0:
+			return cert.DNSNames[0]
+		case n == "uri" && len(cert.URIs) > 0:
+			// SPIFFE IDs, such as spiffe://example.org/orders
+			return cert.URIs[0].String()
+		case n == "email" && len(cert.EmailAddresses) > 0:
+			return cert.EmailAddresses[0]
+		}
+	}
+	return ""
+}
+
+// loadClientCA reads the PEM bundle of CAs that sign client certificates
+func loadClientCA(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s holds no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// adminTLSConfig returns the TLS setup of the admin listener, nil for
+// plaintext. With a client CA, every connection must present a certificate
+// it signed.
+func adminTLSConfig(cfg config) (*tls.Config, error) {
+	if cfg.AdminTLSCert == "" {
+		if cfg.MTLSClientCA != "" {
+			return nil, errors.New("client certificates on the admin listener need its own certificate")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.AdminTLSCert, cfg.AdminTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}}
+	if cfg.MTLSClientCA != "" {
+		pool, err := loadClientCA(cfg.MTLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// publicClientAuth asks clients of the public listener for a certificate
+// when it also serves the publish routes. Browsers opening streams have
+// none, so one is verified only if given.
+func publicClientAuth(cfg config) (func(*tls.Config), error) {
+	if cfg.MTLSClientCA == "" || cfg.AdminAddr != "" {
+		return nil, nil
+	}
+	if !cfg.tlsEnabled() {
+		return nil, errors.New("client certificates need HTTPS")
+	}
+	pool, err := loadClientCA(cfg.MTLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+	return func(tc *tls.Config) {
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+	}, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+)
+
+// nodeStats is one instance's share of the connections
+type nodeStats struct {
+	Node            string `json:"node"`
+	OpenConnections int32  `json:"openConnections"`
+	Sessions        int    `json:"sessions"`
+	Users           int    `json:"users"`
+	// Error is set when the instance couldn't be asked
+	Error string `json:"error,omitempty"`
+}
+
+// sessionInfo describes one session for /sessions
+type sessionInfo struct {
+	SessionID string   `json:"sessionID"`
+	UserID    string   `json:"userID"`
+	Topics    []string `json:"topics"`
+	Node      string   `json:"node"`
+	RemoteIP  string   `json:"remoteIP,omitempty"`
+	UserAgent string   `json:"userAgent,omitempty"`
+	// Metadata is what the client said about itself when connecting
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Labels tag the session for publishes that select by label
+	Labels      map[string]string `json:"labels,omitempty"`
+	ConnectedAt time.Time         `json:"connectedAt"`
+	deliveryStats
+}
+
+// peerQuery asks an instance for its local view
+type peerQuery struct {
+	// Sessions asks for the sessions as well as the counts
+	Sessions  bool   `json:"sessions,omitempty"`
+	UserID    string `json:"userID,omitempty"`
+	SessionID string `json:"sessionID,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	// Disconnect, when set, closes the sessions matched, with a final
+	// disconnect event giving it as the reason
+	Disconnect string `json:"disconnect,omitempty"`
+	// Pause and Resume pause and resume delivery to UserID
+	Pause  *pauseRequest `json:"pause,omitempty"`
+	Resume bool          `json:"resume,omitempty"`
+	// Overview asks for the instance's part of /admin/overview
+	Overview bool `json:"overview,omitempty"`
+	// Ban bans its user, and Unban lifts UserID's ban
+	Ban   *userBan `json:"ban,omitempty"`
+	Unban bool     `json:"unban,omitempty"`
+	// Command acts on one live session, on the instance that holds it
+	Command *sessionCommand `json:"command,omitempty"`
+}
+
+// peerReply is one instance's answer to a peerQuery
+type peerReply struct {
+	Stats    nodeStats     `json:"stats"`
+	Sessions []sessionInfo `json:"sessions,omitempty"`
+	// Matched is how many sessions matched the query, before the limit
+	Matched int `json:"matched,omitempty"`
+	// Pause is the user's pause once a Pause or Resume query is done, nil
+	// when resuming a user that wasn't paused
+	Pause *pauseInfo `json:"pause,omitempty"`
+	// Ban is the ban added or lifted by a Ban or Unban query
+	Ban *userBan `json:"ban,omitempty"`
+	// Overview answers an Overview query
+	Overview *nodeOverview `json:"overview,omitempty"`
+	// Command is what a Command query did, nil when the instance doesn't
+	// hold the session
+	Command *sessionCommandResult `json:"command,omitempty"`
+}
+
+// sessionCommand is a client's request about one of its live sessions. It
+// has to run on the instance holding the session, which, under prefork or
+// behind a load balancer, needn't be the one the request reached.
+type sessionCommand struct {
+	SessionID string `json:"sessionID"`
+	// Owner, when set, is the user the session has to belong to
+	Owner string `json:"owner,omitempty"`
+	// Ack acknowledges that the client processed this event
+	Ack uint64 `json:"ack,omitempty"`
+	// Resubscribe changes the session's topics by Subscribe and Unsubscribe
+	Resubscribe bool     `json:"resubscribe,omitempty"`
+	Subscribe   []string `json:"subscribe,omitempty"`
+	Unsubscribe []string `json:"unsubscribe,omitempty"`
+	// ExpiresAt, when set, is the new expiry of the session's credential
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// sessionCommandResult is what became of a sessionCommand on the instance
+// holding the session
+type sessionCommandResult struct {
+	UserID string `json:"userID,omitempty"`
+	// Forbidden is set when the session isn't the Owner's, and nothing was done
+	Forbidden bool     `json:"forbidden,omitempty"`
+	Topics    []string `json:"topics"`
+}
+
+// peerQuerier is implemented by backplanes that can ask the other instances
+// for their local view, so any instance can answer for the whole cluster
+type peerQuerier interface {
+	queryPeers(ctx context.Context, q peerQuery) []peerReply
+}
+
+// peerQueryTimeout bounds how long cluster-wide endpoints wait for instances
+const peerQueryTimeout = 2 * time.Second
+
+// openConnections counts the connections open on the API listener; main sets it
+var openConnections = func() int32 { return 0 }
+
+// localView answers q for this instance
+func (b *broker) localView(q peerQuery) peerReply {
+	reply := peerReply{Stats: nodeStats{
+		Node:            b.nodeID,
+		OpenConnections: openConnections(),
+		Sessions:        b.sessions.count(),
+		Users:           len(b.sessions.users()),
+	}}
+	switch {
+	case q.Pause != nil:
+		info := b.pause(q.UserID, *q.Pause)
+		reply.Pause = &info
+	case q.Resume:
+		if info, ok := b.resume(q.UserID); ok {
+			reply.Pause = &info
+		}
+	case q.Ban != nil:
+		// Before any Disconnect, so a reconnect can't slip in between
+		b.bans.add(*q.Ban)
+		reply.Ban = q.Ban
+		logger.Warn("User banned", "userID", q.Ban.UserID, "reason", q.Ban.Reason, "until", q.Ban.Until)
+	case q.Unban:
+		if ban, ok := b.bans.remove(q.UserID); ok {
+			reply.Ban = &ban
+			logger.Info("User unbanned", "userID", q.UserID)
+		}
+	}
+	if q.Command != nil {
+		if res, ok := b.runCommandLocal(*q.Command); ok {
+			reply.Command = &res
+		}
+	}
+	if q.Overview {
+		reply.Overview = b.overview()
+	}
+	if !q.Sessions {
+		return reply
+	}
+	matched := b.sessions.matching(func(s *session) bool {
+		return (q.UserID == "" || s.userID == q.UserID) && (q.SessionID == "" || s.id == q.SessionID)
+	})
+	slices.SortFunc(matched, func(a, b *session) int { return a.connectedAt.Compare(b.connectedAt) })
+	reply.Matched = len(matched)
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[:q.Limit]
+	}
+	reply.Sessions = make([]sessionInfo, 0, len(matched))
+	now := time.Now()
+	for _, s := range matched {
+		if q.Disconnect != "" && !b.disconnect(s, q.Disconnect) {
+			// Already closing, so not this query's to report
+			continue
+		}
+		reply.Sessions = append(reply.Sessions, sessionInfo{
+			SessionID:     s.id,
+			UserID:        s.userID,
+			Topics:        s.currentTopics(),
+			Node:          b.nodeID,
+			RemoteIP:      s.clientIP,
+			UserAgent:     s.userAgent,
+			Metadata:      s.metadata,
+			Labels:        s.labels,
+			ConnectedAt:   s.connectedAt,
+			deliveryStats: s.deliveryStats(now),
+		})
+	}
+	return reply
+}
+
+// disconnect closes s, sending a final disconnect event with reason instead
+// of what is still queued. It reports whether this call closed s.
+func (b *broker) disconnect(s *session, reason string) bool {
+	if !s.evictAs("disconnect", reason) {
+		return false
+	}
+	s.log.Info("Session disconnected", "reason", reason)
+	return true
+}
+
+// runCommand carries cmd out on this instance when it holds the session, and
+// otherwise asks the other instances, when the backplane can. It reports
+// false when no instance holds the session.
+func (b *broker) runCommand(ctx context.Context, cmd sessionCommand) (sessionCommandResult, bool) {
+	if res, ok := b.runCommandLocal(cmd); ok {
+		return res, true
+	}
+	pq, ok := b.backplane.(peerQuerier)
+	if !ok {
+		return sessionCommandResult{}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, peerQueryTimeout)
+	defer cancel()
+	for _, r := range pq.queryPeers(ctx, peerQuery{Command: &cmd}) {
+		if r.Command != nil {
+			return *r.Command, true
+		}
+	}
+	return sessionCommandResult{}, false
+}
+
+// runCommandLocal carries cmd out if this instance holds the session. An ack is
+// taken by the instance that tracked the event's delivery, which outlives
+// the session, and checked against the user the event was published to.
+func (b *broker) runCommandLocal(cmd sessionCommand) (sessionCommandResult, bool) {
+	if cmd.Ack != 0 {
+		rec, ok := b.deliveries.get(cmd.Ack)
+		if _, sent := rec.Sessions[cmd.SessionID]; !ok || !sent {
+			return sessionCommandResult{}, false
+		}
+		res := sessionCommandResult{UserID: rec.UserID}
+		if cmd.Owner != "" && cmd.Owner != rec.UserID {
+			res.Forbidden = true
+			return res, true
+		}
+		return res, b.ack(cmd.SessionID, cmd.Ack)
+	}
+	s := b.sessions.findSession(cmd.SessionID)
+	if s == nil {
+		return sessionCommandResult{}, false
+	}
+	res := sessionCommandResult{UserID: s.userID}
+	if cmd.Owner != "" && cmd.Owner != s.userID {
+		res.Forbidden = true
+		return res, true
+	}
+	if cmd.ExpiresAt != nil {
+		s.setAuthExpiry(*cmd.ExpiresAt)
+	}
+	if cmd.Resubscribe {
+		res.Topics, _ = b.updateSubscriptions(s.id, cmd.Subscribe, cmd.Unsubscribe)
+	}
+	return res, true
+}
+
+// clusterView answers q for this instance and, when the backplane can ask
+// them, every other one, ordered by node ID
+func (b *broker) clusterView(ctx context.Context, q peerQuery) []peerReply {
+	replies := []peerReply{b.localView(q)}
+	if pq, ok := b.backplane.(peerQuerier); ok {
+		ctx, cancel := context.WithTimeout(ctx, peerQueryTimeout)
+		defer cancel()
+		replies = append(replies, pq.queryPeers(ctx, q)...)
+	}
+	slices.SortFunc(replies, func(a, b peerReply) int { return cmp.Compare(a.Stats.Node, b.Stats.Node) })
+	return replies
+}
+
+// view answers q for this instance alone when scope is "local", and like
+// clusterView otherwise; either way, each instance acts on q once
+func (b *broker) view(ctx context.Context, q peerQuery, scope string) []peerReply {
+	if scope == "local" {
+		return []peerReply{b.localView(q)}
+	}
+	return b.clusterView(ctx, q)
+}
+
+// peerQueryMessage carries a peerQuery over a pub/sub backplane
+type peerQueryMessage struct {
+	Origin string `json:"origin"`
+	// ReplyTo is where the redis backplane publishes the replies
+	ReplyTo string    `json:"replyTo,omitempty"`
+	Query   peerQuery `json:"query"`
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// offlineQueue holds events in the Store for users without sessions and hands
+// them to the first session that connects
+type offlineQueue struct {
+	store Store
+	// limit caps queued events per user; ttl is how long they wait
+	limit int
+	ttl   time.Duration
+
+	// users with queued events, visited by prune
+	mu    sync.Mutex
+	users map[string]struct{}
+}
+
+func newOfflineQueue(store Store, limit int, ttl time.Duration) *offlineQueue {
+	return &offlineQueue{
+		store: store,
+		limit: limit,
+		ttl:   ttl,
+		users: make(map[string]struct{}),
+	}
+}
+
+func offlineStream(userID string) string {
+	return "offline:" + userID
+}
+
+func (q *offlineQueue) enabled() bool {
+	return q.limit > 0
+}
+
+// add queues ev for userID and reports whether there was room for it
+func (q *offlineQueue) add(userID string, ev event) bool {
+	ctx := context.Background()
+	stream := offlineStream(userID)
+	queued, err := q.store.Range(ctx, stream, 0, q.limit)
+	if err != nil {
+		logger.Error("Offline queue read error", "userID", userID, "error", err)
+		return false
+	}
+	if len(queued) >= q.limit {
+		return false
+	}
+	if err := q.store.Append(ctx, stream, ev); err != nil {
+		logger.Error("Offline queue append error", "userID", userID, "error", err)
+		return false
+	}
+	q.mu.Lock()
+	q.users[userID] = struct{}{}
+	q.mu.Unlock()
+	return true
+}
+
+// count returns how many events wait for userID
+func (q *offlineQueue) count(ctx context.Context, userID string) (int, error) {
+	if !q.enabled() {
+		return 0, nil
+	}
+	events, err := q.store.Range(ctx, offlineStream(userID), 0, 0)
+	return len(events), err
+}
+
+// take empties userID's queue. It returns the live events matching wants and,
+// separately, the ones that expired or that the session isn't subscribed to.
+func (q *offlineQueue) take(userID string, wants func(ev event) bool) (deliver, discard []event) {
+	ctx := context.Background()
+	stream := offlineStream(userID)
+	events, err := q.store.Range(ctx, stream, 0, 0)
+	if err != nil {
+		logger.Error("Offline queue read error", "userID", userID, "error", err)
+		return nil, nil
+	}
+	if len(events) == 0 {
+		return nil, nil
+	}
+	if err := q.store.Trim(ctx, stream, TrimOptions{UpTo: events[len(events)-1].ID}); err != nil {
+		logger.Error("Offline queue trim error", "userID", userID, "error", err)
+	}
+
+	now := time.Now()
+	for _, ev := range events {
+		if !q.stale(ev, now) && wants(ev) {
+			deliver = append(deliver, ev)
+		} else {
+			discard = append(discard, ev)
+		}
+	}
+	return deliver, discard
+}
+
+// prune removes and returns events that waited past their TTL, by user
+func (q *offlineQueue) prune() map[string][]event {
+	q.mu.Lock()
+	users := make([]string, 0, len(q.users))
+	for userID := range q.users {
+		users = append(users, userID)
+	}
+	q.mu.Unlock()
+
+	ctx := context.Background()
+	now := time.Now()
+	expired := make(map[string][]event)
+	for _, userID := range users {
+		stream := offlineStream(userID)
+		events, err := q.store.Range(ctx, stream, 0, 0)
+		if err != nil {
+			logger.Error("Offline queue read error", "userID", userID, "error", err)
+			continue
+		}
+		if len(events) == 0 {
+			q.mu.Lock()
+			delete(q.users, userID)
+			q.mu.Unlock()
+			continue
+		}
+		// Events are queued in publish order, so the stale ones by TTL form a prefix
+		n := 0
+		for n < len(events) && q.stale(events[n], now) {
+			n++
+		}
+		if n == 0 {
+			continue
+		}
+		if err := q.store.Trim(ctx, stream, TrimOptions{UpTo: events[n-1].ID}); err != nil {
+			logger.Error("Offline queue trim error", "userID", userID, "error", err)
+			continue
+		}
+		expired[userID] = events[:n]
+	}
+	return expired
+}
+
+func (q *offlineQueue) stale(ev event, now time.Time) bool {
+	return ev.expired(now) || (q.ttl > 0 && now.Sub(ev.PublishedAt) > q.ttl)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateWindow is how far back /admin/overview measures the publish and drop
+// rates, sampled every rateSampleEvery
+const (
+	rateWindow      = time.Minute
+	rateSampleEvery = 5 * time.Second
+)
+
+// eventRates samples the published and dropped counters, so their rates
+// over the last rateWindow can be read at any time
+type eventRates struct {
+	published, dropped *atomic.Uint64
+
+	mu      sync.Mutex
+	samples []rateSample
+}
+
+type rateSample struct {
+	at                 time.Time
+	published, dropped uint64
+}
+
+func newEventRates(published, dropped *atomic.Uint64) *eventRates {
+	r := &eventRates{published: published, dropped: dropped}
+	r.sample()
+	go r.run()
+	return r
+}
+
+func (r *eventRates) run() {
+	t := time.NewTicker(rateSampleEvery)
+	defer t.Stop()
+	for range t.C {
+		r.sample()
+	}
+}
+
+func (r *eventRates) sample() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.samples = append(r.samples, rateSample{at: time.Now(), published: r.published.Load(), dropped: r.dropped.Load()})
+	if keep := int(rateWindow/rateSampleEvery) + 1; len(r.samples) > keep {
+		r.samples = slices.Delete(r.samples, 0, len(r.samples)-keep)
+	}
+}
+
+// rates returns the events published and dropped per second since the
+// oldest sample, up to now
+func (r *eventRates) rates() (published, dropped float64) {
+	r.mu.Lock()
+	oldest := r.samples[0]
+	r.mu.Unlock()
+	elapsed := time.Since(oldest.at).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(r.published.Load()-oldest.published) / elapsed, float64(r.dropped.Load()-oldest.dropped) / elapsed
+}
+
+// nodeOverview is what an instance adds to its stats for /admin/overview
+type nodeOverview struct {
+	// UserSessions is how many sessions each user has open on the instance
+	UserSessions map[string]int `json:"userSessions,omitempty"`
+	// PublishRate and DropRate are events per second over the last minute
+	PublishRate float64        `json:"publishRate"`
+	DropRate    float64        `json:"dropRate"`
+	Memory      memoryOverview `json:"memory"`
+}
+
+type memoryOverview struct {
+	HeapAllocMB float64 `json:"heapAllocMB"`
+	SysMB       float64 `json:"sysMB"`
+	// HostUsedPercent is left out when the host's memory couldn't be read
+	HostUsedPercent float64 `json:"hostUsedPercent,omitempty"`
+	Goroutines      int     `json:"goroutines"`
+}
+
+// overview returns this instance's part of /admin/overview
+func (b *broker) overview() *nodeOverview {
+	sample := b.metrics.system.current()
+	published, dropped := b.metrics.rates.rates()
+	ov := &nodeOverview{
+		UserSessions: b.sessions.perUser(),
+		PublishRate:  published,
+		DropRate:     dropped,
+		Memory: memoryOverview{
+			HeapAllocMB: bToMbFloat(sample.mem.HeapAlloc),
+			SysMB:       bToMbFloat(sample.mem.Sys),
+			Goroutines:  runtime.NumGoroutine(),
+		},
+	}
+	if sample.vm != nil {
+		ov.Memory.HostUsedPercent = sample.vm.UsedPercent
+	}
+	return ov
+}
+
+// operationsOverview is the /admin/overview document
+type operationsOverview struct {
+	At       time.Time `json:"at"`
+	Sessions int       `json:"sessions"`
+	Users    int       `json:"users"`
+	// SessionsPerUser counts the users by how many sessions they have open
+	SessionsPerUser []sessionCountBucket `json:"sessionsPerUser"`
+	// TopUsers are the users with the most sessions
+	TopUsers    []userSessionCount `json:"topUsers"`
+	PublishRate float64            `json:"publishRate"`
+	DropRate    float64            `json:"dropRate"`
+	Backplane   backplaneOverview  `json:"backplane"`
+	Nodes       []nodeSummary      `json:"nodes"`
+}
+
+type sessionCountBucket struct {
+	Sessions string `json:"sessions"`
+	Users    int    `json:"users"`
+}
+
+type userSessionCount struct {
+	UserID   string `json:"userID"`
+	Sessions int    `json:"sessions"`
+}
+
+// backplaneOverview is how the instances reach each other. Status is ok,
+// degraded when an instance didn't answer, or unreachable when the
+// backplane's server is.
+type backplaneOverview struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Nodes is how many instances answered, this one included
+	Nodes int `json:"nodes"`
+}
+
+type nodeSummary struct {
+	nodeStats
+	PublishRate float64         `json:"publishRate"`
+	DropRate    float64         `json:"dropRate"`
+	Memory      *memoryOverview `json:"memory,omitempty"`
+}
+
+// overviewTopUsers is how many users TopUsers lists
+const overviewTopUsers = 10
+
+// sessionCountBuckets are the upper bounds of the SessionsPerUser buckets;
+// the last one is open-ended
+var sessionCountBuckets = []sessionCountBound{{1, "1"}, {2, "2"}, {5, "3-5"}, {10, "6-10"}, {0, "11+"}}
+
+type sessionCountBound struct {
+	upTo  int
+	label string
+}
+
+// clusterOverview gathers the overview of every instance, or of this one
+// alone when scope is "local"
+func (b *broker) clusterOverview(ctx context.Context, backplaneType, scope string) operationsOverview {
+	replies := b.view(ctx, peerQuery{Overview: true}, scope)
+	ov := operationsOverview{
+		At:              time.Now(),
+		SessionsPerUser: make([]sessionCountBucket, len(sessionCountBuckets)),
+		TopUsers:        []userSessionCount{},
+		Backplane:       backplaneOverview{Type: backplaneType, Status: "ok"},
+	}
+	perUser := make(map[string]int)
+	for _, r := range replies {
+		n := nodeSummary{nodeStats: r.Stats}
+		if r.Stats.Error != "" || r.Overview == nil {
+			ov.Backplane.Status = "degraded"
+			ov.Nodes = append(ov.Nodes, n)
+			continue
+		}
+		ov.Backplane.Nodes++
+		ov.Sessions += r.Stats.Sessions
+		ov.PublishRate += r.Overview.PublishRate
+		ov.DropRate += r.Overview.DropRate
+		n.PublishRate, n.DropRate, n.Memory = r.Overview.PublishRate, r.Overview.DropRate, &r.Overview.Memory
+		ov.Nodes = append(ov.Nodes, n)
+		for userID, count := range r.Overview.UserSessions {
+			perUser[userID] += count
+		}
+	}
+	if p, ok := b.backplane.(pinger); ok {
+		ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+		defer cancel()
+		if err := p.Ping(ctx); err != nil {
+			ov.Backplane.Status, ov.Backplane.Error = "unreachable", err.Error()
+		}
+	}
+
+	ov.Users = len(perUser)
+	for i, bucket := range sessionCountBuckets {
+		ov.SessionsPerUser[i].Sessions = bucket.label
+	}
+	for userID, count := range perUser {
+		i := slices.IndexFunc(sessionCountBuckets, func(bound sessionCountBound) bool {
+			return bound.upTo == 0 || count <= bound.upTo
+		})
+		ov.SessionsPerUser[i].Users++
+		ov.TopUsers = append(ov.TopUsers, userSessionCount{UserID: userID, Sessions: count})
+	}
+	slices.SortFunc(ov.TopUsers, func(a, b userSessionCount) int {
+		return cmp.Or(cmp.Compare(b.Sessions, a.Sessions), cmp.Compare(a.UserID, b.UserID))
+	})
+	ov.TopUsers = ov.TopUsers[:min(len(ov.TopUsers), overviewTopUsers)]
+	return ov
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// pausePolicy is what happens to a paused user's events
+type pausePolicy string
+
+const (
+	// pauseBuffer holds them, to be delivered on resume
+	pauseBuffer pausePolicy = "buffer"
+	// pauseDrop dead-letters them
+	pauseDrop pausePolicy = "drop"
+)
+
+func parsePausePolicy(v string) (pausePolicy, error) {
+	switch p := pausePolicy(v); p {
+	case "":
+		return pauseBuffer, nil
+	case pauseBuffer, pauseDrop:
+		return p, nil
+	}
+	return "", fmt.Errorf("policy must be buffer or drop")
+}
+
+// userPauses stops delivery to users on this instance while an operator
+// deals with a misbehaving client. Events are still published, recorded in
+// the history and forwarded; only the writing to the user's sessions waits.
+type userPauses struct {
+	mu sync.Mutex
+	// limit caps the events held for each user in buffer mode; past it they
+	// are dead-lettered
+	limit int
+	users map[string]*pausedUser
+	// resumed delivers what was held for a user once the pause ends
+	resumed func(userID string, held []pausedEvent)
+}
+
+type pausedUser struct {
+	pauseInfo
+	held  []pausedEvent
+	timer *time.Timer
+}
+
+// pauseInfo describes a user's pause, as the pause endpoints report it
+type pauseInfo struct {
+	UserID string      `json:"userID"`
+	Node   string      `json:"node,omitempty"`
+	Policy pausePolicy `json:"policy"`
+	Reason string      `json:"reason,omitempty"`
+	Since  time.Time   `json:"since"`
+	// Until is when the pause ends by itself, zero when it lasts until resumed
+	Until time.Time `json:"until,omitzero"`
+	// Held counts the events waiting for the resume, Dropped those
+	// dead-lettered instead
+	Held    int `json:"held"`
+	Dropped int `json:"dropped"`
+}
+
+// pausedEvent is an event held for a paused user, with the backpressure
+// policy it was published with
+type pausedEvent struct {
+	ev     event
+	policy backpressurePolicy
+}
+
+func newUserPauses(limit int, resumed func(userID string, held []pausedEvent)) *userPauses {
+	return &userPauses{limit: limit, users: make(map[string]*pausedUser), resumed: resumed}
+}
+
+// pause pauses userID, or changes the pause it is under, for d (0 means
+// until resumed)
+func (up *userPauses) pause(userID string, policy pausePolicy, reason string, d time.Duration) pauseInfo {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	p, ok := up.users[userID]
+	if !ok {
+		p = &pausedUser{pauseInfo: pauseInfo{UserID: userID, Since: time.Now()}}
+		up.users[userID] = p
+	}
+	p.Policy, p.Reason, p.Until = policy, reason, time.Time{}
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if d > 0 {
+		p.Until = time.Now().Add(d)
+		p.timer = time.AfterFunc(d, func() { up.resume(userID) })
+	}
+	return p.info()
+}
+
+// resume ends userID's pause and delivers what was held. It reports false
+// when the user wasn't paused.
+func (up *userPauses) resume(userID string) (pauseInfo, bool) {
+	up.mu.Lock()
+	p, ok := up.users[userID]
+	if ok {
+		delete(up.users, userID)
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+	}
+	up.mu.Unlock()
+	if !ok {
+		return pauseInfo{}, false
+	}
+	info := p.info()
+	up.resumed(userID, p.held)
+	return info, true
+}
+
+// hold takes ev if userID is paused. reason is set when the event is
+// dropped instead of held.
+func (up *userPauses) hold(userID string, ev event, policy backpressurePolicy) (paused bool, reason string) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	p, ok := up.users[userID]
+	if !ok {
+		return false, ""
+	}
+	switch {
+	case p.Policy == pauseDrop:
+		reason = "user paused"
+	case len(p.held) >= up.limit:
+		reason = "pause buffer full"
+	default:
+		// Already settled in the write-ahead log by the publish
+		ev.walID = 0
+		p.held = append(p.held, pausedEvent{ev: ev, policy: policy})
+		return true, ""
+	}
+	p.Dropped++
+	return true, reason
+}
+
+// paused reports whether delivery to userID is paused
+func (up *userPauses) paused(userID string) bool {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	_, ok := up.users[userID]
+	return ok
+}
+
+// get returns userID's pause
+func (up *userPauses) get(userID string) (pauseInfo, bool) {
+	up.mu.Lock()
+	defer up.mu.Unlock()
+	p, ok := up.users[userID]
+	if !ok {
+		return pauseInfo{}, false
+	}
+	return p.info(), true
+}
+
+func (p *pausedUser) info() pauseInfo {
+	info := p.pauseInfo
+	info.Held = len(p.held)
+	return info
+}
+
+// pauseRequest pauses a user on every instance it reaches
+type pauseRequest struct {
+	Policy pausePolicy   `json:"policy"`
+	Reason string        `json:"reason,omitempty"`
+	For    time.Duration `json:"for,omitempty"`
+}
+
+// pause pauses delivery to userID on this instance
+func (b *broker) pause(userID string, req pauseRequest) pauseInfo {
+	info := b.pauses.pause(userID, req.Policy, req.Reason, req.For)
+	info.Node = b.nodeID
+	logger.Warn("User paused", "userID", userID, "policy", req.Policy, "reason", req.Reason, "for", req.For.String())
+	return info
+}
+
+// resumed delivers what was held for userID during its pause, then the
+// state documents whose updates its sessions missed
+func (b *broker) resumed(userID string, held []pausedEvent) {
+	for _, h := range held {
+		b.deliverLocal(userID, h.ev, h.policy)
+	}
+	docs := b.stateDocs.existing(userID)
+	for _, s := range b.sessions.matching(func(s *session) bool { return s.userID == userID }) {
+		for topic, d := range docs {
+			if !s.wants(topic) {
+				continue
+			}
+			d.mu.Lock()
+			if d.version > 0 && s.baseline(topic) != d.version {
+				snapshot := snapshotEvent(d.eventID, topic, d)
+				reason, displaced := s.enqueue(snapshot, b.policy, b.blockTimeout)
+				if reason == "" {
+					s.setBaseline(topic, d.version)
+				} else {
+					b.dropped(userID, s, snapshot, reason)
+				}
+				for _, ev := range displaced {
+					b.wal.release(ev.walID)
+					b.dropped(userID, s, ev, "displaced from full buffer")
+				}
+			}
+			d.mu.Unlock()
+		}
+	}
+	logger.Info("User resumed", "userID", userID, "held", len(held))
+}
+
+// resume resumes delivery to userID on this instance, reporting false when
+// it wasn't paused
+func (b *broker) resume(userID string) (pauseInfo, bool) {
+	info, ok := b.pauses.resume(userID)
+	info.Node = b.nodeID
+	return info, ok
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// payloadLimits bound the values publishers can push to browsers, which
+// parse every event on their main thread
+type payloadLimits struct {
+	// maxBytes caps the encoded value, maxDepth how deeply objects and
+	// arrays nest, and maxFields their members in total (0 means unlimited)
+	maxBytes  int
+	maxDepth  int
+	maxFields int
+}
+
+func newPayloadLimits(cfg config) payloadLimits {
+	return payloadLimits{maxBytes: cfg.MaxPayloadBytes, maxDepth: cfg.MaxPayloadDepth, maxFields: cfg.MaxPayloadFields}
+}
+
+// decode checks the encoded value raw and decodes it; an empty value is null
+func (pl payloadLimits) decode(raw json.RawMessage) (any, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if pl.maxBytes > 0 && len(raw) > pl.maxBytes {
+		return nil, &publishError{status: 413, msg: fmt.Sprintf("value exceeds %d bytes", pl.maxBytes)}
+	}
+	// encoding/json would quietly replace invalid bytes with U+FFFD
+	if !utf8.Valid(raw) {
+		return nil, invalidPublish("value is not valid UTF-8")
+	}
+	var v any
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return nil, invalidPublish("value is not valid JSON")
+	}
+	depth, fields := measureValue(v)
+	if pl.maxDepth > 0 && depth > pl.maxDepth {
+		return nil, invalidPublish(fmt.Sprintf("value nests deeper than %d levels", pl.maxDepth))
+	}
+	if pl.maxFields > 0 && fields > pl.maxFields {
+		return nil, invalidPublish(fmt.Sprintf("value has more than %d fields", pl.maxFields))
+	}
+	return v, nil
+}
+
+// measureValue returns how deeply v's objects and arrays nest, and how many
+// members they have in total
+func measureValue(v any) (depth, fields int) {
+	var children []any
+	switch v := v.(type) {
+	case map[string]any:
+		for _, c := range v {
+			children = append(children, c)
+		}
+	case []any:
+		children = v
+	default:
+		return 0, 0
+	}
+	fields = len(children)
+	for _, c := range children {
+		d, f := measureValue(c)
+		depth = max(depth, d)
+		fields += f
+	}
+	return depth + 1, fields
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pollWaiters wakes the long polls waiting for a user's next event
+type pollWaiters struct {
+	mu sync.Mutex
+	// waiting maps users to a channel closed at their next publish
+	waiting map[string]chan struct{}
+}
+
+// wait returns a channel closed when an event is next published to userID
+func (pw *pollWaiters) wait(userID string) <-chan struct{} {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if pw.waiting == nil {
+		pw.waiting = make(map[string]chan struct{})
+	}
+	ch, ok := pw.waiting[userID]
+	if !ok {
+		ch = make(chan struct{})
+		pw.waiting[userID] = ch
+	}
+	return ch
+}
+
+// wake wakes the polls waiting for userID
+func (pw *pollWaiters) wake(userID string) {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	if ch, ok := pw.waiting[userID]; ok {
+		close(ch)
+		delete(pw.waiting, userID)
+	}
+}
+
+// poll returns the events after since that s would receive, from the user's
+// history, waiting up to wait for one to be published when there are none
+// yet. It also returns the ID to poll from next. A since of 0 starts from
+// the latest event, so the first poll only waits for new ones.
+func (b *broker) poll(ctx context.Context, s *session, since uint64, wait time.Duration) ([]event, uint64, error) {
+	if since == 0 {
+		latest, _, err := b.history.latest(ctx, s.userID)
+		if err != nil {
+			return nil, 0, err
+		}
+		since = latest.ID
+	}
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		// Taken before reading, so a publish in between still wakes this poll
+		woken := b.pollWaiters.wait(s.userID)
+		events, err := b.history.since(ctx, s.userID, since)
+		if err != nil {
+			return nil, since, err
+		}
+		var out []event
+		now := time.Now()
+		for _, ev := range events {
+			since = max(since, ev.ID)
+			if s.receives(ev) && !ev.expired(now) {
+				out = append(out, ev)
+			}
+		}
+		if len(out) > 0 {
+			return out, since, nil
+		}
+		select {
+		case <-woken:
+		case <-timeout.C:
+			return nil, since, nil
+		case <-ctx.Done():
+			return nil, since, nil
+		}
+	}
+}
+
+// pollWriter collects the events of a poll, as the messages /ws sends
+type pollWriter struct {
+	events []any
+}
+
+func (pw *pollWriter) write(id uint64, eventType string, data any) error {
+	pw.events = append(pw.events, newWSMessage(id, eventType, data))
+	return nil
+}
+
+func (pw *pollWriter) flush() error {
+	return nil
+}
+
+func (pw *pollWriter) keepAlive() error {
+	return nil
+}
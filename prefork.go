@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// preforkConfig adapts cfg to Fiber's prefork mode. Every child process keeps
+// its own sessions, so a publish accepted by one child only reaches sessions
+// in the others over a backplane; without one configured, the processes form
+// a cluster through the master. Requests about one session, such as acks,
+// reach the child holding it over the backplane too. The master serves gRPC
+// and the children the HTTP API.
+func preforkConfig(cfg config) (config, error) {
+	if !cfg.Prefork {
+		return cfg, nil
+	}
+	if cfg.WALFile != "" {
+		return cfg, errors.New("the write-ahead log can't be shared by prefork processes")
+	}
+	if cfg.AdminAddr != "" {
+		return cfg, errors.New("the admin listener can't be shared by prefork processes")
+	}
+	if len(splitList(cfg.Addr)) != 1 || strings.HasPrefix(cfg.Addr, "unix:") {
+		return cfg, errors.New("prefork processes share a single TCP address")
+	}
+	if cfg.HTTP2 || cfg.H2C {
+		return cfg, errors.New("prefork processes serve HTTP/1.1 only")
+	}
+	if cfg.Backplane == "none" {
+		cfg.Backplane = "cluster"
+	}
+	if !fiber.IsChild() {
+		if cfg.Backplane == "cluster" && cfg.ClusterSecret == "" {
+			// The children inherit the environment, and with it the secret
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				return cfg, err
+			}
+			cfg.ClusterSecret = hex.EncodeToString(secret)
+			if err := os.Setenv("SSE_CLUSTER_SECRET", cfg.ClusterSecret); err != nil {
+				return cfg, err
+			}
+		}
+		logger.Info("Prefork using a backplane between processes", "backplane", cfg.Backplane)
+		if cfg.Store == "memory" {
+			logger.Warn("Prefork keeps history and offline queues per process; set SSE_STORE to share them")
+		}
+		return cfg, nil
+	}
+
+	if os.Getenv("SSE_NODE_ID") != "" {
+		cfg.NodeID += "-" + strconv.Itoa(os.Getpid())
+	}
+	// Only the master listens for gRPC
+	cfg.GRPCAddr = ""
+	if cfg.Backplane == "cluster" {
+		// The master listens on the configured address; each child picks a
+		// port of its own and joins through it
+		host, port, err := net.SplitHostPort(cfg.ClusterAddr)
+		if err != nil {
+			return cfg, err
+		}
+		seed := net.JoinHostPort(cmp.Or(host, "127.0.0.1"), port)
+		cfg.ClusterPeers = strings.Trim(seed+","+cfg.ClusterPeers, ",")
+		cfg.ClusterAddr = net.JoinHostPort(host, "0")
+		if cfg.ClusterAdvertise != "" {
+			host, _, err := net.SplitHostPort(cfg.ClusterAdvertise)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.ClusterAdvertise = net.JoinHostPort(host, "0")
+		}
+	}
+	return cfg, nil
+}
+
+// preforkChildren tracks the master's child processes, so a signal sent only
+// to the master still shuts the children down gracefully
+type preforkChildren struct {
+	mu   sync.Mutex
+	pids []int
+}
+
+func (pc *preforkChildren) add(pid int) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.pids = append(pc.pids, pid)
+	return nil
+}
+
+// signal sends every child sig
+func (pc *preforkChildren) signal(sig os.Signal) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	for _, pid := range pc.pids {
+		if p, err := os.FindProcess(pid); err == nil {
+			_ = p.Signal(sig)
+		}
+	}
+}
+
+// stop sends every child SIGTERM and waits up to timeout for them to exit
+func (pc *preforkChildren) stop(timeout time.Duration) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	var running []*os.Process
+	for _, pid := range pc.pids {
+		p, err := os.FindProcess(pid)
+		if err != nil {
+			continue
+		}
+		if err := p.Signal(syscall.SIGTERM); err == nil {
+			running = append(running, p)
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	for _, p := range running {
+		for time.Now().Before(deadline) && p.Signal(syscall.Signal(0)) == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// presenceEvent is the body of a presence webhook: a user's first session on
+// an instance connected, or its last one there disconnected
+type presenceEvent struct {
+	// ID is the same on every attempt, so receivers can drop retries they
+	// already handled
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	UserID    string    `json:"userID"`
+	SessionID string    `json:"sessionID"`
+	Node      string    `json:"node"`
+	At        time.Time `json:"at"`
+	// RemoteIP, UserAgent and Metadata describe the client of the session
+	RemoteIP  string            `json:"remoteIP,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+const (
+	userConnected    = "user.connected"
+	userDisconnected = "user.disconnected"
+)
+
+// presenceWebhook sends presence events to a webhook as users come and go
+type presenceWebhook struct {
+	hook *webhook
+	node string
+}
+
+// newPresenceWebhook returns nil when no URL is configured
+func newPresenceWebhook(cfg config) *presenceWebhook {
+	if cfg.PresenceWebhookURL == "" {
+		return nil
+	}
+	return &presenceWebhook{
+		hook: newWebhook("Presence webhook", cfg.PresenceWebhookURL, cfg.PresenceWebhookSecret,
+			cfg.PresenceWebhookAttempts, cfg.PresenceWebhookTimeout, 1000),
+		node: cfg.NodeID,
+	}
+}
+
+// sessionChanged is called as s joins or leaves the sessions, with whether
+// its user still has any on this instance
+func (pw *presenceWebhook) sessionChanged(s *session, joined, userOnline bool) {
+	switch {
+	case joined && !userOnline:
+		pw.put(userConnected, s)
+	case !joined && !userOnline:
+		pw.put(userDisconnected, s)
+	}
+}
+
+func (pw *presenceWebhook) put(kind string, s *session) {
+	ev := presenceEvent{
+		ID:        newRequestID(),
+		Type:      kind,
+		UserID:    s.userID,
+		SessionID: s.id,
+		Node:      pw.node,
+		At:        time.Now(),
+		RemoteIP:  s.clientIP,
+		UserAgent: s.userAgent,
+		Metadata:  s.metadata,
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logger.Error("Presence webhook encode error", "error", err)
+		return
+	}
+	pw.hook.put(body, "userID", s.userID, "sessionID", s.id, "type", kind)
+}
+
+// close waits for the events queued to be delivered, until ctx is done
+func (pw *presenceWebhook) close(ctx context.Context) {
+	if pw == nil {
+		return
+	}
+	pw.hook.close(ctx)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// publishRequest is a publish as submitted by a client, over HTTP or gRPC.
+// Value stays encoded until submit has checked it against the payload limits.
+type publishRequest struct {
+	UserID         string          `json:"userID"`
+	Topic          string          `json:"topic"`
+	Value          json.RawMessage `json:"value"`
+	Backpressure   string          `json:"backpressure"`
+	Delivery       string          `json:"delivery"`
+	TTLMs          int64           `json:"ttlMs"`
+	Priority       string          `json:"priority"`
+	IdempotencyKey string          `json:"idempotencyKey"`
+	DeliverAt      *time.Time      `json:"deliverAt"`
+	DelayMs        int64           `json:"delayMs"`
+	State          string          `json:"state"`
+	// Labels narrows delivery to the sessions carrying them; without a
+	// userID, it picks sessions of any user
+	Labels map[string]string `json:"labels"`
+
+	// trace is the span the publish was received in
+	trace trace.SpanContext
+}
+
+// publishError rejects a publish request; status is the HTTP status to answer with
+type publishError struct {
+	status int
+	msg    string
+}
+
+func (e *publishError) Error() string {
+	return e.msg
+}
+
+func invalidPublish(msg string) error {
+	return &publishError{status: 400, msg: msg}
+}
+
+// publishOutcome is what became of an accepted publish request: either
+// scheduled for deliverAt, or published right away with res
+type publishOutcome struct {
+	Scheduled bool
+	DeliverAt time.Time
+	Result    publishResult
+	Duplicate bool
+}
+
+// response is the body a publish is answered with over HTTP
+func (out publishOutcome) response() fiber.Map {
+	res := out.Result
+	return fiber.Map{
+		"sent":          res.Sent,
+		"dropped":       res.Dropped,
+		"eventID":       res.EventID,
+		"online":        res.Online,
+		"queuedOffline": res.QueuedOffline,
+		"throttled":     res.Throttled,
+		"paused":        res.Paused,
+		"duplicate":     out.Duplicate,
+		"sessions":      res.Sessions,
+	}
+}
+
+// submit validates req and publishes or schedules it
+func (req publishRequest) submit() (publishOutcome, error) {
+	if req.UserID == "" && len(req.Labels) == 0 {
+		return publishOutcome{}, invalidPublish("userID or labels is required")
+	}
+	labels, err := parseLabelSelector(req.Labels)
+	if err != nil {
+		return publishOutcome{}, invalidPublish(err.Error())
+	}
+	value, err := currentBroker.payloadLimits.decode(req.Value)
+	if err != nil {
+		return publishOutcome{}, err
+	}
+
+	var opts publishOptions
+	if req.Backpressure != "" {
+		p, ok := parseBackpressurePolicy(req.Backpressure)
+		if !ok {
+			return publishOutcome{}, invalidPublish("invalid backpressure policy")
+		}
+		opts.Policy = p
+	}
+	if req.TTLMs < 0 {
+		return publishOutcome{}, invalidPublish("ttlMs must not be negative")
+	}
+	switch req.Delivery {
+	case "", "at-most-once":
+	case "at-least-once":
+		if req.UserID == "" {
+			// Acknowledgements and redelivery are kept per user
+			return publishOutcome{}, invalidPublish("at-least-once delivery needs a userID")
+		}
+		opts.AtLeastOnce = true
+	default:
+		return publishOutcome{}, invalidPublish("invalid delivery mode")
+	}
+
+	if req.State != "" {
+		mode, ok := parseStateMode(req.State)
+		if !ok {
+			return publishOutcome{}, invalidPublish("state must be snapshot or patch")
+		}
+		if opts.AtLeastOnce || req.TTLMs > 0 {
+			// A lost or expired delta would leave the client on a broken baseline
+			return publishOutcome{}, invalidPublish("state updates cannot be at-least-once or expire")
+		}
+		if labels != nil {
+			// State documents and their baselines are the whole user's
+			return publishOutcome{}, invalidPublish("state updates cannot select labels")
+		}
+		opts.State = mode
+	}
+
+	prio, ok := parsePriority(req.Priority)
+	if !ok {
+		return publishOutcome{}, invalidPublish("invalid priority")
+	}
+
+	ev := event{Type: "current-value", Topic: req.Topic, Data: value, Priority: prio, Labels: labels, trace: req.trace}
+	if req.TTLMs > 0 {
+		ev.ExpiresAt = time.Now().Add(time.Duration(req.TTLMs) * time.Millisecond)
+	}
+
+	if req.DeliverAt != nil || req.DelayMs != 0 {
+		if req.DelayMs < 0 {
+			return publishOutcome{}, invalidPublish("delayMs must not be negative")
+		}
+		deliverAt := time.Now().Add(time.Duration(req.DelayMs) * time.Millisecond)
+		if req.DeliverAt != nil {
+			deliverAt = *req.DeliverAt
+		}
+		if !ev.ExpiresAt.IsZero() {
+			// The TTL starts counting when the event is delivered, not when it is scheduled
+			ev.ExpiresAt = deliverAt.Add(time.Duration(req.TTLMs) * time.Millisecond)
+		}
+		ev = currentBroker.accept(req.UserID, ev, opts, deliverAt)
+		if !currentBroker.schedule(deliverAt, req.IdempotencyKey, req.UserID, ev, opts, req.mirror) {
+			currentBroker.wal.release(ev.walID)
+			return publishOutcome{}, &publishError{status: 503, msg: "too many scheduled events"}
+		}
+		return publishOutcome{Scheduled: true, DeliverAt: deliverAt}, nil
+	}
+
+	ev = currentBroker.accept(req.UserID, ev, opts, time.Time{})
+	res, duplicate := currentBroker.publishOnce(req.IdempotencyKey, req.UserID, ev, opts)
+	if !duplicate {
+		req.mirror()
+	}
+	return publishOutcome{Result: res, Duplicate: duplicate}, nil
+}
+
+// mirror sends a published request on to MQTT, when a mirror topic is set
+func (req publishRequest) mirror() {
+	currentBroker.mqtt.send(req.UserID, req.Topic, req.Value)
+}
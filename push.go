@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// pushDevicesPerUser caps the devices each user can register; registering
+// another forgets the oldest
+const pushDevicesPerUser = 10
+
+// pushSendTimeout bounds each notification sent to FCM or APNs
+const pushSendTimeout = 10 * time.Second
+
+// errDeviceGone is returned by a pushSender for a device token the service
+// no longer accepts, such as that of an uninstalled app
+var errDeviceGone = errors.New("device token is no longer valid")
+
+// pushNotification is what a device is told about an event published while
+// its user had no session
+type pushNotification struct {
+	Title   string
+	Body    string
+	EventID uint64
+	Topic   string
+	// Data is the event's value, JSON-encoded
+	Data json.RawMessage
+}
+
+// pushSender delivers notifications to the devices of one platform
+type pushSender interface {
+	send(ctx context.Context, token string, n pushNotification) error
+}
+
+// pushDevicesCacheTTL is how long an instance uses the devices it read for a
+// user before reading them again, so devices registered or forgotten on
+// another instance are seen within it
+const pushDevicesCacheTTL = time.Minute
+
+// pushDevicesCacheSize caps how many users' devices an instance caches
+const pushDevicesCacheSize = 10000
+
+// pushDevice is a device a user registered for push notifications
+type pushDevice struct {
+	Platform     string    `json:"platform"`
+	Token        string    `json:"token"`
+	RegisteredAt time.Time `json:"registeredAt"`
+	// id is the device's entry in the store
+	id uint64
+}
+
+// pushDevices keeps each user's registered devices in the Store, one
+// "push-device" event per device with the device as its data, and caches
+// those read for a while
+type pushDevices struct {
+	store  Store
+	nextID func() uint64
+
+	mu    sync.Mutex
+	cache map[string]cachedPushDevices
+}
+
+// cachedPushDevices are a user's devices as read at some point
+type cachedPushDevices struct {
+	devices []pushDevice
+	expires time.Time
+}
+
+func newPushDevices(store Store, nextID func() uint64) *pushDevices {
+	return &pushDevices{store: store, nextID: nextID, cache: make(map[string]cachedPushDevices)}
+}
+
+func pushDevicesStream(userID string) string {
+	return "push-devices:" + userID
+}
+
+// read returns userID's devices as the store has them
+func (pd *pushDevices) read(ctx context.Context, userID string) ([]pushDevice, error) {
+	events, err := pd.store.Range(ctx, pushDevicesStream(userID), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	devices := make([]pushDevice, 0, len(events))
+	for _, ev := range events {
+		// Data has been through JSON in most stores
+		raw, err := json.Marshal(ev.Data)
+		if err != nil {
+			continue
+		}
+		var d pushDevice
+		if json.Unmarshal(raw, &d) != nil || d.Token == "" {
+			continue
+		}
+		d.id = ev.ID
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// cacheLocked keeps devices as userID's, making room when the cache is full
+func (pd *pushDevices) cacheLocked(userID string, devices []pushDevice) {
+	now := time.Now()
+	if _, ok := pd.cache[userID]; !ok && len(pd.cache) >= pushDevicesCacheSize {
+		for u, c := range pd.cache {
+			if now.After(c.expires) {
+				delete(pd.cache, u)
+			}
+		}
+		for u := range pd.cache {
+			if len(pd.cache) < pushDevicesCacheSize {
+				break
+			}
+			delete(pd.cache, u)
+		}
+	}
+	pd.cache[userID] = cachedPushDevices{devices: devices, expires: now.Add(pushDevicesCacheTTL)}
+}
+
+// list returns userID's devices, from the cache while it's fresh
+func (pd *pushDevices) list(ctx context.Context, userID string) ([]pushDevice, error) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	if c, ok := pd.cache[userID]; ok && time.Now().Before(c.expires) {
+		return c.devices, nil
+	}
+	devices, err := pd.read(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	pd.cacheLocked(userID, devices)
+	return devices, nil
+}
+
+// add registers d for userID; registering a token again moves it to the
+// newest
+func (pd *pushDevices) add(ctx context.Context, userID string, d pushDevice) error {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	devices, err := pd.removeLocked(ctx, userID, d.Token)
+	if err != nil {
+		return err
+	}
+	stream := pushDevicesStream(userID)
+	d.id = pd.nextID()
+	d.RegisteredAt = time.Now()
+	if err := pd.store.Append(ctx, stream, event{ID: d.id, Type: "push-device", Data: d, PublishedAt: d.RegisteredAt}); err != nil {
+		return err
+	}
+	if err := pd.store.Trim(ctx, stream, TrimOptions{MaxLen: pushDevicesPerUser}); err != nil {
+		return err
+	}
+	devices = append(devices, d)
+	pd.cacheLocked(userID, devices[max(len(devices)-pushDevicesPerUser, 0):])
+	return nil
+}
+
+// remove forgets userID's device with token; it's not an error if there is none
+func (pd *pushDevices) remove(ctx context.Context, userID, token string) error {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	devices, err := pd.removeLocked(ctx, userID, token)
+	if err != nil {
+		return err
+	}
+	pd.cacheLocked(userID, devices)
+	return nil
+}
+
+// removeLocked deletes userID's device with token from the store, and returns
+// the devices left; it reads them from the store, as another instance may
+// have changed them since they were cached
+func (pd *pushDevices) removeLocked(ctx context.Context, userID, token string) ([]pushDevice, error) {
+	devices, err := pd.read(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(devices, func(d pushDevice) bool { return d.Token == token })
+	if i < 0 {
+		return devices, nil
+	}
+	if err := pd.store.Delete(ctx, pushDevicesStream(userID), []uint64{devices[i].id}); err != nil {
+		return nil, err
+	}
+	return slices.Delete(devices, i, i+1), nil
+}
+
+// pushJob is an event waiting to be pushed to its user's devices
+type pushJob struct {
+	userID string
+	ev     event
+}
+
+// pushFallback notifies users who had no session when an event was
+// published: on their registered devices through FCM or APNs, and through a
+// webhook for anything else. Notifications go out in the background, and
+// are dropped if the services can't keep up.
+type pushFallback struct {
+	devices *pushDevices
+	senders map[string]pushSender
+	hook    *webhook
+	// topics, when set, limits the fallback to events on them
+	topics []string
+	title  messageField
+	body   messageField
+
+	mu     sync.Mutex
+	queue  chan pushJob
+	closed bool
+	done   chan struct{}
+}
+
+// newPushFallback returns nil when no way of pushing is configured
+func newPushFallback(cfg config, store Store, nextID func() uint64) (*pushFallback, error) {
+	fb := &pushFallback{
+		devices: newPushDevices(store, nextID),
+		senders: make(map[string]pushSender),
+		topics:  splitList(cfg.PushTopics),
+		queue:   make(chan pushJob, 1000),
+		done:    make(chan struct{}),
+	}
+	var err error
+	if fb.title, err = parseMessageField(cfg.PushTitleField, nil); err != nil {
+		return nil, fmt.Errorf("SSE_PUSH_TITLE_FIELD: %w", err)
+	}
+	if fb.body, err = parseMessageField(cfg.PushBodyField, nil); err != nil {
+		return nil, fmt.Errorf("SSE_PUSH_BODY_FIELD: %w", err)
+	}
+	if cfg.PushFCMCredentials != "" {
+		if fb.senders["fcm"], err = newFCMSender(cfg.PushFCMCredentials); err != nil {
+			return nil, fmt.Errorf("SSE_PUSH_FCM_CREDENTIALS: %w", err)
+		}
+	}
+	if cfg.PushAPNsKeyFile != "" {
+		if fb.senders["apns"], err = newAPNsSender(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PushWebhookURL != "" {
+		fb.hook = newWebhook("Push webhook", cfg.PushWebhookURL, cfg.PushWebhookSecret,
+			cfg.PushWebhookAttempts, cfg.PushWebhookTimeout, 1000)
+	}
+	if len(fb.senders) == 0 && fb.hook == nil {
+		return nil, nil
+	}
+	go fb.run()
+	return fb, nil
+}
+
+// platformEnabled reports whether devices of platform can be notified
+func (fb *pushFallback) platformEnabled(platform string) bool {
+	_, ok := fb.senders[platform]
+	return ok
+}
+
+// offline is called with an event published to a user without a session
+func (fb *pushFallback) offline(userID string, ev event) {
+	if fb == nil || (len(fb.topics) > 0 && !slices.Contains(fb.topics, ev.Topic)) {
+		return
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.closed {
+		return
+	}
+	select {
+	case fb.queue <- pushJob{userID: userID, ev: ev}:
+	default:
+		logger.Warn("Push backlog full, discarding event", "userID", userID, "eventID", ev.ID)
+	}
+}
+
+func (fb *pushFallback) run() {
+	defer close(fb.done)
+	for job := range fb.queue {
+		fb.push(job.userID, job.ev)
+	}
+}
+
+// pushWebhookEvent is the body of a push webhook
+type pushWebhookEvent struct {
+	UserID string `json:"userID"`
+	Event  event  `json:"event"`
+}
+
+// push notifies userID's devices and the webhook of ev
+func (fb *pushFallback) push(userID string, ev event) {
+	if fb.hook != nil {
+		if body, err := json.Marshal(pushWebhookEvent{UserID: userID, Event: ev}); err == nil {
+			fb.hook.put(body, "userID", userID, "eventID", ev.ID)
+		}
+	}
+	if len(fb.senders) == 0 {
+		return
+	}
+	n, err := fb.notification(ev)
+	if err != nil {
+		logger.Error("Push encode error", "userID", userID, "eventID", ev.ID, "error", err)
+		return
+	}
+	ctx := context.Background()
+	devices, err := fb.devices.list(ctx, userID)
+	if err != nil {
+		logger.Error("Push devices read error", "userID", userID, "error", err)
+		return
+	}
+	for _, d := range devices {
+		sender, ok := fb.senders[d.Platform]
+		if !ok {
+			continue
+		}
+		sendCtx, cancel := context.WithTimeout(ctx, pushSendTimeout)
+		err := sender.send(sendCtx, d.Token, n)
+		cancel()
+		switch {
+		case errors.Is(err, errDeviceGone):
+			logger.Info("Push device unregistered", "userID", userID, "platform", d.Platform)
+			if err := fb.devices.remove(ctx, userID, d.Token); err != nil {
+				logger.Error("Push devices write error", "userID", userID, "error", err)
+			}
+		case err != nil:
+			logger.Warn("Push failed", "userID", userID, "eventID", ev.ID, "platform", d.Platform, "error", err)
+		}
+	}
+}
+
+// notification reads the title and body of ev's notification from its value
+func (fb *pushFallback) notification(ev event) (pushNotification, error) {
+	data, err := json.Marshal(ev.Data)
+	if err != nil {
+		return pushNotification{}, err
+	}
+	n := pushNotification{EventID: ev.ID, Topic: ev.Topic, Data: data}
+	m := newMappedMessage(nil, data)
+	// A value without them gets a silent notification, for the app to handle
+	n.Title, _ = m.text(fb.title)
+	n.Body, _ = m.text(fb.body)
+	return n, nil
+}
+
+// close stops taking events and waits for those queued to be pushed, until
+// ctx is done
+func (fb *pushFallback) close(ctx context.Context) {
+	if fb == nil {
+		return
+	}
+	fb.mu.Lock()
+	fb.closed = true
+	close(fb.queue)
+	fb.mu.Unlock()
+	select {
+	case <-fb.done:
+	case <-ctx.Done():
+		logger.Warn("Push notifications left unsent at shutdown", "count", len(fb.queue))
+	}
+	fb.hook.close(ctx)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// apnsTokenLifetime is how long a provider token is used; Apple refuses
+// tokens older than an hour and ones renewed more often than every 20 minutes
+const apnsTokenLifetime = 50 * time.Minute
+
+// apnsSender sends notifications through the Apple Push Notification
+// service, authenticating with a signing key (.p8) from the developer account
+type apnsSender struct {
+	client *http.Client
+	host   string
+	keyID  string
+	teamID string
+	// topic is the app's bundle ID
+	topic string
+	key   *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	token  string
+	issued time.Time
+}
+
+func newAPNsSender(cfg config) (*apnsSender, error) {
+	if cfg.PushAPNsKeyID == "" || cfg.PushAPNsTeamID == "" || cfg.PushAPNsTopic == "" {
+		return nil, errors.New("SSE_PUSH_APNS_KEY_ID, SSE_PUSH_APNS_TEAM_ID and SSE_PUSH_APNS_TOPIC are required with SSE_PUSH_APNS_KEY_FILE")
+	}
+	pem, err := os.ReadFile(cfg.PushAPNsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("SSE_PUSH_APNS_KEY_FILE: %w", err)
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, fmt.Errorf("SSE_PUSH_APNS_KEY_FILE: %w", err)
+	}
+	host := "https://api.push.apple.com"
+	if cfg.PushAPNsSandbox {
+		host = "https://api.sandbox.push.apple.com"
+	}
+	// APNs only speaks HTTP/2, which the client negotiates over TLS
+	return &apnsSender{
+		client: &http.Client{},
+		host:   host,
+		keyID:  cfg.PushAPNsKeyID,
+		teamID: cfg.PushAPNsTeamID,
+		topic:  cfg.PushAPNsTopic,
+		key:    key,
+	}, nil
+}
+
+// providerToken returns the signed token requests are authorized with
+func (a *apnsSender) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Since(a.issued) < apnsTokenLifetime {
+		return a.token, nil
+	}
+	now := time.Now()
+	t := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": a.teamID, "iat": now.Unix()})
+	t.Header["kid"] = a.keyID
+	token, err := t.SignedString(a.key)
+	if err != nil {
+		return "", err
+	}
+	a.token, a.issued = token, now
+	return token, nil
+}
+
+func (a *apnsSender) send(ctx context.Context, token string, n pushNotification) error {
+	auth, err := a.providerToken()
+	if err != nil {
+		return err
+	}
+	aps := map[string]any{"content-available": 1}
+	pushType, priority := "background", "5"
+	if n.Title != "" || n.Body != "" {
+		aps = map[string]any{"alert": map[string]string{"title": n.Title, "body": n.Body}}
+		pushType, priority = "alert", "10"
+	}
+	body, err := json.Marshal(map[string]any{
+		"aps":     aps,
+		"eventID": strconv.FormatUint(n.EventID, 10),
+		"topic":   n.Topic,
+		"data":    n.Data,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.host+"/3/device/"+token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+auth)
+	req.Header.Set("apns-topic", a.topic)
+	req.Header.Set("apns-push-type", pushType)
+	req.Header.Set("apns-priority", priority)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	var reason struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&reason)
+	if resp.StatusCode == http.StatusGone || reason.Reason == "BadDeviceToken" {
+		return errDeviceGone
+	}
+	return fmt.Errorf("APNs returned %s: %s", resp.Status, reason.Reason)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fcmScope is the OAuth scope of the FCM HTTP v1 API
+const fcmScope = "https://www.googleapis.com/auth/firebase.messaging"
+
+// fcmSender sends notifications through Firebase Cloud Messaging, as the
+// service account whose key file it was given
+type fcmSender struct {
+	client   *http.Client
+	project  string
+	email    string
+	key      *rsa.PrivateKey
+	tokenURI string
+	// sendURL is where messages are sent
+	sendURL string
+
+	mu sync.Mutex
+	// token is the OAuth access token, good until expires
+	token   string
+	expires time.Time
+}
+
+// fcmServiceAccount is the part of a service account key file the sender needs
+type fcmServiceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+func newFCMSender(path string) (*fcmSender, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var sa fcmServiceAccount
+	if err := json.Unmarshal(raw, &sa); err != nil {
+		return nil, err
+	}
+	if sa.ProjectID == "" || sa.ClientEmail == "" || sa.TokenURI == "" {
+		return nil, errors.New("not a service account key file")
+	}
+	key, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(sa.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	return &fcmSender{
+		client:   &http.Client{},
+		project:  sa.ProjectID,
+		email:    sa.ClientEmail,
+		key:      key,
+		tokenURI: sa.TokenURI,
+		sendURL:  "https://fcm.googleapis.com/v1/projects/" + url.PathEscape(sa.ProjectID) + "/messages:send",
+	}, nil
+}
+
+// accessToken returns an OAuth access token, exchanging a fresh assertion
+// signed with the service account's key when the last one is about to expire
+func (f *fcmSender) accessToken(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.token != "" && time.Until(f.expires) > time.Minute {
+		return f.token, nil
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   f.email,
+		"scope": fcmScope,
+		"aud":   f.tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(f.key)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	f.token, f.expires = tok.AccessToken, now.Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return f.token, nil
+}
+
+func (f *fcmSender) send(ctx context.Context, token string, n pushNotification) error {
+	access, err := f.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	msg := map[string]any{
+		"token": token,
+		// FCM data values are strings
+		"data": map[string]string{
+			"eventID": strconv.FormatUint(n.EventID, 10),
+			"topic":   n.Topic,
+			"data":    string(n.Data),
+		},
+	}
+	if n.Title != "" || n.Body != "" {
+		msg["notification"] = map[string]string{"title": n.Title, "body": n.Body}
+	}
+	body, err := json.Marshal(map[string]any{"message": msg})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.sendURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+access)
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	// An unregistered token is answered 404 with UNREGISTERED
+	if resp.StatusCode == http.StatusNotFound || bytes.Contains(detail, []byte("UNREGISTERED")) {
+		return errDeviceGone
+	}
+	return fmt.Errorf("FCM returned %s", resp.Status)
+}
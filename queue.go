@@ -0,0 +1,89 @@
+package main
+
+// priority orders events in a session's queue; the zero value is normal
+type priority int
+
+const (
+	priorityLow    priority = -1
+	priorityNormal priority = 0
+	priorityHigh   priority = 1
+)
+
+func parsePriority(v string) (priority, bool) {
+	switch v {
+	case "low":
+		return priorityLow, true
+	case "", "normal":
+		return priorityNormal, true
+	case "high":
+		return priorityHigh, true
+	}
+	return 0, false
+}
+
+// lane maps a priority to its slot in eventQueue.lanes, highest first
+func (p priority) lane() int {
+	return int(priorityHigh - p)
+}
+
+// eventQueue is a bounded buffer of events, FIFO within each priority
+type eventQueue struct {
+	lanes    [3][]event
+	size     int
+	capacity int
+}
+
+func (q *eventQueue) full() bool {
+	return q.size >= q.capacity
+}
+
+func (q *eventQueue) push(ev event) {
+	l := ev.Priority.lane()
+	q.lanes[l] = append(q.lanes[l], ev)
+	q.size++
+}
+
+// pop removes the oldest event of the highest non-empty priority
+func (q *eventQueue) pop() (event, bool) {
+	for l := range q.lanes {
+		if len(q.lanes[l]) > 0 {
+			ev := q.lanes[l][0]
+			q.lanes[l][0] = event{}
+			q.lanes[l] = q.lanes[l][1:]
+			q.size--
+			return ev, true
+		}
+	}
+	return event{}, false
+}
+
+// lowest returns the lowest priority that has queued events
+func (q *eventQueue) lowest() (priority, bool) {
+	for l := len(q.lanes) - 1; l >= 0; l-- {
+		if len(q.lanes[l]) > 0 {
+			return priorityHigh - priority(l), true
+		}
+	}
+	return 0, false
+}
+
+// dropOldest removes and returns the oldest event of priority p
+func (q *eventQueue) dropOldest(p priority) event {
+	l := p.lane()
+	ev := q.lanes[l][0]
+	q.lanes[l][0] = event{}
+	q.lanes[l] = q.lanes[l][1:]
+	q.size--
+	return ev
+}
+
+// clear empties the queue and returns what was in it
+func (q *eventQueue) clear() []event {
+	var out []event
+	for l := range q.lanes {
+		out = append(out, q.lanes[l]...)
+		q.lanes[l] = nil
+	}
+	q.size = 0
+	return out
+}
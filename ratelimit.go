@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// rateLimiter keeps a token bucket per key. Unlike userThrottle it doesn't
+// hold anything back; a request over the limit is refused.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	buckets map[string]*tokenBucket
+	// done stops the sweep once the limit is lifted
+	done chan struct{}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateDecision is the outcome of taking a token, with what the
+// X-RateLimit-* headers report
+type rateDecision struct {
+	allowed   bool
+	limit     int
+	remaining int
+	// reset is how long until the bucket is full again, retryAfter how long
+	// until the next token when refused
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+// newRateLimiter returns nil when rate is 0, which allows everything
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	rl := &rateLimiter{rate: rate, burst: float64(max(burst, 1)), buckets: make(map[string]*tokenBucket), done: make(chan struct{})}
+	go rl.sweep(time.Minute)
+	return rl
+}
+
+// resize returns the limiter for a new rate and burst: rl itself, keeping its
+// buckets, unless the limit is now lifted (nil) or was until now (a new one)
+func (rl *rateLimiter) resize(rate float64, burst int) *rateLimiter {
+	switch {
+	case rl == nil:
+		return newRateLimiter(rate, burst)
+	case rate <= 0:
+		close(rl.done)
+		return nil
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.rate, rl.burst = rate, float64(max(burst, 1))
+	return rl
+}
+
+// take spends one of key's tokens if it has one
+func (rl *rateLimiter) take(key string) rateDecision {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	d := rateDecision{limit: int(rl.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		d.allowed = true
+	} else {
+		d.retryAfter = rl.after(1 - b.tokens)
+	}
+	d.remaining = int(b.tokens)
+	d.reset = rl.after(rl.burst - b.tokens)
+	return d
+}
+
+// refund returns a token taken from key
+func (rl *rateLimiter) refund(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if b, ok := rl.buckets[key]; ok {
+		b.tokens = min(rl.burst, b.tokens+1)
+	}
+}
+
+func (rl *rateLimiter) after(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have refilled, so idle keys don't pile up
+func (rl *rateLimiter) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.done:
+			return
+		case <-ticker.C:
+		}
+		rl.mu.Lock()
+		now := time.Now()
+		for key, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// publishLimits limit how fast publishes come in, per caller and per target
+// user, so one misbehaving upstream can't flood the broker
+type publishLimits struct {
+	mu     sync.RWMutex
+	caller *rateLimiter
+	user   *rateLimiter
+}
+
+func newPublishLimits(cfg config) *publishLimits {
+	pl := &publishLimits{}
+	pl.update(cfg)
+	return pl
+}
+
+// update applies the configured limits, as on a config reload
+func (pl *publishLimits) update(cfg config) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	pl.caller = pl.caller.resize(cfg.PublishRate, cfg.PublishBurst)
+	pl.user = pl.user.resize(cfg.PublishUserRate, cfg.PublishUserBurst)
+}
+
+// take spends a token of caller and one of userID. The decision returned is
+// the refusing one, or else the one with fewer tokens left; ok is false when
+// neither limit is enabled.
+func (pl *publishLimits) take(caller, userID string) (d rateDecision, ok bool) {
+	pl.mu.RLock()
+	callers, users := pl.caller, pl.user
+	pl.mu.RUnlock()
+	if callers != nil {
+		d, ok = callers.take(caller), true
+		if !d.allowed {
+			return d, true
+		}
+	}
+	if users != nil {
+		ud := users.take(userID)
+		if !ud.allowed && callers != nil {
+			// The publish doesn't happen, so it doesn't count against the caller
+			callers.refund(caller)
+		}
+		if !ok || !ud.allowed || ud.remaining < d.remaining {
+			d = ud
+		}
+		ok = true
+	}
+	return d, ok
+}
+
+// callerKey names who is publishing: the authenticated identity, or else the
+// client's address
+func callerKey(id Identity, ip string) string {
+	if id.Subject != "" {
+		return id.Method + ":" + id.Subject
+	}
+	return "ip:" + ip
+}
+
+// setHeaders reports d in the X-RateLimit-* headers, and in Retry-After when
+// the request was refused
+func (d rateDecision) setHeaders(c fiber.Ctx) {
+	c.Set("X-RateLimit-Limit", strconv.Itoa(d.limit))
+	c.Set("X-RateLimit-Remaining", strconv.Itoa(d.remaining))
+	c.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(d.reset)))
+	if !d.allowed {
+		c.Set("Retry-After", strconv.Itoa(max(ceilSeconds(d.retryAfter), 1)))
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// pinger is implemented by the backplanes and stores that depend on a
+// server, for /readyz to check it's reachable
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// readyTimeout bounds each /readyz check, so a hung dependency fails the
+// probe instead of outlasting it
+const readyTimeout = 2 * time.Second
+
+// readiness decides whether the instance should be sent new connections. It
+// can be alive but not ready, while a dependency is unreachable, while it
+// drains for shutdown or while it is full.
+type readiness struct {
+	store       Store
+	backplane   Backplane
+	sources     *sourceSupervisor
+	maxSessions int
+	draining    atomic.Bool
+}
+
+func newReadiness(cfg config, store Store, backplane Backplane, sources *sourceSupervisor) *readiness {
+	return &readiness{store: store, backplane: backplane, sources: sources, maxSessions: cfg.ReadyMaxSessions}
+}
+
+// drain makes /readyz fail from now on, and undrain makes it pass again
+func (r *readiness) drain() {
+	r.draining.Store(true)
+}
+
+func (r *readiness) undrain() {
+	r.draining.Store(false)
+}
+
+// check runs every check and returns each one's outcome, "ok" or what is
+// wrong, and whether they all passed
+func (r *readiness) check(ctx context.Context) (map[string]string, bool) {
+	checks := map[string]string{}
+	ready := true
+	result := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
+			return
+		}
+		checks[name] = "ok"
+	}
+	ping := func(name string, v any) {
+		p, ok := v.(pinger)
+		if !ok {
+			return
+		}
+		ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+		defer cancel()
+		result(name, p.Ping(ctx))
+	}
+	if r.backplane != nil {
+		ping("backplane", r.backplane)
+	}
+	ping("store", r.store)
+
+	var err error
+	if r.draining.Load() {
+		err = errors.New("draining")
+	}
+	result("drain", err)
+
+	if r.maxSessions > 0 {
+		err = nil
+		if n := currentBroker.sessions.count(); n >= r.maxSessions {
+			err = fmt.Errorf("%d of %d sessions open", n, r.maxSessions)
+		}
+		result("capacity", err)
+	}
+
+	// Sources are reported without failing the check: streams and the API
+	// keep working while one is down, and it is restarted meanwhile
+	for name, err := range r.sources.health() {
+		checks["source:"+name] = "ok"
+		if err != nil {
+			checks["source:"+name] = err.Error()
+		}
+	}
+	return checks, ready
+}
+
+// livez answers as long as the process serves requests
+func livez(c fiber.Ctx) error {
+	return c.Send(nil)
+}
+
+// readyz is 200 when the instance can take new connections and 503 when it
+// can't, with the outcome of each check either way
+func (r *readiness) readyz(c fiber.Ctx) error {
+	checks, ready := r.check(c.Context())
+	status := fiber.StatusOK
+	if !ready {
+		status = fiber.StatusServiceUnavailable
+	}
+	return c.Status(status).JSON(fiber.Map{"ready": ready, "checks": checks})
+}
+
+// probeRoute reports whether path is a health probe, which isn't logged,
+// audited or filtered by IP
+func probeRoute(path string) bool {
+	return path == "/health" || path == "/livez" || path == "/readyz"
+}
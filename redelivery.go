@@ -0,0 +1,75 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// redeliveryQueue retains at-least-once events per user until they are
+// acknowledged, so they can be sent again when the user reconnects
+type redeliveryQueue struct {
+	mu      sync.Mutex
+	pending map[string][]event
+	// limit caps retained events per user, oldest dropped first
+	limit int
+}
+
+func newRedeliveryQueue(limit int) *redeliveryQueue {
+	return &redeliveryQueue{
+		pending: make(map[string][]event),
+		limit:   limit,
+	}
+}
+
+func (q *redeliveryQueue) retain(userID string, ev event) {
+	if q.limit <= 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	events := slices.DeleteFunc(q.pending[userID], func(e event) bool { return e.expired(now) })
+	events = append(events, ev)
+	if len(events) > q.limit {
+		events = slices.Delete(events, 0, len(events)-q.limit)
+	}
+	q.pending[userID] = events
+}
+
+// ack stops retaining eventID for userID
+func (q *redeliveryQueue) ack(userID string, eventID uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	events := slices.DeleteFunc(q.pending[userID], func(ev event) bool { return ev.ID == eventID })
+	q.set(userID, events)
+}
+
+// unacked returns the events still waiting for userID. Events up to lastEventID
+// were already dispatched by the reconnecting client and are released, as are
+// expired ones.
+func (q *redeliveryQueue) unacked(userID string, lastEventID uint64) []event {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	events := slices.DeleteFunc(q.pending[userID], func(ev event) bool {
+		return ev.ID <= lastEventID || ev.expired(now)
+	})
+	q.set(userID, events)
+	return slices.Clone(events)
+}
+
+// count returns how many events for userID wait for an acknowledgement
+func (q *redeliveryQueue) count(userID string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending[userID])
+}
+
+func (q *redeliveryQueue) set(userID string, events []event) {
+	if len(events) == 0 {
+		delete(q.pending, userID)
+		return
+	}
+	q.pending[userID] = events
+}
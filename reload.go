@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// hotReloadable are the settings a config reload applies to the running
+// server; the others only take effect on a restart
+var hotReloadable = []string{
+	"SSE_LOG_LEVEL",
+	"SSE_KEEPALIVE_INTERVAL",
+	"SSE_PUBLISH_RATE", "SSE_PUBLISH_BURST", "SSE_PUBLISH_USER_RATE", "SSE_PUBLISH_USER_BURST",
+	"SSE_USER_MAX_RATE", "SSE_USER_BURST",
+	"SSE_CORS_STREAM_ORIGINS", "SSE_CORS_STREAM_METHODS", "SSE_CORS_STREAM_HEADERS", "SSE_CORS_STREAM_CREDENTIALS",
+	"SSE_CORS_API_ORIGINS", "SSE_CORS_API_METHODS", "SSE_CORS_API_HEADERS", "SSE_CORS_API_CREDENTIALS",
+	"SSE_STREAM_ORIGINS",
+	"SSE_MEMORY_LIMIT", "SSE_GC_PERCENT",
+}
+
+// errNoConfigFile refuses a reload when there is no file to read again
+var errNoConfigFile = errors.New("no config file to reload, set SSE_CONFIG_FILE")
+
+// configFileVarsEnv names, comma-separated, the variables the config file
+// put in the environment, so that processes started with this one's
+// environment, such as prefork children and restarts, don't take them for
+// variables of the environment
+const configFileVarsEnv = "SSE_CONFIG_FILE_VARS"
+
+// configFile holds settings in the environment's NAME=value form, read at
+// startup and again on each reload. They give way to the variables the
+// process was started with and to the flags.
+type configFile struct {
+	mu   sync.Mutex
+	path string
+	// flags are the settings given on the command line, which the file
+	// doesn't change
+	flags map[string]string
+	// environ are the variables the process was started with, which the
+	// file doesn't change either
+	environ map[string]bool
+	// vars is what the file set at the last load
+	vars map[string]string
+	// apply puts a reloaded config in force; set once the server is built
+	apply func(cfg config) error
+}
+
+// reloadResult lists the settings a reload changed, by whether they are in
+// force or wait for a restart
+type reloadResult struct {
+	File            string   `json:"file"`
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// openConfigFile loads the flags into the environment, then the file
+// SSE_CONFIG_FILE names, if any, before the config is read from it
+func openConfigFile(flags map[string]string) (*configFile, error) {
+	cf := &configFile{flags: flags, environ: map[string]bool{}, vars: map[string]string{}}
+	fromFile := strings.Split(os.Getenv(configFileVarsEnv), ",")
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if slices.Contains(fromFile, name) {
+			// Inherited from the file, so the file can change or remove it
+			cf.vars[name] = value
+		} else if name != configFileVarsEnv {
+			cf.environ[name] = true
+		}
+	}
+	for name, value := range flags {
+		if err := os.Setenv(name, value); err != nil {
+			return nil, err
+		}
+	}
+	cf.path = getenv("SSE_CONFIG_FILE")
+	if cf.path == "" {
+		cf.setenv(nil)
+		return cf, nil
+	}
+	vars, err := readConfigFile(cf.path)
+	if err != nil {
+		return nil, err
+	}
+	cf.setenv(vars)
+	return cf, nil
+}
+
+// readEnvFile parses NAME=value lines; blank lines and lines starting with #
+// are skipped, and a value may be quoted
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	vars := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", path, n)
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		vars[name] = value
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// setenv makes the environment hold vars in place of what the file set
+// before, unsetting the variables it no longer sets, and returns the names
+// whose value changed; callers hold cf.mu or are starting up
+func (cf *configFile) setenv(vars map[string]string) []string {
+	var changed, set []string
+	for name, value := range vars {
+		if _, flagged := cf.flags[name]; flagged {
+			if _, ok := cf.vars[name]; !ok {
+				logger.Warn("Config file setting overridden by a flag", "name", name)
+			}
+			continue
+		}
+		if cf.environ[name] {
+			if _, ok := cf.vars[name]; !ok {
+				logger.Warn("Config file setting overridden by the environment", "name", name)
+			}
+			continue
+		}
+		set = append(set, name)
+		if old, ok := cf.vars[name]; ok && old == value {
+			continue
+		}
+		os.Setenv(name, value)
+		changed = append(changed, name)
+	}
+	for name := range cf.vars {
+		if _, ok := vars[name]; ok {
+			continue
+		}
+		if _, flagged := cf.flags[name]; flagged || cf.environ[name] {
+			continue
+		}
+		os.Unsetenv(name)
+		changed = append(changed, name)
+	}
+	cf.vars = vars
+	slices.Sort(set)
+	if len(set) > 0 {
+		os.Setenv(configFileVarsEnv, strings.Join(set, ","))
+	} else {
+		os.Unsetenv(configFileVarsEnv)
+	}
+	slices.Sort(changed)
+	return changed
+}
+
+// check refuses settings in the file or flags that the server doesn't read,
+// once the config has been loaded
+func (cf *configFile) check() error {
+	names := slices.Collect(maps.Keys(cf.vars))
+	if unknown := unknownSettings(names); len(unknown) > 0 {
+		return fmt.Errorf("%s: unknown settings %s", cf.path, strings.Join(unknown, ", "))
+	}
+	names = slices.Collect(maps.Keys(cf.flags))
+	if unknown := unknownSettings(names); len(unknown) > 0 {
+		for i, name := range unknown {
+			unknown[i] = "--" + strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(name, "SSE_"), "_", "-"))
+		}
+		return fmt.Errorf("unknown flags %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// reload reads the file again and applies the hot-reloadable settings it
+// changed. When they can't be applied, the environment is put back as it
+// was and nothing changes.
+func (cf *configFile) reload() (reloadResult, error) {
+	if cf.path == "" {
+		return reloadResult{}, errNoConfigFile
+	}
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	vars, err := readConfigFile(cf.path)
+	if err != nil {
+		return reloadResult{}, err
+	}
+	previous := cf.vars
+	changed := cf.setenv(vars)
+	cfg := loadConfig()
+	if err := cf.check(); err != nil {
+		cf.setenv(previous)
+		return reloadResult{}, err
+	}
+	if err := cf.apply(cfg); err != nil {
+		cf.setenv(previous)
+		return reloadResult{}, err
+	}
+	res := reloadResult{File: cf.path, Applied: []string{}, RestartRequired: []string{}}
+	for _, name := range changed {
+		if slices.Contains(hotReloadable, name) {
+			res.Applied = append(res.Applied, name)
+		} else {
+			res.RestartRequired = append(res.RestartRequired, name)
+		}
+	}
+	logger.Info("Config reloaded", "file", cf.path, "applied", res.Applied)
+	if len(res.RestartRequired) > 0 {
+		logger.Warn("Config changes need a restart", "settings", res.RestartRequired)
+	}
+	return res, nil
+}
+
+// applyReloadable puts the hot-reloadable settings of cfg in force, checking
+// those that can be invalid before changing anything
+func applyReloadable(cfg config, cors *corsRoutes) error {
+	level, err := parseLogLevel(cfg.LogLevel)
+	if err != nil {
+		return err
+	}
+	ms, err := parseMemorySettings(cfg)
+	if err != nil {
+		return err
+	}
+	if err := cors.set(cfg.streamCORS(), cfg.apiCORS()); err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	ms.apply()
+	currentBroker.publishLimits.update(cfg)
+	currentBroker.throttle.update(cfg.UserMaxRate, cfg.UserBurst)
+	currentBroker.keepAlive.Store(int64(cfg.KeepAliveInterval))
+	currentBroker.setStreamOrigins(cfg.StreamOrigins)
+	return nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicaOrigin marks a publish mirrored from another region
+type replicaOrigin struct {
+	Region  string `json:"region"`
+	EventID uint64 `json:"eventID"`
+	// Regions have already been sent the publish, so it is never mirrored back to one
+	Regions []string `json:"regions"`
+}
+
+// replicatedEvent is a publish as sent to a peer region
+type replicatedEvent struct {
+	UserID string         `json:"userID"`
+	Event  event          `json:"event"`
+	Opts   publishOptions `json:"opts"`
+	Origin replicaOrigin  `json:"origin"`
+}
+
+const (
+	replicationBatch    = 100
+	replicationLinger   = 50 * time.Millisecond
+	replicationMaxRetry = 10 * time.Second
+)
+
+// errReplicationRejected is returned by replicationPeer.send when the peer
+// refused a batch in a way that retrying won't change
+var errReplicationRejected = errors.New("peer rejected the batch")
+
+// replicator mirrors publishes to the deployments of other regions and keeps
+// lag figures for the links in both directions
+type replicator struct {
+	region string
+	peers  []*replicationPeer
+
+	mu       sync.Mutex
+	received map[string]*replicationInbound
+}
+
+// replicationInbound counts publishes mirrored here from one region
+type replicationInbound struct {
+	events uint64
+	// lag is how long the last one took to arrive after its region accepted it
+	lag time.Duration
+}
+
+func newReplicator(cfg config) (*replicator, error) {
+	r := &replicator{
+		region:   cfg.Region,
+		received: make(map[string]*replicationInbound),
+	}
+	for _, pair := range strings.Split(cfg.ReplicationPeers, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		region, url, ok := strings.Cut(pair, "=")
+		if !ok || region == "" || url == "" {
+			return nil, fmt.Errorf("invalid replication peer %q, want region=url", pair)
+		}
+		if region == r.region {
+			return nil, fmt.Errorf("replication peer %q is this region", region)
+		}
+		p := &replicationPeer{
+			region: region,
+			url:    strings.TrimSuffix(url, "/") + "/replication/events",
+			secret: cfg.ReplicationSecret,
+			queue:  make(chan replicatedEvent, max(cfg.ReplicationQueue, 1)),
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+		r.peers = append(r.peers, p)
+	}
+	if len(r.peers) > 0 && cfg.ReplicationSecret == "" {
+		return nil, errors.New("SSE_REPLICATION_PEERS needs SSE_REPLICATION_SECRET")
+	}
+	for _, p := range r.peers {
+		go p.run()
+	}
+	return r, nil
+}
+
+// mirror queues a publish for every peer region that hasn't seen it yet.
+// The regions it is sent to are recorded on it, so a peer relays it only to
+// regions this one can't reach and it never loops back.
+func (r *replicator) mirror(userID string, ev event, opts publishOptions) {
+	if len(r.peers) == 0 {
+		return
+	}
+	origin := replicaOrigin{Region: r.region, EventID: ev.ID, Regions: []string{r.region}}
+	if opts.Replica != nil {
+		origin = *opts.Replica
+		origin.Regions = append(slices.Clone(origin.Regions), r.region)
+	}
+	var targets []*replicationPeer
+	for _, p := range r.peers {
+		if !slices.Contains(origin.Regions, p.region) {
+			targets = append(targets, p)
+		}
+	}
+	for _, p := range targets {
+		origin.Regions = append(origin.Regions, p.region)
+	}
+	ev.walID = 0
+	opts.Replica = nil
+	for _, p := range targets {
+		p.put(replicatedEvent{UserID: userID, Event: ev, Opts: opts, Origin: origin})
+	}
+}
+
+// accept publishes events mirrored from another region. The origin's event ID
+// is the idempotency key, so a publish arriving twice by different paths goes
+// out once within the idempotency window.
+func (r *replicator) accept(batch []replicatedEvent) {
+	now := time.Now()
+	for _, rep := range batch {
+		if rep.UserID == "" || rep.Origin.Region == "" || rep.Origin.Region == r.region {
+			continue
+		}
+		r.mu.Lock()
+		in := r.received[rep.Origin.Region]
+		if in == nil {
+			in = &replicationInbound{}
+			r.received[rep.Origin.Region] = in
+		}
+		in.events++
+		in.lag = now.Sub(rep.Event.PublishedAt)
+		r.mu.Unlock()
+
+		origin := rep.Origin
+		opts := rep.Opts
+		opts.Replica = &origin
+		ev := rep.Event
+		ev.ID, ev.PublishedAt = 0, time.Time{}
+		ev = currentBroker.accept(rep.UserID, ev, opts, time.Time{})
+		key := fmt.Sprintf("replica:%s:%d", origin.Region, origin.EventID)
+		currentBroker.publishOnce(key, rep.UserID, ev, opts)
+	}
+}
+
+// stats reports the replication links for /metrics/system
+func (r *replicator) stats() map[string]any {
+	peers := make([]map[string]any, 0, len(r.peers))
+	for _, p := range r.peers {
+		peers = append(peers, p.stats())
+	}
+	received := make(map[string]any)
+	r.mu.Lock()
+	for region, in := range r.received {
+		received[region] = map[string]any{
+			"events": in.events,
+			"lag_ms": in.lag.Milliseconds(),
+		}
+	}
+	r.mu.Unlock()
+	return map[string]any{
+		"region":   r.region,
+		"peers":    peers,
+		"received": received,
+	}
+}
+
+// replicationPeer sends mirrored publishes to one region in batches from a
+// background goroutine, retrying until they are accepted or refused for good
+// and dropping new ones while its queue is full
+type replicationPeer struct {
+	region string
+	url    string
+	secret string
+	queue  chan replicatedEvent
+	client *http.Client
+
+	sent     atomic.Uint64
+	dropped  atomic.Uint64
+	failures atomic.Uint64
+	// failed counts the events of batches the peer refused for good
+	failed atomic.Uint64
+
+	mu sync.Mutex
+	// pendingSince is when the oldest event of the batch being sent was
+	// published; zero while idle
+	pendingSince time.Time
+	// lag is how old the last accepted batch's oldest event was
+	lag       time.Duration
+	lastError string
+}
+
+func (p *replicationPeer) put(rep replicatedEvent) {
+	select {
+	case p.queue <- rep:
+	default:
+		if p.dropped.Add(1) == 1 {
+			logger.Warn("Replication queue full, discarding events", "region", p.region)
+		}
+	}
+}
+
+func (p *replicationPeer) run() {
+	batch := make([]replicatedEvent, 0, replicationBatch)
+	for rep := range p.queue {
+		batch = append(batch[:0], rep)
+		linger := time.After(replicationLinger)
+	fill:
+		for len(batch) < replicationBatch {
+			select {
+			case rep := <-p.queue:
+				batch = append(batch, rep)
+			case <-linger:
+				break fill
+			}
+		}
+		p.deliver(batch)
+	}
+}
+
+// deliver sends batch until the peer accepts it, or gives up on it when the
+// peer refuses it with a client error other than 408 or 429
+func (p *replicationPeer) deliver(batch []replicatedEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		logger.Error("Replication encode error", "error", err)
+		return
+	}
+	p.mu.Lock()
+	p.pendingSince = batch[0].Event.PublishedAt
+	p.mu.Unlock()
+
+	backoff := 100 * time.Millisecond
+	for {
+		err := p.send(body)
+		if err == nil {
+			break
+		}
+		p.failures.Add(1)
+		p.mu.Lock()
+		p.lastError = err.Error()
+		p.mu.Unlock()
+		if errors.Is(err, errReplicationRejected) {
+			p.failed.Add(uint64(len(batch)))
+			p.mu.Lock()
+			p.pendingSince = time.Time{}
+			p.mu.Unlock()
+			logger.Error("Replication batch discarded", "region", p.region, "events", len(batch), "error", err)
+			return
+		}
+		logger.Warn("Replication failed, retrying", "region", p.region, "retryIn", backoff.String(), "error", err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, replicationMaxRetry)
+	}
+	p.sent.Add(uint64(len(batch)))
+	p.mu.Lock()
+	p.lag = time.Since(p.pendingSince)
+	p.pendingSince = time.Time{}
+	p.mu.Unlock()
+}
+
+func (p *replicationPeer) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Replication-Secret", p.secret)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("peer returned %s", resp.Status)
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return fmt.Errorf("%w: %s", errReplicationRejected, resp.Status)
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("peer returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (p *replicationPeer) stats() map[string]any {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// While a batch is outstanding the lag keeps growing until it is accepted
+	lag := p.lag
+	if !p.pendingSince.IsZero() {
+		lag = max(lag, time.Since(p.pendingSince))
+	}
+	return map[string]any{
+		"region":     p.region,
+		"queued":     len(p.queue),
+		"sent":       p.sent.Load(),
+		"dropped":    p.dropped.Load(),
+		"failures":   p.failures.Load(),
+		"failed":     p.failed.Load(),
+		"lag_ms":     lag.Milliseconds(),
+		"last_error": p.lastError,
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionPolicy bounds how much history is kept; zero fields are unlimited
+type retentionPolicy struct {
+	MaxEvents int
+	MaxBytes  int
+	MaxAge    time.Duration
+}
+
+// merge returns p with the non-zero fields of override applied
+func (p retentionPolicy) merge(override retentionPolicy) retentionPolicy {
+	if override.MaxEvents > 0 {
+		p.MaxEvents = override.MaxEvents
+	}
+	if override.MaxBytes > 0 {
+		p.MaxBytes = override.MaxBytes
+	}
+	if override.MaxAge > 0 {
+		p.MaxAge = override.MaxAge
+	}
+	return p
+}
+
+// retentionRules are the history limits of every user, with overrides for
+// particular users and additional limits for the events of particular topics
+type retentionRules struct {
+	defaults retentionPolicy
+	users    map[string]retentionPolicy
+	topics   map[string]retentionPolicy
+}
+
+// forUser returns the limits of userID's whole history
+func (r retentionRules) forUser(userID string) retentionPolicy {
+	return r.defaults.merge(r.users[userID])
+}
+
+// forTopic returns the limits of the events of one topic within a user's
+// history, and whether there are any
+func (r retentionRules) forTopic(topic string) (retentionPolicy, bool) {
+	p, ok := r.topics[topic]
+	return p, ok && topic != ""
+}
+
+// maxAge returns how long ev may stay in userID's history (0 means forever)
+func (r retentionRules) maxAge(userID string, ev event) time.Duration {
+	age := r.forUser(userID).MaxAge
+	if p, ok := r.forTopic(ev.Topic); ok && p.MaxAge > 0 && (age == 0 || p.MaxAge < age) {
+		age = p.MaxAge
+	}
+	return age
+}
+
+// overflow returns the IDs of userID's events, given oldest first, that the
+// rules no longer allow. Counting starts from the newest event, so the oldest
+// go first.
+func (r retentionRules) overflow(userID string, events []event, now time.Time) []uint64 {
+	type usage struct{ events, bytes int }
+	policy := r.forUser(userID)
+	var total usage
+	topics := make(map[string]*usage)
+	var drop []uint64
+	for i := len(events) - 1; i >= 0; i-- {
+		ev := events[i]
+		if age := r.maxAge(userID, ev); age > 0 && now.Sub(ev.PublishedAt) > age {
+			drop = append(drop, ev.ID)
+			continue
+		}
+		size := eventSize(ev)
+		total.events++
+		total.bytes += size
+		over := exceeds(policy, total.events, total.bytes)
+		if p, ok := r.forTopic(ev.Topic); ok {
+			u := topics[ev.Topic]
+			if u == nil {
+				u = &usage{}
+				topics[ev.Topic] = u
+			}
+			u.events++
+			u.bytes += size
+			over = over || exceeds(p, u.events, u.bytes)
+		}
+		if over {
+			drop = append(drop, ev.ID)
+		}
+	}
+	return drop
+}
+
+func exceeds(p retentionPolicy, events, bytes int) bool {
+	return (p.MaxEvents > 0 && events > p.MaxEvents) || (p.MaxBytes > 0 && bytes > p.MaxBytes)
+}
+
+// eventSize approximates the storage an event takes by its JSON encoding
+func eventSize(ev event) int {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// parseRetentionRules reads overrides of the form
+//
+//	user:vip maxEvents=500 maxBytes=1048576; topic:prices maxEvents=10 maxAge=1m
+//
+// Invalid rules are logged and skipped.
+func parseRetentionRules(spec string, defaults retentionPolicy) retentionRules {
+	r := retentionRules{
+		defaults: defaults,
+		users:    make(map[string]retentionPolicy),
+		topics:   make(map[string]retentionPolicy),
+	}
+	for rule := range strings.SplitSeq(spec, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		kind, name, _ := strings.Cut(fields[0], ":")
+		p, err := parseRetentionPolicy(fields[1:])
+		switch {
+		case err != nil:
+		case name == "":
+			err = fmt.Errorf("missing name in %q", fields[0])
+		case kind == "user":
+			r.users[name] = p
+		case kind == "topic":
+			r.topics[name] = p
+		default:
+			err = fmt.Errorf("unknown rule kind %q", kind)
+		}
+		if err != nil {
+			logger.Warn("Invalid retention rule, skipping", "rule", strings.TrimSpace(rule), "error", err)
+		}
+	}
+	return r
+}
+
+func parseRetentionPolicy(fields []string) (retentionPolicy, error) {
+	var p retentionPolicy
+	for _, f := range fields {
+		key, value, _ := strings.Cut(f, "=")
+		var err error
+		switch key {
+		case "maxEvents":
+			p.MaxEvents, err = strconv.Atoi(value)
+		case "maxBytes":
+			p.MaxBytes, err = strconv.Atoi(value)
+		case "maxAge":
+			p.MaxAge, err = time.ParseDuration(value)
+		default:
+			return p, fmt.Errorf("unknown limit %q", key)
+		}
+		if err != nil {
+			return p, fmt.Errorf("invalid %s: %w", key, err)
+		}
+	}
+	return p, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"cmp"
+	"hash/fnv"
+	"slices"
+	"strconv"
+)
+
+// ringReplicas is the number of points each node gets on the ring, which
+// evens out how many users land on each
+const ringReplicas = 128
+
+// hashRing assigns users to nodes by consistent hashing, so a node joining or
+// leaving only moves the users that hash to it
+type hashRing struct {
+	points []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	node string
+}
+
+func newHashRing(nodes []string) *hashRing {
+	r := &hashRing{points: make([]ringPoint, 0, len(nodes)*ringReplicas)}
+	for _, node := range nodes {
+		for i := range ringReplicas {
+			r.points = append(r.points, ringPoint{hash: ringHash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	slices.SortFunc(r.points, func(a, b ringPoint) int {
+		// Same order on every node even if two points collide
+		return cmp.Or(cmp.Compare(a.hash, b.hash), cmp.Compare(a.node, b.node))
+	})
+	return r
+}
+
+// owner returns the node key hashes to, or "" for an empty ring
+func (r *hashRing) owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i, _ := slices.BinarySearchFunc(r.points, h, func(p ringPoint, h uint64) int {
+		return cmp.Compare(p.hash, h)
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+func ringHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV alone leaves similar keys like "node#1" and "node#2" close together;
+	// the murmur3 finalizer spreads them over the ring
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
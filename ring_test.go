@@ -0,0 +1,93 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func ringKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "user-" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func TestHashRingEmpty(t *testing.T) {
+	if got := newHashRing(nil).owner("user-1"); got != "" {
+		t.Errorf("owner on an empty ring = %q, want \"\"", got)
+	}
+}
+
+// Every node has to agree on the owners, whatever order it lists the nodes in
+func TestHashRingOrder(t *testing.T) {
+	a := newHashRing([]string{"node-a", "node-b", "node-c"})
+	b := newHashRing([]string{"node-c", "node-a", "node-b"})
+	for _, key := range ringKeys(1000) {
+		if a.owner(key) != b.owner(key) {
+			t.Fatalf("owner(%q) = %q or %q depending on node order", key, a.owner(key), b.owner(key))
+		}
+	}
+}
+
+// A node joining or leaving only moves the users that hash to it
+func TestHashRingStability(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after []string
+	}{
+		{"join", []string{"node-a", "node-b", "node-c"}, []string{"node-a", "node-b", "node-c", "node-d"}},
+		{"leave", []string{"node-a", "node-b", "node-c"}, []string{"node-a", "node-c"}},
+		{"first", []string{"node-a"}, []string{"node-a", "node-b"}},
+		{"replace", []string{"node-a", "node-b", "node-c"}, []string{"node-a", "node-b", "node-d"}},
+	}
+	keys := ringKeys(10000)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, after := newHashRing(tt.before), newHashRing(tt.after)
+			moved := 0
+			for _, key := range keys {
+				from, to := before.owner(key), after.owner(key)
+				if from == to {
+					continue
+				}
+				moved++
+				if slices.Contains(tt.after, from) && slices.Contains(tt.before, to) {
+					t.Fatalf("owner(%q) moved from %q to %q, both on either ring", key, from, to)
+				}
+			}
+			// Each node joining or leaving moves about 1/n of the users
+			changed := len(tt.before) + len(tt.after) - 2*len(intersect(tt.before, tt.after))
+			if limit := len(keys) * changed * 2 / max(len(tt.before), len(tt.after)); moved > limit {
+				t.Errorf("%d of %d users moved, want at most %d", moved, len(keys), limit)
+			}
+		})
+	}
+}
+
+func intersect(a, b []string) []string {
+	var out []string
+	for _, s := range a {
+		if slices.Contains(b, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func TestHashRingBalance(t *testing.T) {
+	nodes := []string{"node-a", "node-b", "node-c", "node-d"}
+	r := newHashRing(nodes)
+	keys := ringKeys(20000)
+	counts := make(map[string]int)
+	for _, key := range keys {
+		counts[r.owner(key)]++
+	}
+	fair := len(keys) / len(nodes)
+	for _, node := range nodes {
+		if n := counts[node]; n < fair*2/3 || n > fair*4/3 {
+			t.Errorf("%s owns %d of %d users, want about %d", node, n, len(keys), fair)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// timerWheel is a hashed timer wheel: callbacks land in the slot for their due
+// tick and carry the number of full turns left, so scheduling and firing are
+// O(1) regardless of how many are pending
+type timerWheel struct {
+	mu      sync.Mutex
+	tick    time.Duration
+	slots   [][]*timerEntry
+	pos     int
+	pending int
+	limit   int
+}
+
+type timerEntry struct {
+	rounds int
+	fn     func()
+}
+
+func newTimerWheel(tick time.Duration, size, limit int) *timerWheel {
+	tw := &timerWheel{
+		tick:  tick,
+		slots: make([][]*timerEntry, size),
+		limit: limit,
+	}
+	go tw.run()
+	return tw
+}
+
+// schedule runs fn at (or up to one tick after) at. It reports false when the
+// wheel already holds the maximum number of pending callbacks.
+func (tw *timerWheel) schedule(at time.Time, fn func()) bool {
+	ticks := int((time.Until(at) + tw.tick - 1) / tw.tick)
+	ticks = max(ticks, 1)
+
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.limit > 0 && tw.pending >= tw.limit {
+		return false
+	}
+	slot := (tw.pos + ticks) % len(tw.slots)
+	tw.slots[slot] = append(tw.slots[slot], &timerEntry{rounds: (ticks - 1) / len(tw.slots), fn: fn})
+	tw.pending++
+	return true
+}
+
+func (tw *timerWheel) run() {
+	ticker := time.NewTicker(tw.tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, fn := range tw.advance() {
+			fn()
+		}
+	}
+}
+
+// advance moves the wheel one tick and returns the callbacks that are due
+func (tw *timerWheel) advance() []func() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.pos = (tw.pos + 1) % len(tw.slots)
+	var due []func()
+	kept := tw.slots[tw.pos][:0]
+	for _, e := range tw.slots[tw.pos] {
+		if e.rounds > 0 {
+			e.rounds--
+			kept = append(kept, e)
+			continue
+		}
+		due = append(due, e.fn)
+	}
+	clear(tw.slots[tw.pos][len(kept):])
+	tw.slots[tw.pos] = kept
+	tw.pending -= len(due)
+	return due
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// publishScope restricts what a caller may publish: to which users, and
+// under which topics. Patterns use path.Match syntax, such as "shop-*".
+type publishScope struct {
+	// users and topics are the allowed patterns; nil allows any
+	users  []string
+	topics []string
+}
+
+// allows reports whether a publish to userID under topic is in scope; a nil
+// scope allows everything
+func (sc *publishScope) allows(userID, topic string) bool {
+	if sc == nil {
+		return true
+	}
+	return matchesAny(sc.users, userID) && matchesAny(sc.topics, topic)
+}
+
+func matchesAny(patterns []string, v string) bool {
+	if patterns == nil {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePublishScopes parses ";"-separated rules, each naming a caller followed
+// by users= and topics= lists, e.g. "orders users=shop-* topics=order-update".
+// Unlike retention rules, an invalid rule is an error: skipping it would leave
+// the caller unrestricted. kind names the callers in errors, such as "API key".
+func parsePublishScopes(spec, kind string) (map[string]*publishScope, error) {
+	scopes := make(map[string]*publishScope)
+	for rule := range strings.SplitSeq(spec, ";") {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 {
+			continue
+		}
+		name := fields[0]
+		if _, dup := scopes[name]; dup {
+			return nil, fmt.Errorf("%s %q has more than one scope", kind, name)
+		}
+		sc := &publishScope{}
+		for _, f := range fields[1:] {
+			key, value, _ := strings.Cut(f, "=")
+			patterns := splitList(value)
+			for _, p := range patterns {
+				if _, err := path.Match(p, ""); err != nil {
+					return nil, fmt.Errorf("scope of %s %q: invalid pattern %q", kind, name, p)
+				}
+			}
+			switch key {
+			case "users":
+				sc.users = append(sc.users, patterns...)
+			case "topics":
+				sc.topics = append(sc.topics, patterns...)
+			default:
+				return nil, fmt.Errorf("scope of %s %q: unknown restriction %q", kind, name, key)
+			}
+			if len(patterns) == 0 {
+				return nil, fmt.Errorf("scope of %s %q: %s lists nothing", kind, name, key)
+			}
+		}
+		scopes[name] = sc
+	}
+	return scopes, nil
+}
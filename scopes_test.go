@@ -0,0 +1,75 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePublishScopes(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]*publishScope
+		// err is part of the error expected, if any
+		err string
+	}{
+		{spec: "", want: map[string]*publishScope{}},
+		{spec: " ; ", want: map[string]*publishScope{}},
+		{spec: "orders", want: map[string]*publishScope{"orders": {}}},
+		{
+			spec: "orders users=shop-* topics=order-update",
+			want: map[string]*publishScope{"orders": {users: []string{"shop-*"}, topics: []string{"order-update"}}},
+		},
+		{
+			spec: "orders topics=a,b topics=c; chat users=u-?",
+			want: map[string]*publishScope{
+				"orders": {topics: []string{"a", "b", "c"}},
+				"chat":   {users: []string{"u-?"}},
+			},
+		},
+		{spec: "orders users=a; orders topics=b", err: `API key "orders" has more than one scope`},
+		{spec: "orders regions=eu", err: `unknown restriction "regions"`},
+		{spec: "orders topics=", err: "topics lists nothing"},
+		{spec: "orders users=[a", err: `invalid pattern "[a"`},
+	}
+	for _, tt := range tests {
+		got, err := parsePublishScopes(tt.spec, "API key")
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parsePublishScopes(%q) error = %v, want one containing %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePublishScopes(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePublishScopes(%q) = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestPublishScopeAllows(t *testing.T) {
+	scopes, err := parsePublishScopes("shop users=shop-* topics=order-*,invoice; any", "API key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		caller, userID, topic string
+		want                  bool
+	}{
+		{"shop", "shop-1", "order-update", true},
+		{"shop", "shop-1", "invoice", true},
+		{"shop", "admin", "order-update", false},
+		{"shop", "shop-1", "chat", false},
+		{"shop", "shop-1", "", false},
+		{"any", "admin", "", true},
+		{"unknown", "admin", "", true},
+	}
+	for _, tt := range tests {
+		if got := scopes[tt.caller].allows(tt.userID, tt.topic); got != tt.want {
+			t.Errorf("%s allows(%q, %q) = %v, want %v", tt.caller, tt.userID, tt.topic, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sentryReporter sends error reports to Sentry, or anything speaking its
+// envelope protocol, from a background goroutine
+type sentryReporter struct {
+	endpoint    string
+	auth        string
+	environment string
+	node        string
+	client      *http.Client
+
+	// mu guards queue against being sent to once closed
+	mu     sync.Mutex
+	queue  chan ErrorReport
+	closed bool
+	// done is closed once the queue has been drained after close
+	done chan struct{}
+}
+
+func newSentryReporter(cfg config) (*sentryReporter, error) {
+	if cfg.SentryDSN == "" {
+		return nil, errors.New("the sentry error reporter needs SSE_SENTRY_DSN")
+	}
+	endpoint, key, err := parseSentryDSN(cfg.SentryDSN)
+	if err != nil {
+		return nil, err
+	}
+	sr := &sentryReporter{
+		endpoint:    endpoint,
+		auth:        "Sentry sentry_version=7, sentry_client=go-fiber-sse-user-channel, sentry_key=" + key,
+		environment: cfg.SentryEnvironment,
+		node:        cfg.NodeID,
+		client:      &http.Client{Timeout: 5 * time.Second},
+		queue:       make(chan ErrorReport, 100),
+		done:        make(chan struct{}),
+	}
+	go sr.run()
+	return sr, nil
+}
+
+// parseSentryDSN turns https://key@host/path/project into the project's
+// envelope endpoint and the public key
+func parseSentryDSN(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Host == "" || u.User == nil || u.User.Username() == "" {
+		return "", "", fmt.Errorf("invalid sentry DSN %q", dsn)
+	}
+	// The project is last, after the path of a Sentry not served at the root
+	i := strings.LastIndex(u.Path, "/")
+	if i < 0 || i == len(u.Path)-1 {
+		return "", "", fmt.Errorf("sentry DSN %q has no project", dsn)
+	}
+	endpoint = u.Scheme + "://" + u.Host + u.Path[:i] + "/api/" + u.Path[i+1:] + "/envelope/"
+	return endpoint, u.User.Username(), nil
+}
+
+func (sr *sentryReporter) Report(r ErrorReport) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.closed {
+		return
+	}
+	select {
+	case sr.queue <- r:
+	default:
+		logger.Warn("Error reports backlog full, discarding report", "kind", r.Kind, "error", r.Err)
+	}
+}
+
+func (sr *sentryReporter) run() {
+	defer close(sr.done)
+	for r := range sr.queue {
+		if err := sr.send(r); err != nil {
+			logger.Warn("Error report failed", "kind", r.Kind, "error", err)
+		}
+	}
+}
+
+// sentryEvent is the part of Sentry's event payload reports fill in
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Tags        map[string]string `json:"tags"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	// Frames are oldest first
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+func (sr *sentryReporter) event(r ErrorReport) sentryEvent {
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	ev := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   r.At.UTC(),
+		Level:       "error",
+		Platform:    "go",
+		ServerName:  sr.node,
+		Environment: sr.environment,
+		Tags:        map[string]string{"kind": r.Kind},
+	}
+	if r.Kind == "panic" {
+		ev.Level = "fatal"
+	}
+	for k, v := range r.Context {
+		ev.Tags[k] = v
+	}
+	ex := sentryException{Type: r.Kind, Value: r.Err.Error()}
+	if len(r.Stack) > 0 {
+		ex.Stacktrace = &sentryStacktrace{}
+		frames := runtime.CallersFrames(r.Stack)
+		for {
+			f, more := frames.Next()
+			ex.Stacktrace.Frames = append(ex.Stacktrace.Frames, sentryFrame{
+				Function: f.Function,
+				AbsPath:  f.File,
+				Lineno:   f.Line,
+				InApp:    strings.HasPrefix(f.Function, "main."),
+			})
+			if !more {
+				break
+			}
+		}
+		// Sentry wants the outermost call first
+		slices.Reverse(ex.Stacktrace.Frames)
+	}
+	ev.Exception.Values = []sentryException{ex}
+	return ev
+}
+
+// send posts r as an envelope holding a single event
+func (sr *sentryReporter) send(r ErrorReport) error {
+	ev := sr.event(r)
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	header, _ := json.Marshal(map[string]any{"event_id": ev.EventID, "sent_at": time.Now().UTC()})
+	item, _ := json.Marshal(map[string]any{"type": "event", "length": len(payload)})
+	for _, line := range [][]byte{header, item, payload} {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+	req, err := http.NewRequest(http.MethodPost, sr.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", sr.auth)
+	resp, err := sr.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sentry returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (sr *sentryReporter) Close(ctx context.Context) {
+	sr.mu.Lock()
+	sr.closed = true
+	close(sr.queue)
+	sr.mu.Unlock()
+	select {
+	case <-sr.done:
+	case <-ctx.Done():
+		logger.Warn("Error reports left unsent at shutdown", "count", len(sr.queue))
+	}
+}
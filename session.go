@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// event is a single message queued for delivery to a session
+type event struct {
+	ID       uint64   `json:"id"`
+	Type     string   `json:"type"`
+	Topic    string   `json:"topic,omitempty"`
+	Data     any      `json:"data"`
+	Priority priority `json:"priority,omitempty"`
+	// PublishedAt is when the broker accepted the event
+	PublishedAt time.Time `json:"publishedAt,omitzero"`
+	// ExpiresAt is when the event stops being worth delivering (zero means never)
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+	// Labels, when set, narrows delivery to the sessions carrying them
+	Labels labelSelector `json:"labels,omitempty"`
+
+	// walID ties the event to its write-ahead log entry while it is in memory
+	walID uint64
+	// trace is the span of the publish, which the session's write is traced under
+	trace trace.SpanContext
+}
+
+func (ev event) expired(now time.Time) bool {
+	return !ev.ExpiresAt.IsZero() && now.After(ev.ExpiresAt)
+}
+
+// session represents a single SSE connection for a user
+type session struct {
+	id          string
+	userID      string
+	connectedAt time.Time
+	// clientIP is the address the session connected from, for connection limits
+	clientIP string
+	// userAgent is the client's User-Agent, for telling clients apart in /sessions
+	userAgent string
+	// metadata is what the client said about itself when connecting, from
+	// the allowed query parameters and headers; nil when it said nothing
+	metadata map[string]string
+	// labels tag the session for publishes that select by label
+	labels map[string]string
+	// log carries the user, session and request IDs into every line about the session
+	log *slog.Logger
+	// payload encrypts the events written to the session; nil sends plaintext
+	payload cipher.AEAD
+	// cloudEvents wraps the events written to the session in CloudEvents
+	// envelopes
+	cloudEvents bool
+
+	// mu guards the queue of events waiting for the writer and the closed state
+	mu          sync.Mutex
+	queue       eventQueue
+	closed      bool
+	evictReason string
+	// evictEvent is the type of the final event telling the client why
+	evictEvent string
+	// notify wakes the writer when events are queued or the session closes
+	notify chan struct{}
+	// space wakes publishers waiting for room in a full queue
+	space chan struct{}
+	done  chan struct{}
+
+	healthMU sync.Mutex
+	health   sessionHealth
+
+	// topics the session is subscribed to, changed live via /sessions/:id/subscriptions
+	topicsMU sync.RWMutex
+	topics   map[string]struct{}
+
+	// baselines is the state document version the client holds, by topic
+	baselineMU sync.Mutex
+	baselines  map[string]uint64
+
+	// authExpiresAt is when the credential the session was opened or last
+	// reauthenticated with expires (zero means never)
+	authMU        sync.Mutex
+	authExpiresAt time.Time
+	// reauth wakes the writer when authExpiresAt changes
+	reauth chan struct{}
+
+	stats sessionStats
+}
+
+func newSession(userID string, topics []string, buffer int) *session {
+	s := &session{
+		id:          newSessionID(),
+		userID:      userID,
+		connectedAt: time.Now(),
+		queue:       eventQueue{capacity: buffer},
+		notify:      make(chan struct{}, 1),
+		space:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		reauth:      make(chan struct{}, 1),
+		topics:      make(map[string]struct{}),
+
+		baselines: make(map[string]uint64),
+	}
+	s.stats.latency = newLatencyWindow(sessionLatencySamples)
+	s.log = logger.With("userID", userID, "sessionID", s.id)
+	s.updateTopics(topics, nil)
+	return s
+}
+
+// wants reports whether an event for the given topic should be delivered to the session.
+// Events without a topic go to every session of the user.
+func (s *session) wants(topic string) bool {
+	if topic == "" {
+		return true
+	}
+	s.topicsMU.RLock()
+	defer s.topicsMU.RUnlock()
+	_, ok := s.topics[topic]
+	return ok
+}
+
+// receives reports whether ev should be delivered to the session: it wants
+// the event's topic and carries the labels the event selects
+func (s *session) receives(ev event) bool {
+	return s.wants(ev.Topic) && ev.Labels.matches(s.labels)
+}
+
+// updateTopics applies subscribe/unsubscribe changes and returns the resulting topic set
+func (s *session) updateTopics(subscribe, unsubscribe []string) []string {
+	s.topicsMU.Lock()
+	defer s.topicsMU.Unlock()
+	for _, t := range subscribe {
+		if t != "" {
+			s.topics[t] = struct{}{}
+		}
+	}
+	for _, t := range unsubscribe {
+		delete(s.topics, t)
+	}
+	return s.topicList()
+}
+
+func (s *session) topicList() []string {
+	topics := make([]string, 0, len(s.topics))
+	for t := range s.topics {
+		topics = append(topics, t)
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+func (s *session) currentTopics() []string {
+	s.topicsMU.RLock()
+	defer s.topicsMU.RUnlock()
+	return s.topicList()
+}
+
+// baseline returns the version of topic's state document the session was last
+// sent, or 0 if it needs a snapshot
+func (s *session) baseline(topic string) uint64 {
+	s.baselineMU.Lock()
+	defer s.baselineMU.Unlock()
+	return s.baselines[topic]
+}
+
+func (s *session) setBaseline(topic string, version uint64) {
+	s.baselineMU.Lock()
+	defer s.baselineMU.Unlock()
+	s.baselines[topic] = version
+}
+
+// enqueue hands ev to the session's writer, applying policy when the queue is full.
+// It returns why the event was dropped ("" if it was queued) and the queued
+// events that were dropped to make room for it.
+func (s *session) enqueue(ev event, policy backpressurePolicy, timeout time.Duration) (string, []event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var displaced []event
+	var deadline <-chan time.Time
+	for {
+		if s.closed {
+			return "session closed", displaced
+		}
+		if !s.queue.full() {
+			s.queue.push(ev)
+			wake(s.notify)
+			return "", displaced
+		}
+
+		// Lower-priority events are always the first to go; drop-oldest also
+		// gives way to newer events of the same priority
+		if low, ok := s.queue.lowest(); ok && (low < ev.Priority || (policy == dropOldest && low == ev.Priority)) {
+			displaced = append(displaced, s.queue.dropOldest(low))
+			continue
+		}
+
+		switch policy {
+		case blockWithTimeout:
+			if deadline == nil {
+				timer := time.NewTimer(timeout)
+				defer timer.Stop()
+				deadline = timer.C
+			}
+			s.mu.Unlock()
+			select {
+			case <-s.space:
+			case <-s.done:
+			case <-deadline:
+				s.mu.Lock()
+				return "buffer full after timeout", displaced
+			}
+			s.mu.Lock()
+		case disconnectSlowConsumer:
+			s.evictLocked("slow-consumer", "buffer full")
+			return "buffer full, session disconnected", displaced
+		default:
+			return "buffer full", displaced
+		}
+	}
+}
+
+// next pops the event the writer should send next. ok is false when nothing is
+// queued; closed reports whether the session has been closed.
+func (s *session) next() (ev event, ok bool, closed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.evictReason != "" {
+		// Evicted sessions stop writing right away; drain collects the rest
+		return event{}, false, true
+	}
+	ev, ok = s.queue.pop()
+	if ok {
+		wake(s.space)
+	}
+	return ev, ok, s.closed
+}
+
+// close stops the session's writer; it is safe to call more than once
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+func (s *session) closeLocked() {
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+		wake(s.notify)
+	}
+}
+
+// evict closes the session without letting the writer send what is still
+// queued; the writer sends a final slow-consumer event with the reason instead.
+// It reports whether this call closed the session.
+func (s *session) evict(reason string) bool {
+	return s.evictAs("slow-consumer", reason)
+}
+
+// evictAs evicts the session with a final event of the given type
+func (s *session) evictAs(eventType, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evictLocked(eventType, reason)
+}
+
+func (s *session) evictLocked(eventType, reason string) bool {
+	if s.closed {
+		return false
+	}
+	s.evictReason = reason
+	s.evictEvent = eventType
+	s.closeLocked()
+	return true
+}
+
+// authExpiry returns when the session's credential expires (zero means never)
+func (s *session) authExpiry() time.Time {
+	s.authMU.Lock()
+	defer s.authMU.Unlock()
+	return s.authExpiresAt
+}
+
+// setAuthExpiry records a new credential expiry and lets the writer reschedule
+func (s *session) setAuthExpiry(t time.Time) {
+	s.authMU.Lock()
+	s.authExpiresAt = t
+	s.authMU.Unlock()
+	wake(s.reauth)
+}
+
+// drain empties the queue of a finished session and returns what was left unsent
+func (s *session) drain() []event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queue.clear()
+}
+
+// evictionReason returns why the session was evicted, or "" if it wasn't
+func (s *session) evictionReason() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evictReason
+}
+
+// evictionEvent returns the type of the event announcing the eviction
+func (s *session) evictionEvent() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.evictEvent
+}
+
+// wake does a non-blocking send on a wake-up channel
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func newSessionID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sessionsLock stores and manages all active sessions
+type sessionsLock struct {
+	MU       sync.Mutex
+	sessions []*session
+	// changed, if set, is called as a session joins or leaves, with whether
+	// its user has other sessions
+	changed func(s *session, joined, userOnline bool)
+}
+
+func (sl *sessionsLock) removeSession(s *session) {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+	idx := slices.Index(sl.sessions, s)
+	if idx != -1 {
+		sl.sessions[idx].close()
+		sl.sessions[idx] = nil
+		sl.sessions = slices.Delete(sl.sessions, idx, idx+1)
+		sl.notifyChanged(s, false)
+	}
+}
+
+// notifyChanged calls changed for s; the lock must be held and s already
+// added or removed
+func (sl *sessionsLock) notifyChanged(s *session, joined bool) {
+	if sl.changed == nil {
+		return
+	}
+	online := false
+	for _, other := range sl.sessions {
+		if other != nil && other != s && other.userID == s.userID {
+			online = true
+			break
+		}
+	}
+	sl.changed(s, joined, online)
+}
+
+// closeAllSessions closes every session, returning how many were still open
+// and how many events those had queued
+func (sl *sessionsLock) closeAllSessions() (sessions, queued int) {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+	all := sl.sessions
+	sl.sessions = nil
+	for i, s := range all {
+		if s == nil {
+			continue
+		}
+		s.mu.Lock()
+		// Evicted ones are on their way out already
+		if !s.closed {
+			sessions++
+			queued += s.queue.size
+		}
+		s.closeLocked()
+		s.mu.Unlock()
+		if sl.changed != nil && !slices.ContainsFunc(all[i+1:], func(other *session) bool { return other != nil && other.userID == s.userID }) {
+			sl.changed(s, false, false)
+		}
+	}
+	return sessions, queued
+}
+
+func (sl *sessionsLock) count() int {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+	return len(sl.sessions)
+}
+
+func (sl *sessionsLock) hasUser(userID string) bool {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+	for _, s := range sl.sessions {
+		if s != nil && s.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// matching returns a snapshot of the sessions for which match returns true
+func (sl *sessionsLock) matching(match func(s *session) bool) []*session {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+	var out []*session
+	for _, s := range sl.sessions {
+		if s != nil && match(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (sl *sessionsLock) findSession(id string) *session {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+	for _, s := range sl.sessions {
+		if s != nil && s.id == id {
+			return s
+		}
+	}
+	return nil
+}
+
+// perUser returns how many sessions each user has open
+func (sl *sessionsLock) perUser() map[string]int {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+	counts := make(map[string]int)
+	for _, s := range sl.sessions {
+		if s != nil {
+			counts[s.userID]++
+		}
+	}
+	return counts
+}
+
+// users returns the distinct IDs of the users with a session, sorted
+func (sl *sessionsLock) users() []string {
+	sl.MU.Lock()
+	defer sl.MU.Unlock()
+	users := make([]string, 0, len(sl.sessions))
+	for _, s := range sl.sessions {
+		if s != nil {
+			users = append(users, s.userID)
+		}
+	}
+	slices.Sort(users)
+	return slices.Compact(users)
+}
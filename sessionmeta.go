@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v3"
+	"google.golang.org/grpc/metadata"
+)
+
+// sessionMetadataMaxLen caps each metadata value, in bytes, so a client
+// can't make every listing of its session large
+const sessionMetadataMaxLen = 256
+
+// sessionMetadata picks what a client says about itself, such as an app
+// version or a device, from the query parameters and headers allowed, to be
+// kept on its session for the admin listing and the presence webhook
+type sessionMetadata struct {
+	query   []string
+	headers []string
+}
+
+func newSessionMetadata(cfg config) sessionMetadata {
+	return sessionMetadata{query: splitList(cfg.SessionMetadataQuery), headers: splitList(cfg.SessionMetadataHeaders)}
+}
+
+// fromHTTP reads the allowed headers and query parameters, keyed by their
+// configured names; a query parameter wins over a header of the same name.
+// It returns nil when the client sent none.
+func (sm sessionMetadata) fromHTTP(c fiber.Ctx) map[string]string {
+	var md map[string]string
+	for _, h := range sm.headers {
+		md = setSessionMetadata(md, h, c.Get(h))
+	}
+	for _, q := range sm.query {
+		md = setSessionMetadata(md, q, c.Query(q))
+	}
+	return md
+}
+
+// fromGRPC reads the allowed headers from a stream's metadata; gRPC has no
+// query parameters
+func (sm sessionMetadata) fromGRPC(in metadata.MD) map[string]string {
+	var md map[string]string
+	for _, h := range sm.headers {
+		if vs := in.Get(h); len(vs) > 0 {
+			md = setSessionMetadata(md, h, vs[0])
+		}
+	}
+	return md
+}
+
+func setSessionMetadata(md map[string]string, key, value string) map[string]string {
+	if value == "" {
+		return md
+	}
+	if len(value) > sessionMetadataMaxLen {
+		cut := sessionMetadataMaxLen
+		for cut > 0 && !utf8.RuneStart(value[cut]) {
+			cut--
+		}
+		value = value[:cut]
+	}
+	if md == nil {
+		md = make(map[string]string)
+	}
+	// Copied out of the request buffer, which Fiber reuses
+	md[key] = strings.Clone(strings.ToValidUTF8(value, "�"))
+	return md
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// sessionStats counts what has been written to a session's stream
+type sessionStats struct {
+	delivered atomic.Uint64
+	bytes     atomic.Uint64
+	// lastActivity is when anything was last written, in Unix nanoseconds
+	lastActivity atomic.Int64
+	// latency holds the publish-to-flush times of the latest live deliveries
+	latency *latencyWindow
+}
+
+// sessionLatencySamples is how many deliveries a session's latency
+// quantiles are computed over
+const sessionLatencySamples = 64
+
+// wrote records n bytes written to the stream
+func (st *sessionStats) wrote(n int) {
+	st.bytes.Add(uint64(n))
+	st.lastActivity.Store(time.Now().UnixNano())
+	currentBroker.metrics.bytes.Add(uint64(n))
+}
+
+// deliveryStats is a session's delivery so far, as /sessions reports it
+type deliveryStats struct {
+	Delivered    uint64 `json:"delivered"`
+	Dropped      int64  `json:"dropped"`
+	BytesWritten uint64 `json:"bytesWritten"`
+	// Queued is how many events wait in the buffer; one that stays near
+	// the buffer size means the client can't keep up
+	Queued       int       `json:"queued"`
+	LastActivity time.Time `json:"lastActivity,omitzero"`
+	ConnectedMs  int64     `json:"connectedMs"`
+	// LatencyP50Ms and LatencyP99Ms are quantiles of the time from publish to
+	// flush over the session's latest deliveries
+	LatencyP50Ms float64 `json:"latencyP50Ms"`
+	LatencyP99Ms float64 `json:"latencyP99Ms"`
+}
+
+// millis converts seconds to milliseconds, to the microsecond
+func millis(seconds float64) float64 {
+	return math.Round(seconds*1e6) / 1e3
+}
+
+func (s *session) deliveryStats(now time.Time) deliveryStats {
+	st := deliveryStats{
+		Delivered:    s.stats.delivered.Load(),
+		BytesWritten: s.stats.bytes.Load(),
+		ConnectedMs:  now.Sub(s.connectedAt).Milliseconds(),
+	}
+	if ns := s.stats.lastActivity.Load(); ns != 0 {
+		st.LastActivity = time.Unix(0, ns)
+	}
+	if qs := s.stats.latency.quantiles(.5, .99); qs != nil {
+		st.LatencyP50Ms, st.LatencyP99Ms = millis(qs[0]), millis(qs[1])
+	}
+	s.healthMU.Lock()
+	st.Dropped = s.health.totalDrops
+	s.healthMU.Unlock()
+	s.mu.Lock()
+	st.Queued = s.queue.size
+	s.mu.Unlock()
+	return st
+}
+
+// userStats adds up the delivery of a user's open sessions
+type userStats struct {
+	UserID       string    `json:"userID"`
+	Sessions     int       `json:"sessions"`
+	Delivered    uint64    `json:"delivered"`
+	Dropped      int64     `json:"dropped"`
+	BytesWritten uint64    `json:"bytesWritten"`
+	Queued       int       `json:"queued"`
+	LastActivity time.Time `json:"lastActivity,omitzero"`
+	// LatencyP99Ms is the highest of the sessions' LatencyP99Ms
+	LatencyP99Ms float64 `json:"latencyP99Ms"`
+}
+
+// userStatsOrders are the ways /users can be sorted, most first
+var userStatsOrders = map[string]func(a, b userStats) int{
+	"dropped":   func(a, b userStats) int { return cmp.Compare(b.Dropped, a.Dropped) },
+	"queued":    func(a, b userStats) int { return cmp.Compare(b.Queued, a.Queued) },
+	"delivered": func(a, b userStats) int { return cmp.Compare(b.Delivered, a.Delivered) },
+	"bytes":     func(a, b userStats) int { return cmp.Compare(b.BytesWritten, a.BytesWritten) },
+	"sessions":  func(a, b userStats) int { return cmp.Compare(b.Sessions, a.Sessions) },
+	"latency":   func(a, b userStats) int { return cmp.Compare(b.LatencyP99Ms, a.LatencyP99Ms) },
+}
+
+// aggregateUsers adds up sessions by user, ordered by order and then user ID
+func aggregateUsers(sessions []sessionInfo, order func(a, b userStats) int) []userStats {
+	byUser := make(map[string]*userStats)
+	for _, s := range sessions {
+		u, ok := byUser[s.UserID]
+		if !ok {
+			u = &userStats{UserID: s.UserID}
+			byUser[s.UserID] = u
+		}
+		u.Sessions++
+		u.Delivered += s.Delivered
+		u.Dropped += s.Dropped
+		u.BytesWritten += s.BytesWritten
+		u.Queued += s.Queued
+		if s.LastActivity.After(u.LastActivity) {
+			u.LastActivity = s.LastActivity
+		}
+		u.LatencyP99Ms = max(u.LatencyP99Ms, s.LatencyP99Ms)
+	}
+	users := make([]userStats, 0, len(byUser))
+	for _, u := range byUser {
+		users = append(users, *u)
+	}
+	slices.SortFunc(users, func(a, b userStats) int {
+		return cmp.Or(order(a, b), cmp.Compare(a.UserID, b.UserID))
+	})
+	return users
+}
+
+// userDetail is what /users/:id/stats reports about a user
+type userDetail struct {
+	userStats
+	// Offline, Unacked and Throttled count the events waiting for the user
+	// outside session buffers: in the offline queue, for an acknowledgement,
+	// and held back by the user's rate limit
+	Offline   int `json:"offline"`
+	Unacked   int `json:"unacked"`
+	Throttled int `json:"throttled"`
+	// Paused is the user's pause on this instance, nil when not paused
+	Paused *pauseInfo `json:"paused,omitempty"`
+	// LastEventID and LastEventAt are the user's latest event in the history
+	LastEventID  uint64        `json:"lastEventID,omitempty"`
+	LastEventAt  time.Time     `json:"lastEventAt,omitzero"`
+	OpenSessions []sessionInfo `json:"openSessions"`
+}
+
+// userDetail adds what waits for userID here to the totals of its sessions
+func (b *broker) userDetail(ctx context.Context, userID string, sessions []sessionInfo) (userDetail, error) {
+	d := userDetail{
+		userStats:    userStats{UserID: userID},
+		Unacked:      b.redelivery.count(userID),
+		Throttled:    b.throttle.held(userID),
+		OpenSessions: sessions,
+	}
+	if p, ok := b.pauses.get(userID); ok {
+		p.Node = b.nodeID
+		d.Paused = &p
+	}
+	if users := aggregateUsers(sessions, userStatsOrders["dropped"]); len(users) > 0 {
+		d.userStats = users[0]
+	}
+	slices.SortFunc(d.OpenSessions, func(a, b sessionInfo) int { return a.ConnectedAt.Compare(b.ConnectedAt) })
+	var err error
+	if d.Offline, err = b.offline.count(ctx, userID); err != nil {
+		return d, err
+	}
+	last, ok, err := b.history.latest(ctx, userID)
+	if ok {
+		d.LastEventID, d.LastEventAt = last.ID, last.PublishedAt
+	}
+	return d, err
+}
@@ -0,0 +1,45 @@
+package main
+
+import "slices"
+
+// shutdownStep is a step of graceful shutdown, run in the order
+// SSE_SHUTDOWN_STEPS lists them
+type shutdownStep string
+
+const (
+	// stepReadiness fails /readyz, turns new streams away and waits
+	// SSE_DRAIN_DELAY for load balancers to notice
+	stepReadiness shutdownStep = "readiness"
+	// stepDrain asks the open sessions to reconnect, a few at a time over
+	// SSE_SHUTDOWN_DRAIN, so they move to other instances
+	stepDrain shutdownStep = "drain"
+	// stepClose stops the sources and closes the sessions left
+	stepClose shutdownStep = "close"
+)
+
+// defaultShutdownSteps takes the instance out of rotation before ending
+// any session
+var defaultShutdownSteps = []shutdownStep{stepReadiness, stepDrain, stepClose}
+
+// parseShutdownSteps reads a comma-separated list of steps, each named at
+// most once. Steps left out are skipped, except close: the sessions have to
+// end before the server can stop, so it runs last when not listed.
+func parseShutdownSteps(v string) ([]shutdownStep, bool) {
+	var steps []shutdownStep
+	for _, name := range splitList(v) {
+		step := shutdownStep(name)
+		switch step {
+		case stepReadiness, stepDrain, stepClose:
+		default:
+			return nil, false
+		}
+		if slices.Contains(steps, step) {
+			return nil, false
+		}
+		steps = append(steps, step)
+	}
+	if !slices.Contains(steps, stepClose) {
+		steps = append(steps, stepClose)
+	}
+	return steps, true
+}
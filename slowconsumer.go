@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// slowConsumerDetector evicts sessions that keep dropping events or whose
+// writes take too long, so one stuck client can't hold buffers forever
+type slowConsumerDetector struct {
+	// maxDrops is the number of drops tolerated within window (0 disables the check)
+	maxDrops int
+	window   time.Duration
+	// maxWriteLatency is the highest tolerated average write+flush time (0 disables the check)
+	maxWriteLatency time.Duration
+
+	evictions atomic.Int64
+}
+
+// sessionHealth holds the delivery history used to judge a session
+type sessionHealth struct {
+	drops        []time.Time
+	totalDrops   int64
+	writeLatency time.Duration // exponentially weighted moving average
+}
+
+func newSlowConsumerDetector(cfg config) *slowConsumerDetector {
+	return &slowConsumerDetector{
+		maxDrops:        cfg.SlowConsumerMaxDrops,
+		window:          cfg.SlowConsumerWindow,
+		maxWriteLatency: cfg.SlowConsumerMaxWriteLatency,
+	}
+}
+
+// recordDrop notes an event that could not be queued for s and evicts it past the threshold
+func (d *slowConsumerDetector) recordDrop(s *session) {
+	now := time.Now()
+
+	s.healthMU.Lock()
+	s.health.totalDrops++
+	cutoff := now.Add(-d.window)
+	kept := s.health.drops[:0]
+	for _, t := range s.health.drops {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	s.health.drops = append(kept, now)
+	recent := len(s.health.drops)
+	s.healthMU.Unlock()
+
+	if d.maxDrops > 0 && recent > d.maxDrops {
+		d.evict(s, "too many dropped events")
+	}
+}
+
+// recordWrite notes how long a write+flush to s took and evicts it if it is consistently slow
+func (d *slowConsumerDetector) recordWrite(s *session, latency time.Duration) {
+	s.healthMU.Lock()
+	if s.health.writeLatency == 0 {
+		s.health.writeLatency = latency
+	} else {
+		s.health.writeLatency = (s.health.writeLatency*7 + latency) / 8
+	}
+	avg := s.health.writeLatency
+	s.healthMU.Unlock()
+
+	if d.maxWriteLatency > 0 && avg > d.maxWriteLatency {
+		d.evict(s, "writes too slow")
+	}
+}
+
+func (d *slowConsumerDetector) evict(s *session, reason string) {
+	if s.evict(reason) {
+		d.evictions.Add(1)
+		s.log.Warn("SSE slow consumer evicted", "reason", reason)
+	}
+}
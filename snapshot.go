@@ -0,0 +1,259 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateMode marks a publish as an update of a per-topic state document
+type stateMode string
+
+const (
+	// stateSnapshot publishes the full document; the broker works out the delta
+	stateSnapshot stateMode = "snapshot"
+	// statePatch publishes a JSON merge patch (RFC 7386) to apply to the document
+	statePatch stateMode = "patch"
+)
+
+func parseStateMode(v string) (stateMode, bool) {
+	switch m := stateMode(v); m {
+	case stateSnapshot, statePatch:
+		return m, true
+	}
+	return "", false
+}
+
+// stateDocs holds the state document of each user and topic published in
+// snapshot/delta mode
+type stateDocs struct {
+	// snapshotEvery sends a full snapshot after this many deltas
+	snapshotEvery int
+
+	mu   sync.Mutex
+	docs map[string]*stateDoc
+}
+
+// stateDoc is one document; mu is held while an update fans out so sessions
+// see versions in order
+type stateDoc struct {
+	mu      sync.Mutex
+	value   any
+	version uint64
+	// eventID of the publish that produced the current version
+	eventID uint64
+	// deltas sent since the last scheduled snapshot
+	deltas int
+}
+
+func newStateDocs(snapshotEvery int) *stateDocs {
+	return &stateDocs{snapshotEvery: snapshotEvery, docs: make(map[string]*stateDoc)}
+}
+
+func (sd *stateDocs) doc(userID, topic string) *stateDoc {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	key := userID + "\x00" + topic
+	d := sd.docs[key]
+	if d == nil {
+		d = &stateDoc{}
+		sd.docs[key] = d
+	}
+	return d
+}
+
+// existing returns userID's documents that have a version, by topic
+func (sd *stateDocs) existing(userID string) map[string]*stateDoc {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+	out := make(map[string]*stateDoc)
+	for key, d := range sd.docs {
+		if u, topic, _ := strings.Cut(key, "\x00"); u == userID {
+			out[topic] = d
+		}
+	}
+	return out
+}
+
+func snapshotEvent(id uint64, topic string, d *stateDoc) event {
+	return event{
+		ID:    id,
+		Type:  "snapshot",
+		Topic: topic,
+		Data:  map[string]any{"version": d.version, "state": d.value},
+	}
+}
+
+// publishState applies a snapshot or patch publish to the document of the
+// event's topic and sends each subscribed session either the delta or, when
+// the session has no baseline for the previous version or a snapshot is due,
+// the full document. A publish accepted here is forwarded to the other
+// instances as a snapshot of the whole document, so an instance that missed
+// an update still ends up with the same state; received is set for those.
+func (b *broker) publishState(userID string, ev event, opts publishOptions, received bool) publishResult {
+	policy := opts.Policy
+	if policy == "" {
+		policy = b.policy
+	}
+	defer b.wal.release(ev.walID)
+	d := b.stateDocs.doc(userID, ev.Topic)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var patch any
+	if opts.State == statePatch {
+		patch = ev.Data
+		d.value = mergePatch(d.value, patch)
+	} else {
+		patch = diffMergePatch(d.value, ev.Data)
+		d.value = ev.Data
+	}
+	d.version++
+	if !received {
+		ev.ID = b.nextEventID()
+		ev.PublishedAt = time.Now()
+		// Forwarded under the document's lock, so instances apply updates
+		// in the order they were made
+		whole := ev
+		whole.Data = d.value
+		wholeOpts := opts
+		wholeOpts.State = stateSnapshot
+		b.forward(userID, whole, wholeOpts)
+		b.replication.mirror(userID, ev, opts)
+	}
+	d.eventID = ev.ID
+	snapshotDue := d.version == 1 || (b.stateDocs.snapshotEvery > 0 && d.deltas >= b.stateDocs.snapshotEvery)
+	if snapshotDue {
+		d.deltas = 0
+	} else {
+		d.deltas++
+	}
+	snapshot := snapshotEvent(ev.ID, ev.Topic, d)
+	snapshot.Priority, snapshot.PublishedAt = ev.Priority, ev.PublishedAt
+	delta := ev
+	delta.Type = "delta"
+	delta.Data = map[string]any{"version": d.version, "patch": patch}
+
+	b.deliveries.track(ev.ID, userID)
+	targets := b.sessions.matching(func(s *session) bool {
+		return s.userID == userID && s.wants(ev.Topic)
+	})
+	res := publishResult{
+		EventID:  ev.ID,
+		Online:   len(targets) > 0 || b.sessions.hasUser(userID),
+		Sessions: make([]sessionReport, 0, len(targets)),
+	}
+	if len(targets) > 0 && b.pauses.paused(userID) {
+		// The document moves on without them; the resume sends its snapshot
+		res.Paused = true
+		targets = nil
+	}
+	for _, s := range targets {
+		out := delta
+		if snapshotDue || s.baseline(ev.Topic) != d.version-1 {
+			out = snapshot
+		}
+		b.deliveries.set(ev.ID, s.id, deliveryQueued)
+		b.wal.hold(ev.walID)
+		reason, displaced := s.enqueue(out, policy, b.blockTimeout)
+		if reason == "" {
+			s.setBaseline(ev.Topic, d.version)
+			res.Sent++
+			res.Sessions = append(res.Sessions, sessionReport{SessionID: s.id, Status: "queued"})
+		} else {
+			// Without this version the session needs a snapshot next time
+			s.setBaseline(ev.Topic, 0)
+			b.wal.release(ev.walID)
+			res.Dropped++
+			res.Sessions = append(res.Sessions, sessionReport{SessionID: s.id, Status: "dropped", Reason: reason})
+			b.dropped(userID, s, out, reason)
+		}
+		for _, dropped := range displaced {
+			b.wal.release(dropped.walID)
+			if dropped.Type == "snapshot" || dropped.Type == "delta" {
+				s.setBaseline(dropped.Topic, 0)
+			}
+			b.dropped(userID, s, dropped, "displaced from full buffer")
+		}
+	}
+	b.tail.published(userID, ev, res)
+	return res
+}
+
+// currentSnapshots returns a fresh snapshot of every state document a new
+// session is subscribed to and records it as the session's baseline
+func (b *broker) currentSnapshots(s *session) []event {
+	var out []event
+	for topic, d := range b.stateDocs.existing(s.userID) {
+		if !s.wants(topic) {
+			continue
+		}
+		d.mu.Lock()
+		if d.version > 0 {
+			out = append(out, snapshotEvent(d.eventID, topic, d))
+			s.setBaseline(topic, d.version)
+		}
+		d.mu.Unlock()
+	}
+	return out
+}
+
+// mergePatch applies a JSON merge patch to target as described in RFC 7386
+func mergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	} else {
+		// Don't modify a document already handed to sessions
+		t = maps.Clone(t)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// diffMergePatch returns the JSON merge patch that turns from into to
+func diffMergePatch(from, to any) any {
+	f, fok := from.(map[string]any)
+	t, tok := to.(map[string]any)
+	if !fok || !tok {
+		return to
+	}
+	patch := make(map[string]any)
+	for k := range f {
+		if _, ok := t[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, v := range t {
+		old, ok := f[k]
+		if !ok {
+			patch[k] = v
+			continue
+		}
+		if _, isMap := v.(map[string]any); isMap {
+			if sub := diffMergePatch(old, v); !isEmptyPatch(sub) {
+				patch[k] = sub
+			}
+		} else if !reflect.DeepEqual(old, v) {
+			patch[k] = v
+		}
+	}
+	return patch
+}
+
+func isEmptyPatch(p any) bool {
+	m, ok := p.(map[string]any)
+	return ok && len(m) == 0
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decodeJSON decodes s as the state documents are, after a trip through JSON
+func decodeJSON(t *testing.T, s string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("decode %s: %v", s, err)
+	}
+	return v
+}
+
+// The examples of RFC 7386, appendix A
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, tt := range tests {
+		target := decodeJSON(t, tt.target)
+		got := mergePatch(target, decodeJSON(t, tt.patch))
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("mergePatch(%s, %s) = %v, want %v", tt.target, tt.patch, got, want)
+		}
+		if !reflect.DeepEqual(target, decodeJSON(t, tt.target)) {
+			t.Errorf("mergePatch(%s, %s) modified its target to %v", tt.target, tt.patch, target)
+		}
+	}
+}
+
+func TestDiffMergePatch(t *testing.T) {
+	tests := []struct {
+		from, to string
+		// want is the patch expected, when there is only one right answer
+		want string
+	}{
+		{`{"a":1}`, `{"a":1}`, `{}`},
+		{`{"a":1}`, `{"a":2}`, `{"a":2}`},
+		{`{"a":1,"b":2}`, `{"b":2}`, `{"a":null}`},
+		{`{"a":1}`, `{"a":1,"b":{"c":true}}`, `{"b":{"c":true}}`},
+		{`{"a":{"b":1,"c":2}}`, `{"a":{"b":1,"c":3}}`, `{"a":{"c":3}}`},
+		{`{"a":{"b":1,"c":2}}`, `{"a":{"b":1}}`, `{"a":{"c":null}}`},
+		{`{"a":{"b":1}}`, `{"a":[1,2]}`, `{"a":[1,2]}`},
+		{`{"a":[1,2]}`, `{"a":[2,1]}`, `{"a":[2,1]}`},
+		{`{"a":"x"}`, `{"a":{"b":"x"}}`, `{"a":{"b":"x"}}`},
+		{`{"a":{"b":"x"}}`, `{"a":"x"}`, `{"a":"x"}`},
+		{`{"a":1}`, `[1]`, `[1]`},
+		{`[1]`, `{"a":1}`, `{"a":1}`},
+		{`"x"`, `"y"`, `"y"`},
+		{`{"a":{"b":{"c":{"d":1}}},"e":[{"f":1}]}`, `{"a":{"b":{"c":{"d":2}}},"e":[{"f":1}],"g":0}`, `{"a":{"b":{"c":{"d":2}}},"g":0}`},
+	}
+	for _, tt := range tests {
+		from, to := decodeJSON(t, tt.from), decodeJSON(t, tt.to)
+		patch := diffMergePatch(from, to)
+		if want := decodeJSON(t, tt.want); !reflect.DeepEqual(patch, want) {
+			t.Errorf("diffMergePatch(%s, %s) = %v, want %v", tt.from, tt.to, patch, want)
+		}
+		// The patch has to survive JSON, as it does on its way to clients
+		raw, err := json.Marshal(patch)
+		if err != nil {
+			t.Fatalf("encode patch %v: %v", patch, err)
+		}
+		if got := mergePatch(from, decodeJSON(t, string(raw))); !reflect.DeepEqual(got, to) {
+			t.Errorf("mergePatch(%s, diffMergePatch(%s, %s)) = %v, want %s", tt.from, tt.from, tt.to, got, tt.to)
+		}
+	}
+}
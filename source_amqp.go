@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpFields are the fields an AMQP delivery adds: "routing-key",
+// "routing-key:<n>" for the n-th "."-separated word of it counting from 0,
+// and "header:<name>"
+var amqpFields = map[string]fieldArg{"routing-key": optionalIndexArg, "header": nameArg}
+
+// amqpBinding routes an exchange's messages with a matching routing key to
+// the source's queue
+type amqpBinding struct {
+	exchange string
+	key      string
+}
+
+// parseAMQPBindings parses comma-separated exchange:routing-key pairs; a
+// binding without a key gets every message of a fanout or headers exchange
+func parseAMQPBindings(spec string) ([]amqpBinding, error) {
+	var bindings []amqpBinding
+	for _, b := range splitList(spec) {
+		exchange, key, _ := strings.Cut(b, ":")
+		if exchange == "" {
+			return nil, fmt.Errorf("binding %q needs an exchange", b)
+		}
+		bindings = append(bindings, amqpBinding{exchange: exchange, key: key})
+	}
+	return bindings, nil
+}
+
+// newAMQPMessage prepares a delivery for mapping onto a publish
+func newAMQPMessage(d *amqp.Delivery) *mappedMessage {
+	return newMappedMessage(func(f messageField) any {
+		if f.kind == "routing-key" {
+			return fieldPart(d.RoutingKey, ".", f.index)
+		}
+		return d.Headers[f.name]
+	}, d.Body)
+}
+
+// amqpSource consumes a RabbitMQ queue and publishes each message to the user
+// it names. A message is acknowledged once the broker has taken it, so one
+// in flight when the connection drops is delivered again. Instances share
+// the queue, each message going to one of them.
+type amqpSource struct {
+	url      string
+	queue    string
+	bindings []amqpBinding
+	prefetch int
+	consumer string
+	mapping  fieldMapping
+}
+
+func newAMQPSource(cfg config) (*amqpSource, error) {
+	src := &amqpSource{
+		url:      cfg.AMQPURL,
+		queue:    cfg.AMQPQueue,
+		prefetch: cfg.AMQPPrefetch,
+		consumer: "sse-" + cfg.NodeID,
+	}
+	var err error
+	if src.bindings, err = parseAMQPBindings(cfg.AMQPBindings); err != nil {
+		return nil, fmt.Errorf("SSE_AMQP_BINDINGS: %w", err)
+	}
+	src.mapping, err = newFieldMapping("SSE_AMQP", amqpFields, cfg.AMQPUserField, cfg.AMQPTopicField, cfg.AMQPValueField)
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// Start declares and binds the queue, then publishes its messages until ctx
+// is done, or until the connection or channel closes
+func (src *amqpSource) Start(ctx context.Context, publish publishFunc) error {
+	conn, err := amqp.Dial(src.url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	if _, err := ch.QueueDeclare(src.queue, true, false, false, false, nil); err != nil {
+		return err
+	}
+	for _, b := range src.bindings {
+		if err := ch.QueueBind(src.queue, b.key, b.exchange, false, nil); err != nil {
+			return fmt.Errorf("binding to exchange %q: %w", b.exchange, err)
+		}
+	}
+	// The prefetch bounds how many unacknowledged messages this instance
+	// holds at once
+	if err := ch.Qos(src.prefetch, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(src.queue, src.consumer, false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	logger.Info("AMQP source consuming", "queue", src.queue, "bindings", len(src.bindings))
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return amqpCloseError(closed)
+			}
+			src.publish(publish, &d)
+		case <-ctx.Done():
+			// Closing the channel returns what is unacknowledged to the queue,
+			// for the other instances
+			ch.Close()
+			return nil
+		}
+	}
+}
+
+// amqpCloseError is why a channel stopped delivering, from its close
+// notifications
+func amqpCloseError(closed <-chan *amqp.Error) error {
+	if err, ok := <-closed; ok && err != nil {
+		return err
+	}
+	return errors.New("AMQP channel closed")
+}
+
+// publish sends one message to its user and acknowledges it. Messages that
+// can't be mapped are rejected without requeueing, so they go to the queue's
+// dead-letter exchange, if it has one, instead of coming straight back.
+func (src *amqpSource) publish(publish publishFunc, d *amqp.Delivery) {
+	userID, topic, value, err := src.mapping.resolve(newAMQPMessage(d))
+	if err != nil {
+		logger.Warn("AMQP message skipped", "queue", src.queue, "routingKey", d.RoutingKey, "error", err)
+		if err := d.Reject(false); err != nil {
+			logger.Error("AMQP reject error", "error", err)
+		}
+		return
+	}
+	// A message redelivered after a lost acknowledgement is published once,
+	// if the publisher gave it an ID
+	var key string
+	if d.MessageId != "" {
+		key = "amqp:" + d.MessageId
+	}
+	publish(key, userID, topic, value)
+	if err := d.Ack(false); err != nil {
+		logger.Error("AMQP ack error", "error", err)
+	}
+}
+
+// Stop has nothing to release: the connection closes with Start
+func (src *amqpSource) Stop() {}
+
+// Health is always nil; a lost connection ends Start, which the supervisor
+// reports
+func (src *amqpSource) Health() error {
+	return nil
+}
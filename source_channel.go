@@ -0,0 +1,34 @@
+package main
+
+// channelFields are the fields a message of a Redis or Postgres channel or
+// MQTT topic adds: "channel" for the channel's name, and "segment:<n>" for
+// the n-th part of it counting from 0
+var channelFields = map[string]fieldArg{"channel": noArg, "segment": indexArg}
+
+// channelMapping maps the messages of a pub/sub source onto publishes
+type channelMapping struct {
+	fieldMapping
+	// sep separates the segments of a channel's name
+	sep string
+}
+
+// newChannelMapping parses the source's fields, for channel names whose
+// segments sep separates; errors name the settings by their env prefix
+func newChannelMapping(prefix, sep, user, topic, value string) (channelMapping, error) {
+	fm, err := newFieldMapping(prefix, channelFields, user, topic, value)
+	return channelMapping{fieldMapping: fm, sep: sep}, err
+}
+
+// publish sends a message to the user it names with publish, or returns why
+// it can't be mapped
+func (cm channelMapping) publish(publish publishFunc, channel, payload string) error {
+	m := newMappedMessage(func(f messageField) any {
+		return fieldPart(channel, cm.sep, f.index)
+	}, []byte(payload))
+	userID, topic, value, err := cm.resolve(m)
+	if err != nil {
+		return err
+	}
+	publish("", userID, topic, value)
+	return nil
+}
@@ -0,0 +1,97 @@
+//go:build kafka
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// kafkaFields are the fields a Kafka message adds: "key" and
+// "header:<name>"
+var kafkaFields = map[string]fieldArg{"key": noArg, "header": nameArg}
+
+// newKafkaMessage prepares a consumed message for mapping onto a publish
+func newKafkaMessage(rec *kgo.Record) *mappedMessage {
+	return newMappedMessage(func(f messageField) any {
+		if f.kind == "key" {
+			return string(rec.Key)
+		}
+		for _, h := range rec.Headers {
+			if h.Key == f.name {
+				return string(h.Value)
+			}
+		}
+		return nil
+	}, rec.Value)
+}
+
+// kafkaSource consumes a Kafka topic and publishes each message to the user
+// it names, committing offsets once the batch has been published
+type kafkaSource struct {
+	sourceHealth
+	client  *kgo.Client
+	mapping fieldMapping
+}
+
+func newKafkaSource(cfg config) (*kafkaSource, error) {
+	src := &kafkaSource{}
+	var err error
+	src.mapping, err = newFieldMapping("SSE_KAFKA", kafkaFields, cfg.KafkaUserField, cfg.KafkaTopicField, cfg.KafkaValueField)
+	if err != nil {
+		return nil, err
+	}
+	src.client, err = kgo.NewClient(
+		kgo.SeedBrokers(strings.Split(cfg.KafkaBrokers, ",")...),
+		kgo.ConsumerGroup(cfg.KafkaGroup),
+		kgo.ConsumeTopics(cfg.KafkaTopic),
+		kgo.DisableAutoCommit(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return src, nil
+}
+
+// Start consumes until ctx is done; the client reconnects by itself, and
+// fetch errors leave the source unhealthy until a fetch succeeds
+func (src *kafkaSource) Start(ctx context.Context, publish publishFunc) error {
+	for {
+		fetches := src.client.PollFetches(ctx)
+		if fetches.IsClientClosed() || ctx.Err() != nil {
+			return nil
+		}
+		var fetchErr error
+		fetches.EachError(func(topic string, partition int32, err error) {
+			logger.Error("Kafka fetch error", "kafkaTopic", topic, "partition", partition, "error", err)
+			fetchErr = err
+		})
+		src.setHealth(fetchErr)
+		fetches.EachRecord(func(rec *kgo.Record) {
+			src.publish(publish, rec)
+		})
+		if err := src.client.CommitUncommittedOffsets(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			logger.Error("Kafka commit error", "error", err)
+		}
+	}
+}
+
+// publish sends one message to its user. Messages that can't be mapped are
+// logged and skipped, so one bad message doesn't stall the partition.
+func (src *kafkaSource) publish(publish publishFunc, rec *kgo.Record) {
+	userID, topic, value, err := src.mapping.resolve(newKafkaMessage(rec))
+	if err != nil {
+		logger.Warn("Kafka message skipped", "kafkaTopic", rec.Topic, "partition", rec.Partition, "offset", rec.Offset, "error", err)
+		return
+	}
+	// A message redelivered after a rebalance is published once
+	publish(fmt.Sprintf("kafka:%s/%d/%d", rec.Topic, rec.Partition, rec.Offset), userID, topic, value)
+}
+
+func (src *kafkaSource) Stop() {
+	src.client.Close()
+}
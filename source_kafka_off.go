@@ -0,0 +1,26 @@
+//go:build !kafka
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// kafkaSource stands in for the Kafka bridge in binaries built without the
+// kafka tag, which leaves the Kafka client out of the default build
+type kafkaSource struct{}
+
+func newKafkaSource(cfg config) (*kafkaSource, error) {
+	return nil, errors.New("this binary was built without Kafka support; rebuild with -tags kafka")
+}
+
+func (src *kafkaSource) Start(ctx context.Context, publish publishFunc) error {
+	return nil
+}
+
+func (src *kafkaSource) Stop() {}
+
+func (src *kafkaSource) Health() error {
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// mqttTimeout bounds connecting and subscribing to the MQTT broker
+const mqttTimeout = 10 * time.Second
+
+// mqttBridge connects the broker to an MQTT broker for IoT devices. It
+// publishes what arrives on the subscribed topic filters to the users the
+// MQTT topics name and, when a mirror topic is set, sends the publishes of
+// the API to MQTT too. Subscriptions are shared by a group, so with several
+// instances each message reaches one of them.
+type mqttBridge struct {
+	client  mqtt.Client
+	filters []string
+	// group is the shared subscription the filters are taken in, or "none"
+	// to subscribe to them directly
+	group   string
+	qos     byte
+	mapping channelMapping
+	// mirror is the MQTT topic API publishes are sent to, with {userID} and
+	// {topic} standing for the event's; empty when not mirroring
+	mirror string
+	// publishFn publishes what arrives, from Start on
+	publishFn publishFunc
+}
+
+func newMQTTBridge(cfg config) (*mqttBridge, error) {
+	if cfg.MQTTQoS < 0 || cfg.MQTTQoS > 2 {
+		return nil, errors.New("SSE_MQTT_QOS must be 0, 1 or 2")
+	}
+	mb := &mqttBridge{
+		filters: splitList(cfg.MQTTSubscribe),
+		group:   cfg.MQTTShareGroup,
+		qos:     byte(cfg.MQTTQoS),
+		mirror:  cfg.MQTTMirrorTopic,
+	}
+	if len(mb.filters) == 0 && mb.mirror == "" {
+		return nil, errors.New("set SSE_MQTT_SUBSCRIBE, SSE_MQTT_MIRROR_TOPIC or both")
+	}
+	if strings.ContainsAny(mb.mirror, "+#") {
+		return nil, errors.New("SSE_MQTT_MIRROR_TOPIC must not contain wildcards")
+	}
+	var err error
+	mb.mapping, err = newChannelMapping("SSE_MQTT", "/", cfg.MQTTUserField, cfg.MQTTTopicField, cfg.MQTTValueField)
+	if err != nil {
+		return nil, err
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.MQTTBroker).
+		SetClientID(cmp.Or(cfg.MQTTClientID, "sse-"+cfg.NodeID)).
+		SetUsername(cfg.MQTTUsername).
+		SetPassword(cfg.MQTTPassword).
+		SetConnectTimeout(mqttTimeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		// The session isn't kept, so the filters are subscribed to again on
+		// every connect
+		SetCleanSession(true).
+		SetOnConnectHandler(mb.subscribe).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			logger.Error("MQTT connection lost", "error", err)
+		})
+	mb.client = mqtt.NewClient(opts)
+	return mb, nil
+}
+
+// Start connects in the background and stays connected until ctx is done;
+// the client reconnects by itself, and queues mirrored publishes meanwhile
+func (mb *mqttBridge) Start(ctx context.Context, publish publishFunc) error {
+	mb.publishFn = publish
+	mb.client.Connect()
+	<-ctx.Done()
+	return nil
+}
+
+func (mb *mqttBridge) subscribe(c mqtt.Client) {
+	logger.Info("MQTT connected", "filters", mb.filters, "group", mb.group)
+	for _, filter := range mb.filters {
+		if mb.group != "none" {
+			filter = "$share/" + mb.group + "/" + filter
+		}
+		t := c.Subscribe(filter, mb.qos, mb.publish)
+		if !t.WaitTimeout(mqttTimeout) {
+			logger.Error("MQTT subscribe error", "filter", filter, "error", "timed out")
+		} else if err := t.Error(); err != nil {
+			logger.Error("MQTT subscribe error", "filter", filter, "error", err)
+		}
+	}
+}
+
+// publish sends one MQTT message to its user. Messages that can't be mapped
+// are logged and skipped.
+func (mb *mqttBridge) publish(_ mqtt.Client, msg mqtt.Message) {
+	if err := mb.mapping.publish(mb.publishFn, msg.Topic(), string(msg.Payload())); err != nil {
+		logger.Warn("MQTT message skipped", "mqttTopic", msg.Topic(), "error", err)
+	}
+}
+
+// mirrorTopic fills the mirror template in for an event
+func (mb *mqttBridge) mirrorTopic(userID, topic string) string {
+	return strings.NewReplacer("{userID}", userID, "{topic}", topic).Replace(mb.mirror)
+}
+
+// send mirrors an API publish to MQTT without waiting for the MQTT broker;
+// publishes to labels alone name no user and aren't mirrored
+func (mb *mqttBridge) send(userID, topic string, value []byte) {
+	if mb == nil || mb.mirror == "" || userID == "" {
+		return
+	}
+	mqttTopic := mb.mirrorTopic(userID, topic)
+	t := mb.client.Publish(mqttTopic, mb.qos, false, value)
+	go func() {
+		<-t.Done()
+		if err := t.Error(); err != nil {
+			logger.Error("MQTT mirror error", "mqttTopic", mqttTopic, "error", err)
+		}
+	}()
+}
+
+func (mb *mqttBridge) Stop() {
+	mb.client.Disconnect(uint(time.Second / time.Millisecond))
+}
+
+// Health reports the bridge unhealthy while it is disconnected
+func (mb *mqttBridge) Health() error {
+	if !mb.client.IsConnectionOpen() {
+		return errors.New("not connected to the MQTT broker")
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// pgSourceLockKey is the advisory lock the listening instance holds
+const pgSourceLockKey int64 = 0x5353455f534f5552
+
+// pgSourceCheckEvery is how often the Postgres source checks it still holds
+// the lock, or tries to take it when it doesn't
+const pgSourceCheckEvery = 5 * time.Second
+
+// pgSource LISTENs on Postgres channels and publishes each NOTIFY payload to
+// the user it names, so database triggers can push updates to browsers.
+// Every listener gets every notification, so only the instance holding an
+// advisory lock listens; the others stand by to take over. Notifications
+// sent while no instance is listening are lost.
+type pgSource struct {
+	sourceHealth
+	dsn      string
+	channels []string
+	mapping  channelMapping
+	// db holds the connection the lock is taken on, which releases it when
+	// closed, or when the instance goes away
+	db *sql.DB
+}
+
+func newPGSource(cfg config) (*pgSource, error) {
+	dsn := cfg.PGSourceDSN
+	if dsn == "" && cfg.Store == "postgres" {
+		dsn = cfg.SQLDSN
+	}
+	if dsn == "" {
+		return nil, errors.New("SSE_PG_SOURCE_DSN is required")
+	}
+	mapping, err := newChannelMapping("SSE_PG_SOURCE", ":", cfg.PGSourceUserField, cfg.PGSourceTopicField, cfg.PGSourceValueField)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &pgSource{
+		dsn:      dsn,
+		channels: splitList(cfg.PGSourceChannels),
+		mapping:  mapping,
+		db:       db,
+	}, nil
+}
+
+// Start takes the lock whenever it is free and listens for as long as it is
+// held, until ctx is done
+func (src *pgSource) Start(ctx context.Context, publish publishFunc) error {
+	t := time.NewTicker(pgSourceCheckEvery)
+	defer t.Stop()
+	var lock *sql.Conn
+	var listener *pq.Listener
+	for {
+		switch {
+		case lock == nil:
+			if lock = src.lock(ctx); lock != nil {
+				listener = src.listen(publish)
+			}
+		case !src.holds(ctx, lock):
+			logger.Warn("Postgres source lost its lock, unlistening")
+			listener.Close()
+			lock.Close()
+			lock, listener = nil, nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			if lock != nil {
+				listener.Close()
+				lock.Close()
+			}
+			return nil
+		}
+	}
+}
+
+// lock returns the connection holding the lock, or nil when another instance
+// holds it. An error leaves the source unhealthy.
+func (src *pgSource) lock(ctx context.Context) *sql.Conn {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	conn, err := src.db.Conn(ctx)
+	if err != nil {
+		logger.Error("Postgres source lock error", "error", err)
+		src.setHealth(err)
+		return nil
+	}
+	var held bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", pgSourceLockKey).Scan(&held)
+	if err != nil {
+		logger.Error("Postgres source lock error", "error", err)
+	}
+	src.setHealth(err)
+	if err != nil || !held {
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+// holds reports whether the lock's connection is still up; the lock goes
+// with it
+func (src *pgSource) holds(ctx context.Context, lock *sql.Conn) bool {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	return lock.PingContext(ctx) == nil
+}
+
+func (src *pgSource) listen(publish publishFunc) *pq.Listener {
+	l := pq.NewListener(src.dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			logger.Error("Postgres listener error", "error", err)
+		}
+		// The listener reconnects by itself, and is unhealthy until it has
+		src.setHealth(err)
+	})
+	go func() {
+		// Closes with the listener
+		for n := range l.Notify {
+			if n == nil {
+				// Sent after a reconnect; what was notified meanwhile is lost
+				logger.Warn("Postgres listener reconnected")
+				continue
+			}
+			if err := src.mapping.publish(publish, n.Channel, n.Extra); err != nil {
+				logger.Warn("Postgres notification skipped", "channel", n.Channel, "error", err)
+			}
+		}
+	}()
+	for _, ch := range src.channels {
+		if err := l.Listen(ch); err != nil {
+			logger.Error("Postgres listen error", "channel", ch, "error", err)
+		}
+	}
+	logger.Info("Postgres source listening", "channels", src.channels)
+	return l
+}
+
+func (src *pgSource) Stop() {
+	src.db.Close()
+}
@@ -0,0 +1,106 @@
+//go:build pubsub
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/pubsub/v2"
+)
+
+// pubsubFields are the fields a Pub/Sub message adds: "attribute:<name>"
+var pubsubFields = map[string]fieldArg{"attribute": nameArg}
+
+// newPubSubMessage prepares a received message for mapping onto a publish
+func newPubSubMessage(msg *pubsub.Message) *mappedMessage {
+	return newMappedMessage(func(f messageField) any {
+		if v, ok := msg.Attributes[f.name]; ok {
+			return v
+		}
+		return nil
+	}, msg.Data)
+}
+
+// pubsubSource pulls a Pub/Sub subscription over a streaming pull and
+// publishes each message to the user it names. A message is acknowledged
+// once the broker has taken it; until then the client extends its ack
+// deadline. Instances share the subscription, each message going to one of
+// them.
+type pubsubSource struct {
+	client       *pubsub.Client
+	subscriber   *pubsub.Subscriber
+	subscription string
+	mapping      fieldMapping
+}
+
+func newPubSubSource(cfg config) (*pubsubSource, error) {
+	if cfg.PubSubProject == "" {
+		return nil, fmt.Errorf("SSE_PUBSUB_PROJECT is required with SSE_PUBSUB_SUBSCRIPTION")
+	}
+	if cfg.PubSubMaxOutstanding < 1 {
+		return nil, fmt.Errorf("SSE_PUBSUB_MAX_OUTSTANDING must be at least 1, got %d", cfg.PubSubMaxOutstanding)
+	}
+	src := &pubsubSource{subscription: cfg.PubSubSubscription}
+	var err error
+	src.mapping, err = newFieldMapping("SSE_PUBSUB", pubsubFields, cfg.PubSubUserField, cfg.PubSubTopicField, cfg.PubSubValueField)
+	if err != nil {
+		return nil, err
+	}
+	// Credentials come from the application default credentials, or the
+	// emulator when PUBSUB_EMULATOR_HOST is set
+	if src.client, err = pubsub.NewClient(context.Background(), cfg.PubSubProject); err != nil {
+		return nil, err
+	}
+	src.subscriber = src.client.Subscriber(cfg.PubSubSubscription)
+	// The outstanding messages bound how many unacknowledged messages this
+	// instance holds at once
+	src.subscriber.ReceiveSettings.MaxOutstandingMessages = cfg.PubSubMaxOutstanding
+	return src, nil
+}
+
+// Start pulls until ctx is done, waiting for the messages being published,
+// or until the stream fails
+func (src *pubsubSource) Start(ctx context.Context, publish publishFunc) error {
+	logger.Info("Pub/Sub source pulling", "subscription", src.subscription)
+	err := src.subscriber.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+		src.publish(publish, msg)
+	})
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// publish sends one message to its user and acknowledges it. A message that
+// can't be mapped is nacked when the subscription has a dead-letter topic,
+// so it goes there once its delivery attempts run out, and otherwise
+// acknowledged, so it doesn't come back for ever.
+func (src *pubsubSource) publish(publish publishFunc, msg *pubsub.Message) {
+	userID, topic, value, err := src.mapping.resolve(newPubSubMessage(msg))
+	if err != nil {
+		logger.Warn("Pub/Sub message skipped", "subscription", src.subscription, "messageID", msg.ID, "error", err)
+		// Pub/Sub counts delivery attempts only under a dead-letter policy
+		if msg.DeliveryAttempt != nil {
+			msg.Nack()
+		} else {
+			msg.Ack()
+		}
+		return
+	}
+	// A message redelivered after a lost acknowledgement is published once
+	publish("pubsub:"+msg.ID, userID, topic, value)
+	msg.Ack()
+}
+
+// Stop closes the client; messages not yet received go to the other
+// instances
+func (src *pubsubSource) Stop() {
+	src.client.Close()
+}
+
+// Health is always nil; a failed stream ends Start, which the supervisor
+// reports
+func (src *pubsubSource) Health() error {
+	return nil
+}
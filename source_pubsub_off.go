@@ -0,0 +1,27 @@
+//go:build !pubsub
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// pubsubSource stands in for the Pub/Sub source in binaries built without
+// the pubsub tag, which leaves the Google Cloud client out of the default
+// build
+type pubsubSource struct{}
+
+func newPubSubSource(cfg config) (*pubsubSource, error) {
+	return nil, errors.New("this binary was built without Pub/Sub support; rebuild with -tags pubsub")
+}
+
+func (src *pubsubSource) Start(ctx context.Context, publish publishFunc) error {
+	return nil
+}
+
+func (src *pubsubSource) Stop() {}
+
+func (src *pubsubSource) Health() error {
+	return nil
+}
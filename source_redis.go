@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisSourceLockTTL is how long the subscribing instance holds its lock
+// without renewing it; another instance takes over within that time of it
+// going away
+const redisSourceLockTTL = 15 * time.Second
+
+// renewRedisSourceLock extends the lock only while this instance still holds it
+var renewRedisSourceLock = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// releaseRedisSourceLock gives the lock up, if this instance holds it
+var releaseRedisSourceLock = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// redisSource subscribes to Redis channels and publishes each message to the
+// user it names. Every subscriber of a channel gets every message, so only
+// the instance holding a lock in Redis subscribes; the others stand by to
+// take over. Like pub/sub itself, messages sent while no instance is
+// subscribed are lost.
+type redisSource struct {
+	sourceHealth
+	client   *redis.Client
+	channels []string
+	// patterns are the channels given with glob characters, subscribed to
+	// with PSUBSCRIBE
+	patterns []string
+	mapping  channelMapping
+	lockKey  string
+	nodeID   string
+}
+
+func newRedisSource(cfg config) (*redisSource, error) {
+	src := &redisSource{
+		lockKey: cfg.RedisPrefix + "source-lock",
+		nodeID:  cfg.NodeID,
+	}
+	for _, ch := range splitList(cfg.RedisSourceChannels) {
+		if strings.ContainsAny(ch, "*?[") {
+			src.patterns = append(src.patterns, ch)
+		} else {
+			src.channels = append(src.channels, ch)
+		}
+	}
+	var err error
+	src.mapping, err = newChannelMapping("SSE_REDIS_SOURCE", ":", cfg.RedisSourceUserField, cfg.RedisSourceTopicField, cfg.RedisSourceValueField)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := redis.ParseURL(cmp.Or(cfg.RedisSourceURL, cfg.RedisURL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	src.client = redis.NewClient(opts)
+	return src, nil
+}
+
+// Start takes the lock whenever it is free and keeps the subscription for as
+// long as it is held, until ctx is done
+func (src *redisSource) Start(ctx context.Context, publish publishFunc) error {
+	t := time.NewTicker(redisSourceLockTTL / 3)
+	defer t.Stop()
+	var sub *redis.PubSub
+	for {
+		held := src.lock(ctx, sub != nil)
+		switch {
+		case held && sub == nil:
+			var err error
+			if sub, err = src.subscribe(ctx, publish); err != nil {
+				logger.Error("Redis source subscribe error", "error", err)
+				src.setHealth(err)
+				src.unlock(ctx)
+			}
+		case !held && sub != nil:
+			logger.Warn("Redis source lost its lock, unsubscribing")
+			sub.Close()
+			sub = nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			if sub != nil {
+				sub.Close()
+				// Given up at once, so another instance needn't wait for it
+				// to expire
+				src.unlock(context.WithoutCancel(ctx))
+			}
+			return nil
+		}
+	}
+}
+
+// lock takes the lock, or renews it when held already. An error counts as
+// not holding it, as another instance may take it over meanwhile, and
+// leaves the source unhealthy.
+func (src *redisSource) lock(ctx context.Context, held bool) bool {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+	var ok bool
+	var err error
+	if held {
+		var n int
+		n, err = renewRedisSourceLock.Run(ctx, src.client, []string{src.lockKey}, src.nodeID, redisSourceLockTTL.Milliseconds()).Int()
+		ok = n == 1
+	} else {
+		ok, err = src.client.SetNX(ctx, src.lockKey, src.nodeID, redisSourceLockTTL).Result()
+	}
+	if err != nil && ctx.Err() == nil {
+		logger.Error("Redis source lock error", "error", err)
+	}
+	src.setHealth(err)
+	return err == nil && ok
+}
+
+func (src *redisSource) unlock(ctx context.Context) {
+	if err := releaseRedisSourceLock.Run(ctx, src.client, []string{src.lockKey}, src.nodeID).Err(); err != nil {
+		logger.Error("Redis source unlock error", "error", err)
+	}
+}
+
+func (src *redisSource) subscribe(ctx context.Context, publish publishFunc) (*redis.PubSub, error) {
+	sub := src.client.Subscribe(ctx)
+	if len(src.channels) > 0 {
+		if err := sub.Subscribe(ctx, src.channels...); err != nil {
+			sub.Close()
+			return nil, err
+		}
+	}
+	if len(src.patterns) > 0 {
+		if err := sub.PSubscribe(ctx, src.patterns...); err != nil {
+			sub.Close()
+			return nil, err
+		}
+	}
+	logger.Info("Redis source subscribed", "channels", src.channels, "patterns", src.patterns)
+	go func() {
+		// The channel survives reconnects and closes with the subscription
+		for m := range sub.Channel() {
+			src.publish(publish, m)
+		}
+	}()
+	return sub, nil
+}
+
+// publish sends one message to its user. Messages that can't be mapped are
+// logged and skipped.
+func (src *redisSource) publish(publish publishFunc, msg *redis.Message) {
+	if err := src.mapping.publish(publish, msg.Channel, msg.Payload); err != nil {
+		logger.Warn("Redis message skipped", "channel", msg.Channel, "error", err)
+	}
+}
+
+func (src *redisSource) Stop() {
+	src.client.Close()
+}
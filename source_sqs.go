@@ -0,0 +1,244 @@
+//go:build sqs
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// sqsRequestTimeout bounds the deletes and sends that finish off a message,
+// which go ahead while the source is closing
+const sqsRequestTimeout = 5 * time.Second
+
+// sqsFields are the fields an SQS message adds: "attribute:<name>", a
+// message attribute, or for a message SNS delivered, one of the
+// notification's
+var sqsFields = map[string]fieldArg{"attribute": nameArg}
+
+// snsNotification is how SNS wraps a message it delivers to a queue, unless
+// the subscription has raw message delivery
+type snsNotification struct {
+	Type              string
+	MessageId         string
+	TopicArn          string
+	Message           string
+	MessageAttributes map[string]struct {
+		Type  string
+		Value string
+	}
+}
+
+// sqsMessage is a received message, unwrapped when SNS delivered it
+type sqsMessage struct {
+	// id identifies the message across redeliveries, SNS's ID for a
+	// notification, since SNS may deliver one twice
+	id         string
+	body       []byte
+	attributes map[string]string
+}
+
+// newSQSMessage unwraps msg when it's an SNS notification
+func newSQSMessage(msg types.Message) sqsMessage {
+	m := sqsMessage{
+		id:         aws.ToString(msg.MessageId),
+		body:       []byte(aws.ToString(msg.Body)),
+		attributes: make(map[string]string, len(msg.MessageAttributes)),
+	}
+	for name, v := range msg.MessageAttributes {
+		if v.StringValue != nil {
+			m.attributes[name] = *v.StringValue
+		}
+	}
+	var n snsNotification
+	if json.Unmarshal(m.body, &n) != nil || n.Type != "Notification" || n.TopicArn == "" {
+		return m
+	}
+	m.id, m.body = n.MessageId, []byte(n.Message)
+	for name, v := range n.MessageAttributes {
+		if v.Type != "Binary" {
+			m.attributes[name] = v.Value
+		}
+	}
+	return m
+}
+
+// mapped prepares m for mapping onto a publish
+func (m sqsMessage) mapped() *mappedMessage {
+	return newMappedMessage(func(f messageField) any {
+		if v, ok := m.attributes[f.name]; ok {
+			return v
+		}
+		return nil
+	}, m.body)
+}
+
+// sqsSource polls an SQS queue and publishes each message to the user it
+// names. A message is deleted once the broker has taken it; until then it
+// is hidden from the other instances for the visibility timeout, and one
+// left undeleted comes back when that runs out.
+type sqsSource struct {
+	client      *sqs.Client
+	queueURL    string
+	dlqURL      string
+	visibility  int32
+	waitTime    int32
+	maxMessages int32
+	mapping     fieldMapping
+}
+
+func newSQSSource(cfg config) (*sqsSource, error) {
+	if cfg.SQSMaxMessages < 1 || cfg.SQSMaxMessages > 10 {
+		return nil, fmt.Errorf("SSE_SQS_MAX_MESSAGES must be between 1 and 10, got %d", cfg.SQSMaxMessages)
+	}
+	if cfg.SQSWaitTime < 0 || cfg.SQSWaitTime > 20*time.Second {
+		return nil, fmt.Errorf("SSE_SQS_WAIT_TIME must be at most 20s, got %s", cfg.SQSWaitTime)
+	}
+	if cfg.SQSVisibilityTimeout < time.Second || cfg.SQSVisibilityTimeout > 12*time.Hour {
+		return nil, fmt.Errorf("SSE_SQS_VISIBILITY_TIMEOUT must be between 1s and 12h, got %s", cfg.SQSVisibilityTimeout)
+	}
+	src := &sqsSource{
+		queueURL:    cfg.SQSQueueURL,
+		dlqURL:      cfg.SQSDLQURL,
+		visibility:  int32(cfg.SQSVisibilityTimeout / time.Second),
+		waitTime:    int32(cfg.SQSWaitTime / time.Second),
+		maxMessages: int32(cfg.SQSMaxMessages),
+	}
+	var err error
+	src.mapping, err = newFieldMapping("SSE_SQS", sqsFields, cfg.SQSUserField, cfg.SQSTopicField, cfg.SQSValueField)
+	if err != nil {
+		return nil, err
+	}
+	// Credentials and, unless set here, the region come from the usual AWS
+	// environment, shared config or instance role
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.SQSRegion != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.SQSRegion))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	src.client = sqs.NewFromConfig(awsCfg, func(o *sqs.Options) {
+		if cfg.SQSEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.SQSEndpoint)
+		}
+	})
+	return src, nil
+}
+
+// Start polls until ctx is done, or until a receive fails
+func (src *sqsSource) Start(ctx context.Context, publish publishFunc) error {
+	logger.Info("SQS source polling", "queue", src.queueURL)
+	for {
+		out, err := src.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:              aws.String(src.queueURL),
+			MaxNumberOfMessages:   src.maxMessages,
+			WaitTimeSeconds:       src.waitTime,
+			VisibilityTimeout:     src.visibility,
+			MessageAttributeNames: []string{"All"},
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for i, msg := range out.Messages {
+			// Messages received and not yet published go back to the queue
+			if ctx.Err() != nil {
+				src.release(out.Messages[i:])
+				return nil
+			}
+			src.publish(publish, msg)
+		}
+	}
+}
+
+// publish sends one message to its user and deletes it. A message that
+// can't be mapped is moved to the dead-letter queue when one is set, and
+// otherwise left for the queue's redrive policy, which moves it after it has
+// been received too many times.
+func (src *sqsSource) publish(publish publishFunc, msg types.Message) {
+	m := newSQSMessage(msg)
+	userID, topic, value, err := src.mapping.resolve(m.mapped())
+	if err != nil {
+		logger.Warn("SQS message skipped", "queue", src.queueURL, "messageID", m.id, "error", err)
+		if src.dlqURL == "" {
+			return
+		}
+		if err := src.deadLetter(msg); err != nil {
+			logger.Error("SQS dead-letter error", "messageID", m.id, "error", err)
+			return
+		}
+		src.delete(msg)
+		return
+	}
+	// A message received again, after its deletion failed or its visibility
+	// ran out, is published once
+	publish("sqs:"+m.id, userID, topic, value)
+	src.delete(msg)
+}
+
+// deadLetter sends msg, as received, to the dead-letter queue
+func (src *sqsSource) deadLetter(msg types.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sqsRequestTimeout)
+	defer cancel()
+	_, err := src.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(src.dlqURL),
+		MessageBody:       msg.Body,
+		MessageAttributes: msg.MessageAttributes,
+	})
+	return err
+}
+
+func (src *sqsSource) delete(msg types.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqsRequestTimeout)
+	defer cancel()
+	_, err := src.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(src.queueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		logger.Error("SQS delete error", "messageID", aws.ToString(msg.MessageId), "error", err)
+	}
+}
+
+// release makes messages received but not published visible again at once,
+// so another instance needn't wait out their visibility timeout
+func (src *sqsSource) release(msgs []types.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), sqsRequestTimeout)
+	defer cancel()
+	// A receive returns at most 10 messages, as many as a batch takes
+	entries := make([]types.ChangeMessageVisibilityBatchRequestEntry, len(msgs))
+	for i, msg := range msgs {
+		entries[i] = types.ChangeMessageVisibilityBatchRequestEntry{
+			Id:            aws.String(strconv.Itoa(i)),
+			ReceiptHandle: msg.ReceiptHandle,
+		}
+	}
+	_, err := src.client.ChangeMessageVisibilityBatch(ctx, &sqs.ChangeMessageVisibilityBatchInput{
+		QueueUrl: aws.String(src.queueURL),
+		Entries:  entries,
+	})
+	if err != nil {
+		logger.Warn("SQS release error", "error", err, "messages", len(msgs))
+	}
+}
+
+// Stop has nothing to release
+func (src *sqsSource) Stop() {}
+
+// Health is always nil; a failed receive ends Start, which the supervisor
+// reports
+func (src *sqsSource) Health() error {
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !sqs
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// sqsSource stands in for the SQS source in binaries built without the sqs
+// tag, which leaves the AWS SDK out of the default build
+type sqsSource struct{}
+
+func newSQSSource(cfg config) (*sqsSource, error) {
+	return nil, errors.New("this binary was built without SQS support; rebuild with -tags sqs")
+}
+
+func (src *sqsSource) Start(ctx context.Context, publish publishFunc) error {
+	return nil
+}
+
+func (src *sqsSource) Stop() {}
+
+func (src *sqsSource) Health() error {
+	return nil
+}
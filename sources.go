@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sourceRetryMin and sourceRetryMax bound the wait before a failed source is
+// started again, which doubles with each failure in a row
+const (
+	sourceRetryMin = time.Second
+	sourceRetryMax = time.Minute
+)
+
+// publishFunc publishes what a source mapped a message onto. key, when set,
+// identifies the message across redeliveries, so it is published once.
+type publishFunc func(key, userID, topic string, value any)
+
+// SourceConnector is a source of events from outside the API, such as a
+// Kafka topic or a Redis channel, which the sourceSupervisor runs
+type SourceConnector interface {
+	// Start consumes and publishes until ctx is done, returning nil, or until
+	// it fails, returning why. A source that failed is started again.
+	Start(ctx context.Context, publish publishFunc) error
+	// Stop releases what the source holds, once Start has returned for good
+	Stop()
+	// Health is nil while the source works, or what is wrong with it
+	Health() error
+}
+
+// sourceKind is a source the server can run, enabled and configured by its
+// own settings
+type sourceKind struct {
+	// name is the source's name in logs and /readyz
+	name string
+	// title names the source in setup errors
+	title   string
+	enabled func(cfg config) bool
+	open    func(cfg config) (SourceConnector, error)
+}
+
+// sourceKinds are the sources the server can run
+var sourceKinds = []sourceKind{
+	{
+		name:    "kafka",
+		title:   "Kafka source",
+		enabled: func(cfg config) bool { return cfg.KafkaBrokers != "" },
+		open:    func(cfg config) (SourceConnector, error) { return newKafkaSource(cfg) },
+	},
+	{
+		name:    "redis",
+		title:   "Redis source",
+		enabled: func(cfg config) bool { return cfg.RedisSourceChannels != "" },
+		open:    func(cfg config) (SourceConnector, error) { return newRedisSource(cfg) },
+	},
+	{
+		name:    "postgres",
+		title:   "Postgres source",
+		enabled: func(cfg config) bool { return cfg.PGSourceChannels != "" },
+		open:    func(cfg config) (SourceConnector, error) { return newPGSource(cfg) },
+	},
+	{
+		name:    "mqtt",
+		title:   "MQTT bridge",
+		enabled: func(cfg config) bool { return cfg.MQTTBroker != "" },
+		open: func(cfg config) (SourceConnector, error) {
+			mb, err := newMQTTBridge(cfg)
+			if err != nil {
+				return nil, err
+			}
+			// The bridge also mirrors API publishes to MQTT
+			currentBroker.mqtt = mb
+			return mb, nil
+		},
+	},
+	{
+		name:    "amqp",
+		title:   "AMQP source",
+		enabled: func(cfg config) bool { return cfg.AMQPURL != "" },
+		open:    func(cfg config) (SourceConnector, error) { return newAMQPSource(cfg) },
+	},
+	{
+		name:    "sqs",
+		title:   "SQS source",
+		enabled: func(cfg config) bool { return cfg.SQSQueueURL != "" },
+		open:    func(cfg config) (SourceConnector, error) { return newSQSSource(cfg) },
+	},
+	{
+		name:    "pubsub",
+		title:   "Pub/Sub source",
+		enabled: func(cfg config) bool { return cfg.PubSubSubscription != "" },
+		open:    func(cfg config) (SourceConnector, error) { return newPubSubSource(cfg) },
+	},
+}
+
+// publishFromSource publishes a source's message to the user it names, as a
+// publish through the API without options would be
+func publishFromSource(key, userID, topic string, value any) {
+	ev := event{Type: "current-value", Topic: topic, Data: value}
+	ev = currentBroker.accept(userID, ev, publishOptions{}, time.Time{})
+	currentBroker.publishOnce(key, userID, ev, publishOptions{})
+}
+
+// sourceHealth records what is wrong with a source, if anything, for its
+// Health
+type sourceHealth struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (h *sourceHealth) setHealth(err error) {
+	h.mu.Lock()
+	h.err = err
+	h.mu.Unlock()
+}
+
+func (h *sourceHealth) Health() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// supervisedSource is a running source and how its last run ended
+type supervisedSource struct {
+	kind sourceKind
+	conn SourceConnector
+
+	mu sync.Mutex
+	// failed is why the source is waiting to be started again; nil while it
+	// runs
+	failed error
+}
+
+func (src *supervisedSource) setFailed(err error) {
+	src.mu.Lock()
+	src.failed = err
+	src.mu.Unlock()
+}
+
+// health is why the source isn't running, or what it reports about itself
+func (src *supervisedSource) health() error {
+	src.mu.Lock()
+	failed := src.failed
+	src.mu.Unlock()
+	if failed != nil {
+		return fmt.Errorf("restarting after: %w", failed)
+	}
+	return src.conn.Health()
+}
+
+// sourceSupervisor runs the enabled sources, starting any that fails again
+// after a backoff, until stop
+type sourceSupervisor struct {
+	sources []*supervisedSource
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// newSourceSupervisor opens the sources cfg enables; none runs until start
+func newSourceSupervisor(cfg config) (*sourceSupervisor, error) {
+	sv := &sourceSupervisor{}
+	sv.ctx, sv.cancel = context.WithCancel(context.Background())
+	for _, kind := range sourceKinds {
+		if !kind.enabled(cfg) {
+			continue
+		}
+		conn, err := kind.open(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", kind.title, err)
+		}
+		sv.sources = append(sv.sources, &supervisedSource{kind: kind, conn: conn})
+	}
+	return sv, nil
+}
+
+// start runs every source, publishing their messages with publish
+func (sv *sourceSupervisor) start(publish publishFunc) {
+	for _, src := range sv.sources {
+		sv.wg.Add(1)
+		go sv.supervise(src, publish)
+	}
+}
+
+func (sv *sourceSupervisor) supervise(src *supervisedSource, publish publishFunc) {
+	defer sv.wg.Done()
+	backoff := sourceRetryMin
+	for {
+		started := time.Now()
+		err := src.conn.Start(sv.ctx, publish)
+		if sv.ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped on its own")
+		}
+		// A source that ran a good while before failing waits the least
+		if time.Since(started) > sourceRetryMax {
+			backoff = sourceRetryMin
+		}
+		src.setFailed(err)
+		logger.Error("Source failed", "source", src.kind.name, "error", err, "retryIn", backoff.String())
+		select {
+		case <-sv.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, sourceRetryMax)
+		src.setFailed(nil)
+	}
+}
+
+// health returns each source's health by name, for /readyz
+func (sv *sourceSupervisor) health() map[string]error {
+	health := make(map[string]error, len(sv.sources))
+	for _, src := range sv.sources {
+		health[src.kind.name] = src.health()
+	}
+	return health
+}
+
+// stop ends every source and releases what they hold
+func (sv *sourceSupervisor) stop() {
+	sv.cancel()
+	sv.wg.Wait()
+	for _, src := range sv.sources {
+		src.conn.Stop()
+	}
+}
@@ -0,0 +1,4 @@
+// Package ssepb is the gRPC API of the server, generated from sse.proto.
+package ssepb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative sse.proto
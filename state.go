@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+)
+
+// latestValues remembers the newest current-value event per user and topic in
+// the Store, so new sessions start from the current state instead of waiting
+// for the next publish. Each user's state is one stream holding at most one
+// event per topic.
+type latestValues struct {
+	store   Store
+	enabled bool
+}
+
+func newLatestValues(store Store, enabled bool) *latestValues {
+	return &latestValues{store: store, enabled: enabled}
+}
+
+func stateStream(userID string) string {
+	return "state:" + userID
+}
+
+// set makes ev the latest value of its topic for userID
+func (lv *latestValues) set(userID string, ev event) {
+	if !lv.enabled || ev.Type != "current-value" {
+		return
+	}
+	ctx := context.Background()
+	stream := stateStream(userID)
+	current, err := lv.store.Range(ctx, stream, 0, 0)
+	if err != nil {
+		logger.Error("State read error", "userID", userID, "error", err)
+		return
+	}
+	if err := lv.store.Append(ctx, stream, ev); err != nil {
+		logger.Error("State write error", "userID", userID, "error", err)
+		return
+	}
+	var replaced []uint64
+	for _, old := range current {
+		if old.Topic == ev.Topic && old.ID < ev.ID {
+			replaced = append(replaced, old.ID)
+		}
+	}
+	if len(replaced) > 0 {
+		if err := lv.store.Delete(ctx, stream, replaced); err != nil {
+			logger.Error("State write error", "userID", userID, "error", err)
+		}
+	}
+}
+
+// get returns userID's latest value per topic, ordered by topic, leaving out
+// expired ones
+func (lv *latestValues) get(ctx context.Context, userID string) ([]event, error) {
+	if !lv.enabled {
+		return nil, nil
+	}
+	events, err := lv.store.Range(ctx, stateStream(userID), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Concurrent publishes may leave two values for a topic; the newest wins
+	latest := make(map[string]event, len(events))
+	for _, ev := range events {
+		if prev, ok := latest[ev.Topic]; !ok || ev.ID > prev.ID {
+			latest[ev.Topic] = ev
+		}
+	}
+	now := time.Now()
+	out := make([]event, 0, len(latest))
+	for _, ev := range latest {
+		if !ev.expired(now) {
+			out = append(out, ev)
+		}
+	}
+	slices.SortFunc(out, func(a, b event) int { return cmp.Compare(a.Topic, b.Topic) })
+	return out, nil
+}
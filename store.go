@@ -0,0 +1,141 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Store persists ordered event streams, such as a user's history or offline
+// queue, keyed by stream name. Event IDs are the sequence numbers within a
+// stream. Concurrent publishers, or several instances sharing a store, may
+// append them slightly out of order; reads return them in ID order all the
+// same. Implementations must be safe for concurrent use.
+type Store interface {
+	// Append adds ev to the end of stream
+	Append(ctx context.Context, stream string, ev event) error
+	// Range returns up to limit events with an ID greater than after, oldest
+	// first; limit 0 means no limit
+	Range(ctx context.Context, stream string, after uint64, limit int) ([]event, error)
+	// Trim removes events from the front of stream as described by opts
+	Trim(ctx context.Context, stream string, opts TrimOptions) error
+	// Delete removes the events with the given IDs from stream, wherever they are
+	Delete(ctx context.Context, stream string, ids []uint64) error
+	// LatestSeq returns the highest event ID in stream, or 0 if it is empty
+	LatestSeq(ctx context.Context, stream string) (uint64, error)
+}
+
+// TrimOptions select which events Store.Trim removes; zero fields are ignored
+type TrimOptions struct {
+	// UpTo removes events with an ID up to and including it
+	UpTo uint64
+	// MaxLen keeps only the newest MaxLen events
+	MaxLen int
+	// MaxAge removes events published longer ago than this
+	MaxAge time.Duration
+}
+
+// newStore returns the Store selected by cfg.Store
+func newStore(cfg config) (Store, error) {
+	switch cfg.Store {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "redis":
+		return newRedisStore(cfg.RedisURL, cfg.RedisPrefix)
+	case "postgres", "sqlite3":
+		return newSQLStore(cfg.Store, cfg.SQLDSN, cfg.SQLBatchSize, cfg.SQLRetention)
+	}
+	return nil, fmt.Errorf("unknown store %q", cfg.Store)
+}
+
+// memoryStore is the default Store, holding streams in process memory
+type memoryStore struct {
+	mu      sync.Mutex
+	streams map[string][]event
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{streams: make(map[string][]event)}
+}
+
+func (ms *memoryStore) Append(_ context.Context, stream string, ev event) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	// Concurrent publishers may append slightly out of ID order
+	events := ms.streams[stream]
+	i := len(events)
+	for i > 0 && events[i-1].ID > ev.ID {
+		i--
+	}
+	ms.streams[stream] = slices.Insert(events, i, ev)
+	return nil
+}
+
+func (ms *memoryStore) Range(_ context.Context, stream string, after uint64, limit int) ([]event, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	events := ms.streams[stream]
+	start, _ := slices.BinarySearchFunc(events, after+1, func(ev event, id uint64) int {
+		return cmp.Compare(ev.ID, id)
+	})
+	end := len(events)
+	if limit > 0 {
+		end = min(end, start+limit)
+	}
+	return slices.Clone(events[start:end]), nil
+}
+
+func (ms *memoryStore) Trim(_ context.Context, stream string, opts TrimOptions) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	events := ms.streams[stream]
+	drop := 0
+	if opts.UpTo > 0 {
+		for drop < len(events) && events[drop].ID <= opts.UpTo {
+			drop++
+		}
+	}
+	if opts.MaxLen > 0 && len(events)-drop > opts.MaxLen {
+		drop = len(events) - opts.MaxLen
+	}
+	if opts.MaxAge > 0 {
+		cutoff := time.Now().Add(-opts.MaxAge)
+		for drop < len(events) && events[drop].PublishedAt.Before(cutoff) {
+			drop++
+		}
+	}
+	if drop == len(events) {
+		delete(ms.streams, stream)
+		return nil
+	}
+	clear(events[:drop])
+	ms.streams[stream] = events[drop:]
+	return nil
+}
+
+func (ms *memoryStore) Delete(_ context.Context, stream string, ids []uint64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	events := slices.DeleteFunc(ms.streams[stream], func(ev event) bool {
+		return slices.Contains(ids, ev.ID)
+	})
+	if len(events) == 0 {
+		delete(ms.streams, stream)
+		return nil
+	}
+	ms.streams[stream] = events
+	return nil
+}
+
+func (ms *memoryStore) LatestSeq(_ context.Context, stream string) (uint64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	events := ms.streams[stream]
+	if len(events) == 0 {
+		return 0, nil
+	}
+	return events[len(events)-1].ID, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisStore keeps streams in Redis Streams, one key per stream, so history and
+// offline queues survive restarts and are shared by every instance. Redis
+// assigns the entry IDs and the event ID is kept in an "id" field: instances
+// append with their own clocks, so entries can arrive out of event ID order,
+// and reads sort them the way memoryStore does.
+type redisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// redisEntry is a stream entry with the event ID it holds
+type redisEntry struct {
+	entryID string
+	eventID uint64
+	msg     redis.XMessage
+}
+
+func newRedisStore(url, prefix string) (*redisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	return &redisStore{client: redis.NewClient(opts), prefix: prefix}, nil
+}
+
+func (rs *redisStore) key(stream string) string {
+	return rs.prefix + stream
+}
+
+func (rs *redisStore) Append(ctx context.Context, stream string, ev event) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return rs.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: rs.key(stream),
+		ID:     "*",
+		Values: []string{"id", strconv.FormatUint(ev.ID, 10), "event", string(data)},
+	}).Err()
+}
+
+// entries returns the entries of stream sorted by event ID
+func (rs *redisStore) entries(ctx context.Context, stream string) ([]redisEntry, error) {
+	msgs, err := rs.client.XRange(ctx, rs.key(stream), "-", "+").Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]redisEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		id, err := entryEventID(msg)
+		if err != nil {
+			return nil, fmt.Errorf("decode %s entry %s: %w", stream, msg.ID, err)
+		}
+		entries = append(entries, redisEntry{entryID: msg.ID, eventID: id, msg: msg})
+	}
+	slices.SortStableFunc(entries, func(a, b redisEntry) int {
+		return cmp.Compare(a.eventID, b.eventID)
+	})
+	return entries, nil
+}
+
+// event decodes the event the entry holds
+func (e redisEntry) event(stream string) (event, error) {
+	var ev event
+	raw, _ := e.msg.Values["event"].(string)
+	if err := json.Unmarshal([]byte(raw), &ev); err != nil {
+		return ev, fmt.Errorf("decode %s entry %s: %w", stream, e.entryID, err)
+	}
+	return ev, nil
+}
+
+// entryEventID returns the event ID an entry holds; entries written before
+// the "id" field carry it as their own "<eventID>-0" ID
+func entryEventID(msg redis.XMessage) (uint64, error) {
+	if raw, ok := msg.Values["id"].(string); ok {
+		return strconv.ParseUint(raw, 10, 64)
+	}
+	ms, _, _ := strings.Cut(msg.ID, "-")
+	return strconv.ParseUint(ms, 10, 64)
+}
+
+func (rs *redisStore) Range(ctx context.Context, stream string, after uint64, limit int) ([]event, error) {
+	entries, err := rs.entries(ctx, stream)
+	if err != nil {
+		return nil, err
+	}
+	start, _ := slices.BinarySearchFunc(entries, after+1, func(e redisEntry, id uint64) int {
+		return cmp.Compare(e.eventID, id)
+	})
+	end := len(entries)
+	if limit > 0 {
+		end = min(end, start+limit)
+	}
+	events := make([]event, 0, end-start)
+	for _, e := range entries[start:end] {
+		ev, err := e.event(stream)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, nil
+}
+
+func (rs *redisStore) Trim(ctx context.Context, stream string, opts TrimOptions) error {
+	if opts.UpTo > 0 || opts.MaxAge > 0 {
+		cutoff := time.Now().Add(-opts.MaxAge)
+		err := rs.deleteWhere(ctx, stream, func(e redisEntry) (bool, error) {
+			if opts.UpTo > 0 && e.eventID <= opts.UpTo {
+				return true, nil
+			}
+			if opts.MaxAge <= 0 {
+				return false, nil
+			}
+			ev, err := e.event(stream)
+			return ev.PublishedAt.Before(cutoff), err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if opts.MaxLen > 0 {
+		// Entries are kept in the order they arrived, which is close to event
+		// ID order but not always the same
+		return rs.client.XTrimMaxLen(ctx, rs.key(stream), int64(opts.MaxLen)).Err()
+	}
+	return nil
+}
+
+func (rs *redisStore) Delete(ctx context.Context, stream string, ids []uint64) error {
+	return rs.deleteWhere(ctx, stream, func(e redisEntry) (bool, error) {
+		return slices.Contains(ids, e.eventID), nil
+	})
+}
+
+// deleteWhere removes the entries of stream match reports true for
+func (rs *redisStore) deleteWhere(ctx context.Context, stream string, match func(redisEntry) (bool, error)) error {
+	entries, err := rs.entries(ctx, stream)
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, e := range entries {
+		ok, err := match(e)
+		if err != nil {
+			return err
+		}
+		if ok {
+			ids = append(ids, e.entryID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return rs.client.XDel(ctx, rs.key(stream), ids...).Err()
+}
+
+func (rs *redisStore) LatestSeq(ctx context.Context, stream string) (uint64, error) {
+	entries, err := rs.entries(ctx, stream)
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+	return entries[len(entries)-1].eventID, nil
+}
+
+// Ping checks Redis answers, for /readyz
+func (rs *redisStore) Ping(ctx context.Context) error {
+	return rs.client.Ping(ctx).Err()
+}
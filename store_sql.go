@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlMigrations are applied in order, each once; the schema_migrations table
+// records how many have run. Only append to this list.
+var sqlMigrations = []string{
+	`CREATE TABLE sse_events (
+		stream TEXT NOT NULL,
+		id BIGINT NOT NULL,
+		published_at BIGINT NOT NULL,
+		payload TEXT NOT NULL,
+		PRIMARY KEY (stream, id)
+	)`,
+	`CREATE INDEX sse_events_published_at ON sse_events (published_at)`,
+}
+
+// errSQLConflict is returned by Append when another event already has the ID,
+// as events published by two instances in the same microsecond can
+var errSQLConflict = errors.New("event ID already stored for another event")
+
+// sqlStore keeps streams as rows of a single table in Postgres or SQLite.
+// Appends are handed to a writer that inserts whatever has queued up in one
+// transaction, and history and offline rows older than the retention are pruned
+// in the background.
+type sqlStore struct {
+	db        *sql.DB
+	batchSize int
+	appends   chan sqlAppend
+}
+
+// sqlAppend is an event waiting for the writer; err receives the outcome of its batch
+type sqlAppend struct {
+	stream      string
+	id          int64
+	publishedAt int64
+	payload     string
+	err         chan error
+}
+
+// newSQLStore opens dsn with driver ("postgres" or "sqlite3") and brings the
+// schema up to date
+func newSQLStore(driver, dsn string, batchSize int, retention time.Duration) (*sqlStore, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if driver == "sqlite3" {
+		// SQLite allows a single writer; one connection avoids "database is locked"
+		db.SetMaxOpenConns(1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to %s: %w", driver, err)
+	}
+	if err := migrateSQL(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrate: %w", err)
+	}
+	ss := &sqlStore{
+		db:        db,
+		batchSize: max(batchSize, 1),
+		appends:   make(chan sqlAppend, 1024),
+	}
+	go ss.writer()
+	if retention > 0 {
+		go ss.prune(retention, time.Minute)
+	}
+	return ss, nil
+}
+
+func migrateSQL(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(sqlMigrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, sqlMigrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		logger.Info("Applied SQL migration", "version", i+1)
+	}
+	return nil
+}
+
+// Append waits until the event's batch is committed, so a Range right after
+// it sees the event
+func (ss *sqlStore) Append(ctx context.Context, stream string, ev event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	a := sqlAppend{
+		stream:      stream,
+		id:          int64(ev.ID),
+		publishedAt: ev.PublishedAt.UnixMicro(),
+		payload:     string(payload),
+		err:         make(chan error, 1),
+	}
+	select {
+	case ss.appends <- a:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-a.err:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writer inserts queued appends in batches: it takes one, then whatever else is
+// already waiting up to batchSize, without holding back the first
+func (ss *sqlStore) writer() {
+	batch := make([]sqlAppend, 0, ss.batchSize)
+	for a := range ss.appends {
+		batch = append(batch[:0], a)
+	collect:
+		for len(batch) < ss.batchSize {
+			select {
+			case a := <-ss.appends:
+				batch = append(batch, a)
+			default:
+				break collect
+			}
+		}
+		errs := ss.insert(batch)
+		for i, a := range batch {
+			a.err <- errs[i]
+		}
+	}
+}
+
+// insert writes batch in one transaction and returns the outcome of each
+// append. A row already holding an append's stream and ID is fine when it is
+// the same event, as when one is appended again, and a conflict otherwise.
+func (ss *sqlStore) insert(batch []sqlAppend) []error {
+	errs := make([]error, len(batch))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fail(err)
+	}
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO sse_events (stream, id, published_at, payload)
+		VALUES ($1, $2, $3, $4) ON CONFLICT (stream, id) DO NOTHING`)
+	if err != nil {
+		tx.Rollback()
+		return fail(err)
+	}
+	defer stmt.Close()
+	for i, a := range batch {
+		res, err := stmt.ExecContext(ctx, a.stream, a.id, a.publishedAt, a.payload)
+		if err != nil {
+			tx.Rollback()
+			return fail(err)
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			continue
+		}
+		var payload string
+		if err := tx.QueryRowContext(ctx, `SELECT payload FROM sse_events WHERE stream = $1 AND id = $2`,
+			a.stream, a.id).Scan(&payload); err != nil {
+			tx.Rollback()
+			return fail(err)
+		}
+		if payload != a.payload {
+			errs[i] = fmt.Errorf("%w: %s %d", errSQLConflict, a.stream, a.id)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return errs
+}
+
+func (ss *sqlStore) Range(ctx context.Context, stream string, after uint64, limit int) ([]event, error) {
+	query := `SELECT payload FROM sse_events WHERE stream = $1 AND id > $2 ORDER BY id`
+	args := []any{stream, int64(after)}
+	if limit > 0 {
+		query += ` LIMIT $3`
+		args = append(args, limit)
+	}
+	rows, err := ss.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []event
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var ev event
+		if err := json.Unmarshal([]byte(payload), &ev); err != nil {
+			return nil, fmt.Errorf("decode %s event: %w", stream, err)
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+func (ss *sqlStore) Trim(ctx context.Context, stream string, opts TrimOptions) error {
+	if opts.UpTo > 0 {
+		if _, err := ss.db.ExecContext(ctx, `DELETE FROM sse_events WHERE stream = $1 AND id <= $2`,
+			stream, int64(opts.UpTo)); err != nil {
+			return err
+		}
+	}
+	if opts.MaxLen > 0 {
+		// Delete everything at or below the ID of the first row past the newest MaxLen
+		if _, err := ss.db.ExecContext(ctx, `DELETE FROM sse_events WHERE stream = $1 AND id <= (
+			SELECT id FROM sse_events WHERE stream = $1 ORDER BY id DESC LIMIT 1 OFFSET $2)`,
+			stream, opts.MaxLen); err != nil {
+			return err
+		}
+	}
+	if opts.MaxAge > 0 {
+		cutoff := time.Now().Add(-opts.MaxAge).UnixMicro()
+		if _, err := ss.db.ExecContext(ctx, `DELETE FROM sse_events WHERE stream = $1 AND published_at < $2`,
+			stream, cutoff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ss *sqlStore) Delete(ctx context.Context, stream string, ids []uint64) error {
+	tx, err := ss.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM sse_events WHERE stream = $1 AND id = $2`, stream, int64(id)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (ss *sqlStore) LatestSeq(ctx context.Context, stream string) (uint64, error) {
+	var id int64
+	err := ss.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM sse_events WHERE stream = $1`, stream).Scan(&id)
+	return uint64(id), err
+}
+
+// Ping checks the database answers, for /readyz
+func (ss *sqlStore) Ping(ctx context.Context) error {
+	return ss.db.PingContext(ctx)
+}
+
+// prune periodically deletes rows of history and offline streams older than
+// retention, which also covers streams whose users this process has never
+// seen. Records kept in other streams, such as live state, bans and push
+// devices, stay until they are removed.
+func (ss *sqlStore) prune(retention, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-retention).UnixMicro()
+		res, err := ss.db.Exec(`DELETE FROM sse_events WHERE published_at < $1 AND (stream LIKE $2 OR stream LIKE $3)`,
+			cutoff, historyStream("")+"%", offlineStream("")+"%")
+		if err != nil {
+			logger.Error("SQL store prune error", "error", err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			logger.Info("SQL store pruned events", "count", n, "olderThan", retention.String())
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testStores are the Store implementations the contract tests run against.
+// Redis needs a server, named by SSE_TEST_REDIS_URL.
+var testStores = []struct {
+	name string
+	open func(t *testing.T) Store
+}{
+	{"memory", func(t *testing.T) Store { return newMemoryStore() }},
+	{"sqlite3", func(t *testing.T) Store {
+		ss, err := newSQLStore("sqlite3", filepath.Join(t.TempDir(), "sse.db"), 16, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ss.db.Close() })
+		return ss
+	}},
+	{"redis", func(t *testing.T) Store {
+		url := os.Getenv("SSE_TEST_REDIS_URL")
+		if url == "" {
+			t.Skip("SSE_TEST_REDIS_URL not set")
+		}
+		rs, err := newRedisStore(url, fmt.Sprintf("sse-test-%d:", time.Now().UnixNano()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs
+	}},
+}
+
+func eventIDs(events []event) []uint64 {
+	ids := make([]uint64, len(events))
+	for i, ev := range events {
+		ids[i] = ev.ID
+	}
+	return ids
+}
+
+// appendIDs appends an event per ID to stream, in the order given
+func appendIDs(t *testing.T, s Store, stream string, ids ...uint64) {
+	t.Helper()
+	for _, id := range ids {
+		ev := event{ID: id, Type: "current-value", Data: float64(id), PublishedAt: time.Now()}
+		if err := s.Append(context.Background(), stream, ev); err != nil {
+			t.Fatalf("Append %d: %v", id, err)
+		}
+	}
+}
+
+func TestMemoryStoreAppendOutOfOrder(t *testing.T) {
+	tests := []struct {
+		appended []uint64
+		want     []uint64
+	}{
+		{[]uint64{1, 2, 3}, []uint64{1, 2, 3}},
+		{[]uint64{2, 1}, []uint64{1, 2}},
+		{[]uint64{1, 3, 2, 5, 4}, []uint64{1, 2, 3, 4, 5}},
+		{[]uint64{5, 4, 3, 2, 1}, []uint64{1, 2, 3, 4, 5}},
+		{[]uint64{10, 20, 15, 30, 11}, []uint64{10, 11, 15, 20, 30}},
+	}
+	for _, tt := range tests {
+		ms := newMemoryStore()
+		appendIDs(t, ms, "history:u", tt.appended...)
+		if got := eventIDs(ms.streams["history:u"]); !slices.Equal(got, tt.want) {
+			t.Errorf("appending %v kept %v, want %v", tt.appended, got, tt.want)
+		}
+	}
+}
+
+// TestStoreOrdering checks the contract every Store keeps: however the
+// events were appended, they are read back in ID order
+func TestStoreOrdering(t *testing.T) {
+	ctx := context.Background()
+	appended := []uint64{10, 30, 20, 50, 40, 60}
+	ranges := []struct {
+		after uint64
+		limit int
+		want  []uint64
+	}{
+		{0, 0, []uint64{10, 20, 30, 40, 50, 60}},
+		{0, 2, []uint64{10, 20}},
+		{20, 0, []uint64{30, 40, 50, 60}},
+		{25, 3, []uint64{30, 40, 50}},
+		{60, 0, nil},
+	}
+	trims := []struct {
+		name string
+		opts TrimOptions
+		want []uint64
+	}{
+		{"up to", TrimOptions{UpTo: 30}, []uint64{40, 50, 60}},
+		{"up to between", TrimOptions{UpTo: 35}, []uint64{40, 50, 60}},
+		{"max age", TrimOptions{MaxAge: time.Hour}, []uint64{10, 20, 30, 40, 50, 60}},
+	}
+	for _, st := range testStores {
+		t.Run(st.name, func(t *testing.T) {
+			s := st.open(t)
+			appendIDs(t, s, "history:u", appended...)
+			for _, r := range ranges {
+				events, err := s.Range(ctx, "history:u", r.after, r.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := eventIDs(events); !slices.Equal(got, r.want) {
+					t.Errorf("Range(after %d, limit %d) = %v, want %v", r.after, r.limit, got, r.want)
+				}
+			}
+			if seq, err := s.LatestSeq(ctx, "history:u"); err != nil || seq != 60 {
+				t.Errorf("LatestSeq = %d, %v, want 60", seq, err)
+			}
+			if seq, err := s.LatestSeq(ctx, "history:none"); err != nil || seq != 0 {
+				t.Errorf("LatestSeq of an empty stream = %d, %v, want 0", seq, err)
+			}
+
+			for i, tr := range trims {
+				stream := fmt.Sprintf("trim:%d", i)
+				appendIDs(t, s, stream, appended...)
+				if err := s.Trim(ctx, stream, tr.opts); err != nil {
+					t.Fatal(err)
+				}
+				events, err := s.Range(ctx, stream, 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := eventIDs(events); !slices.Equal(got, tr.want) {
+					t.Errorf("%s: Trim left %v, want %v", tr.name, got, tr.want)
+				}
+			}
+
+			if err := s.Delete(ctx, "history:u", []uint64{20, 50, 70}); err != nil {
+				t.Fatal(err)
+			}
+			events, err := s.Range(ctx, "history:u", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := eventIDs(events), []uint64{10, 30, 40, 60}; !slices.Equal(got, want) {
+				t.Errorf("after Delete, Range = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// MaxLen keeps the newest events; appended in order, that is the highest IDs
+func TestStoreTrimMaxLen(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		maxLen int
+		want   []uint64
+	}{
+		{1, []uint64{5}},
+		{3, []uint64{3, 4, 5}},
+		{5, []uint64{1, 2, 3, 4, 5}},
+		{10, []uint64{1, 2, 3, 4, 5}},
+	}
+	for _, st := range testStores {
+		t.Run(st.name, func(t *testing.T) {
+			s := st.open(t)
+			for _, tt := range tests {
+				stream := fmt.Sprintf("history:%d", tt.maxLen)
+				appendIDs(t, s, stream, 1, 2, 3, 4, 5)
+				if err := s.Trim(ctx, stream, TrimOptions{MaxLen: tt.maxLen}); err != nil {
+					t.Fatal(err)
+				}
+				events, err := s.Range(ctx, stream, 0, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := eventIDs(events); !slices.Equal(got, tt.want) {
+					t.Errorf("MaxLen %d left %v, want %v", tt.maxLen, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// An event appended again is fine; another event under its ID is reported
+func TestSQLStoreAppendConflict(t *testing.T) {
+	ss, err := newSQLStore("sqlite3", filepath.Join(t.TempDir(), "sse.db"), 16, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ss.db.Close()
+	ctx := context.Background()
+	ev := event{ID: 1, Type: "current-value", Data: "a", PublishedAt: time.Now()}
+	tests := []struct {
+		data any
+		want error
+	}{
+		{"a", nil},
+		{"a", nil},
+		{"b", errSQLConflict},
+	}
+	for _, tt := range tests {
+		ev.Data = tt.data
+		if err := ss.Append(ctx, "history:u", ev); !errors.Is(err, tt.want) {
+			t.Errorf("Append %v = %v, want %v", tt.data, err, tt.want)
+		}
+	}
+	events, err := ss.Range(ctx, "history:u", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Data != "a" {
+		t.Errorf("Range = %v, want the first event alone", events)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// eventWriter is the transport a session's events are written to: an SSE
+// response or a gRPC stream
+type eventWriter interface {
+	// write sends one event; an event that can't be encoded is logged and skipped
+	write(id uint64, eventType string, data any) error
+	// flush pushes the events written so far to the client
+	flush() error
+	// keepAlive tells the client the stream is still open, without an event
+	keepAlive() error
+}
+
+// sseWriter writes events in the text/event-stream format
+type sseWriter struct {
+	w *bufio.Writer
+	// conn is the response's connection, whose write deadline is moved on
+	// before each write
+	conn  net.Conn
+	stats *sessionStats
+}
+
+func (sw sseWriter) write(id uint64, eventType string, data any) error {
+	msg, err := buildSSEPayload(id, eventType, data)
+	if err != nil {
+		logger.Error("SSE format error", "eventID", id, "eventType", eventType, "error", err)
+		return nil
+	}
+	// A full buffer is flushed by the write itself
+	_ = sw.conn.SetWriteDeadline(writeDeadline())
+	n, err := fmt.Fprint(sw.w, msg)
+	sw.stats.wrote(n)
+	return responseError(err)
+}
+
+func (sw sseWriter) flush() error {
+	_ = sw.conn.SetWriteDeadline(writeDeadline())
+	return responseError(sw.w.Flush())
+}
+
+// keepAlive writes a comment, which clients ignore
+func (sw sseWriter) keepAlive() error {
+	_ = sw.conn.SetWriteDeadline(writeDeadline())
+	n, err := fmt.Fprint(sw.w, ": keepalive\n\n")
+	sw.stats.wrote(n)
+	if err != nil {
+		return responseError(err)
+	}
+	return responseError(sw.w.Flush())
+}
+
+// responseError marks a failed write to an SSE response. The writer feeds a
+// pipe the server copies to the connection, which only fails once the server
+// closed it, unable to write to the client.
+func responseError(err error) error {
+	if err != nil {
+		return fmt.Errorf("%w: %w", errResponseClosed, err)
+	}
+	return nil
+}
+
+// formatWriter wraps w in the envelope and encryption the session asked for
+func formatWriter(w eventWriter, s *session) eventWriter {
+	if s.cloudEvents {
+		w = cloudEventWriter{eventWriter: w, source: currentBroker.streamFormats.source, subject: s.userID}
+	}
+	// Encrypting before wrapping keeps the envelope readable
+	if s.payload != nil {
+		w = encryptingWriter{eventWriter: w, aead: s.payload}
+	}
+	return w
+}
+
+// streamSession writes a session's events to its stream until the client
+// disconnects or the session is closed. lastSeen is the client's Last-Event-ID.
+func streamSession(w eventWriter, s *session, lastSeen uint64) {
+	w = formatWriter(reportingWriter{eventWriter: w, s: s}, s)
+	streamWriters.Add(1)
+	defer streamWriters.Add(-1)
+	keepAliveIn, keepAliveDue := currentBroker.keepAliveTimer()
+	keepAlive := time.NewTimer(keepAliveIn)
+	defer keepAlive.Stop()
+	access := currentBroker.accessLog
+	heartbeat, stopHeartbeat := access.heartbeats()
+	defer stopHeartbeat()
+	// ended is why the stream ended, for the access log
+	ended := "write failed"
+	// Remove session when client disconnects
+	defer func() {
+		currentBroker.sessions.removeSession(s)
+		reason := "disconnected"
+		if evicted := s.evictionReason(); evicted != "" {
+			reason = "evicted: " + evicted
+		}
+		for _, ev := range s.drain() {
+			currentBroker.deadLetter(s.userID, s.id, ev, reason)
+			// Left unsettled on shutdown so the next start publishes it again
+			if currentBroker.closing.Load() {
+				currentBroker.unsentOnShutdown.Add(1)
+			} else {
+				currentBroker.wal.release(ev.walID)
+			}
+		}
+		access.streamEnded(s, ended)
+	}()
+
+	// writeFailed logs why a write failed. A client that went away, or
+	// stopped reading so the write missed its deadline, disconnected; nothing
+	// broke.
+	writeFailed := func(msg string, err error, args ...any) {
+		if clientGone(err) {
+			ended = "disconnected"
+			s.log.Info("Stream client gone", append(args, "error", err)...)
+			return
+		}
+		s.log.Warn(msg, append(args, "error", err)...)
+	}
+
+	access.streamStarted(s)
+
+	// Tell the client its session ID so it can manage subscriptions
+	hello := fiber.Map{"sessionID": s.id, "topics": s.currentTopics()}
+	if s.payload != nil {
+		hello["encrypted"] = true
+	}
+	if err := w.write(0, "session", hello); err != nil {
+		writeFailed("Stream write error", err)
+		return
+	}
+	if err := w.flush(); err != nil {
+		writeFailed("Stream flush error", err)
+		return
+	}
+
+	// Catch up on what the client missed: unacknowledged at-least-once events,
+	// events published since its Last-Event-ID, whatever was queued while the
+	// user was offline, the latest value of each topic and a fresh snapshot of
+	// each state document, in publish order
+	replayed := make(map[uint64]struct{})
+	backlog := currentBroker.pendingRedeliveries(s, lastSeen)
+	backlog = append(backlog, currentBroker.missedEvents(s, lastSeen)...)
+	backlog = append(backlog, currentBroker.pendingOffline(s)...)
+	backlog = append(backlog, currentBroker.currentState(s, lastSeen)...)
+	backlog = append(backlog, currentBroker.currentSnapshots(s)...)
+	slices.SortStableFunc(backlog, func(a, b event) int { return cmp.Compare(a.ID, b.ID) })
+	for _, ev := range backlog {
+		if _, dup := replayed[ev.ID]; dup {
+			continue
+		}
+		if err := w.write(ev.ID, ev.Type, ev.Data); err != nil {
+			writeFailed("Stream write error", err, "eventID", ev.ID, "eventType", ev.Type)
+			return
+		}
+		replayed[ev.ID] = struct{}{}
+		currentBroker.deliveries.set(ev.ID, s.id, deliveryWritten)
+		currentBroker.metrics.delivered.Add(1)
+		s.stats.delivered.Add(1)
+	}
+	if err := w.flush(); err != nil {
+		writeFailed("Stream flush error", err)
+		return
+	}
+
+	// The client is asked to reauthenticate reauthWarning before its
+	// credential expires, and cut off once it has
+	authTimer := time.NewTimer(time.Hour)
+	var warned time.Time
+	scheduleAuth := func() {
+		expiresAt := s.authExpiry()
+		if expiresAt.IsZero() {
+			authTimer.Stop()
+			return
+		}
+		at := expiresAt
+		if !warned.Equal(expiresAt) {
+			at = expiresAt.Add(-currentBroker.reauthWarning)
+		}
+		authTimer.Reset(time.Until(at))
+	}
+	scheduleAuth()
+	defer authTimer.Stop()
+
+	// A stream that went streamIdleTimeout without an event is closed, and
+	// one open streamMaxDuration is asked to reconnect, so connections a
+	// middlebox silently dropped don't pile up
+	var idle *time.Timer
+	var idleC, maxDurationC <-chan time.Time
+	if d := currentBroker.streamIdleTimeout; d > 0 {
+		idle = time.NewTimer(d)
+		defer idle.Stop()
+		idleC = idle.C
+	}
+	if d := currentBroker.streamMaxDuration; d > 0 {
+		maxDuration := time.NewTimer(streamLifetime(d))
+		defer maxDuration.Stop()
+		maxDurationC = maxDuration.C
+	}
+
+	for {
+		select {
+		case <-idleC:
+			if s.evictAs("idle-timeout", "no events for "+currentBroker.streamIdleTimeout.String()) {
+				s.log.Info("Idle stream closed")
+			}
+		case <-maxDurationC:
+			if s.evictAs("reconnect", "max stream duration") {
+				s.log.Info("Stream asked to reconnect, open too long")
+			}
+		case <-s.reauth:
+			scheduleAuth()
+		case <-authTimer.C:
+			expiresAt := s.authExpiry()
+			if expiresAt.IsZero() {
+				continue
+			}
+			if !time.Now().Before(expiresAt) {
+				if err := w.write(0, "auth-expired", fiber.Map{"expiresAt": expiresAt}); err == nil {
+					_ = w.flush()
+				}
+				ended = "credential expired"
+				return
+			}
+			if err := w.write(0, "reauthenticate", fiber.Map{"sessionID": s.id, "expiresAt": expiresAt}); err != nil {
+				writeFailed("Stream write error", err)
+				return
+			}
+			if err := w.flush(); err != nil {
+				writeFailed("Stream flush error", err)
+				return
+			}
+			warned = expiresAt
+			scheduleAuth()
+		case <-s.notify:
+			for {
+				ev, ok, closed := s.next()
+				if !ok {
+					if !closed {
+						break
+					}
+					ended = "closed"
+					if currentBroker.closing.Load() {
+						ended = "shutdown"
+					}
+					if reason := s.evictionReason(); reason != "" {
+						ended = "evicted: " + reason
+						// Let the client know why it was cut off before closing
+						if err := w.write(0, s.evictionEvent(), fiber.Map{"reason": reason}); err == nil {
+							_ = w.flush()
+						}
+					}
+					// Session closed gracefully
+					return
+				}
+				currentBroker.wal.release(ev.walID)
+				if _, dup := replayed[ev.ID]; dup {
+					// Published while the redelivery above was running
+					continue
+				}
+				if ev.expired(time.Now()) {
+					// Sat in the queue past its TTL
+					currentBroker.deliveries.set(ev.ID, s.id, deliveryExpired)
+					currentBroker.deadLetter(s.userID, s.id, ev, "expired")
+					continue
+				}
+
+				start := time.Now()
+				err := traceDelivery(s, ev, func() error {
+					if err := w.write(ev.ID, ev.Type, ev.Data); err != nil {
+						writeFailed("Stream write error", err, "eventID", ev.ID, "eventType", ev.Type)
+						return err
+					}
+					if err := w.flush(); err != nil {
+						writeFailed("Stream flush error", err, "eventID", ev.ID, "eventType", ev.Type)
+						return err
+					}
+					return nil
+				})
+				if err != nil {
+					currentBroker.deadLetter(s.userID, s.id, ev, "write failed")
+					return
+				}
+				currentBroker.slowConsumers.recordWrite(s, time.Since(start))
+				if idle != nil {
+					idle.Reset(currentBroker.streamIdleTimeout)
+				}
+				if ev.ID != 0 {
+					currentBroker.deliveries.set(ev.ID, s.id, deliveryWritten)
+					currentBroker.metrics.observeDelivery(ev, &s.stats)
+				}
+			}
+		case <-heartbeat:
+			access.streamOpen(s)
+		case <-keepAlive.C:
+			if keepAliveDue {
+				if err := w.keepAlive(); err != nil {
+					writeFailed("Stream keepalive error", err)
+					return
+				}
+			}
+			// Picks up an interval changed by a config reload
+			keepAliveIn, keepAliveDue = currentBroker.keepAliveTimer()
+			keepAlive.Reset(keepAliveIn)
+		}
+	}
+}
+
+// streamLifetime is how long a stream may stay open: d less up to a tenth,
+// so the streams opened together, after a deploy, don't all reconnect at once
+func streamLifetime(d time.Duration) time.Duration {
+	return d - rand.N(d/10+1)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// sdNotify sends state, such as "READY=1", to systemd, when the server runs
+// as a Type=notify unit; it does nothing otherwise. Prefork children leave
+// it to the master.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" || fiber.IsChild() {
+		return
+	}
+	// A leading @ is an abstract socket, which net handles
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		logger.Warn("systemd notification failed", "error", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		logger.Warn("systemd notification failed", "error", err)
+	}
+}
+
+// sdReady tells systemd the server serves, and that this process is the
+// unit's main one, which it isn't yet after a restart
+func sdReady() {
+	sdNotify("READY=1\nMAINPID=" + strconv.Itoa(os.Getpid()) + "\nSTATUS=Serving")
+}
+
+// sdWatchdog pings systemd's watchdog at half its timeout until stop is
+// closed, when the unit sets WatchdogSec. Each ping first takes the session
+// registry's lock, so a server stuck on it misses its pings and is
+// restarted.
+func sdWatchdog(stop <-chan struct{}) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			currentBroker.sessions.count()
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
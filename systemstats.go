@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/disk"
+	"github.com/shirou/gopsutil/v3/mem"
+	"github.com/shirou/gopsutil/v3/net"
+	"github.com/shirou/gopsutil/v3/process"
+)
+
+// systemSample is one reading of the host's and the Go runtime's resources
+type systemSample struct {
+	at time.Time
+	// cpuPercent is the CPU usage averaged since the previous sample
+	cpuPercent float64
+	// vm is nil when the host's memory couldn't be read
+	vm  *mem.VirtualMemoryStat
+	mem runtime.MemStats
+
+	// fds is the number of files, sockets included, the process has open,
+	// and fdLimit how many it may; either is -1 when it couldn't be read
+	fds     int64
+	fdLimit int64
+	// tcpStates counts the process's TCP connections by state, such as
+	// ESTABLISHED or CLOSE_WAIT; nil when they couldn't be read
+	tcpStates map[string]int
+	// net is the host's network traffic since boot, nil when it couldn't be
+	// read, and the rates are bytes per second since the previous sample
+	net                *net.IOCountersStat
+	recvRate, sentRate float64
+	// disk is the usage of the filesystem holding diskPath, nil when it
+	// couldn't be read
+	disk *disk.UsageStat
+}
+
+// systemCollector samples the host's and the process's resources in the
+// background, so that /metrics/system and /metrics answer from the latest
+// sample instead of measuring on every request
+type systemCollector struct {
+	interval time.Duration
+	diskPath string
+	// proc is this process, nil when it couldn't be found
+	proc *process.Process
+
+	mu     sync.RWMutex
+	latest systemSample
+}
+
+// newSystemCollector takes a first sample and then one every interval
+func newSystemCollector(interval time.Duration, diskPath string) *systemCollector {
+	sc := &systemCollector{interval: max(interval, 100*time.Millisecond), diskPath: diskPath}
+	sc.proc, _ = process.NewProcess(int32(os.Getpid()))
+	// Without an interval, the first reading is the usage since boot
+	sc.sample(0)
+	go sc.run()
+	return sc
+}
+
+func (sc *systemCollector) run() {
+	for {
+		// Blocks for the interval, averaging CPU usage over it
+		sc.sample(sc.interval)
+	}
+}
+
+func (sc *systemCollector) sample(over time.Duration) {
+	s := systemSample{}
+	if percents, err := cpu.Percent(over, false); err == nil && len(percents) > 0 {
+		s.cpuPercent = percents[0]
+	} else if over > 0 {
+		// Don't spin when the CPU can't be read
+		time.Sleep(over)
+	}
+	s.vm, _ = mem.VirtualMemory()
+	runtime.ReadMemStats(&s.mem)
+	s.fds, s.fdLimit = sc.fds()
+	s.tcpStates = sc.tcpStates()
+	if counters, err := net.IOCounters(false); err == nil && len(counters) > 0 {
+		s.net = &counters[0]
+	}
+	s.disk, _ = disk.Usage(sc.diskPath)
+	s.at = time.Now()
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if prev := sc.latest; prev.net != nil && s.net != nil {
+		if elapsed := s.at.Sub(prev.at).Seconds(); elapsed > 0 {
+			s.recvRate = float64(s.net.BytesRecv-prev.net.BytesRecv) / elapsed
+			s.sentRate = float64(s.net.BytesSent-prev.net.BytesSent) / elapsed
+		}
+	}
+	sc.latest = s
+}
+
+func (sc *systemCollector) fds() (open, limit int64) {
+	open, limit = -1, -1
+	if sc.proc == nil {
+		return open, limit
+	}
+	if n, err := sc.proc.NumFDs(); err == nil {
+		open = int64(n)
+	}
+	if limits, err := sc.proc.Rlimit(); err == nil {
+		for _, l := range limits {
+			if l.Resource == process.RLIMIT_NOFILE {
+				limit = int64(min(l.Soft, math.MaxInt64))
+			}
+		}
+	}
+	return open, limit
+}
+
+// tcpStates counts the process's own TCP connections, which are the
+// streams, the publishers and the backplane
+func (sc *systemCollector) tcpStates() map[string]int {
+	conns, err := net.ConnectionsPidWithoutUids("tcp", int32(os.Getpid()))
+	if err != nil {
+		return nil
+	}
+	states := make(map[string]int)
+	for _, c := range conns {
+		states[c.Status]++
+	}
+	return states
+}
+
+// systemNetwork and systemDisk are a sample's network and disk sections of
+// /metrics/system, nil when they couldn't be read
+func systemNetwork(s systemSample) fiber.Map {
+	if s.net == nil {
+		return nil
+	}
+	return fiber.Map{
+		"bytes_recv":         s.net.BytesRecv,
+		"bytes_sent":         s.net.BytesSent,
+		"recv_bytes_per_sec": fmt.Sprintf("%.0f", s.recvRate),
+		"sent_bytes_per_sec": fmt.Sprintf("%.0f", s.sentRate),
+	}
+}
+
+func systemDisk(s systemSample) fiber.Map {
+	if s.disk == nil {
+		return nil
+	}
+	return fiber.Map{
+		"path":         s.disk.Path,
+		"total_mb":     bToMb(s.disk.Total),
+		"used_mb":      bToMb(s.disk.Used),
+		"free_mb":      bToMb(s.disk.Free),
+		"used_percent": fmt.Sprintf("%.2f", s.disk.UsedPercent),
+	}
+}
+
+// current returns the latest sample
+func (sc *systemCollector) current() systemSample {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return sc.latest
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// activity is something the broker did, as /admin/tail shows it
+type activity struct {
+	// Type is connect, disconnect, publish or drop
+	Type      string    `json:"type"`
+	At        time.Time `json:"at"`
+	UserID    string    `json:"userID"`
+	SessionID string    `json:"sessionID,omitempty"`
+	EventID   uint64    `json:"eventID,omitempty"`
+	EventType string    `json:"eventType,omitempty"`
+	Topic     string    `json:"topic,omitempty"`
+	// Payload is the start of the event's value, as JSON
+	Payload   string `json:"payload,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// Sent and Dropped are the sessions a publish was queued for and wasn't
+	Sent    int    `json:"sent,omitempty"`
+	Dropped int    `json:"dropped,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// tailPayloadBytes is how much of a payload a tail shows
+const tailPayloadBytes = 256
+
+// activityTail fans broker activity out to the /admin/tail streams. A
+// stream that can't keep up misses activity rather than slowing the broker.
+type activityTail struct {
+	// watching is the number of streams, so there is nothing to do without any
+	watching atomic.Int32
+
+	mu       sync.Mutex
+	watchers map[*tailWatcher]struct{}
+	closed   bool
+}
+
+// tailWatcher is one /admin/tail stream, following userID or everyone
+type tailWatcher struct {
+	userID string
+	feed   chan activity
+	// missed counts the activity that didn't fit in feed
+	missed atomic.Int64
+}
+
+func newActivityTail() *activityTail {
+	return &activityTail{watchers: make(map[*tailWatcher]struct{})}
+}
+
+// watch adds a stream following userID ("" follows everyone). It returns
+// nil once the tail is closed for shutdown.
+func (t *activityTail) watch(userID string) *tailWatcher {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	w := &tailWatcher{userID: userID, feed: make(chan activity, 256)}
+	t.watchers[w] = struct{}{}
+	t.watching.Add(1)
+	return w
+}
+
+func (t *activityTail) unwatch(w *tailWatcher) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.watchers[w]; ok {
+		delete(t.watchers, w)
+		t.watching.Add(-1)
+		close(w.feed)
+	}
+}
+
+// close ends every stream
+func (t *activityTail) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for w := range t.watchers {
+		delete(t.watchers, w)
+		close(w.feed)
+	}
+	t.watching.Store(0)
+}
+
+func (t *activityTail) emit(a activity) {
+	a.At = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for w := range t.watchers {
+		if w.userID != "" && w.userID != a.UserID {
+			continue
+		}
+		select {
+		case w.feed <- a:
+		default:
+			w.missed.Add(1)
+		}
+	}
+}
+
+// sessionChanged shows s connecting or disconnecting
+func (t *activityTail) sessionChanged(s *session, joined bool) {
+	if t.watching.Load() == 0 {
+		return
+	}
+	kind := "disconnect"
+	if joined {
+		kind = "connect"
+	}
+	t.emit(activity{Type: kind, UserID: s.userID, SessionID: s.id})
+}
+
+// published shows ev being delivered to the user's sessions here
+func (t *activityTail) published(userID string, ev event, res publishResult) {
+	if t.watching.Load() == 0 {
+		return
+	}
+	a := activity{Type: "publish", UserID: userID, EventID: ev.ID, EventType: ev.Type, Topic: ev.Topic, Sent: res.Sent, Dropped: res.Dropped}
+	a.Payload, a.Truncated = tailPayload(ev.Data)
+	t.emit(a)
+}
+
+// dropped shows ev not reaching s
+func (t *activityTail) dropped(userID string, s *session, ev event, reason string) {
+	if t.watching.Load() == 0 {
+		return
+	}
+	t.emit(activity{Type: "drop", UserID: userID, SessionID: s.id, EventID: ev.ID, EventType: ev.Type, Topic: ev.Topic, Reason: reason})
+}
+
+// tailPayload encodes data and cuts it to tailPayloadBytes, on a character
+// boundary
+func tailPayload(data any) (string, bool) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return "", false
+	}
+	if len(b) <= tailPayloadBytes {
+		return string(b), false
+	}
+	cut := tailPayloadBytes
+	for cut > 0 && !utf8.RuneStart(b[cut]) {
+		cut--
+	}
+	return string(b[:cut]), true
+}
+
+// follow writes w's activity to an /admin/tail stream until the client goes
+// away or the tail is closed, with a comment every 15 seconds so a quiet
+// stream notices a client that left
+func (t *activityTail) follow(out *bufio.Writer, w *tailWatcher) {
+	defer t.unwatch(w)
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	write := func(kind string, data any) error {
+		msg, err := buildSSEPayload(0, kind, data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprint(out, msg); err != nil {
+			return err
+		}
+		return out.Flush()
+	}
+	if err := write("tail", map[string]string{"userID": w.userID}); err != nil {
+		return
+	}
+	for {
+		select {
+		case a, ok := <-w.feed:
+			if !ok {
+				return
+			}
+			if n := w.missed.Swap(0); n > 0 {
+				if err := write("missed", map[string]int64{"count": n}); err != nil {
+					return
+				}
+			}
+			if err := write(a.Type, a); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(out, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := out.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// userThrottle limits how fast events reach each user. Events over the limit are
+// held back per topic and replaced by newer ones, so when the user's budget
+// refills they get the freshest state instead of every intermediate update.
+type userThrottle struct {
+	mu    sync.Mutex
+	rate  float64 // events per second
+	burst float64
+	users map[string]*throttleState
+	// flush publishes a held-back event once the user has budget again;
+	// drop is told about held-back events replaced by newer ones
+	flush func(userID string, ev event, opts publishOptions)
+	drop  func(userID string, ev event)
+	// sweeping is set once the sweep runs
+	sweeping bool
+}
+
+type throttleState struct {
+	tokens  float64
+	last    time.Time
+	pending map[string]heldEvent
+	order   []string
+	timer   *time.Timer
+}
+
+type heldEvent struct {
+	ev   event
+	opts publishOptions
+}
+
+func newUserThrottle(rate float64, burst int, flush func(userID string, ev event, opts publishOptions), drop func(userID string, ev event)) *userThrottle {
+	ut := &userThrottle{
+		users: make(map[string]*throttleState),
+		flush: flush,
+		drop:  drop,
+	}
+	ut.update(rate, burst)
+	return ut
+}
+
+// update changes the limit, as on a config reload. Once it is lifted, the
+// events held back go out at once.
+func (ut *userThrottle) update(rate float64, burst int) {
+	ut.mu.Lock()
+	ut.rate, ut.burst = rate, float64(max(burst, 1))
+	if rate > 0 && !ut.sweeping {
+		ut.sweeping = true
+		go ut.sweep(time.Minute)
+	}
+	due := make(map[string][]heldEvent)
+	if rate <= 0 {
+		for userID, st := range ut.users {
+			if st.timer != nil {
+				st.timer.Stop()
+			}
+			for _, topic := range st.order {
+				due[userID] = append(due[userID], st.pending[topic])
+			}
+			delete(ut.users, userID)
+		}
+	}
+	ut.mu.Unlock()
+
+	for userID, held := range due {
+		for _, h := range held {
+			ut.flush(userID, h.ev, h.opts)
+		}
+	}
+}
+
+func (ut *userThrottle) enabled() bool {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	return ut.rate > 0
+}
+
+// allow reports whether an event for userID may go out now. If not, the event
+// is held (replacing any held event for the same topic) and flushed later.
+func (ut *userThrottle) allow(userID string, ev event, opts publishOptions) bool {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	if ut.rate <= 0 {
+		// Lifted since enabled was checked
+		return true
+	}
+	st, ok := ut.users[userID]
+	if !ok {
+		st = &throttleState{tokens: ut.burst, last: time.Now(), pending: make(map[string]heldEvent)}
+		ut.users[userID] = st
+	}
+	ut.refill(st)
+
+	// Nothing may overtake held events, or an older value would arrive last
+	if len(st.pending) == 0 && st.tokens >= 1 {
+		st.tokens--
+		return true
+	}
+	if prev, held := st.pending[ev.Topic]; held {
+		ut.drop(userID, prev.ev)
+	} else {
+		st.order = append(st.order, ev.Topic)
+	}
+	st.pending[ev.Topic] = heldEvent{ev: ev, opts: opts}
+	if st.timer == nil {
+		st.timer = time.AfterFunc(ut.wait(st), func() { ut.release(userID) })
+	}
+	return false
+}
+
+func (ut *userThrottle) refill(st *throttleState) {
+	now := time.Now()
+	st.tokens = min(ut.burst, st.tokens+now.Sub(st.last).Seconds()*ut.rate)
+	st.last = now
+}
+
+// wait is how long until the user has a whole token again
+func (ut *userThrottle) wait(st *throttleState) time.Duration {
+	if st.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - st.tokens) / ut.rate * float64(time.Second))
+}
+
+// release flushes as many held events for userID as the budget allows and
+// re-arms the timer for the rest
+func (ut *userThrottle) release(userID string) {
+	ut.mu.Lock()
+	st := ut.users[userID]
+	if st == nil {
+		// Flushed when the limit was lifted
+		ut.mu.Unlock()
+		return
+	}
+	st.timer = nil
+	ut.refill(st)
+	var due []heldEvent
+	for len(st.order) > 0 && st.tokens >= 1 {
+		topic := st.order[0]
+		st.order = st.order[1:]
+		due = append(due, st.pending[topic])
+		delete(st.pending, topic)
+		st.tokens--
+	}
+	if len(st.pending) > 0 {
+		st.timer = time.AfterFunc(ut.wait(st), func() { ut.release(userID) })
+	}
+	ut.mu.Unlock()
+
+	for _, h := range due {
+		ut.flush(userID, h.ev, h.opts)
+	}
+}
+
+// held returns how many events for userID are held back
+func (ut *userThrottle) held(userID string) int {
+	ut.mu.Lock()
+	defer ut.mu.Unlock()
+	if st := ut.users[userID]; st != nil {
+		return len(st.pending)
+	}
+	return 0
+}
+
+// sweep forgets users whose budget has fully refilled
+func (ut *userThrottle) sweep(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		ut.mu.Lock()
+		for userID, st := range ut.users {
+			ut.refill(st)
+			if len(st.pending) == 0 && st.tokens >= ut.burst {
+				delete(ut.users, userID)
+			}
+		}
+		ut.mu.Unlock()
+	}
+}
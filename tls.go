@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsEnabled reports whether the public listener serves HTTPS
+func (cfg config) tlsEnabled() bool {
+	return cfg.TLSCert != "" || cfg.ACMEDomains != ""
+}
+
+// listenConfig returns how the public listener is set up: plain HTTP, HTTPS
+// with a certificate from files, or HTTPS with certificates obtained from an
+// ACME CA such as Let's Encrypt. For the latter it also returns the server
+// answering HTTP-01 challenges, nil when there is none.
+func listenConfig(cfg config) (fiber.ListenConfig, *http.Server, error) {
+	lc := fiber.ListenConfig{EnablePrefork: cfg.Prefork}
+	clientAuth, err := publicClientAuth(cfg)
+	if err != nil {
+		return lc, nil, err
+	}
+	if !cfg.tlsEnabled() {
+		return lc, nil, nil
+	}
+	lc.TLSMinVersion = tls.VersionTLS12
+	lc.TLSConfigFunc = clientAuth
+
+	if cfg.TLSCert != "" {
+		if cfg.ACMEDomains != "" {
+			return lc, nil, errors.New("set either a certificate or ACME domains, not both")
+		}
+		if cfg.TLSKey == "" {
+			return lc, nil, errors.New("a TLS certificate needs its key")
+		}
+		lc.CertFile, lc.CertKeyFile = cfg.TLSCert, cfg.TLSKey
+		return lc, nil, nil
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(splitList(cfg.ACMEDomains)...),
+		// Prefork processes share the cache, challenge tokens included
+		Cache: autocert.DirCache(cfg.ACMECache),
+		Email: cfg.ACMEEmail,
+	}
+	if cfg.ACMEDirectory != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.ACMEDirectory}
+	}
+	lc.AutoCertManager = m
+
+	// TLS-ALPN-01 challenges are answered on the HTTPS port itself; HTTP-01
+	// ones need port 80, which otherwise redirects to HTTPS
+	if cfg.ACMEHTTPAddr == "" || fiber.IsChild() {
+		return lc, nil, nil
+	}
+	return lc, &http.Server{
+		Addr:              cfg.ACMEHTTPAddr,
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+	}, nil
+}
+
+// publicTLSConfig is the TLS setup of lc as Fiber's Listen would build it,
+// for the listeners the server opens itself; nil serves plain HTTP
+func publicTLSConfig(lc fiber.ListenConfig) (*tls.Config, error) {
+	var tc *tls.Config
+	switch {
+	case lc.CertFile != "":
+		cert, err := tls.LoadX509KeyPair(lc.CertFile, lc.CertKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc = &tls.Config{MinVersion: lc.TLSMinVersion, Certificates: []tls.Certificate{cert}}
+	case lc.AutoCertManager != nil:
+		tc = &tls.Config{
+			MinVersion:     lc.TLSMinVersion,
+			GetCertificate: lc.AutoCertManager.GetCertificate,
+			// acme-tls/1 answers TLS-ALPN-01 challenges
+			NextProtos: []string{"http/1.1", acme.ALPNProto},
+		}
+	default:
+		return nil, nil
+	}
+	if lc.TLSConfigFunc != nil {
+		lc.TLSConfigFunc(tc)
+	}
+	return tc, nil
+}
+
+// serveACMEChallenges runs srv on ln until it is shut down
+func serveACMEChallenges(srv *http.Server, ln net.Listener) {
+	logger.Info("ACME HTTP-01 challenges served", "addr", srv.Addr)
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("ACME challenge server error", "error", err)
+	}
+}
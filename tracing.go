@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gofiber/fiber/v3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// tracer starts the spans of a publish and its delivery; it does nothing
+// until setupTracing installs an exporter
+var tracer = otel.Tracer("go-fiber-sse-user-channel")
+
+// traceContext reads a publisher's W3C traceparent and tracestate
+var traceContext = propagation.TraceContext{}
+
+// setupTracing exports spans over OTLP/HTTP to cfg.OTLPEndpoint. It returns
+// a function flushing the spans still buffered, or nil when tracing is off.
+func setupTracing(cfg config) (func(context.Context) error, error) {
+	if cfg.OTLPEndpoint == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.OTLPEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("go-fiber-sse-user-channel"),
+		semconv.ServiceInstanceID(cfg.NodeID),
+	))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		// A publisher's sampling decision is kept; publishes without one are sampled at the ratio
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+	tracer = tp.Tracer("go-fiber-sse-user-channel")
+	return tp.Shutdown, nil
+}
+
+// fiberCarrier exposes a request's headers to the propagator
+type fiberCarrier struct {
+	c fiber.Ctx
+}
+
+func (fc fiberCarrier) Get(key string) string { return fc.c.Get(key) }
+func (fc fiberCarrier) Set(key, value string) { fc.c.Set(key, value) }
+func (fc fiberCarrier) Keys() []string {
+	var keys []string
+	fc.c.Request().Header.VisitAll(func(k, _ []byte) {
+		keys = append(keys, string(k))
+	})
+	return keys
+}
+
+// tracePublish runs a publish route in a server span, a child of the
+// publisher's span if it sent a traceparent. The handler finds the span in
+// c.Context().
+func tracePublish(next fiber.Handler) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		ctx := traceContext.Extract(c.Context(), fiberCarrier{c})
+		ctx, span := tracer.Start(ctx, "publish", trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.route", c.Path())))
+		defer span.End()
+		c.SetContext(ctx)
+		err := next(c)
+		status := c.Response().StatusCode()
+		var ferr *fiber.Error
+		if errors.As(err, &ferr) {
+			status = ferr.Code
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if err != nil || status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
+
+// metadataCarrier exposes gRPC metadata, whose keys are lowercase, to the
+// propagator
+type metadataCarrier metadata.MD
+
+func (mc metadataCarrier) Get(key string) string {
+	if v := metadata.MD(mc).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+func (mc metadataCarrier) Set(key, value string) { metadata.MD(mc).Set(key, value) }
+func (mc metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(mc))
+	for k := range mc {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startGRPCPublishSpan starts the span of a gRPC publish, whose traceparent
+// comes in the call's metadata
+func startGRPCPublishSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = traceContext.Extract(ctx, metadataCarrier(md))
+	return tracer.Start(ctx, "publish", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.method", method)))
+}
+
+// publishAttributes describe the publish of req on its span
+func publishAttributes(req publishRequest) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("sse.user_id", req.UserID),
+		attribute.String("sse.topic", req.Topic),
+	}
+}
+
+// traceDelivery records the time ev spent in s's buffer and then runs
+// write, the write and flush to the stream, in a span of its own. Both are
+// children of the publish span; events without one are just written.
+func traceDelivery(s *session, ev event, write func() error) error {
+	if !ev.trace.IsValid() {
+		return write()
+	}
+	ctx := trace.ContextWithSpanContext(context.Background(), ev.trace)
+	attrs := trace.WithAttributes(
+		attribute.String("sse.session_id", s.id),
+		attribute.String("sse.user_id", s.userID),
+		attribute.Int64("sse.event_id", int64(ev.ID)),
+	)
+	_, queued := tracer.Start(ctx, "queue", attrs, trace.WithTimestamp(ev.PublishedAt))
+	queued.End()
+
+	_, span := tracer.Start(ctx, "write", attrs)
+	err := write()
+	if err != nil {
+		failSpan(span, err)
+	}
+	span.End()
+	return err
+}
+
+// failSpan marks span as having failed with err
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// version, commit and buildTime are set when building a release:
+//
+//	go build -ldflags "-X main.version=v1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// Left empty, they are read from the build info the go command records.
+var (
+	version   string
+	commit    string
+	buildTime string
+)
+
+// startedAt is when the process started, for uptime
+var startedAt = time.Now()
+
+// buildInfo describes the running binary, as /version reports it
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"buildTime"`
+	// Modified is set when the binary was built from a checkout with
+	// uncommitted changes
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"goVersion"`
+}
+
+// binaryInfo fills in what the linker flags didn't from the build info,
+// which has the module version when installed with go install and the
+// commit when built in a git checkout
+func binaryInfo() buildInfo {
+	info := buildInfo{Version: version, Commit: commit, BuildTime: buildTime, GoVersion: runtime.Version()}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = s.Value
+			}
+		case "vcs.time":
+			if info.BuildTime == "" {
+				// The commit's time; a build's own time only comes from ldflags
+				info.BuildTime = s.Value
+			}
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
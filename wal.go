@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// walRecord is one line of the write-ahead log. An accept record is written
+// before a publish is acknowledged; a settle record once the event has been
+// written to every session it was queued for, dropped, or handed to the Store.
+type walRecord struct {
+	Op        string          `json:"op"`
+	ID        uint64          `json:"id"`
+	UserID    string          `json:"userID,omitempty"`
+	Event     *event          `json:"event,omitempty"`
+	Opts      *publishOptions `json:"opts,omitempty"`
+	DeliverAt time.Time       `json:"deliverAt,omitzero"`
+}
+
+// writeAheadLog records accepted publishes until they settle, so those still
+// in memory when the process stops can be published again on the next start
+type writeAheadLog struct {
+	path  string
+	fsync bool
+
+	mu      sync.Mutex
+	f       *os.File
+	lastID  uint64
+	pending map[uint64]*walEntry
+	// records written since the last compaction
+	records int
+}
+
+type walEntry struct {
+	rec walRecord
+	// refs counts the places still holding the event: the accepting publish
+	// and every session queue it sits in
+	refs int
+}
+
+// openWriteAheadLog opens the log at path and returns it along with the
+// accepted publishes that never settled. An empty path disables the log.
+func openWriteAheadLog(path string, fsync bool) (*writeAheadLog, []walRecord, error) {
+	w := &writeAheadLog{path: path, fsync: fsync, pending: make(map[uint64]*walEntry)}
+	if path == "" {
+		return w, nil, nil
+	}
+	unsettled, err := w.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := w.compact(); err != nil {
+		return nil, nil, err
+	}
+	return w, unsettled, nil
+}
+
+func (w *writeAheadLog) enabled() bool {
+	return w.path != ""
+}
+
+// load reads the existing log into pending
+func (w *writeAheadLog) load() ([]walRecord, error) {
+	f, err := os.Open(w.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var order []uint64
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var rec walRecord
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			// A crash can leave the last line half written
+			logger.Warn("WAL skipping unreadable record", "error", err)
+			continue
+		}
+		w.lastID = max(w.lastID, rec.ID)
+		switch rec.Op {
+		case "accept":
+			w.pending[rec.ID] = &walEntry{rec: rec}
+			order = append(order, rec.ID)
+		case "settle":
+			delete(w.pending, rec.ID)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	var unsettled []walRecord
+	for _, id := range order {
+		if e, ok := w.pending[id]; ok {
+			unsettled = append(unsettled, e.rec)
+		}
+	}
+	return unsettled, nil
+}
+
+// accept logs a publish before it is acknowledged and returns the ID that
+// ties the event to its log entry (0 when the log is disabled)
+func (w *writeAheadLog) accept(userID string, ev event, opts publishOptions, deliverAt time.Time) uint64 {
+	if !w.enabled() {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastID++
+	rec := walRecord{Op: "accept", ID: w.lastID, UserID: userID, Event: &ev, Opts: &opts, DeliverAt: deliverAt}
+	w.pending[rec.ID] = &walEntry{rec: rec, refs: 1}
+	w.writeLocked(rec)
+	return rec.ID
+}
+
+// adopt takes over an unsettled entry from a previous run for republishing
+func (w *writeAheadLog) adopt(id uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.pending[id]; ok {
+		e.refs = 1
+	}
+}
+
+// hold records one more place the event of entry id sits in
+func (w *writeAheadLog) hold(id uint64) {
+	if id == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if e, ok := w.pending[id]; ok {
+		e.refs++
+	}
+}
+
+// release drops one hold on entry id and settles it when none are left
+func (w *writeAheadLog) release(id uint64) {
+	if id == 0 {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	e, ok := w.pending[id]
+	if !ok {
+		return
+	}
+	if e.refs--; e.refs > 0 {
+		return
+	}
+	delete(w.pending, id)
+	w.writeLocked(walRecord{Op: "settle", ID: id})
+	// Rewrite the log once it is mostly settled entries
+	if w.records > 10000 && w.records > 4*len(w.pending) {
+		if err := w.compactLocked(); err != nil {
+			logger.Error("WAL compaction error", "error", err)
+		}
+	}
+}
+
+func (w *writeAheadLog) writeLocked(rec walRecord) {
+	if w.f == nil {
+		return
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		logger.Error("WAL encode error", "error", err)
+		return
+	}
+	// One write per record, so a crash loses at most the record being written
+	if _, err := w.f.Write(append(line, '\n')); err != nil {
+		logger.Error("WAL write error", "error", err)
+		return
+	}
+	if w.fsync {
+		if err := w.f.Sync(); err != nil {
+			logger.Error("WAL sync error", "error", err)
+		}
+	}
+	w.records++
+}
+
+func (w *writeAheadLog) compact() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.compactLocked()
+}
+
+// compactLocked replaces the log with the accept records of pending entries,
+// in the order they were accepted, which replay keeps
+func (w *writeAheadLog) compactLocked() error {
+	tmp := w.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for _, id := range slices.Sorted(maps.Keys(w.pending)) {
+		if err := enc.Encode(w.pending[id].rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.path); err != nil {
+		return err
+	}
+	if w.f != nil {
+		w.f.Close()
+	}
+	w.f, err = os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("reopen: %w", err)
+	}
+	w.records = len(w.pending)
+	return nil
+}
+
+func (w *writeAheadLog) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// webhook POSTs JSON bodies to a URL, in order, from a background
+// goroutine. Failed deliveries are retried with backoff, and bodies are
+// dropped if the endpoint can't keep up.
+type webhook struct {
+	// name tells webhooks apart in the log, such as "Presence webhook"
+	name     string
+	url      string
+	secret   []byte
+	attempts int
+	client   *http.Client
+
+	// mu guards queue against being sent to once closed
+	mu     sync.Mutex
+	queue  chan webhookDelivery
+	closed bool
+	// done is closed once the queue has been drained after close
+	done chan struct{}
+}
+
+// webhookDelivery is a body waiting to be sent, with what to log about it
+type webhookDelivery struct {
+	body  []byte
+	attrs []any
+}
+
+// webhookRetryMax caps the wait between attempts
+const webhookRetryMax = 30 * time.Second
+
+func newWebhook(name, url, secret string, attempts int, timeout time.Duration, backlog int) *webhook {
+	wh := &webhook{
+		name:     name,
+		url:      url,
+		secret:   []byte(secret),
+		attempts: max(attempts, 1),
+		queue:    make(chan webhookDelivery, backlog),
+		client:   &http.Client{Timeout: timeout},
+		done:     make(chan struct{}),
+	}
+	go wh.run()
+	return wh
+}
+
+// put queues body, with attrs describing it in log lines
+func (wh *webhook) put(body []byte, attrs ...any) {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.closed {
+		return
+	}
+	select {
+	case wh.queue <- webhookDelivery{body: body, attrs: attrs}:
+	default:
+		logger.Warn(wh.name+" backlog full, discarding event", attrs...)
+	}
+}
+
+func (wh *webhook) run() {
+	defer close(wh.done)
+	for d := range wh.queue {
+		wh.deliver(d)
+	}
+}
+
+// deliver sends d until the endpoint accepts it or the attempts run out
+func (wh *webhook) deliver(d webhookDelivery) {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := wh.send(d.body)
+		if err == nil {
+			return
+		}
+		if attempt == wh.attempts {
+			logger.Error(wh.name+" failed, discarding event", append(d.attrs, "attempts", attempt, "error", err)...)
+			return
+		}
+		logger.Warn(wh.name+" failed, retrying", append(d.attrs, "retryIn", backoff.String(), "error", err)...)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, webhookRetryMax)
+	}
+}
+
+func (wh *webhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Signature", signWebhook(wh.secret, timestamp, body))
+	}
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+// signWebhook is the hex HMAC-SHA256, under secret, of the timestamp and
+// body joined by a newline
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	fmt.Fprintf(h, "%s\n", timestamp)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// close stops taking bodies and waits for those queued to be delivered,
+// until ctx is done
+func (wh *webhook) close(ctx context.Context) {
+	if wh == nil {
+		return
+	}
+	wh.mu.Lock()
+	wh.closed = true
+	close(wh.queue)
+	wh.mu.Unlock()
+	select {
+	case <-wh.done:
+	case <-ctx.Done():
+		logger.Warn(wh.name+" events left undelivered at shutdown", "count", len(wh.queue))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v3"
+	"github.com/valyala/fasthttp"
+)
+
+// wsWriteTimeout bounds the close frame written to a WebSocket as it ends
+const wsWriteTimeout = 10 * time.Second
+
+var wsUpgrader = websocket.FastHTTPUpgrader{
+	// The origin was checked against the stream origins before upgrading
+	CheckOrigin: func(*fasthttp.RequestCtx) bool { return true },
+}
+
+// wsMessage is one event as a WebSocket text message: the SSE event's type,
+// ID and data line, as one JSON object
+type wsMessage struct {
+	Event string `json:"event"`
+	ID    uint64 `json:"id,omitempty"`
+	Data  any    `json:"data"`
+}
+
+// wsWriter writes a session's events to a WebSocket, one message each
+type wsWriter struct {
+	conn  *websocket.Conn
+	stats *sessionStats
+}
+
+// newWSMessage returns the message an event is sent as. A CloudEvent carries
+// its type and ID itself, so it is the whole message.
+func newWSMessage(id uint64, eventType string, data any) any {
+	if ce, ok := data.(cloudEventEnvelope); ok {
+		return ce
+	}
+	return wsMessage{Event: eventType, ID: id, Data: data}
+}
+
+func (ww wsWriter) write(id uint64, eventType string, data any) error {
+	payload, err := json.Marshal(newWSMessage(id, eventType, data))
+	if err != nil {
+		logger.Error("WebSocket event encode error", "eventID", id, "eventType", eventType, "error", err)
+		return nil
+	}
+	_ = ww.conn.SetWriteDeadline(writeDeadline())
+	if err := ww.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+		return err
+	}
+	ww.stats.wrote(len(payload))
+	return nil
+}
+
+// flush is a no-op: each event is written as a message of its own
+func (ww wsWriter) flush() error {
+	return nil
+}
+
+// keepAlive sends a ping, which clients answer without the application
+// seeing it
+func (ww wsWriter) keepAlive() error {
+	return ww.conn.WriteControl(websocket.PingMessage, nil, writeDeadline())
+}
+
+// serveWebSocket upgrades the request and streams the session's events over
+// it. The client's messages are read only to notice it going away; acks and
+// subscription changes go through the HTTP routes, as for SSE.
+func serveWebSocket(c fiber.Ctx, s *session, lastSeen uint64) error {
+	return wsUpgrader.Upgrade(c.RequestCtx(), func(conn *websocket.Conn) {
+		defer conn.Close()
+		// Unlike an SSE response, a WebSocket learns of a gone client by
+		// reading; closing the session ends streamSession
+		go func() {
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					currentBroker.sessions.removeSession(s)
+					return
+				}
+			}
+		}()
+		streamSession(wsWriter{conn: conn, stats: &s.stats}, s, lastSeen)
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteTimeout))
+	})
+}